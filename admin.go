@@ -0,0 +1,506 @@
+//Copyright (C) 2020 Daniel Bokser.  See LICENSE file for license
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"twitter"
+)
+
+//What has to happen before the bot is ready to take tweets and DMs.  Use atomic to access
+type Readiness struct {
+	webhook_registered int32
+	subscribed         int32
+	stream_connected   int32
+	//set before the admin server is started, if the bot runs its own Xvfb
+	framebuffers *Framebuffers
+}
+
+var bot_readiness = &Readiness{}
+
+func set_readiness_flag(flag *int32, is_set bool) {
+	value := int32(0)
+	if is_set {
+		value = 1
+	}
+	atomic.StoreInt32(flag, value)
+}
+
+//Returns what is not ready yet.  Empty if the bot is ready
+func (readiness *Readiness) not_ready() []string {
+	not_ready := make([]string, 0)
+	if atomic.LoadInt32(&readiness.webhook_registered) == 0 {
+		not_ready = append(not_ready, "webhook not registered")
+	}
+	if atomic.LoadInt32(&readiness.subscribed) == 0 {
+		not_ready = append(not_ready, "not subscribed to DMs")
+	}
+	if atomic.LoadInt32(&readiness.stream_connected) == 0 {
+		not_ready = append(not_ready, "filter stream not connected")
+	}
+	if down := readiness.framebuffers.down(); down > 0 {
+		not_ready = append(not_ready, fmt.Sprintf("%v framebuffers not running", down))
+	}
+	return not_ready
+}
+
+//Lets operators pause the bot so no new carts are started, and see how many are still running
+type IntakeControl struct {
+	mutex   sync.Mutex
+	changed *sync.Cond
+	paused  bool
+	running int
+}
+
+func new_intake_control() *IntakeControl {
+	intake := &IntakeControl{}
+	intake.changed = sync.NewCond(&intake.mutex)
+	return intake
+}
+
+func (intake *IntakeControl) pause() {
+	intake.mutex.Lock()
+	defer intake.mutex.Unlock()
+	intake.paused = true
+	intake.changed.Broadcast()
+}
+
+func (intake *IntakeControl) resume() {
+	intake.mutex.Lock()
+	defer intake.mutex.Unlock()
+	intake.paused = false
+	intake.changed.Broadcast()
+}
+
+//Blocks until intake is not paused, then counts the job as running.  Call job_finished when it is done
+func (intake *IntakeControl) job_started() {
+	intake.mutex.Lock()
+	defer intake.mutex.Unlock()
+	for intake.paused {
+		intake.changed.Wait()
+	}
+	intake.running++
+}
+
+func (intake *IntakeControl) job_finished() {
+	intake.mutex.Lock()
+	defer intake.mutex.Unlock()
+	intake.running--
+	intake.changed.Broadcast()
+}
+
+func (intake *IntakeControl) status() (bool, int) {
+	intake.mutex.Lock()
+	defer intake.mutex.Unlock()
+	return intake.paused, intake.running
+}
+
+//Pauses intake and waits for the running jobs to finish.  Returns the number still running if ctx is done first
+func (intake *IntakeControl) drain(ctx context.Context) (int, error) {
+	intake.pause()
+	//sync.Cond can not wait on a context, so wake the waiter up when the context is done
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			intake.mutex.Lock()
+			intake.changed.Broadcast()
+			intake.mutex.Unlock()
+		case <-stop:
+		}
+	}()
+
+	intake.mutex.Lock()
+	defer intake.mutex.Unlock()
+	for intake.running > 0 && ctx.Err() == nil {
+		intake.changed.Wait()
+	}
+	if intake.running > 0 {
+		return intake.running, ctx.Err()
+	}
+	return 0, nil
+}
+
+//Everything the admin server needs to look at and control the bot
+type AdminContext struct {
+	//admin endpoints are disabled if empty
+	token              string
+	jobs               *JobStore
+	intake             *IntakeControl
+	twitter_client     *twitter.Client
+	my_user            *twitter.User
+	rate_limits        *RateLimitTracker
+	blocklist          *Blocklist
+	cart_tweet_channel chan TweetCart
+	dm_channel         chan *DMCart
+	//held jobs are approved or rejected one at a time so nothing gets posted twice
+	moderation_mutex sync.Mutex
+}
+
+const DEFAULT_DRAIN_TIMEOUT = 10 * time.Minute
+
+//The admin server listens on its own address so it does not have to be reachable by twitter
+func new_admin_mux(admin *AdminContext) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", bot_metrics)
+	mux.HandleFunc("/healthz", func(writer http.ResponseWriter, req *http.Request) {
+		fmt.Fprintln(writer, "ok")
+	})
+	mux.HandleFunc("/readyz", func(writer http.ResponseWriter, req *http.Request) {
+		if not_ready := bot_readiness.not_ready(); len(not_ready) > 0 {
+			writer.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(writer, "not ready:", strings.Join(not_ready, ", "))
+			return
+		}
+		fmt.Fprintln(writer, "ready")
+	})
+	mux.Handle("/admin/jobs", admin.authenticated("GET", admin.handle_jobs))
+	mux.Handle("/admin/rerun", admin.authenticated("POST", admin.handle_rerun))
+	mux.Handle("/admin/pause", admin.authenticated("POST", admin.handle_pause))
+	mux.Handle("/admin/resume", admin.authenticated("POST", admin.handle_resume))
+	mux.Handle("/admin/drain", admin.authenticated("POST", admin.handle_drain))
+	mux.Handle("/admin/rate_limits", admin.authenticated("GET", admin.handle_rate_limits))
+	mux.Handle("/admin/blocklist", admin.authenticated("GET", admin.handle_blocklist))
+	mux.Handle("/admin/block", admin.authenticated("POST", admin.handle_block))
+	mux.Handle("/admin/unblock", admin.authenticated("POST", admin.handle_unblock))
+	mux.Handle("/admin/held", admin.authenticated("GET", admin.handle_held))
+	mux.Handle("/admin/approve", admin.authenticated("POST", admin.handle_approve))
+	mux.Handle("/admin/reject", admin.authenticated("POST", admin.handle_reject))
+	return mux
+}
+
+func start_admin_server(config *Config, admin *AdminContext) {
+	listener, err := net.Listen("tcp", config.AdminListenAddress)
+	if err != nil {
+		root_logger.Fatal("Error listening on admin address", "address", config.AdminListenAddress, "err", err)
+	}
+	srv := &http.Server{Handler: new_admin_mux(admin)}
+	go func() {
+		err := srv.Serve(listener)
+		root_logger.Error("Admin server went down", "err", err)
+	}()
+	root_logger.Info("Admin server listening", "address", listener.Addr().String())
+}
+
+func write_admin_json(writer http.ResponseWriter, status int, v interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
+
+func write_admin_error(writer http.ResponseWriter, status int, msg string) {
+	write_admin_json(writer, status, map[string]string{"error": msg})
+}
+
+//Requires "Authorization: Bearer <admin_token>" and the given method
+func (admin *AdminContext) authenticated(method string, handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		if len(admin.token) == 0 {
+			write_admin_error(writer, http.StatusNotFound, "the admin API is disabled.  Set admin_token to enable it")
+			return
+		}
+		token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(admin.token)) != 1 {
+			root_logger.Warn("Rejected admin request with a missing or invalid token", "remote_addr", req.RemoteAddr, "path", req.URL.Path)
+			write_admin_error(writer, http.StatusUnauthorized, "missing or invalid token")
+			return
+		}
+		if req.Method != method {
+			writer.Header().Set("Allow", method)
+			write_admin_error(writer, http.StatusMethodNotAllowed, "use "+method)
+			return
+		}
+		handler(writer, req)
+	})
+}
+
+type admin_status struct {
+	Paused  bool `json:"paused"`
+	Running int  `json:"running"`
+}
+
+type admin_jobs_response struct {
+	admin_status
+	Jobs []Job `json:"jobs"`
+}
+
+//GET /admin/jobs lists the jobs that are queued or running
+func (admin *AdminContext) handle_jobs(writer http.ResponseWriter, req *http.Request) {
+	response := admin_jobs_response{}
+	response.Paused, response.Running = admin.intake.status()
+	response.Jobs = append(admin.jobs.unfinished_jobs(JOB_TYPE_TWEET), admin.jobs.unfinished_jobs(JOB_TYPE_DM)...)
+	write_admin_json(writer, http.StatusOK, response)
+}
+
+//POST /admin/rerun?id=<job id, tweet ID or DM ID> runs a finished job again.
+//Tweets the bot has never seen are fetched and run as if they had just mentioned the bot
+func (admin *AdminContext) handle_rerun(writer http.ResponseWriter, req *http.Request) {
+	id := req.URL.Query().Get("id")
+	if len(id) == 0 {
+		write_admin_error(writer, http.StatusBadRequest, "id is required")
+		return
+	}
+	job, ok := find_history_job(admin.jobs, id)
+	if !ok {
+		tweet_id, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			write_admin_error(writer, http.StatusNotFound, "no job "+id)
+			return
+		}
+		//DMs can not be looked up, so only tweets get here
+		tweet, err := fetch_tweet(req.Context(), tweet_id, admin.twitter_client, root_logger.with("stage", "admin"))
+		if err != nil {
+			write_admin_error(writer, http.StatusNotFound, fmt.Sprintf("no job %v and could not fetch it as a tweet: %v", id, err))
+			return
+		}
+		job_id := tweet_job_id(tweet.ID)
+		if cart_tweet, is_new := record_tweet_job(tweet, admin.jobs); is_new {
+			sent := false
+			select {
+			case admin.cart_tweet_channel <- cart_tweet:
+				sent = true
+			case <-req.Context().Done():
+			default:
+			}
+			if !sent {
+				//finished so it can be rerun later
+				admin.jobs.finish(job_id, &JobResult{Status: JOB_STATUS_FAILED, Error: "cart queue was full"})
+				write_admin_error(writer, http.StatusServiceUnavailable, "the cart queue is full.  Try again later")
+				return
+			}
+		}
+		write_admin_json(writer, http.StatusAccepted, map[string]string{"job": job_id})
+		return
+	}
+
+	if err := admin.jobs.requeue(job.ID); err != nil {
+		write_admin_error(writer, http.StatusConflict, err.Error())
+		return
+	}
+	logger := root_logger.for_job(job.ID, job.Type, job.Author).stage("admin")
+	logger.Info("Rerunning job")
+	//the handlers can be busy for a long time, so do not hold the request until there is room for the job
+	sent := false
+	switch job.Type {
+	case JOB_TYPE_TWEET:
+		select {
+		case admin.cart_tweet_channel <- TweetCart{tweet_id: dm_id_to_int(job.SourceID), parent_tweet_id: job.ParentTweetID, author: job.Author, author_id: job.AuthorID}:
+			sent = true
+		case <-req.Context().Done():
+		default:
+		}
+	case JOB_TYPE_DM:
+		select {
+		case admin.dm_channel <- job.DM:
+			sent = true
+		case <-req.Context().Done():
+		default:
+		}
+	}
+	if !sent {
+		if err := admin.jobs.unqueue(&job); err != nil {
+			logger.Error("Could not put back job that could not be rerun", "err", err)
+		}
+		write_admin_error(writer, http.StatusServiceUnavailable, "the cart queue is full.  Try again later")
+		return
+	}
+	write_admin_json(writer, http.StatusAccepted, map[string]string{"job": job.ID})
+}
+
+//POST /admin/pause stops new carts from being started.  Tweets and DMs are still recorded and run once resumed
+func (admin *AdminContext) handle_pause(writer http.ResponseWriter, req *http.Request) {
+	admin.intake.pause()
+	root_logger.Info("Paused intake")
+	status := admin_status{}
+	status.Paused, status.Running = admin.intake.status()
+	write_admin_json(writer, http.StatusOK, status)
+}
+
+func (admin *AdminContext) handle_resume(writer http.ResponseWriter, req *http.Request) {
+	admin.intake.resume()
+	root_logger.Info("Resumed intake")
+	status := admin_status{}
+	status.Paused, status.Running = admin.intake.status()
+	write_admin_json(writer, http.StatusOK, status)
+}
+
+//POST /admin/drain?timeout=10m pauses intake and responds once nothing is running,
+//so the bot can be brought down without losing work.  Queued jobs run after the bot comes back up
+func (admin *AdminContext) handle_drain(writer http.ResponseWriter, req *http.Request) {
+	timeout := DEFAULT_DRAIN_TIMEOUT
+	if value := req.URL.Query().Get("timeout"); len(value) > 0 {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			write_admin_error(writer, http.StatusBadRequest, "invalid timeout: "+err.Error())
+			return
+		}
+		timeout = parsed
+	}
+	root_logger.Info("Draining...", "timeout", timeout)
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	defer cancel()
+	running, err := admin.intake.drain(ctx)
+	if err != nil {
+		root_logger.Warn("Timed out draining", "running", running)
+		write_admin_json(writer, http.StatusServiceUnavailable, admin_status{Paused: true, Running: running})
+		return
+	}
+	root_logger.Info("Drained")
+	write_admin_json(writer, http.StatusOK, admin_status{Paused: true, Running: 0})
+}
+
+//GET /admin/rate_limits lists what is left of the rate limit of every twitter endpoint the bot has used
+func (admin *AdminContext) handle_rate_limits(writer http.ResponseWriter, req *http.Request) {
+	write_admin_json(writer, http.StatusOK, map[string][]RateLimitBucket{"rate_limits": admin.rate_limits.buckets_snapshot()})
+}
+
+//GET /admin/blocklist lists the blocked users
+func (admin *AdminContext) handle_blocklist(writer http.ResponseWriter, req *http.Request) {
+	write_admin_json(writer, http.StatusOK, map[string][]BlockedUser{"blocklist": admin.blocklist.list()})
+}
+
+//POST /admin/block?user=<ID or screen name>&reason=<why> stops the bot from running the user's tweets and DMs
+func (admin *AdminContext) handle_block(writer http.ResponseWriter, req *http.Request) {
+	user := req.URL.Query().Get("user")
+	if len(user) == 0 {
+		write_admin_error(writer, http.StatusBadRequest, "user is required")
+		return
+	}
+	blocked, err := admin.blocklist.block(user, req.URL.Query().Get("reason"))
+	if err != nil {
+		write_admin_error(writer, http.StatusInternalServerError, "could not block user: "+err.Error())
+		return
+	}
+	root_logger.Info("Blocked user", "user", user, "reason", blocked.Reason)
+	write_admin_json(writer, http.StatusOK, blocked)
+}
+
+//POST /admin/unblock?user=<ID or screen name> takes the user off the blocklist.  The user has to be given the same way they were blocked
+func (admin *AdminContext) handle_unblock(writer http.ResponseWriter, req *http.Request) {
+	user := req.URL.Query().Get("user")
+	if len(user) == 0 {
+		write_admin_error(writer, http.StatusBadRequest, "user is required")
+		return
+	}
+	was_blocked, err := admin.blocklist.unblock(user)
+	if err != nil {
+		write_admin_error(writer, http.StatusInternalServerError, "could not unblock user: "+err.Error())
+		return
+	}
+	if !was_blocked {
+		write_admin_error(writer, http.StatusNotFound, user+" is not blocked")
+		return
+	}
+	root_logger.Info("Unblocked user", "user", user)
+	write_admin_json(writer, http.StatusOK, map[string]string{"unblocked": user})
+}
+
+//GET /admin/held lists the jobs waiting for approval
+func (admin *AdminContext) handle_held(writer http.ResponseWriter, req *http.Request) {
+	write_admin_json(writer, http.StatusOK, map[string][]Job{"jobs": admin.jobs.jobs_with_status(JOB_STATUS_HELD)})
+}
+
+//Writes an error and returns false unless ?id= names a held job.  Call with moderation_mutex held
+func (admin *AdminContext) held_job(writer http.ResponseWriter, req *http.Request) (Job, bool) {
+	id := req.URL.Query().Get("id")
+	if len(id) == 0 {
+		write_admin_error(writer, http.StatusBadRequest, "id is required")
+		return Job{}, false
+	}
+	job, ok := find_history_job(admin.jobs, id)
+	if !ok {
+		write_admin_error(writer, http.StatusNotFound, "no job "+id)
+		return Job{}, false
+	}
+	if job.Status != JOB_STATUS_HELD || job.Held == nil || (job.Type == JOB_TYPE_DM && job.DM == nil) {
+		write_admin_error(writer, http.StatusConflict, fmt.Sprintf("job %v is %v, not held", job.ID, job.Status))
+		return Job{}, false
+	}
+	return job, true
+}
+
+//Records the result of a held job and deletes its media.  The run is not counted again in the metrics
+func (admin *AdminContext) finish_held_job(job Job, result *JobResult, logger *Logger) {
+	result.Output = job.Output
+	result.RunDuration = job.RunDuration
+	result.Cached = job.Cached
+	if err := admin.jobs.finish(job.ID, result); err != nil {
+		logger.stage("finish").Error("Could not record result of job", "err", err)
+	}
+	logger.stage("finish").Info("Finished held job", "status", result.Status)
+	bot_metrics.jobs.inc(string(job.Type), string(result.Status), result.ErrorKind)
+	if err := os.Remove(job.Held.MediaFile); err != nil && !os.IsNotExist(err) {
+		logger.stage("finish").Warn("Could not delete held media", "file", job.Held.MediaFile, "err", err)
+	}
+}
+
+//POST /admin/approve?id=<job id, tweet ID or DM ID> posts a held job's GIF
+func (admin *AdminContext) handle_approve(writer http.ResponseWriter, req *http.Request) {
+	admin.moderation_mutex.Lock()
+	defer admin.moderation_mutex.Unlock()
+	job, ok := admin.held_job(writer, req)
+	if !ok {
+		return
+	}
+	media_data, err := ioutil.ReadFile(job.Held.MediaFile)
+	if err != nil {
+		write_admin_error(writer, http.StatusInternalServerError, "could not read held media: "+err.Error())
+		return
+	}
+	logger := root_logger.for_job(job.ID, job.Type, job.Author)
+	logger.stage("admin").Info("Approved held job")
+	result := &JobResult{Status: JOB_STATUS_FAILED}
+	switch job.Type {
+	case JOB_TYPE_TWEET:
+		post_tweet_reply(req.Context(), admin.twitter_client, job.Held.ReplyToTweetID, job.Author, media_data, job.Held.MediaType,
+			job.Held.ParamsDescription, logger, result)
+	case JOB_TYPE_DM:
+		post_dm_result(req.Context(), admin.twitter_client, admin.my_user.ScreenName, job.DM.Sender, job.CartSource, false,
+			media_data, job.Held.MediaType, job.Held.ParamsDescription, logger, result)
+	}
+	if result.Status != JOB_STATUS_SUCCEEDED && result.ReplyTweetID == 0 {
+		//nothing was posted, so it stays held and can be approved again
+		write_admin_error(writer, http.StatusBadGateway, "could not post: "+result.Error)
+		return
+	}
+	admin.finish_held_job(job, result, logger)
+	job, _ = admin.jobs.job(job.ID)
+	write_admin_json(writer, http.StatusOK, job)
+}
+
+//POST /admin/reject?id=<job id, tweet ID or DM ID>&reason=<why> drops a held job.  DM senders are told it will not be tweeted
+func (admin *AdminContext) handle_reject(writer http.ResponseWriter, req *http.Request) {
+	admin.moderation_mutex.Lock()
+	defer admin.moderation_mutex.Unlock()
+	job, ok := admin.held_job(writer, req)
+	if !ok {
+		return
+	}
+	reason := req.URL.Query().Get("reason")
+	if len(reason) == 0 {
+		reason = "rejected by an operator"
+	}
+	logger := root_logger.for_job(job.ID, job.Type, job.Author)
+	logger.stage("admin").Info("Rejected held job", "reason", reason)
+	if job.Type == JOB_TYPE_DM {
+		send_dm(req.Context(), "A moderator did not approve your program, so it will not be tweeted.", job.DM.Sender, admin.twitter_client, logger.stage("dm"))
+	}
+	admin.finish_held_job(job, &JobResult{Status: JOB_STATUS_REJECTED, Error: reason}, logger)
+	job, _ = admin.jobs.job(job.ID)
+	write_admin_json(writer, http.StatusOK, job)
+}
@@ -0,0 +1,171 @@
+//Copyright (C) 2020 Daniel Bokser.  See LICENSE file for license
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//A user the bot will not run carts for.  Users are blocked by either their ID, which survives them changing their screen name, or their screen name
+type BlockedUser struct {
+	ID         string    `json:"id,omitempty"`
+	ScreenName string    `json:"screen_name,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+	BlockedAt  time.Time `json:"blocked_at"`
+}
+
+//Users the bot ignores, kept in a JSON file so they stay blocked when the bot comes back up
+type Blocklist struct {
+	mutex sync.Mutex
+	path  string
+	//keyed by blocklist_key
+	users map[string]BlockedUser
+}
+
+//Users given as all digits are taken to be IDs, since screen names can not be all digits
+func is_user_id(user string) bool {
+	if len(user) == 0 {
+		return false
+	}
+	for _, c := range user {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func blocklist_key(user string) string {
+	user = strings.TrimSpace(user)
+	if is_user_id(user) {
+		return "id:" + user
+	}
+	return "screen_name:" + normalize_screen_name(user)
+}
+
+//A missing file is an empty blocklist
+func open_blocklist(path string) (*Blocklist, error) {
+	blocklist := &Blocklist{path: path, users: make(map[string]BlockedUser)}
+	contents, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return blocklist, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var users []BlockedUser
+	if err := json.Unmarshal(contents, &users); err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		if len(user.ID) > 0 {
+			blocklist.users[blocklist_key(user.ID)] = user
+		} else {
+			blocklist.users[blocklist_key(user.ScreenName)] = user
+		}
+	}
+	return blocklist, nil
+}
+
+//Either can be empty.  A nil blocklist blocks no one
+func (blocklist *Blocklist) is_blocked(user_id, screen_name string) bool {
+	if blocklist == nil {
+		return false
+	}
+	blocklist.mutex.Lock()
+	defer blocklist.mutex.Unlock()
+	if _, ok := blocklist.users[blocklist_key(user_id)]; ok && len(user_id) > 0 {
+		return true
+	}
+	_, ok := blocklist.users[blocklist_key(screen_name)]
+	return ok && len(normalize_screen_name(screen_name)) > 0
+}
+
+//user is an ID or a screen name.  Blocking someone who is already blocked updates the reason
+func (blocklist *Blocklist) block(user, reason string) (BlockedUser, error) {
+	blocklist.mutex.Lock()
+	defer blocklist.mutex.Unlock()
+	blocked := BlockedUser{Reason: reason, BlockedAt: time.Now().UTC()}
+	if user = strings.TrimSpace(user); is_user_id(user) {
+		blocked.ID = user
+	} else {
+		blocked.ScreenName = normalize_screen_name(user)
+	}
+	if len(blocked.ID) == 0 && len(blocked.ScreenName) == 0 {
+		return BlockedUser{}, errors.New("user is required")
+	}
+	key := blocklist_key(user)
+	previous, was_blocked := blocklist.users[key]
+	blocklist.users[key] = blocked
+	if err := blocklist.save(); err != nil {
+		if was_blocked {
+			blocklist.users[key] = previous
+		} else {
+			delete(blocklist.users, key)
+		}
+		return BlockedUser{}, err
+	}
+	return blocked, nil
+}
+
+//Returns false if user was not blocked
+func (blocklist *Blocklist) unblock(user string) (bool, error) {
+	blocklist.mutex.Lock()
+	defer blocklist.mutex.Unlock()
+	key := blocklist_key(user)
+	previous, ok := blocklist.users[key]
+	if !ok {
+		return false, nil
+	}
+	delete(blocklist.users, key)
+	if err := blocklist.save(); err != nil {
+		blocklist.users[key] = previous
+		return false, err
+	}
+	return true, nil
+}
+
+//Oldest first
+func (blocklist *Blocklist) list() []BlockedUser {
+	blocklist.mutex.Lock()
+	defer blocklist.mutex.Unlock()
+	return blocklist.sorted_users()
+}
+
+//Call with the mutex held
+func (blocklist *Blocklist) sorted_users() []BlockedUser {
+	users := make([]BlockedUser, 0, len(blocklist.users))
+	for _, user := range blocklist.users {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].BlockedAt.Before(users[j].BlockedAt) })
+	return users
+}
+
+//Call with the mutex held.  The file is replaced all at once so a crash can not leave half of it behind
+func (blocklist *Blocklist) save() error {
+	contents, err := json.MarshalIndent(blocklist.sorted_users(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(blocklist.path), filepath.Base(blocklist.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(contents); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), blocklist.path)
+}
@@ -0,0 +1,166 @@
+//Copyright (C) 2020 Daniel Bokser.  See LICENSE file for license
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type CartErrorKind int
+
+const (
+	CART_ERROR_SYNTAX CartErrorKind = iota
+	CART_ERROR_RUNTIME
+	CART_ERROR_TIMEOUT
+	//PICO-8 was killed for going over one of the sandbox's limits
+	CART_ERROR_LIMIT
+)
+
+func (kind CartErrorKind) String() string {
+	switch kind {
+	case CART_ERROR_SYNTAX:
+		return "syntax error"
+	case CART_ERROR_RUNTIME:
+		return "runtime error"
+	case CART_ERROR_TIMEOUT:
+		return "timeout"
+	case CART_ERROR_LIMIT:
+		return "resource limit"
+	default:
+		return "unknown error"
+	}
+}
+
+//An error in the user's cart, as opposed to an error in the bot
+type CartError struct {
+	Kind CartErrorKind
+	//line in the user's code, or 0 if unknown
+	Line    int
+	Message string
+}
+
+func (err *CartError) Error() string {
+	if err.Line > 0 {
+		return fmt.Sprintf("%v on line %v: %v", err.Kind, err.Line, err.Message)
+	}
+	return fmt.Sprintf("%v: %v", err.Kind, err.Message)
+}
+
+//e.g. "syntax error line 14 (tab 0)" or "runtime error line 14 tab 0"
+var CART_ERROR_HEADER_REGEX = regexp.MustCompile(`(syntax|runtime) error line (\d+)`)
+
+//PICO-8 echoes the offending line of code and a stack trace around the actual message,
+//so look for something that reads like a lua error message
+var CART_ERROR_MESSAGE_REGEX = regexp.MustCompile(`attempt to|expected|near|unexpected|unfinished|malformed|out of memory|stack overflow|bad argument`)
+var CART_ERROR_LINE_REGEX = regexp.MustCompile(`line (\d+)`)
+
+//Parses the error PICO-8 printed while running a cart, if any.  line_offset is the number of lines
+//before the user's code and user_line_count is the number of lines in the user's code.
+//Returns nil if there is no error or if the message has not been completely printed yet
+func parse_cart_error(output string, line_offset, user_line_count int) *CartError {
+	header_indices := CART_ERROR_HEADER_REGEX.FindStringSubmatchIndex(output)
+	if header_indices == nil {
+		return nil
+	}
+	cart_error := &CartError{}
+	if output[header_indices[2]:header_indices[3]] == "syntax" {
+		cart_error.Kind = CART_ERROR_SYNTAX
+	} else {
+		cart_error.Kind = CART_ERROR_RUNTIME
+	}
+	pico8_line, _ := strconv.Atoi(output[header_indices[4]:header_indices[5]])
+	cart_error.Line = user_line(pico8_line, line_offset, user_line_count)
+
+	//only look at complete lines
+	rest := output[header_indices[1]:]
+	rest = rest[:strings.LastIndex(rest, "\n")+1]
+	lines := strings.Split(rest, "\n")
+	if len(lines) > 0 {
+		//the remainder of the header line
+		lines = lines[1:]
+	}
+	first_line := ""
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "at line") || strings.HasPrefix(line, "in ") {
+			continue
+		}
+		if len(first_line) == 0 {
+			first_line = line
+		}
+		if CART_ERROR_MESSAGE_REGEX.MatchString(line) {
+			cart_error.Message = line
+			break
+		}
+	}
+	if len(cart_error.Message) == 0 {
+		if len(lines) < 3 {
+			//wait for PICO-8 to finish printing the error
+			return nil
+		}
+		cart_error.Message = first_line
+	}
+
+	//the message can reference other lines, e.g. "(to close 'function' at line 14)"
+	cart_error.Message = CART_ERROR_LINE_REGEX.ReplaceAllStringFunc(cart_error.Message, func(match string) string {
+		pico8_line, _ := strconv.Atoi(match[len("line "):])
+		return "line " + strconv.Itoa(user_line(pico8_line, line_offset, user_line_count))
+	})
+
+	return cart_error
+}
+
+func user_line(pico8_line, line_offset, user_line_count int) int {
+	line := pico8_line - line_offset
+	if line < 1 {
+		return 0
+	}
+	if line > user_line_count {
+		//errors such as a missing "end" get reported at the end of the file
+		return user_line_count
+	}
+	return line
+}
+
+//CartErrorKind as a string for carts, or "internal error" for errors in the bot
+func error_kind(err error) string {
+	if cart_error, ok := err.(*CartError); ok {
+		return cart_error.Kind.String()
+	}
+	return "internal error"
+}
+
+//The reply to the user when their cart could not be run
+func describe_cart_error(err error) string {
+	const max_message_length = 160
+	cart_error, ok := err.(*CartError)
+	if !ok {
+		return `Possible reasons:
+
+- There is a syntax error in your tweetcart.
+- There is an infinite loop and flip() is not being called.
+- flip() is overridden.`
+	}
+	if cart_error.Kind == CART_ERROR_TIMEOUT {
+		return `Your cart timed out. Possible reasons:
+
+- There is an infinite loop and flip() is not being called.
+- flip() is overridden.`
+	}
+	if cart_error.Kind == CART_ERROR_LIMIT {
+		return cart_error.Message
+	}
+	message := cart_error.Error()
+	if len(message) > max_message_length {
+		//cut on a rune boundary, since half a character is not valid UTF-8
+		cut := max_message_length
+		for cut > 0 && !utf8.RuneStart(message[cut]) {
+			cut--
+		}
+		message = message[:cut] + "..."
+	}
+	return "PICO-8 reported a " + message
+}
@@ -0,0 +1,145 @@
+//Copyright (C) 2020 Daniel Bokser.  See LICENSE file for license
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"twitter"
+)
+
+//Carts longer than a tweet get posted as a thread of replies ending in "--1/3", "--2/3", etc.
+//This is the same format divide_cart_up_into_tweets uses
+var CART_PART_COUNTER_REGEX = regexp.MustCompile(`(\s*)--(\d+)/(\d+)\s*$`)
+
+//Longest thread we will walk up
+const MAX_CART_PARTS = 25
+
+type cart_part struct {
+	//tweet text without the counter
+	text string
+	//whitespace that was between the text and the counter
+	separator string
+	part      int
+	total     int
+}
+
+//Returns false if text does not end in a counter
+func split_cart_part_counter(text string) (cart_part, bool) {
+	match := CART_PART_COUNTER_REGEX.FindStringSubmatchIndex(text)
+	if match == nil {
+		return cart_part{text: text}, false
+	}
+	part, _ := strconv.Atoi(text[match[4]:match[5]])
+	total, _ := strconv.Atoi(text[match[6]:match[7]])
+	if part < 1 || part > total {
+		return cart_part{text: text}, false
+	}
+	return cart_part{
+		text:      text[:match[0]],
+		separator: text[match[2]:match[3]],
+		part:      part,
+		total:     total,
+	}, true
+}
+
+func tweet_text(tweet *twitter.Tweet) string {
+	if len(tweet.FullText) > 0 {
+		return tweet.FullText
+	}
+	if tweet.ExtendedTweet != nil {
+		return tweet.ExtendedTweet.FullText
+	}
+	return tweet.Text
+}
+
+func is_cart_part(tweet *twitter.Tweet) bool {
+	_, ok := split_cart_part_counter(tweet_text(tweet))
+	return ok
+}
+
+//Whether tweet is part of a multi-tweet cart, but not the last part.  Running it would only run the cart up to it,
+//and the parts after it can not be looked up, so these are never run
+func is_unfinished_cart_part(tweet *twitter.Tweet) (cart_part, bool) {
+	part, ok := split_cart_part_counter(tweet_text(tweet))
+	return part, ok && part.part < part.total
+}
+
+//The tweet whose cart should be run for a mention.  Mentions in a reply to your own tweet
+//run the tweet being replied to, unless the mention is itself part of a multi-tweet cart
+func tweet_id_to_run(mention *twitter.Tweet) int64 {
+	if mention.InReplyToStatusID != 0 && mention.InReplyToUserID == mention.User.ID && !is_cart_part(mention) {
+		return mention.InReplyToStatusID
+	}
+	return mention.ID
+}
+
+//Walks up the reply chain of last_tweet to find the earlier parts of its cart, if it is part of a
+//multi-tweet cart.  Only replies by the same author with consecutive counters are followed.
+//Returns the tweets in order, ending in last_tweet
+func collect_cart_thread(ctx context.Context, last_tweet *twitter.Tweet, tc *twitter.Client, logger *Logger) []*twitter.Tweet {
+	thread := []*twitter.Tweet{last_tweet}
+	part, ok := split_cart_part_counter(tweet_text(last_tweet))
+	if !ok {
+		return thread
+	}
+	tweet := last_tweet
+	for part.part > 1 && len(thread) < MAX_CART_PARTS {
+		if tweet.InReplyToStatusID == 0 || tweet.InReplyToUserID != last_tweet.User.ID {
+			break
+		}
+		parent, err := fetch_tweet(ctx, tweet.InReplyToStatusID, tc, logger)
+		if err != nil {
+			break
+		}
+		parent_part, ok := split_cart_part_counter(tweet_text(parent))
+		if !ok || parent_part.part != part.part-1 || parent_part.total != part.total {
+			break
+		}
+		thread = append(thread, parent)
+		tweet, part = parent, parent_part
+	}
+	if part.part != 1 {
+		logger.Warn("Could not find all parts of the cart.  Only running the parts found", "tweet_id", last_tweet.IDStr, "parts_found", len(thread))
+	}
+
+	for i, j := 0, len(thread)-1; i < j; i, j = i+1, j-1 {
+		thread[i], thread[j] = thread[j], thread[i]
+	}
+	return thread
+}
+
+//Puts the cart back together from its tweets, which must be in order.
+//This is the inverse of divide_cart_up_into_tweets
+func reassemble_cart(thread []*twitter.Tweet) string {
+	cart := ""
+	for i, tweet := range thread {
+		part, _ := split_cart_part_counter(tweet_text(tweet))
+		//removing the mention at the start of a reply leaves the space after it
+		cart += strings.TrimLeft(sanitize_tweet_text(part.text, text_edits_from_entities(tweet.Entities, true)), " ")
+		if i < len(thread)-1 {
+			if len(part.separator) == 0 {
+				part.separator = "\n"
+			}
+			cart += part.separator
+		}
+	}
+	return cart
+}
+
+func fetch_tweet(ctx context.Context, tweet_id int64, tc *twitter.Client, logger *Logger) (*twitter.Tweet, error) {
+	return call_twitter_api(ctx, fmt.Sprintf("Error retrieving tweet ID: %v", tweet_id), logger, func() (*twitter.Tweet, *http.Response, error) {
+		status_show_params := &twitter.StatusShowParams{
+			ID:               tweet_id,
+			TrimUser:         twitter.Bool(false),
+			IncludeMyRetweet: twitter.Bool(false),
+			IncludeEntities:  twitter.Bool(true),
+			TweetMode:        "extended",
+		}
+		return tc.Statuses.Show(tweet_id, status_show_params)
+	})
+}
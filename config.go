@@ -0,0 +1,522 @@
+//Copyright (C) 2020 Daniel Bokser.  See LICENSE file for license
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Everything that can be configured about the bot.
+//Settings are loaded from, in order of precedence: command-line flags, environment variables, the config file
+type Config struct {
+	KeysFile               string   `json:"keys_file"`
+	ConcurrentCartHandlers int64    `json:"concurrent_cart_handlers"`
+	WebhookDomainName      string   `json:"webhook_domain_name"`
+	WebhookEnvName         string   `json:"webhook_env_name"`
+	LogFile                string   `json:"log_file"`
+	LogFormat              string   `json:"log_format"`
+	LogLevel               string   `json:"log_level"`
+	LogMaxSize             int      `json:"log_max_size"`
+	LogMaxAge              Duration `json:"log_max_age"`
+	LogMaxBackups          int      `json:"log_max_backups"`
+	ListenAddress          string   `json:"listen_address"`
+	AdminListenAddress     string   `json:"admin_listen_address"`
+	AdminToken             string   `json:"admin_token"`
+	TLSCertFile            string   `json:"tls_cert_file"`
+	TLSKeyFile             string   `json:"tls_key_file"`
+	JobJournalFile         string   `json:"job_journal_file"`
+	ArchiveDir             string   `json:"archive_dir"`
+	JobRetention           Duration `json:"job_retention"`
+	StateFile              string   `json:"state_file"`
+	Pico8Path              string   `json:"pico8_path"`
+	ScratchDir             string   `json:"scratch_dir"`
+	CartTimeout            Duration `json:"cart_timeout"`
+	ShutdownGracePeriod    Duration `json:"shutdown_grace_period"`
+	TwitterAPIMaxAttempts  int      `json:"twitter_api_max_attempts"`
+	TwitterAPIRetryTimeout Duration `json:"twitter_api_retry_timeout"`
+	//calls to an endpoint wait for its rate limit to reset once it has this many calls left
+	TwitterRateLimitReserve int `json:"twitter_rate_limit_reserve"`
+	//0 means no limit
+	CartsPerUserPerHour int `json:"carts_per_user_per_hour"`
+	//screen names that have no limit
+	QuotaAllowlist []string `json:"quota_allowlist"`
+	BlocklistFile  string   `json:"blocklist_file"`
+	//carts matching a word or /regex/ in this file are not run
+	ModerationWordlistFile string `json:"moderation_wordlist_file"`
+	//DMed carts are not tweeted until an operator approves them
+	HoldDMTweetsForApproval bool   `json:"hold_dm_tweets_for_approval"`
+	HeldMediaDir            string `json:"held_media_dir"`
+	//limits on each PICO-8 process.  0 means no limit
+	CartCPUSeconds    int `json:"cart_cpu_seconds"`
+	CartMemoryLimitMB int `json:"cart_memory_limit_mb"`
+	CartMaxOpenFiles  int `json:"cart_max_open_files"`
+	//cgroup v2 directory to put each run in.  Not used if empty
+	CartCgroupDir        string `json:"cart_cgroup_dir"`
+	CartCgroupCPUPercent int    `json:"cart_cgroup_cpu_percent"`
+	CartCgroupMemoryMB   int    `json:"cart_cgroup_memory_mb"`
+	IsolateCartNetwork   bool   `json:"isolate_cart_network"`
+	//if set, the bot runs its own Xvfb servers for PICO-8 rather than using DISPLAY
+	XvfbPath       string `json:"xvfb_path"`
+	XvfbPerHandler bool   `json:"xvfb_per_handler"`
+	XvfbScreen     string `json:"xvfb_screen"`
+	SDLAudioDriver string `json:"sdl_audio_driver"`
+	//run a cart on start up to make sure recording works
+	SelfTest bool `json:"self_test"`
+	//keep a PICO-8 running for each cart handler rather than starting one per cart
+	Pico8WorkerPool    bool `json:"pico8_worker_pool"`
+	Pico8WorkerMaxRuns int  `json:"pico8_worker_max_runs"`
+	//keep what deterministic carts make, so they are not run again.  Off if the directory is empty
+	ResultCacheDir       string `json:"result_cache_dir"`
+	ResultCacheMaxSizeMB int    `json:"result_cache_max_size_mb"`
+	//defaults and limits for what carts can ask for with directives
+	RecordingLength       Duration `json:"recording_length"`
+	MinRecordingLength    Duration `json:"min_recording_length"`
+	MaxRecordingLength    Duration `json:"max_recording_length"`
+	StaticRecordingLength Duration `json:"static_recording_length"`
+	FrameRate             int      `json:"frame_rate"`
+	MinFrameRate          int      `json:"min_frame_rate"`
+	StartFrame            int      `json:"start_frame"`
+	MaxStartFrame         int      `json:"max_start_frame"`
+	//"gif" or "mp4".  Carts can override this with --format
+	OutputFormat string `json:"output_format"`
+	FFmpegPath   string `json:"ffmpeg_path"`
+}
+
+//A time.Duration that is written as "8s" or "1m30s" in config files
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return fmt.Errorf("duration must be a string such as \"8s\": %v", err)
+	}
+	parsed, err := time.ParseDuration(str)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+const CONFIG_ENV_PREFIX = "TWEETCARTRUNNER_"
+
+//Time PICO-8 gets to start before a cart's first frame, when checking cart_timeout is long enough
+const PICO_8_STARTUP_ALLOWANCE = 5 * time.Second
+
+func default_config() *Config {
+	return &Config{
+		ConcurrentCartHandlers:  1,
+		LogFormat:               LOG_FORMAT_LOGFMT,
+		LogLevel:                "info",
+		LogMaxSize:              100,
+		LogMaxAge:               Duration{24 * time.Hour},
+		LogMaxBackups:           7,
+		ListenAddress:           ":443",
+		AdminListenAddress:      "localhost:9090",
+		TLSCertFile:             "tls/server.crt",
+		TLSKeyFile:              "tls/server.key",
+		JobJournalFile:          "jobs.journal",
+		JobRetention:            Duration{30 * 24 * time.Hour},
+		StateFile:               "persistent_state.json",
+		Pico8Path:               PICO_8_EXEC_PATH,
+		ScratchDir:              default_scratch_root(),
+		CartTimeout:             Duration{35 * time.Second},
+		ShutdownGracePeriod:     Duration{time.Minute},
+		TwitterAPIMaxAttempts:   DEFAULT_TWITTER_API_MAX_ATTEMPTS,
+		TwitterAPIRetryTimeout:  Duration{DEFAULT_TWITTER_API_RETRY_TIMEOUT},
+		TwitterRateLimitReserve: DEFAULT_TWITTER_RATE_LIMIT_RESERVE,
+		CartsPerUserPerHour:     DEFAULT_CARTS_PER_USER_PER_HOUR,
+		BlocklistFile:           "blocklist.json",
+		HeldMediaDir:            "held",
+		CartCPUSeconds:          60,
+		CartMemoryLimitMB:       4096,
+		CartMaxOpenFiles:        256,
+		CartCgroupCPUPercent:    100,
+		CartCgroupMemoryMB:      512,
+		XvfbScreen:              "640x480x24",
+		SDLAudioDriver:          "dummy",
+		SelfTest:                true,
+		Pico8WorkerMaxRuns:      50,
+		ResultCacheMaxSizeMB:    512,
+		RecordingLength:         Duration{8 * time.Second},
+		MinRecordingLength:      Duration{1 * time.Second},
+		MaxRecordingLength:      Duration{15 * time.Second},
+		StaticRecordingLength:   Duration{2 * time.Second},
+		FrameRate:               PICO_8_GIF_FRAME_RATE,
+		MinFrameRate:            5,
+		StartFrame:              2,
+		MaxStartFrame:           300,
+		OutputFormat:            MEDIA_FORMAT_GIF,
+		FFmpegPath:              "ffmpeg",
+	}
+}
+
+//A setting that can be set by a flag or environment variable.
+//The flag is -<name> and the environment variable is TWEETCARTRUNNER_<NAME>
+type config_setting struct {
+	name  string
+	usage string
+	set   func(config *Config, value string) error
+}
+
+func string_setting(field func(config *Config) *string) func(*Config, string) error {
+	return func(config *Config, value string) error {
+		*field(config) = value
+		return nil
+	}
+}
+
+func int_setting(field func(config *Config) *int) func(*Config, string) error {
+	return func(config *Config, value string) error {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		*field(config) = parsed
+		return nil
+	}
+}
+
+//true, false, 1, 0, etc.
+func bool_setting(field func(config *Config) *bool) func(*Config, string) error {
+	return func(config *Config, value string) error {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		*field(config) = parsed
+		return nil
+	}
+}
+
+//Comma separated, e.g. "user1,user2"
+func string_list_setting(field func(config *Config) *[]string) func(*Config, string) error {
+	return func(config *Config, value string) error {
+		list := make([]string, 0)
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); len(item) > 0 {
+				list = append(list, item)
+			}
+		}
+		*field(config) = list
+		return nil
+	}
+}
+
+func duration_setting(field func(config *Config) *Duration) func(*Config, string) error {
+	return func(config *Config, value string) error {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field(config).Duration = parsed
+		return nil
+	}
+}
+
+var CONFIG_SETTINGS = []config_setting{
+	{"keys_file", "file containing the twitter API keys", string_setting(func(c *Config) *string { return &c.KeysFile })},
+	{"concurrent_cart_handlers", "number of carts that can be run at once", func(config *Config, value string) error {
+		num_handlers, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		config.ConcurrentCartHandlers = int64(num_handlers)
+		return nil
+	}},
+	{"webhook_domain_name", "domain name twitter uses to reach the webhook", string_setting(func(c *Config) *string { return &c.WebhookDomainName })},
+	{"webhook_env_name", "name of the twitter dev environment", string_setting(func(c *Config) *string { return &c.WebhookEnvName })},
+	{"log_file", "file to log to instead of stderr", string_setting(func(c *Config) *string { return &c.LogFile })},
+	{"log_format", "logfmt or json", string_setting(func(c *Config) *string { return &c.LogFormat })},
+	{"log_level", "lowest level that gets logged: debug, info, warn or error", string_setting(func(c *Config) *string { return &c.LogLevel })},
+	{"log_max_size", "size in megabytes at which the log file gets rotated.  0 to never rotate by size", int_setting(func(c *Config) *int { return &c.LogMaxSize })},
+	{"log_max_age", "age at which the log file gets rotated, e.g. 24h.  0 to never rotate by age", duration_setting(func(c *Config) *Duration { return &c.LogMaxAge })},
+	{"log_max_backups", "number of rotated log files to keep.  0 to keep all of them", int_setting(func(c *Config) *int { return &c.LogMaxBackups })},
+	{"listen_address", "address the webhook server listens on", string_setting(func(c *Config) *string { return &c.ListenAddress })},
+	{"admin_listen_address", "address the admin server with /metrics listens on.  Not started if empty", string_setting(func(c *Config) *string { return &c.AdminListenAddress })},
+	{"admin_token", "token the admin API requires as \"Authorization: Bearer <token>\".  The admin API is disabled if empty", string_setting(func(c *Config) *string { return &c.AdminToken })},
+	{"tls_cert_file", "HTTPS certificate for the webhook server", string_setting(func(c *Config) *string { return &c.TLSCertFile })},
+	{"tls_key_file", "HTTPS key for the webhook server", string_setting(func(c *Config) *string { return &c.TLSKeyFile })},
+	{"job_journal_file", "file every job is recorded in", string_setting(func(c *Config) *string { return &c.JobJournalFile })},
+	{"archive_dir", "directory to keep a copy of every GIF in.  Not kept if empty", string_setting(func(c *Config) *string { return &c.ArchiveDir })},
+	{"job_retention", "how long finished jobs are kept in the job journal.  0 keeps them forever", duration_setting(func(c *Config) *Duration { return &c.JobRetention })},
+	{"state_file", "persistent state file from older versions to import into a new job journal", string_setting(func(c *Config) *string { return &c.StateFile })},
+	{"pico8_path", "path to the PICO-8 executable", string_setting(func(c *Config) *string { return &c.Pico8Path })},
+	{"scratch_dir", "directory carts are run in", string_setting(func(c *Config) *string { return &c.ScratchDir })},
+	{"cart_timeout", "how long a cart can run before giving up, e.g. 30s", duration_setting(func(c *Config) *Duration { return &c.CartTimeout })},
+	{"shutdown_grace_period", "how long to wait for running carts to finish when going down before killing them, e.g. 1m", duration_setting(func(c *Config) *Duration { return &c.ShutdownGracePeriod })},
+	{"twitter_api_max_attempts", "how many times a failed twitter API call is tried before giving up.  0 for no limit", int_setting(func(c *Config) *int { return &c.TwitterAPIMaxAttempts })},
+	{"twitter_api_retry_timeout", "how long to keep retrying a failed twitter API call before giving up, e.g. 10m.  0 for no limit", duration_setting(func(c *Config) *Duration { return &c.TwitterAPIRetryTimeout })},
+	{"twitter_rate_limit_reserve", "calls to a twitter endpoint wait for its rate limit window to reset once it has this many calls left", int_setting(func(c *Config) *int { return &c.TwitterRateLimitReserve })},
+	{"carts_per_user_per_hour", "how many carts each user can run per hour.  0 for no limit", int_setting(func(c *Config) *int { return &c.CartsPerUserPerHour })},
+	{"quota_allowlist", "comma separated screen names that can run as many carts as they want", string_list_setting(func(c *Config) *[]string { return &c.QuotaAllowlist })},
+	{"blocklist_file", "file the users the bot ignores are kept in", string_setting(func(c *Config) *string { return &c.BlocklistFile })},
+	{"moderation_wordlist_file", "carts containing a word or /regex/ listed in this file, one per line, are not run", string_setting(func(c *Config) *string { return &c.ModerationWordlistFile })},
+	{"hold_dm_tweets_for_approval", "true to not tweet DMed carts until they are approved with the admin API", bool_setting(func(c *Config) *bool { return &c.HoldDMTweetsForApproval })},
+	{"held_media_dir", "directory GIFs waiting for approval are kept in", string_setting(func(c *Config) *string { return &c.HeldMediaDir })},
+	{"cart_cpu_seconds", "CPU time each PICO-8 process can use.  0 for no limit", int_setting(func(c *Config) *int { return &c.CartCPUSeconds })},
+	{"cart_memory_limit_mb", "address space each PICO-8 process can use in megabytes.  0 for no limit", int_setting(func(c *Config) *int { return &c.CartMemoryLimitMB })},
+	{"cart_max_open_files", "files each PICO-8 process can have open.  0 for no limit", int_setting(func(c *Config) *int { return &c.CartMaxOpenFiles })},
+	{"cart_cgroup_dir", "cgroup v2 directory the bot can write to.  Each run gets its own cgroup under it with the cart_cgroup_* caps", string_setting(func(c *Config) *string { return &c.CartCgroupDir })},
+	{"cart_cgroup_cpu_percent", "percent of one CPU each run's cgroup can use.  0 for no limit", int_setting(func(c *Config) *int { return &c.CartCgroupCPUPercent })},
+	{"cart_cgroup_memory_mb", "memory each run's cgroup can use in megabytes.  0 for no limit", int_setting(func(c *Config) *int { return &c.CartCgroupMemoryMB })},
+	{"isolate_cart_network", "true to run PICO-8 in its own network namespace with no way out", bool_setting(func(c *Config) *bool { return &c.IsolateCartNetwork })},
+	{"xvfb_path", "path to Xvfb.  If set, the bot runs its own Xvfb for PICO-8 to draw to rather than using DISPLAY", string_setting(func(c *Config) *string { return &c.XvfbPath })},
+	{"xvfb_per_handler", "true to run an Xvfb for each concurrent cart handler rather than one shared by all of them", bool_setting(func(c *Config) *bool { return &c.XvfbPerHandler })},
+	{"xvfb_screen", "size and depth of the Xvfb screen, e.g. 640x480x24", string_setting(func(c *Config) *string { return &c.XvfbScreen })},
+	{"sdl_audio_driver", "SDL_AUDIODRIVER PICO-8 is run with.  Left alone if empty", string_setting(func(c *Config) *string { return &c.SDLAudioDriver })},
+	{"self_test", "true to run a cart on start up and exit if it can not be recorded", bool_setting(func(c *Config) *bool { return &c.SelfTest })},
+	{"pico8_worker_pool", "true to keep a PICO-8 running for each cart handler rather than starting one for every cart.  Needs PICO-8 0.2.2 or newer", bool_setting(func(c *Config) *bool { return &c.Pico8WorkerPool })},
+	{"pico8_worker_max_runs", "how many carts a PICO-8 worker runs before it is replaced", int_setting(func(c *Config) *int { return &c.Pico8WorkerMaxRuns })},
+	{"result_cache_dir", "directory to keep what deterministic carts make in, so they are not run again.  Off if empty", string_setting(func(c *Config) *string { return &c.ResultCacheDir })},
+	{"result_cache_max_size_mb", "megabytes the result cache keeps before it removes the least recently used results", int_setting(func(c *Config) *int { return &c.ResultCacheMaxSizeMB })},
+	{"recording_length", "how long to record each cart for, e.g. 8s", duration_setting(func(c *Config) *Duration { return &c.RecordingLength })},
+	{"min_recording_length", "shortest recording a cart can ask for with --len", duration_setting(func(c *Config) *Duration { return &c.MinRecordingLength })},
+	{"max_recording_length", "longest recording a cart can ask for with --len", duration_setting(func(c *Config) *Duration { return &c.MaxRecordingLength })},
+	{"static_recording_length", "how long to record carts without a _draw() function after they finish", duration_setting(func(c *Config) *Duration { return &c.StaticRecordingLength })},
+	{"frame_rate", "frame rate of recordings", int_setting(func(c *Config) *int { return &c.FrameRate })},
+	{"min_frame_rate", "lowest frame rate a cart can ask for with --fps", int_setting(func(c *Config) *int { return &c.MinFrameRate })},
+	{"start_frame", "recording starts on this call to flip()", int_setting(func(c *Config) *int { return &c.StartFrame })},
+	{"max_start_frame", "latest start frame a cart can ask for with --start", int_setting(func(c *Config) *int { return &c.MaxStartFrame })},
+	{"output_format", "gif or mp4", string_setting(func(c *Config) *string { return &c.OutputFormat })},
+	{"ffmpeg_path", "path to ffmpeg, used to encode MP4s. GIFs are used if it is not installed", string_setting(func(c *Config) *string { return &c.FFmpegPath })},
+}
+
+//args should be os.Args and getenv should be os.Getenv
+func load_config(args []string, getenv func(string) string) (*Config, error) {
+	config := default_config()
+
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	config_file_name := flags.String("config", getenv(CONFIG_ENV_PREFIX+"CONFIG"), "JSON config file")
+	flag_values := make(map[string]*string, len(CONFIG_SETTINGS))
+	for _, setting := range CONFIG_SETTINGS {
+		flag_values[setting.name] = flags.String(setting.name, "", setting.usage)
+	}
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %v [flags]\n   or: %v file_containing_api_keys number_of_concurrent_tweetcart_handlers webhook_domain_name webook_env_name [log_file_name]\n", args[0], args[0])
+		fmt.Fprintf(flags.Output(), "Every flag can also be set with the environment variable %v<FLAG NAME>\n", CONFIG_ENV_PREFIX)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args[1:]); err != nil {
+		return nil, err
+	}
+
+	if len(*config_file_name) > 0 {
+		if err := read_config_file(config, *config_file_name); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, setting := range CONFIG_SETTINGS {
+		env_name := CONFIG_ENV_PREFIX + strings.ToUpper(setting.name)
+		if value := getenv(env_name); len(value) > 0 {
+			if err := setting.set(config, value); err != nil {
+				return nil, fmt.Errorf("invalid %v: %v", env_name, err)
+			}
+		}
+	}
+
+	//the original positional arguments are still supported
+	positional_args := flags.Args()
+	if len(positional_args) > 0 {
+		if len(positional_args) < 4 {
+			flags.Usage()
+			return nil, errors.New("not enough arguments")
+		}
+		positional_settings := []string{"keys_file", "concurrent_cart_handlers", "webhook_domain_name", "webhook_env_name", "log_file"}
+		for i := range positional_args {
+			if i >= len(positional_settings) {
+				break
+			}
+			flag_values[positional_settings[i]] = &positional_args[i]
+		}
+	}
+
+	for _, setting := range CONFIG_SETTINGS {
+		if value := *flag_values[setting.name]; len(value) > 0 {
+			if err := setting.set(config, value); err != nil {
+				return nil, fmt.Errorf("invalid -%v: %v", setting.name, err)
+			}
+		}
+	}
+
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+//Overrides the settings in config with the ones in the JSON file
+func read_config_file(config *Config, file_name string) error {
+	contents, err := ioutil.ReadFile(file_name)
+	if err != nil {
+		return fmt.Errorf("could not read config file %v: %v", file_name, err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(contents))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(config); err != nil {
+		return fmt.Errorf("could not parse config file %v: %v", file_name, err)
+	}
+	return nil
+}
+
+func (config *Config) validate() error {
+	required := map[string]string{
+		"keys_file":           config.KeysFile,
+		"webhook_domain_name": config.WebhookDomainName,
+		"webhook_env_name":    config.WebhookEnvName,
+		"listen_address":      config.ListenAddress,
+		"tls_cert_file":       config.TLSCertFile,
+		"tls_key_file":        config.TLSKeyFile,
+		"job_journal_file":    config.JobJournalFile,
+		"blocklist_file":      config.BlocklistFile,
+		"held_media_dir":      config.HeldMediaDir,
+		"pico8_path":          config.Pico8Path,
+		"scratch_dir":         config.ScratchDir,
+	}
+	if len(config.XvfbPath) > 0 {
+		required["xvfb_screen"] = config.XvfbScreen
+	}
+	for _, setting := range CONFIG_SETTINGS {
+		if value, ok := required[setting.name]; ok && len(value) == 0 {
+			return fmt.Errorf("%v must be set", setting.name)
+		}
+	}
+	if config.ConcurrentCartHandlers <= 0 {
+		return errors.New("concurrent_cart_handlers must be a number > 0")
+	}
+	if config.MinRecordingLength.Duration <= 0 {
+		return errors.New("min_recording_length must be > 0")
+	}
+	if config.RecordingLength.Duration < config.MinRecordingLength.Duration || config.RecordingLength.Duration > config.MaxRecordingLength.Duration {
+		return errors.New("recording_length must be between min_recording_length and max_recording_length")
+	}
+	if config.StaticRecordingLength.Duration < config.MinRecordingLength.Duration || config.StaticRecordingLength.Duration > config.MaxRecordingLength.Duration {
+		return errors.New("static_recording_length must be between min_recording_length and max_recording_length")
+	}
+	//the longest run a cart can ask for waits for max_start_frame frames, then records for max_recording_length
+	longest_run := config.MaxRecordingLength.Duration + time.Duration(config.MaxStartFrame)*time.Second/PICO_8_GIF_FRAME_RATE + PICO_8_STARTUP_ALLOWANCE
+	if config.CartTimeout.Duration <= longest_run {
+		return fmt.Errorf("cart_timeout must be longer than max_recording_length plus max_start_frame frames plus %v for PICO-8 to start, which is %v",
+			PICO_8_STARTUP_ALLOWANCE, longest_run)
+	}
+	if config.MinFrameRate <= 0 || config.FrameRate < config.MinFrameRate || config.FrameRate > PICO_8_GIF_FRAME_RATE {
+		return fmt.Errorf("frame_rate must be between min_frame_rate and %v", PICO_8_GIF_FRAME_RATE)
+	}
+	if config.StartFrame < 1 || config.StartFrame > config.MaxStartFrame {
+		return errors.New("start_frame must be between 1 and max_start_frame")
+	}
+	if config.ShutdownGracePeriod.Duration < 0 {
+		return errors.New("shutdown_grace_period must be >= 0")
+	}
+	if config.JobRetention.Duration < 0 {
+		return errors.New("job_retention must be >= 0")
+	}
+	if config.TwitterAPIMaxAttempts < 0 || config.TwitterAPIRetryTimeout.Duration < 0 {
+		return errors.New("twitter_api_max_attempts and twitter_api_retry_timeout must be >= 0")
+	}
+	if config.TwitterRateLimitReserve < 0 {
+		return errors.New("twitter_rate_limit_reserve must be >= 0")
+	}
+	if config.CartsPerUserPerHour < 0 {
+		return errors.New("carts_per_user_per_hour must be >= 0")
+	}
+	if config.CartCPUSeconds < 0 || config.CartMemoryLimitMB < 0 || config.CartMaxOpenFiles < 0 {
+		return errors.New("cart_cpu_seconds, cart_memory_limit_mb and cart_max_open_files must be >= 0")
+	}
+	if config.CartCgroupCPUPercent < 0 || config.CartCgroupMemoryMB < 0 {
+		return errors.New("cart_cgroup_cpu_percent and cart_cgroup_memory_mb must be >= 0")
+	}
+	if config.Pico8WorkerMaxRuns < 1 {
+		return errors.New("pico8_worker_max_runs must be a number > 0")
+	}
+	if config.ResultCacheMaxSizeMB < 0 {
+		return errors.New("result_cache_max_size_mb must be >= 0")
+	}
+	if !is_valid_media_format(config.OutputFormat) {
+		return errors.New("output_format must be gif or mp4")
+	}
+	if config.LogFormat != LOG_FORMAT_LOGFMT && config.LogFormat != LOG_FORMAT_JSON {
+		return errors.New("log_format must be logfmt or json")
+	}
+	if _, err := parse_log_level(config.LogLevel); err != nil {
+		return errors.New("log_level must be debug, info, warn or error")
+	}
+	if config.LogMaxSize < 0 || config.LogMaxAge.Duration < 0 || config.LogMaxBackups < 0 {
+		return errors.New("log_max_size, log_max_age and log_max_backups must be >= 0")
+	}
+	return nil
+}
+
+func (config *Config) run_limits() *RunLimits {
+	return &RunLimits{
+		Default: RunParams{
+			RecordingLength:       config.RecordingLength.Duration,
+			StaticRecordingLength: config.StaticRecordingLength.Duration,
+			FrameRate:             config.FrameRate,
+			StartFrame:            config.StartFrame,
+			Format:                config.OutputFormat,
+		},
+		Min: RunParams{
+			RecordingLength:       config.MinRecordingLength.Duration,
+			StaticRecordingLength: config.MinRecordingLength.Duration,
+			FrameRate:             config.MinFrameRate,
+			StartFrame:            1,
+		},
+		Max: RunParams{
+			RecordingLength:       config.MaxRecordingLength.Duration,
+			StaticRecordingLength: config.MaxRecordingLength.Duration,
+			FrameRate:             PICO_8_GIF_FRAME_RATE,
+			StartFrame:            config.MaxStartFrame,
+		},
+	}
+}
+
+func (config *Config) sandbox() *Sandbox {
+	const megabyte = 1024 * 1024
+	sandbox := &Sandbox{
+		cpu_seconds:     uint64(config.CartCPUSeconds),
+		max_memory:      uint64(config.CartMemoryLimitMB) * megabyte,
+		max_open_files:  uint64(config.CartMaxOpenFiles),
+		isolate_network: config.IsolateCartNetwork,
+	}
+	if len(config.CartCgroupDir) > 0 {
+		sandbox.cgroup_dir = config.CartCgroupDir
+		sandbox.cgroup_memory_max = uint64(config.CartCgroupMemoryMB) * megabyte
+		if config.CartCgroupCPUPercent > 0 {
+			//the quota is per 100ms period
+			sandbox.cgroup_cpu_max = fmt.Sprintf("%v 100000", config.CartCgroupCPUPercent*1000)
+		}
+	}
+	return sandbox
+}
+
+//Environment variables PICO-8 is run with on top of the bot's
+func (config *Config) pico8_env() []string {
+	env := []string{}
+	if len(config.SDLAudioDriver) > 0 {
+		env = append(env, "SDL_AUDIODRIVER="+config.SDLAudioDriver)
+	}
+	return env
+}
+
+func (config *Config) twitter_account_activity_url() string {
+	return "https://api.twitter.com/1.1/account_activity/all/" + config.WebhookEnvName
+}
+
+func (config *Config) webhook_url() string {
+	return "https://" + config.WebhookDomainName + WEBHOOK_PATH
+}
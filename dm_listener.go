@@ -9,31 +9,29 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net"
 	"net/http"
 	"net/url"
-	"os"
-	"os/signal"
 	"strconv"
 	"strings"
-	"syscall"
 	"time"
 	"twitter"
 	"unicode"
 	"unicode/utf8"
-
-	"golang.org/x/sync/semaphore"
 )
 
 const (
-	WEBHOOK_PATH = "/webhook"
+	WEBHOOK_PATH             = "/webhook"
+	WEBHOOK_SIGNATURE_HEADER = "x-twitter-webhooks-signature"
+	//DM events are a few KB.  Bodies are read before the signature can be checked, so anyone could send a huge one
+	MAX_WEBHOOK_BODY_SIZE = 1 << 20
 )
 
 type DirectMessage struct {
 	SenderId    string `json:"sender_id"`
 	MessageData struct {
-		Text string `json:"text"`
+		Text     string            `json:"text"`
+		Entities *twitter.Entities `json:"entities"`
 	} `json:"message_data"`
 }
 type DirectMessageEvent struct {
@@ -52,64 +50,98 @@ type DirectMessageEvents struct {
 }
 
 type DMCart struct {
-	DMID   string
-	DMText string
-	Sender User
+	DMID       string
+	DMText     string
+	DMEntities *twitter.Entities `json:",omitempty"`
+	Sender     User
 }
 
 type DMHanderContext struct {
-	consumer_secret            []byte
-	goroutine_context          context.Context
-	program_handling_semaphore *semaphore.Weighted
-	twitter_client             *twitter.Client
-	my_user                    *twitter.User
-	dm_channel                 chan *DMCart
-	dms_in_progress            chan *DMCart
-	processed_dm_ids           chan string
+	consumer_secret   []byte
+	goroutine_context context.Context
+	twitter_client    *twitter.Client
+	my_user           *twitter.User
+	runner            CartRunner
+	run_limits        *RunLimits
+	dm_channel        chan *DMCart
+	jobs              *JobStore
+	quota             *UserQuota
+	scheduler         *FairScheduler
+	blocklist         *Blocklist
+	moderation        *Moderation
+}
+
+//Returns "sha256=<base64 of the HMAC-SHA256 of message>" which is the format Twitter uses
+//for both the crc_token response and the x-twitter-webhooks-signature header
+func compute_webhook_signature(message, consumer_secret []byte) string {
+	hash := hmac.New(sha256.New, consumer_secret)
+	hash.Write(message)
+	return "sha256=" + base64.StdEncoding.EncodeToString(hash.Sum(nil))
+}
+
+func is_valid_webhook_signature(signature string, body, consumer_secret []byte) bool {
+	if len(signature) == 0 {
+		return false
+	}
+	expected := compute_webhook_signature(body, consumer_secret)
+	return hmac.Equal([]byte(signature), []byte(expected))
 }
 
 func (dm_context *DMHanderContext) ServeHTTP(writer http.ResponseWriter, req *http.Request) {
+	if req.ContentLength > MAX_WEBHOOK_BODY_SIZE {
+		root_logger.Warn("Rejected webhook request that is too large", "remote_addr", req.RemoteAddr, "size", req.ContentLength)
+		writer.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
 	buf := bytes.Buffer{}
 	if req.ContentLength > 0 {
 		buf.Grow(int(req.ContentLength))
 	}
 
-	_, err := buf.ReadFrom(req.Body)
+	_, err := buf.ReadFrom(http.MaxBytesReader(writer, req.Body, MAX_WEBHOOK_BODY_SIZE))
+	if err != nil && buf.Len() >= MAX_WEBHOOK_BODY_SIZE {
+		root_logger.Warn("Rejected webhook request that is too large", "remote_addr", req.RemoteAddr)
+		writer.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
 	if err != nil {
-		log.Println("Error reading webhook request: ", err)
+		root_logger.Warn("Error reading webhook request", "err", err)
 		return
 	}
 	if token_slice, ok := req.URL.Query()["crc_token"]; ok {
 		if len(token_slice) < 1 {
-			log.Println("crc_token has no elements!")
+			root_logger.Warn("crc_token has no elements!")
 			writer.WriteHeader(http.StatusBadRequest)
 			return
 		}
 		token := []byte(token_slice[0])
-		hash := hmac.New(sha256.New, dm_context.consumer_secret)
-		if _, err := hash.Write(token); err != nil {
-			log.Println("Could not hash crc_token!  Error:", err)
-			writer.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		resp_str := fmt.Sprintf("{\"response_token\": \"sha256=%v\"}", base64.StdEncoding.EncodeToString(hash.Sum(nil)))
+		resp_str := fmt.Sprintf("{\"response_token\": \"%v\"}", compute_webhook_signature(token, dm_context.consumer_secret))
 		writer.Header().Set("Content-Type", "application/json")
 		writer.Write([]byte(resp_str))
 		return
 	}
 
+	//anyone can reach this endpoint, so only trust events that were signed with our consumer secret
+	if !is_valid_webhook_signature(req.Header.Get(WEBHOOK_SIGNATURE_HEADER), buf.Bytes(), dm_context.consumer_secret) {
+		bot_metrics.webhook_requests_rejected.inc()
+		root_logger.Warn("Rejected webhook request with missing or invalid signature", "remote_addr", req.RemoteAddr,
+			"total_rejected", bot_metrics.webhook_requests_rejected.value())
+		writer.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
 	var dm_events DirectMessageEvents
 	if err = json.Unmarshal(buf.Bytes(), &dm_events); err != nil {
 		return
 	}
 	for _, dm_event := range dm_events.Events {
 		if dm_event.Type != "message_create" {
-			log.Println("Got dm event that was not of type message_create. Skipping... Type: ", dm_event.Type)
+			root_logger.Debug("Got dm event that was not of type message_create. Skipping...", "event_type", dm_event.Type)
 			continue
 		}
 		sender, ok := dm_events.Users[dm_event.Message.SenderId]
 		if !ok {
-			log.Printf("User %v not found in dm event %+v.  Skipping", dm_event.Message.SenderId, dm_event)
+			root_logger.Warn("User not found in dm event.  Skipping", "user_id", dm_event.Message.SenderId, "dm_id", dm_event.Id)
 			continue
 		}
 
@@ -118,31 +150,67 @@ func (dm_context *DMHanderContext) ServeHTTP(writer http.ResponseWriter, req *ht
 		}
 		dm_cart := &DMCart{}
 		dm_cart.DMText = dm_event.Message.MessageData.Text
+		dm_cart.DMEntities = dm_event.Message.MessageData.Entities
 		dm_cart.DMID = dm_event.Id
 		dm_cart.Sender = sender
-		dm_context.dm_channel <- dm_cart
+		queue_dm(dm_cart, dm_context.jobs, dm_context.dm_channel)
 	}
 
 	writer.WriteHeader(http.StatusOK)
 }
 
+//Records a job for the DM and sends it off to be run.  Returns false if the DM already has a job
+func queue_dm(dm_cart *DMCart, jobs *JobStore, dm_channel chan *DMCart) bool {
+	is_new, err := jobs.enqueue(&Job{
+		ID:       dm_job_id(dm_cart.DMID),
+		Type:     JOB_TYPE_DM,
+		SourceID: dm_cart.DMID,
+		DM:       dm_cart,
+		Author:   dm_cart.Sender.ScreenName,
+		AuthorID: dm_cart.Sender.Id,
+	})
+	if err != nil {
+		//still run it, it just will not be retried if the bot goes down
+		root_logger.for_job(dm_job_id(dm_cart.DMID), JOB_TYPE_DM, dm_cart.Sender.ScreenName).stage("intake").
+			Error("Could not record job", "err", err)
+	} else if !is_new {
+		return false
+	}
+	dm_channel <- dm_cart
+	return true
+}
+
+//Lets DMs in as long as their sender is not blocked and is under quota, and schedules them to be run
 func dm_event_loop(dm_context *DMHanderContext) {
 	for dm_cart := range dm_context.dm_channel {
-		err := dm_context.program_handling_semaphore.Acquire(dm_context.goroutine_context, 1)
-		if err != nil {
-			log.Print("Error acquiring semaphore: ", err)
+		job_id := dm_job_id(dm_cart.DMID)
+		if dm_context.blocklist.is_blocked(dm_cart.Sender.Id, dm_cart.Sender.ScreenName) {
+			logger := root_logger.for_job(job_id, JOB_TYPE_DM, dm_cart.Sender.ScreenName)
+			logger.stage("intake").Info("User is blocked.  Ignoring DM")
+			finish_job(dm_context.jobs, job_id, JOB_TYPE_DM, &JobResult{Status: JOB_STATUS_BLOCKED}, logger)
+			continue
+		}
+		if ok, retry_after, notify := dm_context.quota.admit(dm_cart.Sender.ScreenName); !ok {
+			logger := root_logger.for_job(job_id, JOB_TYPE_DM, dm_cart.Sender.ScreenName)
+			logger.stage("intake").Info("User is over quota", "retry_after", retry_after, "notify", notify)
+			if notify {
+				send_dm(dm_context.goroutine_context, dm_context.quota.over_quota_message(retry_after), dm_cart.Sender, dm_context.twitter_client, logger.stage("dm"))
+			}
+			finish_job(dm_context.jobs, job_id, JOB_TYPE_DM, &JobResult{Status: JOB_STATUS_OVER_QUOTA}, logger)
 			continue
 		}
 		tmp_dm_cart := dm_cart
-		go func() {
-			dm_context.dms_in_progress <- tmp_dm_cart
-			handle_dm(tmp_dm_cart.DMID, tmp_dm_cart.DMText, tmp_dm_cart.Sender, dm_context)
-			dm_context.processed_dm_ids <- tmp_dm_cart.DMID
-			dm_context.program_handling_semaphore.Release(1)
-		}()
+		dm_context.scheduler.push(&ScheduledCart{
+			job_id:   job_id,
+			job_type: JOB_TYPE_DM,
+			user:     dm_cart.Sender.ScreenName,
+			run: func(ctx context.Context, logger *Logger) *JobResult {
+				return handle_dm(ctx, tmp_dm_cart.DMID, tmp_dm_cart.DMText, tmp_dm_cart.DMEntities, tmp_dm_cart.Sender, dm_context, logger)
+			},
+		})
 	}
 }
-func user_screen_names_from_dms(twitter_client *twitter.Client, dms []twitter.DirectMessageEvent) map[string]string {
+func user_screen_names_from_dms(ctx context.Context, twitter_client *twitter.Client, dms []twitter.DirectMessageEvent, logger *Logger) (map[string]string, error) {
 
 	ret := make(map[string]string, len(dms))
 	users := make([]twitter.User, 100)
@@ -158,69 +226,69 @@ func user_screen_names_from_dms(twitter_client *twitter.Client, dms []twitter.Di
 		for _, dm := range dms[i : i+max_len] {
 			sender_id, err := strconv.Atoi(dm.Message.SenderID)
 			if err != nil {
-				log.Fatalf("User id is not a number! It is %v. Exiting due to DM %v", dm.Message.SenderID, dm.ID)
+				return nil, fmt.Errorf("user ID %v of DM %v is not a number", dm.Message.SenderID, dm.ID)
 			}
 			ids_to_lookup = append(ids_to_lookup, int64(sender_id))
 		}
-		api_func := func() (interface{}, error) {
+		tmp_users, err := call_twitter_api(ctx, "", logger, func() ([]twitter.User, *http.Response, error) {
 			lookup_params := &twitter.UserLookupParams{
 				UserID:          ids_to_lookup,
 				ScreenName:      nil,
 				IncludeEntities: twitter.Bool(false),
 			}
-			user_lookup, _, err := twitter_client.Users.Lookup(lookup_params)
-			return user_lookup, err
+			return twitter_client.Users.Lookup(lookup_params)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up users for DMs: %w", err)
 		}
-		user_lookup_int, _ := execute_twitter_api(api_func, "Failed to lookup users for dms", true)
-		tmp_users := user_lookup_int.([]twitter.User)
 		users = append(users, tmp_users...)
 		ids_to_lookup = ids_to_lookup[:0]
 	}
 	for _, user := range users {
 		ret[user.IDStr] = user.ScreenName
 	}
-	return ret
+	return ret, nil
 }
-func process_missed_dms(tc *twitter.Client, my_user *twitter.User, persistent_state *TweetCartRunnerPersistentState,
-	dm_cart_channel chan *DMCart) {
-	log.Print("Loading missed dms...")
-	for _, dm_cart := range persistent_state.DMsInProgress {
-		dm_cart_channel <- dm_cart
-	}
-	if persistent_state.LastDMID == 0 {
-		log.Print("Done!")
-		return
+func process_missed_dms(ctx context.Context, tc *twitter.Client, my_user *twitter.User, jobs *JobStore,
+	dm_cart_channel chan *DMCart) error {
+	logger := root_logger.with("stage", "intake", "type", JOB_TYPE_DM)
+	logger.Info("Loading missed dms...")
+	for _, job := range jobs.unfinished_jobs(JOB_TYPE_DM) {
+		if job.DM != nil {
+			dm_cart_channel <- job.DM
+		}
+	}
+	if jobs.last_processed_dm_id() == 0 {
+		logger.Info("Done!")
+		return nil
 	}
 
 	const buffer_size = 20
 	total_loaded_dms := 0
-	last_dm_id := persistent_state.LastDMID
+	last_dm_id := jobs.last_processed_dm_id()
 	params := &twitter.DirectMessageEventsListParams{Count: 50}
 	cursor := ""
 	for {
 		params.Cursor = cursor
-		api_func := func() (interface{}, error) {
-			log.Print("Since DM id: ", last_dm_id)
-
-			dms, _, err := tc.DirectMessages.EventsList(params)
-			return dms, err
-		}
-
-		dms_int, err := execute_twitter_api(api_func, "Cannot dms sent before bring up.  Exiting...", true)
+		logger.Debug("Loading DMs", "since_id", last_dm_id)
+		dms, err := call_twitter_api(ctx, "", logger, func() (*twitter.DirectMessageEvents, *http.Response, error) {
+			return tc.DirectMessages.EventsList(params)
+		})
 		if err != nil {
-			//should never get here
-			return
+			return fmt.Errorf("could not retrieve DMs sent before bring up: %w", err)
 		}
-		dms := dms_int.(*twitter.DirectMessageEvents)
 		if len(dms.Events) == 0 {
-			log.Print("Attempted to load ", total_loaded_dms, " dms")
-			return
+			logger.Info("Loaded missed dms", "count", total_loaded_dms)
+			return nil
+		}
+		user_ids_to_screen_names, err := user_screen_names_from_dms(ctx, tc, dms.Events, logger)
+		if err != nil {
+			return err
 		}
-		user_ids_to_screen_names := user_screen_names_from_dms(tc, dms.Events)
 		for _, dm := range dms.Events {
-			if dm.ID == strconv.Itoa(int(persistent_state.LastDMID)) {
-				log.Print("Attempted to load ", total_loaded_dms, " dms")
-				return
+			if dm.ID == strconv.Itoa(int(last_dm_id)) {
+				logger.Info("Loaded missed dms", "count", total_loaded_dms)
+				return nil
 			}
 			if dm.Type != "message_create" {
 				continue
@@ -228,60 +296,55 @@ func process_missed_dms(tc *twitter.Client, my_user *twitter.User, persistent_st
 			if dm.Message.SenderID == my_user.IDStr {
 				continue
 			}
-			//TODO potential race condition
-			if _, does_contain := persistent_state.DMsInProgress[dm.ID]; does_contain {
-				continue
-			}
 			dm_cart := &DMCart{}
 			dm_cart.DMID = dm.ID
 			dm_cart.DMText = dm.Message.Data.Text
+			dm_cart.DMEntities = dm.Message.Data.Entities
 			dm_cart.Sender.Id = dm.Message.SenderID
 			if screen_name, ok := user_ids_to_screen_names[dm.Message.SenderID]; ok {
 				dm_cart.Sender.ScreenName = screen_name
 			} else {
-				log.Printf("User %v ID does not exist. Skipping DM id %v", dm.Message.SenderID, dm.ID)
+				logger.Warn("User ID does not exist. Skipping DM", "user_id", dm.Message.SenderID, "dm_id", dm.ID)
 				continue
 			}
-			dm_cart_channel <- dm_cart
-			total_loaded_dms++
+			//DMs that are already known are either done or were queued above
+			if queue_dm(dm_cart, jobs, dm_cart_channel) {
+				total_loaded_dms++
+			}
 
 		}
 
 	}
 }
 
-func send_dm(dm_text string, to User, twitter_client *twitter.Client) {
+func send_dm(ctx context.Context, dm_text string, to User, twitter_client *twitter.Client, logger *Logger) {
 	//TODO: loop that reads from channel?
-	api_func := func() (interface{}, error) {
+	_, err := call_twitter_write_api(ctx, "", logger, func() (*twitter.DirectMessageEvent, *http.Response, error) {
 		new_dm_params := twitter.DirectMessageEventsNewParams{
 			Event: &twitter.DirectMessageEvent{Type: "message_create",
 				Message: &twitter.DirectMessageEventMessage{
 					Target: &twitter.DirectMessageTarget{RecipientID: to.Id},
 					Data:   &twitter.DirectMessageData{Text: dm_text}}}}
-		new_event, _, err := twitter_client.DirectMessages.EventsNew(&new_dm_params)
-		return new_event, err
-	}
-	_, err := execute_twitter_api(api_func, "", false)
+		return twitter_client.DirectMessages.EventsNew(&new_dm_params)
+	})
 	if err != nil {
-		log.Printf("Failed to send DM \"%v\" to user %v. Reason: %v", dm_text, to.ScreenName, err)
+		logger.Error("Failed to send DM", "text", dm_text, "to", to.ScreenName, "err", err)
 	}
 }
-func send_dm_with_gif(dm_text string, to User, gif_id int64, twitter_client *twitter.Client) {
+func send_dm_with_media(ctx context.Context, dm_text string, to User, media_id int64, twitter_client *twitter.Client, logger *Logger) {
 	//TODO: loop that reads from channel?
-	api_func := func() (interface{}, error) {
+	_, err := call_twitter_write_api(ctx, "", logger, func() (*twitter.DirectMessageEvent, *http.Response, error) {
 		new_dm_params := twitter.DirectMessageEventsNewParams{
 			Event: &twitter.DirectMessageEvent{Type: "message_create",
 				Message: &twitter.DirectMessageEventMessage{
 					Target: &twitter.DirectMessageTarget{RecipientID: to.Id},
 					Data: &twitter.DirectMessageData{Text: dm_text,
 						Attachment: &twitter.DirectMessageDataAttachment{Type: "media",
-							Media: twitter.MediaEntity{ID: gif_id}}}}}}
-		new_event, _, err := twitter_client.DirectMessages.EventsNew(&new_dm_params)
-		return new_event, err
-	}
-	_, err := execute_twitter_api(api_func, "", false)
+							Media: twitter.MediaEntity{ID: media_id}}}}}}
+		return twitter_client.DirectMessages.EventsNew(&new_dm_params)
+	})
 	if err != nil {
-		log.Printf("Failed to send DM \"%v\" to user %v. Reason: %v", dm_text, to.ScreenName, err)
+		logger.Error("Failed to send DM", "text", dm_text, "to", to.ScreenName, "err", err)
 	}
 }
 
@@ -361,34 +424,86 @@ func divide_cart_up_into_tweets(cart, my_screen_name string) []string {
 	return tweets
 
 }
-func handle_dm(dm_id, dm_text string, sender User, handler *DMHanderContext) {
-	sanitized_text := sanitize_tweet_text(dm_text, nil)
-	is_notweet := strings.HasPrefix(sanitized_text, "--notweet")
+//Returns what happened so it can be recorded in the job store
+func handle_dm(ctx context.Context, dm_id, dm_text string, dm_entities *twitter.Entities, sender User, handler *DMHanderContext, logger *Logger) *JobResult {
+	sanitized_text := sanitize_tweet_text(dm_text, text_edits_from_entities(dm_entities, false))
+	result := &JobResult{Status: JOB_STATUS_FAILED, Author: sender.ScreenName, CartSource: sanitized_text}
+	_, is_notweet := parse_cart_directives(sanitized_text)["notweet"]
+	moderation_request := &ModerationRequest{
+		JobType:  JOB_TYPE_DM,
+		Author:   sender.ScreenName,
+		AuthorID: sender.Id,
+		Source:   sanitized_text,
+		Public:   !is_notweet,
+	}
+	if verdict := handler.moderation.before_run(moderation_request, logger.stage("moderation")); verdict.Action != MODERATION_ALLOW {
+		send_dm(ctx, "Sorry, I can not run this program.", sender, handler.twitter_client, logger.stage("dm"))
+		result.set_rejected(verdict)
+		return result
+	}
 	if is_notweet {
-		go send_dm("Your code is being run and will not be tweeted.  I will DM you once it's finished!", sender, handler.twitter_client)
+		go send_dm(ctx, "Your code is being run and will not be tweeted.  I will DM you once it's finished!", sender, handler.twitter_client, logger.stage("dm"))
 	} else {
-		go send_dm("Your code is being run and will be tweeted when finished.  I will DM you once it's finished!", sender, handler.twitter_client)
+		go send_dm(ctx, "Your code is being run and will be tweeted when finished.  I will DM you once it's finished!", sender, handler.twitter_client, logger.stage("dm"))
 	}
 
-	gif_data, err := run_pico8_and_generate_gif(sanitized_text, dm_id)
+	run_params := resolve_run_params(sanitized_text, handler.run_limits)
+	run_result, err := handler.runner.Run(ctx, sanitized_text, dm_id, run_params, logger.stage("run"))
+	result.set_run_result(run_result)
+	if ctx.Err() != nil {
+		result.set_error(ctx.Err())
+		return result
+	}
 	if err != nil {
-		msg := `I was unable to generate the GIF of your program. Possible reasons:
+		msg := "I was unable to generate the GIF of your program. " + describe_cart_error(err)
+		send_dm(ctx, msg, sender, handler.twitter_client, logger.stage("dm"))
+		logger.stage("run").Warn("Failed generate for DM gif. Dropping...", "err", err, "error_kind", error_kind(err))
+		result.set_error(err)
+		return result
+	}
+	moderation_request.MediaData, moderation_request.MediaType = run_result.MediaData, run_result.MediaType
+	switch verdict := handler.moderation.before_post(moderation_request, logger.stage("moderation")); verdict.Action {
+	case MODERATION_ALLOW:
+	case MODERATION_HOLD:
+		held := &HeldPost{
+			Reason:            verdict.Reason,
+			ParamsDescription: describe_run_params(run_result.Params, handler.run_limits),
+			MediaType:         run_result.MediaType,
+		}
+		if err := handler.moderation.hold(held, run_result.MediaData, result); err != nil {
+			logger.stage("moderation").Error("Could not hold GIF for approval", "err", err)
+			send_dm(ctx, "An internal error has occurred.  Please try back later.", sender, handler.twitter_client, logger.stage("dm"))
+			result.set_error(err)
+			return result
+		}
+		send_dm(ctx, "I have successfully ran your program!  It will be tweeted once a moderator approves it.  I will DM you when it is posted.",
+			sender, handler.twitter_client, logger.stage("dm"))
+		return result
+	default:
+		send_dm(ctx, "Sorry, I can not post what your program made.", sender, handler.twitter_client, logger.stage("dm"))
+		result.set_rejected(verdict)
+		return result
+	}
+
+	post_dm_result(ctx, handler.twitter_client, handler.my_user.ScreenName, sender, sanitized_text, is_notweet,
+		run_result.MediaData, run_result.MediaType, describe_run_params(run_result.Params, handler.run_limits), logger, result)
+	return result
+}
 
-- There is a syntax error in your tweetcart.
-- There is an infinite loop and flip() is not being called.
-- flip() is overridden.`
-		send_dm(msg, sender, handler.twitter_client)
-		log.Printf("Failed generate for DM gif. Dropping... Reason: %v", err)
-		return
-	}
+//Tweets the media along with the cart, or only DMs the media back for notweet carts, and tells the sender.
+//Sets the result to succeeded if it worked
+func post_dm_result(ctx context.Context, tc *twitter.Client, my_screen_name string, sender User, cart_source string, is_notweet bool,
+	media_data []byte, media_type, params_description string, logger *Logger, result *JobResult) {
 	if !is_notweet {
-		gif_id, err := upload_gif(gif_data, handler.twitter_client, "tweet_gif")
+		media_id, err := upload_media(ctx, media_data, media_type, tc, media_category(media_type, false), logger.stage("upload"))
 		if err != nil {
-			log.Print("Could not upload GIF! Error: ", err)
-			send_dm("An internal error has occurred.  Please try back later.", sender, handler.twitter_client)
+			logger.stage("upload").Error("Could not upload media!", "err", err)
+			send_dm(ctx, "An internal error has occurred.  Please try back later.", sender, tc, logger.stage("dm"))
+			result.set_error(err)
 			return
 		}
-		api_func := func() (interface{}, error) {
+		result.MediaIDs = []int64{media_id}
+		tweet, err := call_twitter_write_api(ctx, "Error posting GIF tweet of DM!", logger.stage("reply"), func() (*twitter.Tweet, *http.Response, error) {
 			status_update_params := &twitter.StatusUpdateParams{
 				Status:             "",
 				InReplyToStatusID:  0,
@@ -398,22 +513,22 @@ func handle_dm(dm_id, dm_text string, sender User, handler *DMHanderContext) {
 				PlaceID:            "",
 				DisplayCoordinates: twitter.Bool(false),
 				TrimUser:           twitter.Bool(true),
-				MediaIds:           []int64{gif_id},
+				MediaIds:           []int64{media_id},
 				TweetMode:          "extended",
 			}
-			tweet, _, err := handler.twitter_client.Statuses.Update("By @"+sender.ScreenName, status_update_params)
-			return tweet, err
-		}
-		tweet_int, err := execute_twitter_api(api_func, "Error posting GIF tweet of DM!", false)
+			status := fmt.Sprintf("By @%v\n%v", sender.ScreenName, params_description)
+			return tc.Statuses.Update(status, status_update_params)
+		})
 		if err != nil {
-			send_dm("There was an error posting your program.  Please try back later.", sender, handler.twitter_client)
+			send_dm(ctx, "There was an error posting your program.  Please try back later.", sender, tc, logger.stage("dm"))
+			result.set_error(err)
 			return
 		}
-		tweet := tweet_int.(*twitter.Tweet)
+		result.ReplyTweetID = tweet.ID
 
-		cart_tweets := divide_cart_up_into_tweets(sanitized_text, handler.my_user.ScreenName)
+		cart_tweets := divide_cart_up_into_tweets(cart_source, my_screen_name)
 		for _, cart_tweet := range cart_tweets {
-			api_func := func() (interface{}, error) {
+			_, err := call_twitter_write_api(ctx, "Error posting cart from DM!", logger.stage("reply"), func() (*twitter.Tweet, *http.Response, error) {
 				status_update_params := &twitter.StatusUpdateParams{
 					Status:             "",
 					InReplyToStatusID:  tweet.ID,
@@ -426,41 +541,43 @@ func handle_dm(dm_id, dm_text string, sender User, handler *DMHanderContext) {
 					MediaIds:           nil,
 					TweetMode:          "extended",
 				}
-				tweet, _, err := handler.twitter_client.Statuses.Update(cart_tweet, status_update_params)
-				return tweet, err
-			}
-			_, err := execute_twitter_api(api_func, "Error posting cart from DM!", false)
+				return tc.Statuses.Update(cart_tweet, status_update_params)
+			})
 			if err != nil {
-				send_dm(fmt.Sprintf("I have successfully ran your program! But there was an error posting your source code. I posted your program here. https://twitter.com/%v/status/%v",
-					sender.Id, tweet.IDStr), sender, handler.twitter_client)
+				send_dm(ctx, fmt.Sprintf("I have successfully ran your program! But there was an error posting your source code. I posted your program here. https://twitter.com/%v/status/%v",
+					sender.Id, tweet.IDStr), sender, tc, logger.stage("dm"))
+				result.set_error(err)
 				return
 			}
 		}
 
-		send_dm(fmt.Sprintf("I have successfully ran your program!  I posted it here along with the source code. https://twitter.com/%v/status/%v",
-			sender.Id, tweet.IDStr), sender, handler.twitter_client)
+		send_dm(ctx, fmt.Sprintf("I have successfully ran your program! (%v)  I posted it here along with the source code. https://twitter.com/%v/status/%v",
+			params_description, sender.Id, tweet.IDStr), sender, tc, logger.stage("dm"))
 
 	} else {
-		gif_id, err := upload_gif(gif_data, handler.twitter_client, "dm_gif")
+		media_id, err := upload_media(ctx, media_data, media_type, tc, media_category(media_type, true), logger.stage("upload"))
 		if err != nil {
-			log.Print("Could not upload GIF! Error: ", err)
-			send_dm("An internal error has occurred.  Please try back later.", sender, handler.twitter_client)
+			logger.stage("upload").Error("Could not upload media!", "err", err)
+			send_dm(ctx, "An internal error has occurred.  Please try back later.", sender, tc, logger.stage("dm"))
+			result.set_error(err)
 			return
 		}
-		send_dm_with_gif("I have successfully ran your program!  Here is the result: ", sender, gif_id, handler.twitter_client)
+		result.MediaIDs = []int64{media_id}
+		send_dm_with_media(ctx, fmt.Sprintf("I have successfully ran your program! (%v)  Here is the result: ", params_description),
+			sender, media_id, tc, logger.stage("dm"))
 
 	}
-
+	result.Status = JOB_STATUS_SUCCEEDED
 }
-func register_webhook(http_client *http.Client) {
-	tw_url := TWITTER_ACCOUNT_ACTIVITY + "/webhooks.json?url=" + url.QueryEscape(WEBHOOK_URL)
+func register_webhook(http_client *http.Client, config *Config) {
+	tw_url := config.twitter_account_activity_url() + "/webhooks.json?url=" + url.QueryEscape(config.webhook_url())
 	req, err := http.NewRequest("POST", tw_url, nil)
 	if err != nil {
-		log.Fatal("Error registering webhook: ", err)
+		root_logger.Fatal("Error registering webhook", "err", err)
 	}
 	resp, err := http_client.Do(req)
 	if err != nil {
-		log.Fatal("Error registering webhook: ", err)
+		root_logger.Fatal("Error registering webhook", "err", err)
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
@@ -470,22 +587,22 @@ func register_webhook(http_client *http.Client) {
 		}
 		_, err = buf.ReadFrom(resp.Body)
 		if err != nil {
-			log.Fatal("Error reading registration response: ", err)
+			root_logger.Fatal("Error reading registration response", "err", err)
 		}
 
-		log.Fatalf("Could not register webhook. Status Code: %v Reason: %v", resp.StatusCode, buf.String())
+		root_logger.Fatal("Could not register webhook", "status_code", resp.StatusCode, "response", buf.String())
 	}
 }
-func subscribe_to_messages(http_client *http.Client) {
+func subscribe_to_messages(http_client *http.Client, config *Config) {
 
-	tw_url := TWITTER_ACCOUNT_ACTIVITY + "/subscriptions.json"
+	tw_url := config.twitter_account_activity_url() + "/subscriptions.json"
 	req, err := http.NewRequest("POST", tw_url, nil)
 	if err != nil {
-		log.Fatal("Error subscribing to messages: ", err)
+		root_logger.Fatal("Error subscribing to messages", "err", err)
 	}
 	resp, err := http_client.Do(req)
 	if err != nil {
-		log.Fatal("Error subscribing to messages: ", err)
+		root_logger.Fatal("Error subscribing to messages", "err", err)
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != 204 {
@@ -495,9 +612,9 @@ func subscribe_to_messages(http_client *http.Client) {
 		}
 		_, err = buf.ReadFrom(resp.Body)
 		if err != nil {
-			log.Fatal("Error reading subscribing response: ", err)
+			root_logger.Fatal("Error reading subscribing response", "err", err)
 		}
-		log.Fatal("Error subscribing to messages: ", buf.String())
+		root_logger.Fatal("Error subscribing to messages", "response", buf.String())
 	}
 
 }
@@ -507,17 +624,17 @@ type Webhook struct {
 	Valid bool   `json:"valid"`
 }
 
-func delete_all_current_webhooks(http_client *http.Client) {
+func delete_all_current_webhooks(http_client *http.Client, config *Config) {
 
-	tw_url := TWITTER_ACCOUNT_ACTIVITY + "/webhooks.json"
+	tw_url := config.twitter_account_activity_url() + "/webhooks.json"
 
 	req, err := http.NewRequest("GET", tw_url, nil)
 	if err != nil {
-		log.Fatal("Error getting webhooks: ", err)
+		root_logger.Fatal("Error getting webhooks", "err", err)
 	}
 	resp, err := http_client.Do(req)
 	if err != nil {
-		log.Fatal("Error registering webhook: ", err)
+		root_logger.Fatal("Error registering webhook", "err", err)
 	}
 	defer resp.Body.Close()
 	buf := bytes.Buffer{}
@@ -526,37 +643,37 @@ func delete_all_current_webhooks(http_client *http.Client) {
 	}
 	_, err = buf.ReadFrom(resp.Body)
 	if err != nil {
-		log.Fatal("Error reading registration response: ", err)
+		root_logger.Fatal("Error reading registration response", "err", err)
 	}
 	var webhooks []Webhook
 	if err = json.Unmarshal(buf.Bytes(), &webhooks); err != nil {
-		log.Fatal("Error registering webhook.  Response: ", buf.String())
+		root_logger.Fatal("Error registering webhook", "response", buf.String())
 	}
 
 	for _, webhook := range webhooks {
-		tw_url := TWITTER_ACCOUNT_ACTIVITY + "/webhooks/" + webhook.Id + ".json"
+		tw_url := config.twitter_account_activity_url() + "/webhooks/" + webhook.Id + ".json"
 		req, err := http.NewRequest("DELETE", tw_url, nil)
 		if err != nil {
-			log.Fatal("Error getting webhooks: ", err)
+			root_logger.Fatal("Error getting webhooks", "err", err)
 		}
 		resp, err := http_client.Do(req)
 		if err != nil {
-			log.Fatal("Error registering webhook: ", err)
+			root_logger.Fatal("Error registering webhook", "err", err)
 		}
 		defer resp.Body.Close()
 		if resp.StatusCode != 204 {
-			log.Fatal("Error deleting webhook: ", webhook.Id)
+			root_logger.Fatal("Error deleting webhook", "webhook_id", webhook.Id)
 		}
-		log.Printf("Deleted webhook %v", webhook.Id)
+		root_logger.Info("Deleted webhook", "webhook_id", webhook.Id)
 	}
 }
-func wait_for_webhook_to_come_up() {
-	if _, err := net.Dial("tcp", os.Args[3]+":443"); err != nil {
-		log.Fatal("Webhook did not come up!  Reason: ", err)
+func wait_for_webhook_to_come_up(config *Config) {
+	if _, err := net.Dial("tcp", net.JoinHostPort(config.WebhookDomainName, "443")); err != nil {
+		root_logger.Fatal("Webhook did not come up", "err", err)
 	}
 }
 func register_welcome_message(twitter_client *twitter.Client) {
-	log.Print("Registering welcome message...")
+	root_logger.Info("Registering welcome message...")
 	welcome_message_params := twitter.DirectMessageWelcomeMessageNewParams{
 		MessageData: twitter.DirectMessageData{Text: `Welcome! 240 characters not enough?  You've come to the right place!
 		Simply DM me your PICO-8 code and I'll run it and will post the tweet of the following:
@@ -564,20 +681,22 @@ func register_welcome_message(twitter_client *twitter.Client) {
 			- Tagging you as the author.
 			- Reply to this tweet with the source code.
 			
-		Want to see how your GIF will look without me tweeting it? Have your code start with the comment: --notweet and I'll DM you the GIF!`,
+		Want to see how your GIF will look without me tweeting it? Have your code start with the comment: --notweet and I'll DM you the GIF!
+		Want a shorter, longer or choppier GIF? Start your code with a comment such as: --len=4 fps=15
+		Want a video instead of a GIF? Start your code with the comment: --format=mp4`,
 		},
 		Name: "Default Message"}
 	msg, _, err := twitter_client.DirectMessages.WelcomeMessageNew(&welcome_message_params)
 
 	if err != nil {
-		log.Fatal("Error posting welcome message! Reason: ", err)
+		root_logger.Fatal("Error posting welcome message", "err", err)
 	}
 	_, _, err = twitter_client.DirectMessages.WelcomeMessageRuleNew(msg.ID)
 	if err != nil {
-		log.Fatal("Error posting welcome message! Reason: ", err)
+		root_logger.Fatal("Error posting welcome message", "err", err)
 	}
 
-	log.Print("Done!")
+	root_logger.Info("Done!")
 
 }
 func delete_all_welcome_messages(twitter_client *twitter.Client) {
@@ -585,13 +704,13 @@ func delete_all_welcome_messages(twitter_client *twitter.Client) {
 	{
 		list, _, err := twitter_client.DirectMessages.WelcomeMessageList(nil)
 		if err != nil {
-			log.Fatal("Error listing welcome messages! Reason: ", err)
+			root_logger.Fatal("Error listing welcome messages", "err", err)
 		}
 		for _, msg := range list.WelcomeMessages {
 			_, err := twitter_client.DirectMessages.WelcomeMessageDestroy(msg.ID)
 
 			if err != nil {
-				log.Fatal("Error deleting welcome message! Reason: ", err)
+				root_logger.Fatal("Error deleting welcome message", "err", err)
 			}
 		}
 	}
@@ -599,13 +718,13 @@ func delete_all_welcome_messages(twitter_client *twitter.Client) {
 	{
 		list, _, err := twitter_client.DirectMessages.WelcomeMessageRuleList(nil)
 		if err != nil {
-			log.Fatal("Error listing welcome message rules! Reason: ", err)
+			root_logger.Fatal("Error listing welcome message rules", "err", err)
 		}
 		for _, rule := range list.WelcomeMessageRules {
 			_, err := twitter_client.DirectMessages.WelcomeMessageRuleDestroy(rule.ID)
 
 			if err != nil {
-				log.Fatal("Error deleting welcome message rule! Reason: ", err)
+				root_logger.Fatal("Error deleting welcome message rule", "err", err)
 			}
 		}
 
@@ -615,17 +734,17 @@ func dm_id_to_int(dm_id string) int64 {
 	if dm_id_num, err := strconv.Atoi(dm_id); err == nil {
 		return int64(dm_id_num)
 	} else {
-		log.Fatal("DM ID is not a number, we need to handle this..., DM ID: ", dm_id)
+		root_logger.Fatal("DM ID is not a number, we need to handle this...", "dm_id", dm_id)
 	}
 
 	panic("Should not get here")
 }
 
-func wait_for_server_to_come_up() {
+func wait_for_server_to_come_up(config *Config) {
 	var err error
 	for i := 0; i < 3; i++ {
 		timeout := time.Second
-		conn, err := net.DialTimeout("tcp", net.JoinHostPort(WEBHOOK_DOMAIN_NAME, "443"), timeout)
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(config.WebhookDomainName, "443"), timeout)
 		if err != nil {
 			time.Sleep(5 * time.Second)
 			continue
@@ -636,35 +755,40 @@ func wait_for_server_to_come_up() {
 		}
 	}
 
-	log.Fatal("HTTPS server failed to come up. Exiting... Reason: ", err)
+	root_logger.Fatal("HTTPS server failed to come up. Exiting", "err", err)
 }
-func init_dm_listener(consumer_secret string, http_client *http.Client,
-	twitter_client *twitter.Client, my_user *twitter.User,
-	dms_in_progress chan *DMCart, processed_dm_ids chan string,
-	persistent_state *TweetCartRunnerPersistentState,
-	ctx context.Context, program_handling_semaphore *semaphore.Weighted) {
+func init_dm_listener(config *Config, consumer_secret string, http_client *http.Client,
+	twitter_client *twitter.Client, my_user *twitter.User, runner CartRunner, jobs *JobStore,
+	dm_channel chan *DMCart, quota *UserQuota, scheduler *FairScheduler, blocklist *Blocklist, moderation *Moderation,
+	ctx context.Context) *http.Server {
 	delete_all_welcome_messages(twitter_client)
 	register_welcome_message(twitter_client)
 
 	dm_context := DMHanderContext{
-		consumer_secret:            []byte(consumer_secret),
-		goroutine_context:          ctx,
-		program_handling_semaphore: program_handling_semaphore,
-		twitter_client:             twitter_client,
-		my_user:                    my_user,
-		dm_channel:                 make(chan *DMCart, 256),
-		dms_in_progress:            dms_in_progress,
-		processed_dm_ids:           processed_dm_ids,
+		consumer_secret:   []byte(consumer_secret),
+		goroutine_context: ctx,
+		twitter_client:    twitter_client,
+		my_user:           my_user,
+		runner:            runner,
+		run_limits:        config.run_limits(),
+		dm_channel:        dm_channel,
+		jobs:              jobs,
+		quota:             quota,
+		scheduler:         scheduler,
+		blocklist:         blocklist,
+		moderation:        moderation,
 	}
 
 	go dm_event_loop(&dm_context)
 
-	process_missed_dms(twitter_client, my_user, persistent_state, dm_context.dm_channel)
+	if err := process_missed_dms(ctx, twitter_client, my_user, jobs, dm_context.dm_channel); err != nil {
+		root_logger.Error("Could not load missed DMs.  They will not be run", "err", err)
+	}
 
 	mux := http.NewServeMux()
 	mux.Handle(WEBHOOK_PATH, &dm_context)
 
-	listener, err := net.Listen("tcp", ":443")
+	listener, err := net.Listen("tcp", config.ListenAddress)
 	cfg := &tls.Config{
 		MinVersion:               tls.VersionTLS12,
 		CurvePreferences:         []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256},
@@ -690,36 +814,33 @@ func init_dm_listener(consumer_secret string, http_client *http.Client,
 		},
 	}
 	srv := &http.Server{
-		Addr:         ":443",
+		Addr:         config.ListenAddress,
 		Handler:      mux,
 		TLSConfig:    cfg,
 		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler), 0),
 	}
 	if err != nil {
-		log.Fatal("Error listening on port for webhook: ", err)
+		root_logger.Fatal("Error listening on port for webhook", "err", err)
 	}
 
 	//start web server!
-	go func() { log.Fatal(srv.ServeTLS(listener, "tls/server.crt", "tls/server.key")) }()
-
-	//delete all webhooks on shutdown
-	signal_channel := make(chan os.Signal)
-	signal.Notify(signal_channel, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
-		sig := <-signal_channel
-		log.Printf("Received signal %v.  Deleting all webhooks and then going down...", sig)
-		delete_all_current_webhooks(http_client)
-		srv.Shutdown(ctx)
+		err := srv.ServeTLS(listener, config.TLSCertFile, config.TLSKeyFile)
+		if err != http.ErrServerClosed {
+			root_logger.Fatal("HTTPS server went down", "err", err)
+		}
 	}()
 
-	wait_for_webhook_to_come_up()
-	delete_all_current_webhooks(http_client)
-
-	log.Println("Registering webhook...")
-	register_webhook(http_client)
-	subscribe_to_messages(http_client)
-	log.Println("Done!")
+	wait_for_webhook_to_come_up(config)
+	delete_all_current_webhooks(http_client, config)
 
-	log.Printf("Ready to listen for DMs!")
+	root_logger.Info("Registering webhook...")
+	register_webhook(http_client, config)
+	set_readiness_flag(&bot_readiness.webhook_registered, true)
+	subscribe_to_messages(http_client, config)
+	set_readiness_flag(&bot_readiness.subscribed, true)
+	root_logger.Info("Done!")
 
+	root_logger.Info("Ready to listen for DMs!")
+	return srv
 }
@@ -0,0 +1,101 @@
+//Copyright (C) 2020 Daniel Bokser.  See LICENSE file for license
+package main
+
+import (
+	"bytes"
+	"context"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/gif"
+	"io/ioutil"
+	"os"
+)
+
+//The 16 colors of the default PICO-8 palette
+var PICO_8_PALETTE = color.Palette{
+	color.RGBA{0x00, 0x00, 0x00, 0xff},
+	color.RGBA{0x1d, 0x2b, 0x53, 0xff},
+	color.RGBA{0x7e, 0x25, 0x53, 0xff},
+	color.RGBA{0x00, 0x87, 0x51, 0xff},
+	color.RGBA{0xab, 0x52, 0x36, 0xff},
+	color.RGBA{0x5f, 0x57, 0x4f, 0xff},
+	color.RGBA{0xc2, 0xc3, 0xc7, 0xff},
+	color.RGBA{0xff, 0xf1, 0xe8, 0xff},
+	color.RGBA{0xff, 0x00, 0x4d, 0xff},
+	color.RGBA{0xff, 0xa3, 0x00, 0xff},
+	color.RGBA{0xff, 0xec, 0x27, 0xff},
+	color.RGBA{0x00, 0xe4, 0x36, 0xff},
+	color.RGBA{0x29, 0xad, 0xff, 0xff},
+	color.RGBA{0x83, 0x76, 0x9c, 0xff},
+	color.RGBA{0xff, 0x77, 0xa8, 0xff},
+	color.RGBA{0xff, 0xcc, 0xaa, 0xff},
+}
+
+//Stands in for PICO-8 so the tweet and DM pipelines can be tested on machines
+//without a PICO-8 install.  The GIF it generates only depends on the cart source,
+//so the same cart always produces the same bytes
+type FakeRunner struct {
+	frame_count int
+	//if set, MP4s are encoded with ffmpeg just like Pico8Runner
+	ffmpeg_path string
+	//if set, Run returns this error instead of a GIF
+	err    error
+	output string
+}
+
+func (runner *FakeRunner) Run(ctx context.Context, cart_source, job_id string, params RunParams, logger *Logger) (*RunResult, error) {
+	if err := ctx.Err(); err != nil {
+		return &RunResult{Params: params}, err
+	}
+	if runner.err != nil {
+		return &RunResult{Output: runner.output, Params: params}, runner.err
+	}
+	delay := 3
+	if params.FrameRate > 0 {
+		delay = 100 / params.FrameRate
+	}
+
+	frame_count := runner.frame_count
+	if frame_count <= 0 {
+		frame_count = 8
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(cart_source))
+	seed := hash.Sum32()
+
+	const screen_size = 128
+	anim := gif.GIF{}
+	for frame := 0; frame < frame_count; frame++ {
+		img := image.NewPaletted(image.Rect(0, 0, screen_size, screen_size), PICO_8_PALETTE)
+		for y := 0; y < screen_size; y++ {
+			for x := 0; x < screen_size; x++ {
+				img.Pix[y*img.Stride+x] = uint8((uint32(x/8+y/8+frame) + seed) % uint32(len(PICO_8_PALETTE)))
+			}
+		}
+		anim.Image = append(anim.Image, img)
+		anim.Delay = append(anim.Delay, delay)
+	}
+
+	buf := bytes.Buffer{}
+	if err := gif.EncodeAll(&buf, &anim); err != nil {
+		return nil, err
+	}
+
+	media_data, media_type := buf.Bytes(), MEDIA_TYPE_GIF
+	if params.Format == MEDIA_FORMAT_MP4 {
+		work_dir, err := ioutil.TempDir("", "fake_runner")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(work_dir)
+		media_data, media_type, params.Format = encode_recording(media_data, params.Format, runner.ffmpeg_path, work_dir, logger)
+	}
+
+	return &RunResult{
+		MediaData: media_data,
+		MediaType: media_type,
+		Output:    runner.output + job_id + " done\n",
+		Params:    params,
+	}, nil
+}
@@ -0,0 +1,308 @@
+//Copyright (C) 2020 Daniel Bokser.  See LICENSE file for license
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"strings"
+)
+
+//Draws every frame on top of the previous ones so that each frame can be used on its own.
+//The returned frames all use the palette of the first frame
+func composite_gif_frames(anim *gif.GIF) []*image.Paletted {
+	if len(anim.Image) == 0 {
+		return nil
+	}
+	bounds := image.Rect(0, 0, anim.Config.Width, anim.Config.Height)
+	if bounds.Empty() {
+		bounds = anim.Image[0].Bounds()
+	}
+	palette := anim.Image[0].Palette
+	canvas := image.NewPaletted(bounds, palette)
+	frames := make([]*image.Paletted, 0, len(anim.Image))
+
+	for i, frame := range anim.Image {
+		//index in the frame's palette -> index in the canvas' palette, or -1 if transparent
+		var index_map [256]int
+		for j := range index_map {
+			index_map[j] = -1
+		}
+		for j, c := range frame.Palette {
+			if _, _, _, a := c.RGBA(); a != 0 {
+				index_map[j] = palette.Index(c)
+			}
+		}
+
+		var previous *image.Paletted
+		if i < len(anim.Disposal) && anim.Disposal[i] == gif.DisposalPrevious {
+			previous = clone_paletted(canvas)
+		}
+		frame_bounds := frame.Bounds().Intersect(bounds)
+		for y := frame_bounds.Min.Y; y < frame_bounds.Max.Y; y++ {
+			for x := frame_bounds.Min.X; x < frame_bounds.Max.X; x++ {
+				if index := index_map[frame.ColorIndexAt(x, y)]; index >= 0 {
+					canvas.SetColorIndex(x, y, uint8(index))
+				}
+			}
+		}
+		frames = append(frames, clone_paletted(canvas))
+
+		if i < len(anim.Disposal) {
+			switch anim.Disposal[i] {
+			case gif.DisposalBackground:
+				for y := frame_bounds.Min.Y; y < frame_bounds.Max.Y; y++ {
+					for x := frame_bounds.Min.X; x < frame_bounds.Max.X; x++ {
+						canvas.SetColorIndex(x, y, anim.BackgroundIndex)
+					}
+				}
+			case gif.DisposalPrevious:
+				canvas = previous
+			}
+		}
+	}
+	return frames
+}
+
+func clone_paletted(img *image.Paletted) *image.Paletted {
+	clone := image.NewPaletted(img.Rect, img.Palette)
+	copy(clone.Pix, img.Pix)
+	return clone
+}
+
+func frame_rate_of_gif(anim *gif.GIF) int {
+	total_delay := 0
+	for _, delay := range anim.Delay {
+		total_delay += delay
+	}
+	if total_delay == 0 {
+		return 0
+	}
+	return len(anim.Delay) * 100 / total_delay
+}
+
+//Drops frames so the GIF plays at about fps frames per second.
+//GIFs that are already at or below that frame rate are returned as is
+func set_gif_frame_rate(gif_data []byte, fps int) ([]byte, error) {
+	if fps <= 0 {
+		return gif_data, nil
+	}
+	anim, err := gif.DecodeAll(bytes.NewReader(gif_data))
+	if err != nil {
+		return nil, err
+	}
+	if frame_rate_of_gif(anim) <= fps {
+		return gif_data, nil
+	}
+
+	//GIF delays are in 100ths of a second
+	frame_interval := 100.0 / float64(fps)
+	frames := composite_gif_frames(anim)
+	resampled := &gif.GIF{Config: anim.Config, LoopCount: anim.LoopCount}
+	next_frame_time := 0.0
+	current_time := 0
+	for i, frame := range frames {
+		if float64(current_time) >= next_frame_time {
+			resampled.Image = append(resampled.Image, frame)
+			resampled.Delay = append(resampled.Delay, 0)
+			for next_frame_time <= float64(current_time) {
+				next_frame_time += frame_interval
+			}
+		}
+		resampled.Delay[len(resampled.Delay)-1] += anim.Delay[i]
+		current_time += anim.Delay[i]
+	}
+	resampled.Config.ColorModel = nil
+
+	buf := bytes.Buffer{}
+	if err := gif.EncodeAll(&buf, resampled); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+//Largest GIF twitter accepts
+const MAX_GIF_UPLOAD_SIZE = 15 * (1 << 20)
+
+//Smallest size GIFs get downscaled to, which is PICO-8's actual resolution
+const MIN_GIF_DIMENSION = 128
+
+//Fully composited frames of a GIF that gif_optimizer strategies work on
+type gif_frames struct {
+	frames     []*image.Paletted
+	delays     []int
+	loop_count int
+	//if set, frames only store the pixels that changed since the previous frame
+	use_delta bool
+}
+
+func (g *gif_frames) encode() ([]byte, error) {
+	anim := &gif.GIF{LoopCount: g.loop_count}
+	for i, frame := range g.frames {
+		if g.use_delta && i > 0 {
+			frame = delta_frame(g.frames[i-1], frame)
+		}
+		anim.Disposal = append(anim.Disposal, gif.DisposalNone)
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, g.delays[i])
+	}
+	buf := bytes.Buffer{}
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+//Returns just the part of current that changed since previous.  Pixels that did not change
+//are transparent, which compresses much better than noise
+func delta_frame(previous, current *image.Paletted) *image.Paletted {
+	bounds := current.Bounds()
+	changed := image.Rectangle{}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if previous.ColorIndexAt(x, y) != current.ColorIndexAt(x, y) {
+				changed = changed.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	if changed.Empty() {
+		//GIF frames cannot be empty
+		changed = image.Rect(bounds.Min.X, bounds.Min.Y, bounds.Min.X+1, bounds.Min.Y+1)
+	}
+
+	palette := append(color.Palette{}, current.Palette...)
+	transparent_index := uint8(len(palette))
+	palette = append(palette, color.RGBA{})
+	delta := image.NewPaletted(changed, palette)
+	for y := changed.Min.Y; y < changed.Max.Y; y++ {
+		for x := changed.Min.X; x < changed.Max.X; x++ {
+			if previous.ColorIndexAt(x, y) == current.ColorIndexAt(x, y) {
+				delta.SetColorIndex(x, y, transparent_index)
+			} else {
+				delta.SetColorIndex(x, y, current.ColorIndexAt(x, y))
+			}
+		}
+	}
+	return delta
+}
+
+//Merges consecutive frames that look the same
+func dedup_gif_frames(g *gif_frames) bool {
+	frames := g.frames[:1]
+	delays := g.delays[:1]
+	for i := 1; i < len(g.frames); i++ {
+		if bytes.Equal(g.frames[i].Pix, frames[len(frames)-1].Pix) {
+			delays[len(delays)-1] += g.delays[i]
+			continue
+		}
+		frames = append(frames, g.frames[i])
+		delays = append(delays, g.delays[i])
+	}
+	changed := len(frames) != len(g.frames)
+	g.frames, g.delays = frames, delays
+	return changed
+}
+
+func use_delta_gif_frames(g *gif_frames) bool {
+	//the transparent color needs a spot in the palette
+	if g.use_delta || len(g.frames[0].Palette) >= 256 {
+		return false
+	}
+	g.use_delta = true
+	return true
+}
+
+//Drops every other frame, which halves the frame rate
+func drop_gif_frames(g *gif_frames) bool {
+	if len(g.frames) < 2 {
+		return false
+	}
+	frames := make([]*image.Paletted, 0, len(g.frames)/2+1)
+	delays := make([]int, 0, len(g.delays)/2+1)
+	for i := 0; i < len(g.frames); i += 2 {
+		delay := g.delays[i]
+		if i+1 < len(g.delays) {
+			delay += g.delays[i+1]
+		}
+		frames = append(frames, g.frames[i])
+		delays = append(delays, delay)
+	}
+	g.frames, g.delays = frames, delays
+	return true
+}
+
+//Halves the width and height.  PICO-8 records GIFs scaled up, so this loses nothing until MIN_GIF_DIMENSION
+func downscale_gif_frames(g *gif_frames) bool {
+	bounds := g.frames[0].Bounds()
+	if bounds.Dx()/2 < MIN_GIF_DIMENSION || bounds.Dy()/2 < MIN_GIF_DIMENSION {
+		return false
+	}
+	for i, frame := range g.frames {
+		scaled := image.NewPaletted(image.Rect(0, 0, bounds.Dx()/2, bounds.Dy()/2), frame.Palette)
+		for y := 0; y < scaled.Rect.Dy(); y++ {
+			for x := 0; x < scaled.Rect.Dx(); x++ {
+				scaled.SetColorIndex(x, y, frame.ColorIndexAt(bounds.Min.X+x*2, bounds.Min.Y+y*2))
+			}
+		}
+		g.frames[i] = scaled
+	}
+	return true
+}
+
+//Strategies to shrink a GIF, from the one that loses the least to the one that loses the most.
+//Each one is applied on top of the previous ones, and a strategy that returns false could not be applied
+var GIF_OPTIMIZER_STRATEGIES = []struct {
+	name  string
+	apply func(g *gif_frames) bool
+	//whether the strategy can keep being applied until it stops working
+	repeat bool
+}{
+	{"frame dedup", dedup_gif_frames, false},
+	{"delta encoding", use_delta_gif_frames, false},
+	{"downscale", downscale_gif_frames, true},
+	{"frame dropping", drop_gif_frames, false},
+}
+
+//Shrinks the GIF until it is at most max_size bytes.  Returns the new GIF and the names of the
+//strategies that were needed, which is empty if the GIF already fit
+func optimize_gif(gif_data []byte, max_size int) ([]byte, []string, error) {
+	if len(gif_data) <= max_size {
+		return gif_data, nil, nil
+	}
+	anim, err := gif.DecodeAll(bytes.NewReader(gif_data))
+	if err != nil {
+		return nil, nil, err
+	}
+	g := &gif_frames{
+		frames:     composite_gif_frames(anim),
+		delays:     append([]int{}, anim.Delay...),
+		loop_count: anim.LoopCount,
+	}
+	if len(g.frames) == 0 {
+		return nil, nil, errors.New("GIF has no frames")
+	}
+
+	strategies_used := make([]string, 0, len(GIF_OPTIMIZER_STRATEGIES))
+	for _, strategy := range GIF_OPTIMIZER_STRATEGIES {
+		for strategy.apply(g) {
+			if len(strategies_used) == 0 || strategies_used[len(strategies_used)-1] != strategy.name {
+				strategies_used = append(strategies_used, strategy.name)
+			}
+			optimized, err := g.encode()
+			if err != nil {
+				return nil, strategies_used, err
+			}
+			if len(optimized) <= max_size {
+				return optimized, strategies_used, nil
+			}
+			if !strategy.repeat {
+				break
+			}
+		}
+	}
+
+	return nil, strategies_used, fmt.Errorf("GIF is still too large after %v", strings.Join(strategies_used, ", "))
+}
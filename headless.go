@@ -0,0 +1,199 @@
+//Copyright (C) 2020 Daniel Bokser.  See LICENSE file for license
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image/gif"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+//An Xvfb server for PICO-8 to draw to, so the bot can run on a machine without a display.
+//It is started again whenever it dies
+type Framebuffer struct {
+	exec_path string
+	//-screen argument of Xvfb, e.g. 640x480x24
+	screen string
+	mutex  sync.Mutex
+	//e.g. ":1".  Empty while Xvfb is not running
+	display string
+	//closed once display is set.  Replaced whenever Xvfb dies
+	running chan struct{}
+}
+
+//Hands framebuffers out to runs.  A nil Framebuffers means PICO-8 uses the bot's own DISPLAY
+type Framebuffers struct {
+	all  []*Framebuffer
+	free chan *Framebuffer
+}
+
+//Starts count Xvfb servers shared between the slots runs that can happen at once.
+//They are killed once ctx is done
+func start_framebuffers(ctx context.Context, exec_path, screen string, count, slots int) *Framebuffers {
+	framebuffers := &Framebuffers{free: make(chan *Framebuffer, slots)}
+	for i := 0; i < count; i++ {
+		framebuffer := &Framebuffer{exec_path: exec_path, screen: screen, running: make(chan struct{})}
+		framebuffers.all = append(framebuffers.all, framebuffer)
+		go framebuffer.supervise(ctx, root_logger.with("framebuffer", i))
+	}
+	for i := 0; i < slots; i++ {
+		framebuffers.free <- framebuffers.all[i%count]
+	}
+	return framebuffers
+}
+
+//Returns the environment PICO-8 should run with, and a function to call once it is done with the display.
+//Waits for Xvfb if it is being restarted
+func (framebuffers *Framebuffers) acquire(ctx context.Context) (env []string, release func(), err error) {
+	if framebuffers == nil {
+		return nil, func() {}, nil
+	}
+	var framebuffer *Framebuffer
+	select {
+	case framebuffer = <-framebuffers.free:
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+	release = func() { framebuffers.free <- framebuffer }
+	display, err := framebuffer.wait_display(ctx)
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	return []string{"DISPLAY=" + display}, release, nil
+}
+
+//How many Xvfb servers are not running right now
+func (framebuffers *Framebuffers) down() int {
+	if framebuffers == nil {
+		return 0
+	}
+	down := 0
+	for _, framebuffer := range framebuffers.all {
+		framebuffer.mutex.Lock()
+		if len(framebuffer.display) == 0 {
+			down++
+		}
+		framebuffer.mutex.Unlock()
+	}
+	return down
+}
+
+func (framebuffer *Framebuffer) wait_display(ctx context.Context) (string, error) {
+	for {
+		framebuffer.mutex.Lock()
+		display, running := framebuffer.display, framebuffer.running
+		framebuffer.mutex.Unlock()
+		if len(display) > 0 {
+			return display, nil
+		}
+		select {
+		case <-running:
+		case <-ctx.Done():
+			return "", errors.New("no framebuffer is running")
+		}
+	}
+}
+
+//Keeps Xvfb running until ctx is done, backing off if it keeps dying
+func (framebuffer *Framebuffer) supervise(ctx context.Context, logger *Logger) {
+	const (
+		min_restart_delay = time.Second
+		max_restart_delay = time.Minute
+	)
+	restart_delay := min_restart_delay
+	for {
+		started_at := time.Now()
+		err := framebuffer.run(ctx, logger)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(started_at) > max_restart_delay {
+			restart_delay = min_restart_delay
+		}
+		bot_metrics.framebuffer_restarts.inc()
+		logger.Error("Xvfb died.  Restarting it", "err", err, "restart_delay", restart_delay)
+		select {
+		case <-time.After(restart_delay):
+		case <-ctx.Done():
+			return
+		}
+		if restart_delay *= 2; restart_delay > max_restart_delay {
+			restart_delay = max_restart_delay
+		}
+	}
+}
+
+//Runs Xvfb until it exits.  Xvfb picks a free display itself and writes it to -displayfd once it is ready
+func (framebuffer *Framebuffer) run(ctx context.Context, logger *Logger) error {
+	display_reader, display_writer, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer display_reader.Close()
+	xvfb_command := exec.CommandContext(ctx, framebuffer.exec_path, "-displayfd", "3", "-screen", "0", framebuffer.screen, "-nolisten", "tcp")
+	xvfb_command.ExtraFiles = []*os.File{display_writer}
+	kill_with_bot(xvfb_command)
+	err = xvfb_command.Start()
+	display_writer.Close()
+	if err != nil {
+		return err
+	}
+	line, err := bufio.NewReader(display_reader).ReadString('\n')
+	if err == nil {
+		display := ":" + strings.TrimSpace(line)
+		logger.Info("Xvfb is running", "display", display)
+		framebuffer.mutex.Lock()
+		framebuffer.display = display
+		close(framebuffer.running)
+		framebuffer.mutex.Unlock()
+		defer func() {
+			framebuffer.mutex.Lock()
+			framebuffer.display = ""
+			framebuffer.running = make(chan struct{})
+			framebuffer.mutex.Unlock()
+		}()
+	}
+	if err := xvfb_command.Wait(); err != nil {
+		return err
+	}
+	return errors.New("Xvfb exited")
+}
+
+//Drawn by the start up self test.  It does not define _draw(), so it is recorded like a still image
+const SELF_TEST_CART = "cls(1)circfill(64,64,32,8)print('self test',46,62,7)"
+
+//Runs a cart to make sure PICO-8 can start and record before the bot takes any carts
+func run_self_test(ctx context.Context, runner CartRunner, limits *RunLimits, logger *Logger) error {
+	params := limits.Default
+	params.RecordingLength = limits.Min.RecordingLength
+	params.StaticRecordingLength = limits.Min.StaticRecordingLength
+	params.Format = MEDIA_FORMAT_GIF
+	start_time := time.Now()
+	result, err := runner.Run(ctx, SELF_TEST_CART, "self_test", params, logger)
+	if err != nil {
+		if result != nil && len(result.Output) > 0 {
+			return fmt.Errorf("%v.  PICO-8 output: %v", err, result.Output)
+		}
+		return err
+	}
+	if result.MediaType != MEDIA_TYPE_GIF {
+		return fmt.Errorf("expected a GIF, got %v", result.MediaType)
+	}
+	recording, err := gif.DecodeAll(bytes.NewReader(result.MediaData))
+	if err != nil {
+		return fmt.Errorf("recording is not a valid GIF: %v", err)
+	}
+	if len(recording.Image) == 0 {
+		return errors.New("recording has no frames")
+	}
+	logger.Info("Self test passed", "duration", time.Since(start_time), "frames", len(recording.Image), "size", len(result.MediaData))
+	return nil
+}
@@ -0,0 +1,254 @@
+//Copyright (C) 2020 Daniel Bokser.  See LICENSE file for license
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const HISTORY_TIME_FORMAT = "2006-01-02 15:04:05"
+
+//Which jobs `history` lists.  Zero values match everything
+type history_filter struct {
+	user     string
+	status   JobStatus
+	job_type JobType
+	since    time.Time
+	until    time.Time
+}
+
+func (filter *history_filter) matches(job *Job) bool {
+	if len(filter.user) > 0 && !strings.EqualFold(filter.user, job.Author) {
+		return false
+	}
+	if len(filter.status) > 0 && filter.status != job.Status {
+		return false
+	}
+	if len(filter.job_type) > 0 && filter.job_type != job.Type {
+		return false
+	}
+	if !filter.since.IsZero() && job.CreatedAt.Before(filter.since) {
+		return false
+	}
+	if !filter.until.IsZero() && !job.CreatedAt.Before(filter.until) {
+		return false
+	}
+	return true
+}
+
+//Accepts "2006-01-02", "2006-01-02 15:04:05" in local time, or RFC 3339
+func parse_history_time(value string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02", HISTORY_TIME_FORMAT} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q.  Use YYYY-MM-DD, \"YYYY-MM-DD HH:MM:SS\" or RFC 3339", value)
+	}
+	return t, nil
+}
+
+//Filters the jobs and returns them newest first, at most limit of them if limit > 0
+func filter_job_history(jobs []*Job, filter *history_filter, limit int) []*Job {
+	filtered := make([]*Job, 0)
+	for i := len(jobs) - 1; i >= 0; i-- {
+		if limit > 0 && len(filtered) >= limit {
+			break
+		}
+		if filter.matches(jobs[i]) {
+			filtered = append(filtered, jobs[i])
+		}
+	}
+	return filtered
+}
+
+//`tweetcartrunner history [flags] [job id]`.  Lists jobs from the job journal, or dumps a single job
+func run_history_command(args []string, getenv func(string) string, out io.Writer) error {
+	flags := flag.NewFlagSet("history", flag.ContinueOnError)
+	config_file_name := flags.String("config", getenv(CONFIG_ENV_PREFIX+"CONFIG"), "JSON config file to read job_journal_file from")
+	journal_file_name := flags.String("job_journal_file", "", "job journal to read.  Defaults to the one the bot uses")
+	user := flags.String("user", "", "only list jobs from this user")
+	status := flags.String("status", "", "only list jobs with this status: queued, running, succeeded, failed, ignored, over_quota, blocked, rejected or held")
+	job_type := flags.String("type", "", "only list jobs of this type: tweet or dm")
+	since := flags.String("since", "", "only list jobs created at or after this time, e.g. 2020-08-01")
+	until := flags.String("until", "", "only list jobs created before this time")
+	limit := flags.Int("limit", 50, "list at most this many jobs.  0 for all of them")
+	as_json := flags.Bool("json", false, "print jobs as JSON")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: tweetcartrunner history [flags] [job id]\n")
+		fmt.Fprintf(flags.Output(), "Lists jobs, newest first, or shows everything about a single job\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	config := default_config()
+	if len(*config_file_name) > 0 {
+		if err := read_config_file(config, *config_file_name); err != nil {
+			return err
+		}
+	}
+	if value := getenv(CONFIG_ENV_PREFIX + "JOB_JOURNAL_FILE"); len(value) > 0 {
+		config.JobJournalFile = value
+	}
+	if len(*journal_file_name) > 0 {
+		config.JobJournalFile = *journal_file_name
+	}
+	store, err := read_job_journal(config.JobJournalFile)
+	if err != nil {
+		return fmt.Errorf("could not read job journal: %v", err)
+	}
+
+	if flags.NArg() > 0 {
+		job, ok := find_history_job(store, flags.Arg(0))
+		if !ok {
+			return fmt.Errorf("no job %v", flags.Arg(0))
+		}
+		if *as_json {
+			return write_jobs_json(out, job)
+		}
+		print_job(out, &job)
+		return nil
+	}
+
+	filter := &history_filter{
+		user:     strings.TrimPrefix(*user, "@"),
+		status:   JobStatus(strings.ToLower(*status)),
+		job_type: JobType(strings.ToLower(*job_type)),
+	}
+	if len(*since) > 0 {
+		if filter.since, err = parse_history_time(*since); err != nil {
+			return err
+		}
+	}
+	if len(*until) > 0 {
+		if filter.until, err = parse_history_time(*until); err != nil {
+			return err
+		}
+	}
+	jobs := filter_job_history(store.sorted_jobs(), filter, *limit)
+	if *as_json {
+		return write_jobs_json(out, jobs)
+	}
+	print_job_list(out, jobs)
+	return nil
+}
+
+//Accepts a job ID such as "tweet-123", or just the ID of the tweet or DM
+func find_history_job(store *JobStore, id string) (Job, bool) {
+	job_ids := []string{id, dm_job_id(id)}
+	if tweet_id, err := strconv.ParseInt(id, 10, 64); err == nil {
+		job_ids = append(job_ids, tweet_job_id(tweet_id))
+	}
+	for _, job_id := range job_ids {
+		if job, ok := store.job(job_id); ok {
+			return job, true
+		}
+	}
+	return Job{}, false
+}
+
+func write_jobs_json(out io.Writer, v interface{}) error {
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+func format_history_time(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(HISTORY_TIME_FORMAT)
+}
+
+func format_history_duration(d time.Duration) string {
+	if d <= 0 {
+		return "-"
+	}
+	return d.Round(time.Millisecond).String()
+}
+
+//How long the job sat in the queue before it started
+func job_wait_duration(job *Job) time.Duration {
+	if job.StartedAt.IsZero() {
+		return 0
+	}
+	return job.StartedAt.Sub(job.CreatedAt)
+}
+
+//How long the job took from starting to replying, including the run
+func job_handle_duration(job *Job) time.Duration {
+	if job.StartedAt.IsZero() || job.FinishedAt.IsZero() {
+		return 0
+	}
+	return job.FinishedAt.Sub(job.StartedAt)
+}
+
+func print_job_list(out io.Writer, jobs []*Job) {
+	writer := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "JOB\tAUTHOR\tSTATUS\tERROR\tCREATED\tWAITED\tRAN\tREPLY")
+	for _, job := range jobs {
+		error_kind := job.ErrorKind
+		if len(error_kind) == 0 {
+			error_kind = "-"
+		}
+		reply := "-"
+		if job.ReplyTweetID != 0 {
+			reply = fmt.Sprint(job.ReplyTweetID)
+		}
+		fmt.Fprintf(writer, "%v\t@%v\t%v\t%v\t%v\t%v\t%v\t%v\n", job.ID, job.Author, job.Status, error_kind,
+			format_history_time(job.CreatedAt), format_history_duration(job_wait_duration(job)),
+			format_history_duration(job.RunDuration), reply)
+	}
+	writer.Flush()
+}
+
+func print_job(out io.Writer, job *Job) {
+	writer := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(writer, "Job:\t%v\n", job.ID)
+	fmt.Fprintf(writer, "Type:\t%v\n", job.Type)
+	fmt.Fprintf(writer, "Source ID:\t%v\n", job.SourceID)
+	if job.ParentTweetID != 0 && fmt.Sprint(job.ParentTweetID) != job.SourceID {
+		fmt.Fprintf(writer, "Ran tweet:\t%v\n", job.ParentTweetID)
+	}
+	fmt.Fprintf(writer, "Author:\t@%v\n", job.Author)
+	fmt.Fprintf(writer, "Status:\t%v\n", job.Status)
+	fmt.Fprintf(writer, "Attempts:\t%v\n", job.Attempts)
+	if len(job.Error) > 0 {
+		fmt.Fprintf(writer, "Error:\t%v\n", job.Error)
+		fmt.Fprintf(writer, "Error kind:\t%v\n", job.ErrorKind)
+	}
+	fmt.Fprintf(writer, "Created:\t%v\n", format_history_time(job.CreatedAt))
+	fmt.Fprintf(writer, "Started:\t%v\n", format_history_time(job.StartedAt))
+	fmt.Fprintf(writer, "Finished:\t%v\n", format_history_time(job.FinishedAt))
+	fmt.Fprintf(writer, "Waited:\t%v\n", format_history_duration(job_wait_duration(job)))
+	fmt.Fprintf(writer, "Ran:\t%v\n", format_history_duration(job.RunDuration))
+	if job.Cached {
+		fmt.Fprintf(writer, "From cache:\tyes\n")
+	}
+	fmt.Fprintf(writer, "Handled in:\t%v\n", format_history_duration(job_handle_duration(job)))
+	if len(job.MediaIDs) > 0 {
+		fmt.Fprintf(writer, "Media IDs:\t%v\n", strings.Trim(fmt.Sprint(job.MediaIDs), "[]"))
+	}
+	if job.ReplyTweetID != 0 {
+		fmt.Fprintf(writer, "Reply:\thttps://twitter.com/i/web/status/%v\n", job.ReplyTweetID)
+	}
+	if len(job.MediaFile) > 0 {
+		fmt.Fprintf(writer, "Media file:\t%v\n", job.MediaFile)
+	}
+	writer.Flush()
+
+	fmt.Fprintf(out, "\nCart source:\n%v\n", job.CartSource)
+	if len(job.Output) > 0 {
+		fmt.Fprintf(out, "\nOutput:\n%v\n", strings.TrimRight(job.Output, "\n"))
+	}
+}
@@ -0,0 +1,590 @@
+//Copyright (C) 2020 Daniel Bokser.  See LICENSE file for license
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+type JobType string
+
+const (
+	JOB_TYPE_TWEET JobType = "tweet"
+	JOB_TYPE_DM    JobType = "dm"
+)
+
+type JobStatus string
+
+const (
+	JOB_STATUS_QUEUED    JobStatus = "queued"
+	JOB_STATUS_RUNNING   JobStatus = "running"
+	JOB_STATUS_SUCCEEDED JobStatus = "succeeded"
+	JOB_STATUS_FAILED    JobStatus = "failed"
+	//the tweet did not look like code, so it was not replied to
+	JOB_STATUS_IGNORED JobStatus = "ignored"
+	//the user had already run as many carts as they can this hour, so it was not run
+	JOB_STATUS_OVER_QUOTA JobStatus = "over_quota"
+	//the author is on the blocklist, so it was not run
+	JOB_STATUS_BLOCKED JobStatus = "blocked"
+	//moderation did not allow it to be run or posted
+	JOB_STATUS_REJECTED JobStatus = "rejected"
+	//it ran, but moderation is keeping the result until an operator approves or rejects it
+	JOB_STATUS_HELD JobStatus = "held"
+)
+
+func (status JobStatus) is_finished() bool {
+	return status != JOB_STATUS_QUEUED && status != JOB_STATUS_RUNNING
+}
+
+//A tweet or DM the bot has been asked to run
+type Job struct {
+	ID   string
+	Type JobType
+	//ID of the mention or DM that created the job
+	SourceID string
+	//for tweets, the tweet whose cart gets run, which is not always the mention
+	ParentTweetID int64 `json:",omitempty"`
+	//for DMs, everything needed to run the DM again
+	DM     *DMCart `json:",omitempty"`
+	Author string
+	//twitter ID of the author, which does not change when they change their screen name
+	AuthorID   string `json:",omitempty"`
+	CartSource string `json:",omitempty"`
+	Status     JobStatus
+	Attempts   int
+	Error      string `json:",omitempty"`
+	//CART_ERROR_* as a string, or "internal error" for errors in the bot
+	ErrorKind string `json:",omitempty"`
+	//the end of what PICO-8 printed
+	Output   string  `json:",omitempty"`
+	MediaIDs []int64 `json:",omitempty"`
+	//the tweet with the GIF
+	ReplyTweetID int64 `json:",omitempty"`
+	//copy of the GIF in the archive directory, if archiving is on
+	MediaFile string `json:",omitempty"`
+	//what to post once it is approved, while the job is held
+	Held *HeldPost `json:",omitempty"`
+
+	CreatedAt   time.Time
+	StartedAt   time.Time
+	FinishedAt  time.Time
+	RunDuration time.Duration `json:",omitempty"`
+	//set if the media came from the result cache
+	Cached bool `json:",omitempty"`
+}
+
+func tweet_job_id(tweet_id int64) string {
+	return fmt.Sprintf("%v-%v", JOB_TYPE_TWEET, tweet_id)
+}
+
+func dm_job_id(dm_id string) string {
+	return fmt.Sprintf("%v-%v", JOB_TYPE_DM, dm_id)
+}
+
+//What handle_tweet and handle_dm did with a job
+type JobResult struct {
+	Status       JobStatus
+	Author       string
+	CartSource   string
+	Error        string
+	ErrorKind    string
+	Output       string
+	MediaIDs     []int64
+	ReplyTweetID int64
+	RunDuration  time.Duration
+	Cached       bool
+	//only kept in the journal if there is an archive directory
+	MediaData []byte
+	MediaType string
+	//set if moderation is holding the result
+	Held *HeldPost
+}
+
+//Records why the job failed
+func (result *JobResult) set_error(err error) {
+	result.Status = JOB_STATUS_FAILED
+	result.Error = err.Error()
+	result.ErrorKind = error_kind(err)
+}
+
+//Records what the runner did, which can be nil if the runner failed
+func (result *JobResult) set_run_result(run_result *RunResult) {
+	if run_result == nil {
+		return
+	}
+	result.RunDuration = run_result.Duration
+	result.Cached = run_result.Cached
+	result.Output = run_result.Output
+	result.MediaData = run_result.MediaData
+	result.MediaType = run_result.MediaType
+}
+
+//Only the end of the output is kept, which is where errors are
+const MAX_JOB_OUTPUT_LENGTH = 4096
+
+func truncate_job_output(output string) string {
+	if len(output) <= MAX_JOB_OUTPUT_LENGTH {
+		return output
+	}
+	return "..." + output[len(output)-MAX_JOB_OUTPUT_LENGTH:]
+}
+
+//One line of the journal.  Either a job or the cursors get updated, or both
+type journal_record struct {
+	Job         *Job  `json:",omitempty"`
+	LastTweetID int64 `json:",omitempty"`
+	LastDMID    int64 `json:",omitempty"`
+}
+
+//The journal gets compacted once it has this many records and more than twice as many as there are jobs
+const JOB_JOURNAL_COMPACT_MIN_RECORDS = 1000
+
+//Keeps track of every job in an append-only journal.  Every update is a single line of JSON
+//that is synced to disk before returning, so a crash can at most lose the line being written,
+//which gets dropped the next time the journal is opened.  The journal is periodically rewritten
+//with only the latest version of every job
+type JobStore struct {
+	mutex          sync.Mutex
+	path           string
+	file           *os.File
+	jobs           map[string]*Job
+	tweet_cursor   int64
+	dm_cursor      int64
+	record_count   int
+	compact_at_min int
+	//where copies of generated media are kept.  Empty to not keep them
+	archive_dir string
+	//finished jobs older than this are dropped when the journal is compacted.  0 keeps them forever
+	retention time.Duration
+}
+
+//Opens the journal at path, creating it if needed.  If there is no journal yet but there is
+//a persistent state file from an older version, its state gets imported
+func open_job_store(path, legacy_state_file string, retention time.Duration) (*JobStore, error) {
+	store := &JobStore{
+		path:           path,
+		jobs:           make(map[string]*Job),
+		compact_at_min: JOB_JOURNAL_COMPACT_MIN_RECORDS,
+		retention:      retention,
+	}
+	_, err := os.Stat(path)
+	needs_migration := os.IsNotExist(err) && len(legacy_state_file) > 0
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+	if needs_migration {
+		if err := store.migrate_legacy_state(legacy_state_file); err != nil {
+			return nil, err
+		}
+	}
+	//start off with a clean journal
+	if err := store.compact(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (store *JobStore) load() error {
+	file, err := os.Open(store.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	line_number := 0
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				root_logger.Warn("Dropping incomplete last record of job journal", "file", store.path)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line_number++
+		record := journal_record{}
+		if err := json.Unmarshal(line, &record); err != nil {
+			root_logger.Warn("Skipping corrupt record of job journal", "file", store.path, "line", line_number, "err", err)
+			continue
+		}
+		store.apply(&record)
+		store.record_count++
+	}
+}
+
+func (store *JobStore) apply(record *journal_record) {
+	if record.Job != nil {
+		store.jobs[record.Job.ID] = record.Job
+	}
+	if record.LastTweetID > store.tweet_cursor {
+		store.tweet_cursor = record.LastTweetID
+	}
+	if record.LastDMID > store.dm_cursor {
+		store.dm_cursor = record.LastDMID
+	}
+}
+
+//Imports the persistent_state.json used before there was a job store.
+//In progress tweets and DMs become queued jobs so they get run again
+func (store *JobStore) migrate_legacy_state(file_name string) error {
+	if _, err := os.Stat(file_name); os.IsNotExist(err) {
+		return nil
+	}
+	persistent_state, err := load_persistent_state_file(file_name)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	store.tweet_cursor = persistent_state.LastTweetID
+	store.dm_cursor = persistent_state.LastDMID
+	for tweet_id := range persistent_state.TweetIDsInProgress {
+		job := &Job{
+			ID:            tweet_job_id(tweet_id),
+			Type:          JOB_TYPE_TWEET,
+			SourceID:      fmt.Sprint(tweet_id),
+			ParentTweetID: tweet_id,
+			Status:        JOB_STATUS_QUEUED,
+			CreatedAt:     now,
+		}
+		store.jobs[job.ID] = job
+	}
+	for _, dm_cart := range persistent_state.DMsInProgress {
+		job := &Job{
+			ID:        dm_job_id(dm_cart.DMID),
+			Type:      JOB_TYPE_DM,
+			SourceID:  dm_cart.DMID,
+			DM:        dm_cart,
+			Author:    dm_cart.Sender.ScreenName,
+			Status:    JOB_STATUS_QUEUED,
+			CreatedAt: now,
+		}
+		store.jobs[job.ID] = job
+	}
+	root_logger.Info("Imported in progress jobs", "count", len(store.jobs), "file", file_name)
+	return nil
+}
+
+//Rewrites the journal with one record per job, leaving out jobs past the retention.  The new journal is written next to the old
+//one and renamed over it, so the old journal is still there if this fails.  Must hold the mutex
+func (store *JobStore) compact() error {
+	store.drop_expired_jobs()
+	tmp_path := store.path + ".tmp"
+	tmp_file, err := os.OpenFile(tmp_path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(tmp_file)
+	encoder := json.NewEncoder(writer)
+	err = encoder.Encode(&journal_record{LastTweetID: store.tweet_cursor, LastDMID: store.dm_cursor})
+	for _, job := range store.sorted_jobs() {
+		if err != nil {
+			break
+		}
+		err = encoder.Encode(&journal_record{Job: job})
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = tmp_file.Sync()
+	}
+	if close_err := tmp_file.Close(); err == nil {
+		err = close_err
+	}
+	if err != nil {
+		os.Remove(tmp_path)
+		return fmt.Errorf("could not compact job journal: %v", err)
+	}
+	if err := os.Rename(tmp_path, store.path); err != nil {
+		return fmt.Errorf("could not replace job journal: %v", err)
+	}
+	//the rename is only on disk once the directory is
+	if err := sync_dir(filepath.Dir(store.path)); err != nil {
+		root_logger.Warn("Could not sync job journal directory", "file", store.path, "err", err)
+	}
+
+	if store.file != nil {
+		store.file.Close()
+	}
+	store.file, err = os.OpenFile(store.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	store.record_count = len(store.jobs) + 1
+	return nil
+}
+
+//Forgets finished jobs that finished longer than the retention ago.  Held jobs are kept until they are approved or rejected.
+//Must hold the mutex
+func (store *JobStore) drop_expired_jobs() {
+	if store.retention <= 0 {
+		return
+	}
+	cutoff := time.Now().Add(-store.retention)
+	dropped := 0
+	for id, job := range store.jobs {
+		if job.Status.is_finished() && job.Status != JOB_STATUS_HELD && job.FinishedAt.Before(cutoff) {
+			delete(store.jobs, id)
+			dropped++
+		}
+	}
+	if dropped > 0 {
+		root_logger.Info("Dropped old jobs from job journal", "file", store.path, "count", dropped, "retention", store.retention)
+	}
+}
+
+//Makes renames and new files in dir survive a crash
+func sync_dir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+func (store *JobStore) sorted_jobs() []*Job {
+	jobs := make([]*Job, 0, len(store.jobs))
+	for _, job := range store.jobs {
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		if !jobs[i].CreatedAt.Equal(jobs[j].CreatedAt) {
+			return jobs[i].CreatedAt.Before(jobs[j].CreatedAt)
+		}
+		return jobs[i].ID < jobs[j].ID
+	})
+	return jobs
+}
+
+//Appends the record and applies it once it is on disk.  Must hold the mutex
+func (store *JobStore) write(record *journal_record) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if _, err := store.file.Write(line); err != nil {
+		return err
+	}
+	if err := store.file.Sync(); err != nil {
+		return err
+	}
+	store.apply(record)
+	store.record_count++
+
+	if store.record_count >= store.compact_at_min && store.record_count > 2*len(store.jobs) {
+		if err := store.compact(); err != nil {
+			//the journal is still intact, just bigger than it needs to be
+			root_logger.Warn("Could not compact job journal", "file", store.path, "err", err)
+		}
+	}
+	return nil
+}
+
+//Writes the media to dir/<job id>.gif or dir/<job id>.mp4 and returns the path
+func archive_media(dir, job_id string, media_data []byte, media_type string) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	extension := MEDIA_FORMAT_GIF
+	if media_type == MEDIA_TYPE_MP4 {
+		extension = MEDIA_FORMAT_MP4
+	}
+	media_file := filepath.Join(dir, job_id+"."+extension)
+	if err := ioutil.WriteFile(media_file, media_data, 0600); err != nil {
+		return "", err
+	}
+	return media_file, nil
+}
+
+//Loads the journal without opening it for writing, so it can be read while the bot is running
+func read_job_journal(path string) (*JobStore, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	store := &JobStore{path: path, jobs: make(map[string]*Job)}
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (store *JobStore) Close() error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.file.Close()
+}
+
+//Records a new job as queued.  Returns false if the job is already known, in which case nothing changes
+func (store *JobStore) enqueue(job *Job) (bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if _, ok := store.jobs[job.ID]; ok {
+		return false, nil
+	}
+	new_job := *job
+	new_job.Status = JOB_STATUS_QUEUED
+	if new_job.CreatedAt.IsZero() {
+		new_job.CreatedAt = time.Now()
+	}
+	if err := store.write(&journal_record{Job: &new_job}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (store *JobStore) start(job_id string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	job, ok := store.jobs[job_id]
+	if !ok {
+		return fmt.Errorf("unknown job %v", job_id)
+	}
+	updated := *job
+	updated.Status = JOB_STATUS_RUNNING
+	updated.Attempts++
+	updated.StartedAt = time.Now()
+	return store.write(&journal_record{Job: &updated})
+}
+
+//Queues a finished job to be run again
+func (store *JobStore) requeue(job_id string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	job, ok := store.jobs[job_id]
+	if !ok {
+		return fmt.Errorf("unknown job %v", job_id)
+	}
+	if !job.Status.is_finished() {
+		return fmt.Errorf("job %v is already %v", job_id, job.Status)
+	}
+	if job.Type == JOB_TYPE_DM && job.DM == nil {
+		return fmt.Errorf("job %v does not have the DM it came from", job_id)
+	}
+	updated := *job
+	updated.Status = JOB_STATUS_QUEUED
+	return store.write(&journal_record{Job: &updated})
+}
+
+//Undoes requeue for a job that could not be sent off to be run, so it is the way it was before.  previous is the job before it was requeued
+func (store *JobStore) unqueue(previous *Job) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	job, ok := store.jobs[previous.ID]
+	if !ok {
+		return fmt.Errorf("unknown job %v", previous.ID)
+	}
+	if job.Status != JOB_STATUS_QUEUED {
+		return fmt.Errorf("job %v is already %v", previous.ID, job.Status)
+	}
+	restored := *previous
+	return store.write(&journal_record{Job: &restored})
+}
+
+//Records the result and moves the cursor used to find missed tweets and DMs past the job
+func (store *JobStore) finish(job_id string, result *JobResult) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	job, ok := store.jobs[job_id]
+	if !ok {
+		return fmt.Errorf("unknown job %v", job_id)
+	}
+	updated := *job
+	updated.Status = result.Status
+	updated.Error = result.Error
+	updated.ErrorKind = result.ErrorKind
+	updated.Output = truncate_job_output(result.Output)
+	updated.MediaIDs = result.MediaIDs
+	updated.ReplyTweetID = result.ReplyTweetID
+	updated.RunDuration = result.RunDuration
+	updated.Cached = result.Cached
+	updated.Held = result.Held
+	updated.FinishedAt = time.Now()
+	if len(store.archive_dir) > 0 && len(result.MediaData) > 0 {
+		media_file, err := archive_media(store.archive_dir, job_id, result.MediaData, result.MediaType)
+		if err != nil {
+			root_logger.for_job(job_id, job.Type, job.Author).stage("finish").Error("Could not archive media", "err", err)
+		} else {
+			updated.MediaFile = media_file
+		}
+	}
+	if len(result.Author) > 0 {
+		updated.Author = result.Author
+	}
+	if len(result.CartSource) > 0 {
+		updated.CartSource = result.CartSource
+	}
+
+	record := &journal_record{Job: &updated}
+	switch job.Type {
+	case JOB_TYPE_TWEET:
+		record.LastTweetID = dm_id_to_int(job.SourceID)
+	case JOB_TYPE_DM:
+		record.LastDMID = dm_id_to_int(job.SourceID)
+	}
+	return store.write(record)
+}
+
+//Returns a copy of the job
+func (store *JobStore) job(job_id string) (Job, bool) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	job, ok := store.jobs[job_id]
+	if !ok {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+//Jobs of the given type that were queued or running when the bot went down, oldest first
+func (store *JobStore) unfinished_jobs(job_type JobType) []Job {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	jobs := make([]Job, 0)
+	for _, job := range store.sorted_jobs() {
+		if job.Type == job_type && !job.Status.is_finished() {
+			jobs = append(jobs, *job)
+		}
+	}
+	return jobs
+}
+
+//Returns copies of every job with the status, oldest first
+func (store *JobStore) jobs_with_status(status JobStatus) []Job {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	jobs := make([]Job, 0)
+	for _, job := range store.sorted_jobs() {
+		if job.Status == status {
+			jobs = append(jobs, *job)
+		}
+	}
+	return jobs
+}
+
+func (store *JobStore) last_processed_tweet_id() int64 {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.tweet_cursor
+}
+
+func (store *JobStore) last_processed_dm_id() int64 {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.dm_cursor
+}
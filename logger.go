@@ -0,0 +1,332 @@
+//Copyright (C) 2020 Daniel Bokser.  See LICENSE file for license
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type LogLevel int
+
+const (
+	LOG_LEVEL_DEBUG LogLevel = iota
+	LOG_LEVEL_INFO
+	LOG_LEVEL_WARN
+	LOG_LEVEL_ERROR
+)
+
+func (level LogLevel) String() string {
+	switch level {
+	case LOG_LEVEL_DEBUG:
+		return "debug"
+	case LOG_LEVEL_INFO:
+		return "info"
+	case LOG_LEVEL_WARN:
+		return "warn"
+	default:
+		return "error"
+	}
+}
+
+func parse_log_level(value string) (LogLevel, error) {
+	for level := LOG_LEVEL_DEBUG; level <= LOG_LEVEL_ERROR; level++ {
+		if strings.EqualFold(value, level.String()) {
+			return level, nil
+		}
+	}
+	return LOG_LEVEL_INFO, fmt.Errorf("unknown log level %q", value)
+}
+
+const (
+	LOG_FORMAT_LOGFMT = "logfmt"
+	LOG_FORMAT_JSON   = "json"
+)
+
+//Where log lines go.  Shared by a logger and every logger made from it with with()
+type log_sink struct {
+	mutex     sync.Mutex
+	writer    io.Writer
+	format    string
+	min_level LogLevel
+	//for tests
+	now func() time.Time
+}
+
+//Writes one line per message with the level, the message and key/value fields,
+//either as logfmt (time=... level=info msg="..." job=tweet-123) or as a JSON object
+type Logger struct {
+	sink *log_sink
+	//alternating keys and values
+	fields []interface{}
+}
+
+func new_logger(writer io.Writer, format string, min_level LogLevel) *Logger {
+	return &Logger{sink: &log_sink{writer: writer, format: format, min_level: min_level, now: time.Now}}
+}
+
+//Used for everything that does not belong to a job
+var root_logger = new_logger(os.Stderr, LOG_FORMAT_LOGFMT, LOG_LEVEL_INFO)
+
+//Returns a logger that adds the key/value pairs to every message
+func (logger *Logger) with(key_values ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(logger.fields)+len(key_values))
+	fields = append(fields, logger.fields...)
+	fields = append(fields, key_values...)
+	return &Logger{sink: logger.sink, fields: fields}
+}
+
+//A logger for everything that happens while handling a job
+func (logger *Logger) for_job(job_id string, job_type JobType, user string) *Logger {
+	return logger.with("job", job_id, "type", job_type, "user", user)
+}
+
+func (logger *Logger) stage(stage string) *Logger {
+	return logger.with("stage", stage)
+}
+
+func (logger *Logger) Debug(msg string, key_values ...interface{}) {
+	logger.log(LOG_LEVEL_DEBUG, msg, key_values)
+}
+
+func (logger *Logger) Info(msg string, key_values ...interface{}) {
+	logger.log(LOG_LEVEL_INFO, msg, key_values)
+}
+
+func (logger *Logger) Warn(msg string, key_values ...interface{}) {
+	logger.log(LOG_LEVEL_WARN, msg, key_values)
+}
+
+func (logger *Logger) Error(msg string, key_values ...interface{}) {
+	logger.log(LOG_LEVEL_ERROR, msg, key_values)
+}
+
+//Logs at the error level and exits
+func (logger *Logger) Fatal(msg string, key_values ...interface{}) {
+	logger.log(LOG_LEVEL_ERROR, msg, key_values)
+	os.Exit(1)
+}
+
+func (logger *Logger) log(level LogLevel, msg string, key_values []interface{}) {
+	sink := logger.sink
+	if level < sink.min_level {
+		return
+	}
+	fields := make([]interface{}, 0, 6+len(logger.fields)+len(key_values))
+	fields = append(fields, "time", sink.now().UTC().Format(time.RFC3339Nano), "level", level.String(), "msg", msg)
+	fields = append(fields, logger.fields...)
+	fields = append(fields, key_values...)
+	if len(fields)%2 != 0 {
+		fields = append(fields, "(missing)")
+	}
+
+	var line []byte
+	if sink.format == LOG_FORMAT_JSON {
+		line = format_json_log_line(fields)
+	} else {
+		line = format_logfmt_log_line(fields)
+	}
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	sink.writer.Write(line)
+}
+
+func log_value_string(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func format_logfmt_log_line(fields []interface{}) []byte {
+	builder := strings.Builder{}
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			builder.WriteByte(' ')
+		}
+		builder.WriteString(log_value_string(fields[i]))
+		builder.WriteByte('=')
+		value := log_value_string(fields[i+1])
+		if len(value) == 0 || strings.ContainsAny(value, " =\"\n\t") {
+			value = strconv.Quote(value)
+		}
+		builder.WriteString(value)
+	}
+	builder.WriteByte('\n')
+	return []byte(builder.String())
+}
+
+func format_json_log_line(fields []interface{}) []byte {
+	//not a map, so the fields stay in order
+	builder := strings.Builder{}
+	builder.WriteByte('{')
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			builder.WriteByte(',')
+		}
+		key, _ := json.Marshal(log_value_string(fields[i]))
+		builder.Write(key)
+		builder.WriteByte(':')
+		var value []byte
+		switch v := fields[i+1].(type) {
+		case int, int64, int32, uint, uint64, float64, bool:
+			value, _ = json.Marshal(v)
+		default:
+			value, _ = json.Marshal(log_value_string(v))
+		}
+		builder.Write(value)
+	}
+	builder.WriteString("}\n")
+	return []byte(builder.String())
+}
+
+//Sends lines written with the standard log package through the logger, for code that still uses it
+type std_log_writer struct {
+	logger *Logger
+}
+
+func (writer std_log_writer) Write(p []byte) (int, error) {
+	writer.logger.Info(strings.TrimRight(string(p), "\n"))
+	return len(p), nil
+}
+
+//A log file that gets rotated once it is larger than max_size bytes or older than max_age.
+//Rotated files are renamed to <name>.<time> and only the newest max_backups of them are kept
+type rotating_file struct {
+	mutex       sync.Mutex
+	path        string
+	max_size    int64
+	max_age     time.Duration
+	max_backups int
+	//nil if the file could not be opened again after rotating, in which case logs go to stderr
+	file      *os.File
+	size      int64
+	opened_at time.Time
+	now       func() time.Time
+}
+
+const ROTATED_LOG_TIME_FORMAT = "20060102T150405.000000000"
+
+//What comes after <name> in rotated files.  -<n> is added if a file was already rotated at the same time
+var ROTATED_LOG_SUFFIX_REGEX = regexp.MustCompile(`^\.\d{8}T\d{6}\.\d{9}(-\d+)?$`)
+
+func open_rotating_file(path string, max_size int64, max_age time.Duration, max_backups int) (*rotating_file, error) {
+	rotating := &rotating_file{path: path, max_size: max_size, max_age: max_age, max_backups: max_backups, now: time.Now}
+	if err := rotating.open(); err != nil {
+		return nil, err
+	}
+	return rotating, nil
+}
+
+func (rotating *rotating_file) open() error {
+	file, err := os.OpenFile(rotating.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	rotating.file = file
+	rotating.size = info.Size()
+	rotating.opened_at = info.ModTime()
+	if rotating.size == 0 {
+		rotating.opened_at = rotating.now()
+	}
+	return nil
+}
+
+func (rotating *rotating_file) Write(p []byte) (int, error) {
+	rotating.mutex.Lock()
+	defer rotating.mutex.Unlock()
+	if rotating.file == nil {
+		if err := rotating.open(); err != nil {
+			return os.Stderr.Write(p)
+		}
+	}
+	is_too_big := rotating.max_size > 0 && rotating.size > 0 && rotating.size+int64(len(p)) > rotating.max_size
+	is_too_old := rotating.max_age > 0 && rotating.now().Sub(rotating.opened_at) >= rotating.max_age
+	if is_too_big || is_too_old {
+		if err := rotating.rotate(); err != nil {
+			fmt.Fprintln(os.Stderr, "Could not rotate log file", rotating.path, "Reason:", err)
+		}
+		if rotating.file == nil {
+			return os.Stderr.Write(p)
+		}
+	}
+	n, err := rotating.file.Write(p)
+	rotating.size += int64(n)
+	return n, err
+}
+
+//Must hold the mutex
+func (rotating *rotating_file) rotate() error {
+	rotating.file.Close()
+	rotating.file = nil
+	rotated_path := rotating.path + "." + rotating.now().UTC().Format(ROTATED_LOG_TIME_FORMAT)
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(rotated_path); os.IsNotExist(err) {
+			break
+		}
+		rotated_path = fmt.Sprintf("%v.%v-%v", rotating.path, rotating.now().UTC().Format(ROTATED_LOG_TIME_FORMAT), i)
+	}
+	if err := os.Rename(rotating.path, rotated_path); err != nil {
+		rotating.open()
+		return err
+	}
+	if err := rotating.open(); err != nil {
+		return err
+	}
+
+	backups, err := rotating.backups()
+	if err != nil || rotating.max_backups <= 0 || len(backups) <= rotating.max_backups {
+		return err
+	}
+	for _, backup := range backups[:len(backups)-rotating.max_backups] {
+		os.Remove(backup)
+	}
+	return nil
+}
+
+//Rotated files, oldest first.  Other files starting with the name, e.g. bot.log.old, are left alone
+func (rotating *rotating_file) backups() ([]string, error) {
+	entries, err := ioutil.ReadDir(filepath.Dir(rotating.path))
+	if err != nil {
+		return nil, err
+	}
+	name := filepath.Base(rotating.path)
+	backups := []string{}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), name) && ROTATED_LOG_SUFFIX_REGEX.MatchString(entry.Name()[len(name):]) {
+			backups = append(backups, filepath.Join(filepath.Dir(rotating.path), entry.Name()))
+		}
+	}
+	//the timestamps sort oldest first
+	sort.Strings(backups)
+	return backups, nil
+}
+
+func (rotating *rotating_file) Close() error {
+	rotating.mutex.Lock()
+	defer rotating.mutex.Unlock()
+	if rotating.file == nil {
+		return nil
+	}
+	return rotating.file.Close()
+}
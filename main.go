@@ -4,16 +4,14 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
-	"os/exec"
-	"os/user"
 	"regexp"
-	"runtime"
 	"sort"
 	"strings"
 	"time"
@@ -31,127 +29,61 @@ type TweetCartRunnerPersistentState struct {
 	DMsInProgress      map[string]*DMCart
 }
 
-const (
-	//PTS -> "persisted thread state"
-	PTS_STATE_PERSISTED = iota
-)
-
 type TweetCart struct {
 	tweet_id        int64
 	parent_tweet_id int64
+	//screen name of whoever mentioned the bot
+	author    string
+	author_id string
 }
 
-func perstisting_thread(tweet_ids_in_progress, processed_tweet_ids <-chan int64,
-	dms_in_progress <-chan *DMCart, processed_dm_ids <-chan string,
-	persistent_state *TweetCartRunnerPersistentState, status_channel chan<- int, file_name string) {
-	needs_persist := false
-	for {
-		if needs_persist {
-			select {
-			case tweet_id := <-tweet_ids_in_progress:
-				persistent_state.TweetIDsInProgress[tweet_id] = true
-				needs_persist = true
-			case tweet_id := <-processed_tweet_ids:
-				if tweet_id > persistent_state.LastTweetID {
-					persistent_state.LastTweetID = tweet_id
-				}
-				delete(persistent_state.TweetIDsInProgress, tweet_id)
-				needs_persist = true
-			case dm_id := <-processed_dm_ids:
-				dm_id_num := dm_id_to_int(dm_id)
-				if dm_id_num > persistent_state.LastDMID {
-					persistent_state.LastDMID = dm_id_num
-				}
-				delete(persistent_state.DMsInProgress, dm_id)
-				needs_persist = true
-			case dm_cart := <-dms_in_progress:
-				persistent_state.DMsInProgress[dm_cart.DMID] = dm_cart
-				needs_persist = true
-			default:
-				//persist file
-				bytes, err := json.Marshal(persistent_state)
-				if err != nil {
-					log.Print("Cannot serialize persistent state.  No state will persiste anymore. Reason: ", err)
-					return
-				}
-				err = ioutil.WriteFile(file_name, bytes, 0600)
-				if err != nil {
-					log.Print("Cannot write ", file_name, " No state will persiste anymore. Reason: ", err)
-					return
-
-				}
-				if status_channel != nil {
-					status_channel <- PTS_STATE_PERSISTED
-				}
-				needs_persist = false
-			}
-		} else {
-			select {
-			case tweet_id := <-tweet_ids_in_progress:
-				persistent_state.TweetIDsInProgress[tweet_id] = true
-				needs_persist = true
-			case tweet_id := <-processed_tweet_ids:
-				if tweet_id > persistent_state.LastTweetID {
-					persistent_state.LastTweetID = tweet_id
-				}
-				delete(persistent_state.TweetIDsInProgress, tweet_id)
-				needs_persist = true
-			case dm_id := <-processed_dm_ids:
-				dm_id_num := dm_id_to_int(dm_id)
-				if dm_id_num > persistent_state.LastDMID {
-					persistent_state.LastDMID = dm_id_num
-				}
-				delete(persistent_state.DMsInProgress, dm_id)
-				needs_persist = true
-			case dm_cart := <-dms_in_progress:
-				persistent_state.DMsInProgress[dm_cart.DMID] = dm_cart
-				needs_persist = true
-			}
-
-		}
-
-	}
+type TweetHandlerContext struct {
+	twitter_client *twitter.Client
+	runner         CartRunner
+	run_limits     *RunLimits
+	blocklist      *Blocklist
+	moderation     *Moderation
 }
 
-func load_persistent_state_file(file_name string) *TweetCartRunnerPersistentState {
+//Reads the state file used before there was a job store.  Only used to migrate to the job store
+func load_persistent_state_file(file_name string) (*TweetCartRunnerPersistentState, error) {
 	var persistent_state TweetCartRunnerPersistentState
 	state_json, err := ioutil.ReadFile(file_name)
 	if err == nil && len(state_json) > 0 {
 		err = json.Unmarshal(state_json, &persistent_state)
 		if err != nil {
-			log.Fatal("Could not read json from perisistent_state.json. Exiting... Reason: ", err)
+			return nil, fmt.Errorf("could not read json from %v: %v", file_name, err)
 		}
-	} else {
-		persistent_state.TweetIDsInProgress = make(map[int64]bool)
 	}
 
+	if persistent_state.TweetIDsInProgress == nil {
+		persistent_state.TweetIDsInProgress = make(map[int64]bool)
+	}
 	if persistent_state.DMsInProgress == nil {
-		persistent_state.DMsInProgress = make(map[string]*DMCart, NUMBER_OF_CONCURRENT_CART_HANDLERS)
+		persistent_state.DMsInProgress = make(map[string]*DMCart)
 	}
 
-	return &persistent_state
+	return &persistent_state, nil
 }
 
-func process_missed_tweets(tc *twitter.Client, my_user *twitter.User, persistent_state *TweetCartRunnerPersistentState,
-	cart_tweet_channel chan TweetCart) {
-	log.Print("Loading missed tweets...")
-	cart_tweet := TweetCart{}
-	for tweet_id, _ := range persistent_state.TweetIDsInProgress {
-		cart_tweet.tweet_id = tweet_id
-		cart_tweet.parent_tweet_id = tweet_id
-		cart_tweet_channel <- cart_tweet
-	}
-	if persistent_state.LastTweetID == 0 {
-		log.Print("Done!")
-		return
+func process_missed_tweets(ctx context.Context, tc *twitter.Client, my_user *twitter.User, jobs *JobStore,
+	cart_tweet_channel chan TweetCart) error {
+	logger := root_logger.with("stage", "intake", "type", JOB_TYPE_TWEET)
+	logger.Info("Loading missed tweets...")
+	for _, job := range jobs.unfinished_jobs(JOB_TYPE_TWEET) {
+		cart_tweet_channel <- TweetCart{tweet_id: dm_id_to_int(job.SourceID), parent_tweet_id: job.ParentTweetID, author: job.Author, author_id: job.AuthorID}
+	}
+	if jobs.last_processed_tweet_id() == 0 {
+		logger.Info("Done!")
+		return nil
 	}
 
 	const buffer_size = 50
 	total_loaded_tweets := 0
-	last_tweet_id := persistent_state.LastTweetID
+	last_tweet_id := jobs.last_processed_tweet_id()
 	for {
-		api_func := func() (interface{}, error) {
-			log.Print("Since id: ", last_tweet_id)
+		logger.Debug("Loading mentions", "since_id", last_tweet_id)
+		tweets, err := call_twitter_api(ctx, "", logger, func() ([]twitter.Tweet, *http.Response, error) {
 			timeline_params := &twitter.MentionTimelineParams{
 				Count:              buffer_size,
 				SinceID:            last_tweet_id,
@@ -161,43 +93,29 @@ func process_missed_tweets(tc *twitter.Client, my_user *twitter.User, persistent
 				IncludeEntities:    twitter.Bool(true),
 				TweetMode:          "extended",
 			}
-			tweets, _, err := tc.Timelines.MentionTimeline(timeline_params)
-			return tweets, err
-		}
-
-		tweets_int, err := execute_twitter_api(api_func, "Cannot retrieve mentions sent before bring up.  Exiting...", true)
+			return tc.Timelines.MentionTimeline(timeline_params)
+		})
 		if err != nil {
-			//should never get here
-			return
+			return fmt.Errorf("could not retrieve mentions sent before bring up: %w", err)
 		}
-		tweets := tweets_int.([]twitter.Tweet)
 		if len(tweets) == 0 {
-			log.Print("Attempted to load ", total_loaded_tweets, " tweets")
-			return
+			logger.Info("Loaded missed tweets", "count", total_loaded_tweets)
+			return nil
 		}
 		for _, tweet := range tweets {
-			if _, does_contain := persistent_state.TweetIDsInProgress[tweet.ID]; does_contain {
+			if tweet.User.IDStr == my_user.IDStr {
 				if tweet.ID > last_tweet_id {
 					last_tweet_id = tweet.ID
 				}
 				continue
 			}
-			if tweet.User.IDStr == my_user.IDStr {
+			//tweets that are already known are either done or were queued above
+			if !queue_tweet(&tweet, jobs, cart_tweet_channel) {
 				if tweet.ID > last_tweet_id {
 					last_tweet_id = tweet.ID
 				}
 				continue
 			}
-			var tweet_id int64
-			if tweet.InReplyToStatusID != 0 && tweet.InReplyToUserID == tweet.User.ID {
-				tweet_id = tweet.InReplyToStatusID
-			} else {
-				tweet_id = tweet.ID
-			}
-
-			cart_tweet.tweet_id = tweet_id
-			cart_tweet.parent_tweet_id = tweet.ID
-			cart_tweet_channel <- cart_tweet
 
 			if tweet.ID > last_tweet_id {
 				last_tweet_id = tweet.ID
@@ -208,25 +126,37 @@ func process_missed_tweets(tc *twitter.Client, my_user *twitter.User, persistent
 
 	}
 }
-func setup_logging(log_file_name string) *os.File {
-	f, err := os.OpenFile(log_file_name, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
-	if err != nil {
-		log.Print("Could not open log file: ", os.Args[1], ". Defaulting to stdout")
-		return nil
+//Sends everything to root_logger in the configured format and level.  If there is a log file,
+//it gets rotated by size and age and is returned so it can be closed
+func setup_logging(config *Config) io.Closer {
+	level, _ := parse_log_level(config.LogLevel)
+	var (
+		output io.Writer = os.Stderr
+		file   io.Closer
+	)
+	if len(config.LogFile) > 0 {
+		rotating, err := open_rotating_file(config.LogFile, int64(config.LogMaxSize)*1024*1024, config.LogMaxAge.Duration, config.LogMaxBackups)
+		if err != nil {
+			root_logger.Error("Could not open log file. Defaulting to stderr", "file", config.LogFile, "err", err)
+		} else {
+			output, file = rotating, rotating
+		}
 	}
-
-	log.SetOutput(f)
-	return f
+	root_logger = new_logger(output, config.LogFormat, level)
+	//anything still using the standard log package, such as libraries
+	log.SetFlags(0)
+	log.SetOutput(std_log_writer{root_logger.with("source", "stdlib")})
+	return file
 }
 func load_keys_file(keys_file_name string) (string, string, string, string) {
 	contents, err := ioutil.ReadFile(keys_file_name)
 	if err != nil {
-		log.Fatal("Could not load keys file: ", os.Args[1], ". Exiting...")
+		root_logger.Fatal("Could not load keys file. Exiting...", "file", keys_file_name, "err", err)
 	}
 
 	lines := strings.Split(string(contents), "\n")
 	if len(lines) < 4 {
-		log.Fatal("Invalid keys file!  Must have 4 lines. Exiting...")
+		root_logger.Fatal("Invalid keys file!  Must have 4 lines. Exiting...", "file", keys_file_name)
 	}
 	consumer_key := strings.TrimSpace(lines[0])
 	consumer_secret := strings.TrimSpace(lines[1])
@@ -235,81 +165,242 @@ func load_keys_file(keys_file_name string) (string, string, string, string) {
 
 	return consumer_key, consumer_secret, token, token_secret
 }
-func run_tweet_cart_thread(cart_tweet_channel chan TweetCart,
-	tweet_ids_in_progress_channel chan int64, processed_tweet_ids_channel chan int64,
-	twitter_client *twitter.Client,
-	goroutine_context context.Context, processing_tweet_semaphore *semaphore.Weighted) {
+//Records a job for the mention and sends it off to be run.  Returns false if the mention already has a job
+func queue_tweet(mention *twitter.Tweet, jobs *JobStore, cart_tweet_channel chan TweetCart) bool {
+	cart_tweet, is_new := record_tweet_job(mention, jobs)
+	if !is_new {
+		return false
+	}
+	cart_tweet_channel <- cart_tweet
+	return true
+}
+
+//Records a job for the mention.  Returns false if the mention already has a job
+func record_tweet_job(mention *twitter.Tweet, jobs *JobStore) (TweetCart, bool) {
+	cart_tweet := TweetCart{tweet_id: mention.ID, parent_tweet_id: tweet_id_to_run(mention), author: mention.User.ScreenName, author_id: mention.User.IDStr}
+	is_new, err := jobs.enqueue(&Job{
+		ID:            tweet_job_id(cart_tweet.tweet_id),
+		Type:          JOB_TYPE_TWEET,
+		SourceID:      mention.IDStr,
+		ParentTweetID: cart_tweet.parent_tweet_id,
+		Author:        mention.User.ScreenName,
+		AuthorID:      mention.User.IDStr,
+	})
+	if err != nil {
+		//still run it, it just will not be retried if the bot goes down
+		root_logger.for_job(tweet_job_id(cart_tweet.tweet_id), JOB_TYPE_TWEET, cart_tweet.author).stage("intake").
+			Error("Could not record job", "err", err)
+	} else if !is_new {
+		return cart_tweet, false
+	}
+	return cart_tweet, true
+}
+
+//Lets tweets in as long as their author is not blocked and is under quota, and schedules them to be run
+func run_tweet_cart_thread(cart_tweet_channel chan TweetCart, jobs *JobStore, handler *TweetHandlerContext,
+	quota *UserQuota, scheduler *FairScheduler, goroutine_context context.Context) {
 
 	for tweet := range cart_tweet_channel {
-		if err := processing_tweet_semaphore.Acquire(goroutine_context, 1); err != nil {
-			log.Print("Error acquiring semaphore: ", err)
+		job_id := tweet_job_id(tweet.tweet_id)
+		if handler.blocklist.is_blocked(tweet.author_id, tweet.author) {
+			logger := root_logger.for_job(job_id, JOB_TYPE_TWEET, tweet.author)
+			logger.stage("intake").Info("User is blocked.  Ignoring tweet")
+			finish_job(jobs, job_id, JOB_TYPE_TWEET, &JobResult{Status: JOB_STATUS_BLOCKED}, logger)
+			continue
+		}
+		if ok, retry_after, notify := quota.admit(tweet.author); !ok {
+			logger := root_logger.for_job(job_id, JOB_TYPE_TWEET, tweet.author)
+			logger.stage("intake").Info("User is over quota", "retry_after", retry_after, "notify", notify)
+			result := &JobResult{Status: JOB_STATUS_OVER_QUOTA}
+			if notify {
+				status := fmt.Sprintf("@%v %v", tweet.author, quota.over_quota_message(retry_after))
+				reply, err := call_twitter_write_api(goroutine_context, "Error replying to tweet", logger.stage("reply"), func() (*twitter.Tweet, *http.Response, error) {
+					status_update_params := &twitter.StatusUpdateParams{
+						InReplyToStatusID: tweet.tweet_id,
+						TrimUser:          twitter.Bool(true),
+						TweetMode:         "extended",
+					}
+					return handler.twitter_client.Statuses.Update(status, status_update_params)
+				})
+				if err == nil {
+					result.ReplyTweetID = reply.ID
+				}
+			}
+			finish_job(jobs, job_id, JOB_TYPE_TWEET, result, logger)
 			continue
 		}
 		tmp_tweet := tweet
-		go func() {
-			tweet_ids_in_progress_channel <- tmp_tweet.tweet_id
-			handle_tweet(tmp_tweet.parent_tweet_id, twitter_client)
-			processed_tweet_ids_channel <- tmp_tweet.tweet_id
-			processing_tweet_semaphore.Release(1)
-		}()
+		scheduler.push(&ScheduledCart{
+			job_id:   job_id,
+			job_type: JOB_TYPE_TWEET,
+			user:     tweet.author,
+			run: func(ctx context.Context, logger *Logger) *JobResult {
+				return handle_tweet(ctx, tmp_tweet.parent_tweet_id, tmp_tweet.tweet_id, handler, logger)
+			},
+		})
 	}
 
 }
 
 func main() {
-	load_args()
-
-	if len(LOGFILE_NAME) > 0 {
-		if f := setup_logging(LOGFILE_NAME); f != nil {
-			defer f.Close()
+	if len(os.Args) > 1 && os.Args[1] == SANDBOX_EXEC_COMMAND {
+		//only returns if PICO-8 could not be started
+		err := run_sandbox_exec(os.Args[2:])
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(127)
+	}
+	if len(os.Args) > 1 && os.Args[1] == "history" {
+		if err := run_history_command(os.Args[2:], os.Getenv, os.Stdout); err != nil && err != flag.ErrHelp {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
 		}
+		return
 	}
 
-	conusmer_key, consumer_secret, token_str, token_secret := load_keys_file(API_KEYS_FILE_NAME)
+	config, err := load_config(os.Args, os.Getenv)
+	if err != nil {
+		root_logger.Fatal("Invalid configuration. Exiting...", "err", err)
+	}
 
-	config := oauth1.NewConfig(conusmer_key, consumer_secret)
+	if f := setup_logging(config); f != nil {
+		defer f.Close()
+	}
+	twitter_retry_policy = new_twitter_retry_policy(config.TwitterAPIMaxAttempts, config.TwitterAPIRetryTimeout.Duration)
+
+	conusmer_key, consumer_secret, token_str, token_secret := load_keys_file(config.KeysFile)
+
+	oauth_config := oauth1.NewConfig(conusmer_key, consumer_secret)
 	token := oauth1.NewToken(token_str, token_secret)
 
-	goroutine_context := context.Background()
-	processing_tweet_semaphore := semaphore.NewWeighted(NUMBER_OF_CONCURRENT_CART_HANDLERS)
+	//cancelled once the shutdown grace period is over, which kills any carts still running
+	goroutine_context, kill_running_carts := context.WithCancel(context.Background())
+	defer kill_running_carts()
+	//cancelled as soon as we are asked to go down, which stops new work from coming in
+	intake_context, stop_intake := context.WithCancel(goroutine_context)
+	defer stop_intake()
+	handle_shutdown_signals(stop_intake)
+
+	runner := &Pico8Runner{
+		exec_path:    config.Pico8Path,
+		scratch_root: config.ScratchDir,
+		timeout:      config.CartTimeout.Duration,
+		ffmpeg_path:  config.FFmpegPath,
+		sandbox:      config.sandbox(),
+		env:          config.pico8_env(),
+	}
+	if err := runner.sandbox.setup(); err != nil {
+		root_logger.Fatal("Could not set up cart limits. Exiting...", "err", err)
+	}
+	if len(config.XvfbPath) > 0 {
+		framebuffer_count := 1
+		if config.XvfbPerHandler {
+			framebuffer_count = int(config.ConcurrentCartHandlers)
+		}
+		runner.framebuffers = start_framebuffers(goroutine_context, config.XvfbPath, config.XvfbScreen, framebuffer_count, int(config.ConcurrentCartHandlers))
+		bot_readiness.framebuffers = runner.framebuffers
+	}
+	cart_runner := start_cart_runner(goroutine_context, runner, config.Pico8WorkerPool, int(config.ConcurrentCartHandlers), config.Pico8WorkerMaxRuns)
+	if config.SelfTest {
+		if err := run_self_test(intake_context, cart_runner, config.run_limits(), root_logger.stage("self_test")); err != nil {
+			root_logger.Fatal("Self test failed, so carts can not be recorded. Exiting...", "err", err)
+		}
+	}
+	//after the self test, which should really run PICO-8
+	if len(config.ResultCacheDir) > 0 {
+		result_cache, err := open_result_cache(config.ResultCacheDir, int64(config.ResultCacheMaxSizeMB)*1024*1024)
+		if err != nil {
+			root_logger.Fatal("Could not open result cache. Exiting...", "dir", config.ResultCacheDir, "err", err)
+		}
+		cart_runner = &CachingRunner{runner: cart_runner, cache: result_cache}
+		uploaded_media = new_uploaded_media()
+	}
+	processing_tweet_semaphore := semaphore.NewWeighted(config.ConcurrentCartHandlers)
+	bot_metrics.cart_handlers_capacity.add(config.ConcurrentCartHandlers)
 
 	// http_client will automatically authorize http.Request's
-	http_client := config.Client(oauth1.NoContext, token)
+	twitter_rate_limits := new_rate_limit_tracker(config.TwitterRateLimitReserve, real_clock{}, bot_metrics)
+	base_http_client := &http.Client{Transport: &metrics_transport{
+		base:    &rate_limit_transport{base: http.DefaultTransport, tracker: twitter_rate_limits},
+		metrics: bot_metrics,
+	}}
+	http_client := oauth_config.Client(context.WithValue(oauth1.NoContext, oauth1.HTTPClient, base_http_client), token)
 	twitter_client := twitter.NewClient(http_client)
 	//log on
-	user_name := ""
-	logon_func := func() (interface{}, error) {
-		user, _, err := twitter_client.Accounts.VerifyCredentials(nil)
-		return user, err
-	}
-	user_int, _ := execute_twitter_api(logon_func, "Could not log on to twitter", true)
-	my_user := user_int.(*twitter.User)
-	user_name = my_user.ScreenName
-	log.Print("Logged on as ", my_user.ScreenName)
-
-	dms_in_progress_channel := make(chan *DMCart, NUMBER_OF_CONCURRENT_CART_HANDLERS)
-	processed_dm_ids_channel := make(chan string, NUMBER_OF_CONCURRENT_CART_HANDLERS)
-	persistent_state_file_name := "persistent_state.json"
-	persistent_state := load_persistent_state_file(persistent_state_file_name)
-	tweet_ids_in_progress_channel := make(chan int64, NUMBER_OF_CONCURRENT_CART_HANDLERS)
-	processed_tweet_ids_channel := make(chan int64, NUMBER_OF_CONCURRENT_CART_HANDLERS)
-
-	go perstisting_thread(tweet_ids_in_progress_channel, processed_tweet_ids_channel,
-		dms_in_progress_channel, processed_dm_ids_channel,
-		persistent_state, nil, persistent_state_file_name)
+	logon_func := func() (*twitter.User, *http.Response, error) {
+		return twitter_client.Accounts.VerifyCredentials(nil)
+	}
+	my_user, err := call_twitter_api(intake_context, "", root_logger, logon_func)
+	if err != nil {
+		root_logger.Fatal("Could not log on to twitter. Exiting...", "err", err)
+	}
+	root_logger.Info("Logged on", "screen_name", my_user.ScreenName)
+	if err := twitter_rate_limits.seed(intake_context, twitter_client, root_logger); err != nil {
+		root_logger.Warn("Could not load rate limits.  They will be learned as the bot goes", "err", err)
+	}
+
+	jobs, err := open_job_store(config.JobJournalFile, config.StateFile, config.JobRetention.Duration)
+	if err != nil {
+		root_logger.Fatal("Could not open job journal. Exiting...", "file", config.JobJournalFile, "err", err)
+	}
+	defer jobs.Close()
+	jobs.archive_dir = config.ArchiveDir
+	blocklist, err := open_blocklist(config.BlocklistFile)
+	if err != nil {
+		root_logger.Fatal("Could not load blocklist. Exiting...", "file", config.BlocklistFile, "err", err)
+	}
+	moderation, err := load_moderation(config)
+	if err != nil {
+		root_logger.Fatal("Could not set up moderation. Exiting...", "err", err)
+	}
 
+	tweet_handler := &TweetHandlerContext{
+		twitter_client: twitter_client,
+		runner:         cart_runner,
+		run_limits:     config.run_limits(),
+		blocklist:      blocklist,
+		moderation:     moderation,
+	}
 	cart_tweet_channel := make(chan TweetCart, 256)
-	go run_tweet_cart_thread(cart_tweet_channel, tweet_ids_in_progress_channel, processed_tweet_ids_channel,
-		twitter_client, goroutine_context, processing_tweet_semaphore)
+	dm_channel := make(chan *DMCart, 256)
+	bot_metrics.queue_length.set_func("tweet", func() float64 { return float64(len(cart_tweet_channel)) })
+	bot_metrics.queue_length.set_func("dm", func() float64 { return float64(len(dm_channel)) })
+	scheduler := new_fair_scheduler()
+	bot_metrics.queue_length.set_func("scheduled", func() float64 { return float64(scheduler.length()) })
+	quota := new_user_quota(config.CartsPerUserPerHour, config.QuotaAllowlist, real_clock{})
+	intake := new_intake_control()
+	if len(config.AdminListenAddress) > 0 {
+		start_admin_server(config, &AdminContext{
+			token:              config.AdminToken,
+			jobs:               jobs,
+			intake:             intake,
+			twitter_client:     twitter_client,
+			my_user:            my_user,
+			rate_limits:        twitter_rate_limits,
+			blocklist:          blocklist,
+			cart_tweet_channel: cart_tweet_channel,
+			dm_channel:         dm_channel,
+		})
+	}
+	go run_scheduled_carts(scheduler, jobs, intake, goroutine_context, processing_tweet_semaphore)
+	go run_tweet_cart_thread(cart_tweet_channel, jobs, tweet_handler, quota, scheduler, goroutine_context)
 
-	process_missed_tweets(twitter_client, my_user, persistent_state, cart_tweet_channel)
+	if err := process_missed_tweets(intake_context, twitter_client, my_user, jobs, cart_tweet_channel); err != nil {
+		root_logger.Error("Could not load missed tweets.  They will not be run", "err", err)
+	}
 
-	init_dm_listener(consumer_secret, http_client, twitter_client, my_user,
-		dms_in_progress_channel, processed_dm_ids_channel,
-		persistent_state,
-		goroutine_context, processing_tweet_semaphore)
+	webhook_server := init_dm_listener(config, consumer_secret, http_client, twitter_client, my_user, cart_runner, jobs,
+		dm_channel, quota, scheduler, blocklist, moderation, goroutine_context)
 
-	for {
+	listen_for_mentions(intake_context, twitter_client, my_user, logon_func, jobs, cart_tweet_channel)
+
+	graceful_shutdown(config, http_client, webhook_server, intake, kill_running_carts)
+}
+
+//Runs until ctx is cancelled
+func listen_for_mentions(ctx context.Context, twitter_client *twitter.Client, my_user *twitter.User,
+	logon_func func() (*twitter.User, *http.Response, error), jobs *JobStore, cart_tweet_channel chan TweetCart) {
+	user_name := my_user.ScreenName
+	for ctx.Err() == nil {
 
 		//now listen for tweets tagging the bot
 
@@ -325,96 +416,56 @@ func main() {
 
 		stream, err := twitter_client.Streams.Filter(filter_params)
 		if err != nil {
-			log.Fatal("Could not get stream.  Reason: ", err)
+			root_logger.Fatal("Could not get stream", "err", err)
 		}
+		set_readiness_flag(&bot_readiness.stream_connected, true)
 
-		cart_tweet := TweetCart{}
-		for message := range stream.Messages {
-			switch msg := message.(type) {
-			case *twitter.Tweet:
-				if msg.RetweetedStatus != nil {
-					//do not handle retweets
-					continue
-				}
-				if msg.User.IDStr == my_user.IDStr {
-					//do not process tweets from myself!
-					continue
+		for is_connected := true; is_connected; {
+			select {
+			case message, ok := <-stream.Messages:
+				if !ok {
+					is_connected = false
+					break
 				}
-				var parent_tweet_id int64
-				if msg.InReplyToStatusID != 0 && msg.InReplyToUserID == msg.User.ID {
-					parent_tweet_id = msg.InReplyToStatusID
-				} else {
-					parent_tweet_id = msg.ID
+				switch msg := message.(type) {
+				case *twitter.Tweet:
+					if msg.RetweetedStatus != nil {
+						//do not handle retweets
+						continue
+					}
+					if msg.User.IDStr == my_user.IDStr {
+						//do not process tweets from myself!
+						continue
+					}
+					queue_tweet(msg, jobs, cart_tweet_channel)
+
+				default:
+					root_logger.Debug("Generic handler", "message_type", fmt.Sprintf("%T", msg), "message", fmt.Sprint(msg))
 				}
-				cart_tweet.tweet_id = msg.ID
-				cart_tweet.parent_tweet_id = parent_tweet_id
-				cart_tweet_channel <- cart_tweet
-
-			default:
-				log.Printf("Generic handler -- type: %T -- %v", msg, msg)
+			case <-ctx.Done():
+				set_readiness_flag(&bot_readiness.stream_connected, false)
+				root_logger.Info("Stopping filter stream...")
+				stream.Stop()
+				return
 			}
 		}
 
-		log.Print("Connection lost, retrying login in 30 seconds...")
-		time.Sleep(30 * time.Second)
-		//log on
-		user_int, _ := execute_twitter_api(logon_func, "Could not log on to twitter", true)
-		user := user_int.(*twitter.User)
-		user_name = user.ScreenName
-		log.Print("Relogged on as ", user.ScreenName)
-	}
-
-}
-
-func is_retriable_error(err error) bool {
-	switch typed_err := err.(type) {
-	case twitter.APIError:
-		if len(typed_err.Errors) > 1 {
-			//if there is more than one error, we shouldn't retry.  Just bail out
-			return false
-		}
-		api_err := typed_err.Errors[0]
-		if api_err.Code == 420 || api_err.Code == 429 {
-			return true
+		set_readiness_flag(&bot_readiness.stream_connected, false)
+		root_logger.Warn("Connection lost, retrying login in 30 seconds...")
+		select {
+		case <-time.After(30 * time.Second):
+		case <-ctx.Done():
+			return
 		}
-
-	default:
-		//TODO handle timeouts
-		return false
-	}
-
-	return false
-}
-
-func execute_twitter_api(api func() (interface{}, error), error_msg string, is_fatal bool) (interface{}, error) {
-	const sleep_seconds = 20
-	var (
-		ret interface{}
-		err error
-	)
-	for retry := true; retry; {
-		ret, err = api()
+		//log on
+		user, err := call_twitter_api(ctx, "Could not log on to twitter", root_logger, logon_func)
 		if err != nil {
-			if is_retriable_error(err) {
-				log.Print(error_msg, " Reason: ", err)
-				log.Print("Retrying in ", sleep_seconds, " seconds")
-				time.Sleep(sleep_seconds * time.Second)
-				continue
-
-			} else if is_fatal {
-				log.Fatal(error_msg, "Exiting... Reason: ", err)
-			} else {
-				if len(error_msg) > 0 {
-					log.Print(error_msg, " Reason: ", err)
-				}
-				return nil, err
-			}
+			continue
 		}
-		retry = false
+		user_name = user.ScreenName
+		root_logger.Info("Relogged on", "screen_name", user.ScreenName)
 	}
 
-	return ret, nil
-
 }
 
 var APPROX_FUNCTION_CALL_REGEX = regexp.MustCompile(`\w+?\(([\w'"{}\[\]]*?(, *?)*?)*?\)`)
@@ -424,29 +475,51 @@ func is_probably_code(tweet string) bool {
 		strings.Contains(tweet, "?'") || strings.Contains(tweet, "?\"")
 }
 
-func upload_gif(gif_data []byte, tc *twitter.Client, category string) (int64, error) {
-	api_func := func() (interface{}, error) {
-		upload_result, _, err := tc.Media.Upload(gif_data, "image/gif", category)
-		return upload_result, err
-	}
-	upload_result_int, err := execute_twitter_api(api_func, "Error uploading gif", false)
+func upload_media(ctx context.Context, media_data []byte, media_type string, tc *twitter.Client, category string, logger *Logger) (int64, error) {
+	if media_type == MEDIA_TYPE_GIF && len(media_data) > MAX_GIF_UPLOAD_SIZE {
+		original_size := len(media_data)
+		optimized, strategies_used, err := optimize_gif(media_data, MAX_GIF_UPLOAD_SIZE)
+		if err != nil {
+			return 0, fmt.Errorf("GIF of size %v is too large to upload and could not be shrunk. Reason: %v", original_size, err)
+		}
+		media_data = optimized
+		logger.Info("Shrunk GIF", "original_size", original_size, "size", len(media_data), "strategies", strings.Join(strategies_used, ","))
+	}
+	if media_id := uploaded_media.lookup(media_data, category); media_id != 0 {
+		bot_metrics.media_reuses.inc(category)
+		logger.Info("Reusing media uploaded before", "media_id", media_id)
+		return media_id, nil
+	}
+	attempts := 0
+	upload_result, err := call_twitter_api(ctx, "Error uploading media", logger, func() (*twitter.MediaUploadResult, *http.Response, error) {
+		attempts++
+		if attempts > 1 {
+			bot_metrics.upload_retries.inc(category)
+		}
+		return tc.Media.Upload(media_data, media_type, category)
+	})
 	if err != nil {
 		return 0, err
 	}
-	upload_result := upload_result_int.(*twitter.MediaUploadResult)
 
 	if upload_result.ProcessingInfo != nil {
-		log.Print("Upload of gif not finished yet.  Checking again in ", upload_result.ProcessingInfo.CheckAfterSecs, " seconds")
+		logger.Info("Upload of media not finished yet", "check_after", time.Duration(upload_result.ProcessingInfo.CheckAfterSecs)*time.Second)
 		for retry := true; retry; {
-			time.Sleep(time.Duration(upload_result.ProcessingInfo.CheckAfterSecs) * time.Second)
-			media_status_result, _, err := tc.Media.Status(upload_result.MediaID)
-			if err != nil {
-				if is_retriable_error(err) {
-					//lets retry again
-					continue
-				} else {
-					return 0, fmt.Errorf("Error checking status of uploaded media. Bailing out... Reason: %v", err)
+			select {
+			case <-time.After(time.Duration(upload_result.ProcessingInfo.CheckAfterSecs) * time.Second):
+			case <-ctx.Done():
+				return 0, ctx.Err()
+			}
+			attempts = 0
+			media_status_result, err := call_twitter_api(ctx, "", logger, func() (*twitter.MediaStatusResult, *http.Response, error) {
+				attempts++
+				if attempts > 1 {
+					bot_metrics.upload_retries.inc(category)
 				}
+				return tc.Media.Status(upload_result.MediaID)
+			})
+			if err != nil {
+				return 0, fmt.Errorf("Error checking status of uploaded media. Bailing out... Reason: %w", err)
 			}
 
 			switch media_status_result.ProcessingInfo.State {
@@ -454,11 +527,11 @@ func upload_gif(gif_data []byte, tc *twitter.Client, category string) (int64, er
 			case "pending":
 				fallthrough
 			case "in_progress":
-				log.Print("Error checking status of uploaded media: ", err)
+				logger.Debug("Uploaded media still processing", "state", media_status_result.ProcessingInfo.State)
 				//check status again
 				continue
 			case "failed":
-				return 0, fmt.Errorf("Failed to upload gif. Reason: %v", media_status_result.ProcessingInfo.Error.Message)
+				return 0, fmt.Errorf("Failed to upload media. Reason: %v", media_status_result.ProcessingInfo.Error.Message)
 			default:
 				return 0, fmt.Errorf("Unknown media upload state %v. Bailing out", media_status_result.ProcessingInfo.State)
 			}
@@ -467,55 +540,91 @@ func upload_gif(gif_data []byte, tc *twitter.Client, category string) (int64, er
 
 	}
 
+	uploaded_media.remember(media_data, category, upload_result.MediaID, time.Duration(upload_result.ExpiresAfterSecs)*time.Second)
 	return upload_result.MediaID, nil
 
 }
 
-func handle_tweet(tweet_id int64, tc *twitter.Client) {
-	var (
-		err   error
-		tweet *twitter.Tweet
-	)
-
-	api_func := func() (interface{}, error) {
-		status_show_params := &twitter.StatusShowParams{
-			ID:               tweet_id,
-			TrimUser:         twitter.Bool(false),
-			IncludeMyRetweet: twitter.Bool(false),
-			IncludeEntities:  twitter.Bool(true),
-			TweetMode:        "extended",
-		}
-		tweet, _, err = tc.Statuses.Show(tweet_id, status_show_params)
-		return tweet, err
-	}
-	tweet_int, err := execute_twitter_api(api_func, fmt.Sprintf("Error retrieving tweet ID: %v", tweet_id), false)
+//Runs the cart in tweet_id for the mention mention_id, which is tweet_id itself unless the mention is a reply to the cart.
+//Returns what happened so it can be recorded in the job store
+func handle_tweet(ctx context.Context, tweet_id, mention_id int64, handler *TweetHandlerContext, logger *Logger) *JobResult {
+	result := &JobResult{Status: JOB_STATUS_FAILED}
+	tc := handler.twitter_client
+	tweet, err := fetch_tweet(ctx, tweet_id, tc, logger.stage("fetch"))
 	if err != nil {
-		return
+		result.set_error(err)
+		return result
+	}
+	result.Author = tweet.User.ScreenName
+	//someone else can ask for a blocked user's cart to be run
+	if handler.blocklist.is_blocked(tweet.User.IDStr, tweet.User.ScreenName) {
+		logger.stage("fetch").Info("Cart is by a blocked user.  Ignoring it", "tweet_id", tweet.IDStr)
+		result.Status = JOB_STATUS_BLOCKED
+		return result
 	}
-	tweet = tweet_int.(*twitter.Tweet)
 	//log.Print("Tweet full text: ", tweet.FullText)
 
-	var indicies_to_remove []twitter.Indices
-	if entities := tweet.Entities; entities != nil {
-		indicies_to_remove = make([]twitter.Indices, 0, len(entities.UserMentions))
-		for _, user_mention := range entities.UserMentions {
-			indicies_to_remove = append(indicies_to_remove, user_mention.Indices)
+	if part, ok := is_unfinished_cart_part(tweet); ok {
+		result.Status = JOB_STATUS_IGNORED
+		if mention_id == tweet_id {
+			//the author mentioned us in every part, so the last part will get run when its mention comes in
+			logger.stage("fetch").Info("Tweet is not the last part of its cart.  Ignoring it", "tweet_id", tweet.IDStr, "part", part.part, "total", part.total)
+			return result
 		}
-		sort.Slice(indicies_to_remove, func(i, j int) bool {
-			return indicies_to_remove[i][1] < indicies_to_remove[i][0]
+		status := fmt.Sprintf("@%v This is part %v of %v of a cart.  Mention me in a reply to the last part, %v/%v, to run the whole cart.",
+			tweet.User.ScreenName, part.part, part.total, part.total, part.total)
+		reply, err := call_twitter_write_api(ctx, "Error replying to tweet", logger.stage("reply"), func() (*twitter.Tweet, *http.Response, error) {
+			status_update_params := &twitter.StatusUpdateParams{
+				InReplyToStatusID: mention_id,
+				TrimUser:          twitter.Bool(true),
+				TweetMode:         "extended",
+			}
+			return tc.Statuses.Update(status, status_update_params)
 		})
+		if err == nil {
+			result.ReplyTweetID = reply.ID
+		}
+		return result
+	}
+
+	thread := collect_cart_thread(ctx, tweet, tc, logger.stage("fetch"))
+	if len(thread) > 1 {
+		logger.stage("fetch").Info("Tweet is the last of a multi-tweet cart", "tweet_id", tweet.IDStr, "parts", len(thread))
 	}
-	sanitized_tweet := sanitize_tweet_text(tweet.FullText, indicies_to_remove)
+	sanitized_tweet := reassemble_cart(thread)
+	result.CartSource = sanitized_tweet
 	//log.Print("Sanitized tweet: ", sanitized_tweet)
 
-	gif_data, err := run_pico8_and_generate_gif(sanitized_tweet, tweet.IDStr)
+	moderation_request := &ModerationRequest{
+		JobType:  JOB_TYPE_TWEET,
+		Author:   tweet.User.ScreenName,
+		AuthorID: tweet.User.IDStr,
+		Source:   sanitized_tweet,
+		Public:   true,
+	}
+	if verdict := handler.moderation.before_run(moderation_request, logger.stage("moderation")); verdict.Action != MODERATION_ALLOW {
+		result.set_rejected(verdict)
+		return result
+	}
+
+	run_params := resolve_run_params(sanitized_tweet, handler.run_limits)
+	run_result, err := handler.runner.Run(ctx, sanitized_tweet, tweet.IDStr, run_params, logger.stage("run"))
+	result.set_run_result(run_result)
+	if ctx.Err() != nil {
+		result.set_error(ctx.Err())
+		return result
+	}
 	if err != nil {
 		if !is_probably_code(sanitized_tweet) {
-			return
+			logger.stage("run").Info("Tweet is not code.  Ignoring it")
+			result.Status = JOB_STATUS_IGNORED
+			return result
 		}
-		log.Print("Error generating gif for cart. Reason: ", err)
+		result.set_error(err)
+		logger.stage("run").Warn("Error generating gif for cart", "err", err, "error_kind", error_kind(err))
 
-		api_func = func() (interface{}, error) {
+		status := fmt.Sprintf("@%v\nI was unable to generate the GIF of your tweetcart. %v", tweet.User.ScreenName, describe_cart_error(err))
+		reply, err := call_twitter_write_api(ctx, "Error replying to tweet", logger.stage("reply"), func() (*twitter.Tweet, *http.Response, error) {
 			status_update_params := &twitter.StatusUpdateParams{
 				Status:             "",
 				InReplyToStatusID:  tweet_id,
@@ -528,27 +637,51 @@ func handle_tweet(tweet_id int64, tc *twitter.Client) {
 				MediaIds:           nil,
 				TweetMode:          "extended",
 			}
-			status := fmt.Sprintf(`@%v
-I was unable to generate the GIF of your tweetcart. Possible reasons:
-
-- There is a syntax error in your tweetcart.
-- There is an infinite loop and flip() is not being called.
-- flip() is overridden.`, tweet.User.ScreenName)
-
-			tweet, _, err = tc.Statuses.Update(status, status_update_params)
-			return tweet, err
+			return tc.Statuses.Update(status, status_update_params)
+		})
+		if err == nil {
+			result.ReplyTweetID = reply.ID
 		}
-		execute_twitter_api(api_func, fmt.Sprintf("Error replying to tweet id: %v", tweet.IDStr), false)
-		return
+		return result
+	}
+
+	moderation_request.MediaData, moderation_request.MediaType = run_result.MediaData, run_result.MediaType
+	switch verdict := handler.moderation.before_post(moderation_request, logger.stage("moderation")); verdict.Action {
+	case MODERATION_ALLOW:
+	case MODERATION_HOLD:
+		held := &HeldPost{
+			Reason:            verdict.Reason,
+			ReplyToTweetID:    tweet_id,
+			ParamsDescription: describe_run_params(run_result.Params, handler.run_limits),
+			MediaType:         run_result.MediaType,
+		}
+		if err := handler.moderation.hold(held, run_result.MediaData, result); err != nil {
+			logger.stage("moderation").Error("Could not hold GIF for approval", "err", err)
+			result.set_error(err)
+		}
+		return result
+	default:
+		result.set_rejected(verdict)
+		return result
 	}
 
-	gif_id, err := upload_gif(gif_data, tc, "tweet_gif")
+	post_tweet_reply(ctx, tc, tweet_id, tweet.User.ScreenName, run_result.MediaData, run_result.MediaType,
+		describe_run_params(run_result.Params, handler.run_limits), logger, result)
+	return result
+}
+
+//Uploads the media and replies to the tweet with it.  Sets the result to succeeded if it worked
+func post_tweet_reply(ctx context.Context, tc *twitter.Client, tweet_id int64, screen_name string, media_data []byte, media_type string,
+	params_description string, logger *Logger, result *JobResult) {
+	media_id, err := upload_media(ctx, media_data, media_type, tc, media_category(media_type, false), logger.stage("upload"))
 	if err != nil {
-		log.Print(err)
+		logger.stage("upload").Error("Could not upload media", "err", err)
+		result.set_error(err)
 		return
 	}
+	result.MediaIDs = []int64{media_id}
 
-	api_func = func() (interface{}, error) {
+	reply, err := call_twitter_write_api(ctx, "Error replying to tweet", logger.stage("reply"), func() (*twitter.Tweet, *http.Response, error) {
 		status_update_params := &twitter.StatusUpdateParams{
 			Status:             "",
 			InReplyToStatusID:  tweet_id,
@@ -558,172 +691,99 @@ I was unable to generate the GIF of your tweetcart. Possible reasons:
 			PlaceID:            "",
 			DisplayCoordinates: twitter.Bool(false),
 			TrimUser:           twitter.Bool(true),
-			MediaIds:           []int64{gif_id},
+			MediaIds:           []int64{media_id},
 			TweetMode:          "extended",
 		}
-		tweet, _, err = tc.Statuses.Update("@"+tweet.User.ScreenName, status_update_params)
-		return tweet, err
-	}
-	_, err = execute_twitter_api(api_func, fmt.Sprintf("Error replying to tweet id: %v", tweet.IDStr), false)
+		status := fmt.Sprintf("@%v %v", screen_name, params_description)
+		return tc.Statuses.Update(status, status_update_params)
+	})
 	if err != nil {
+		result.set_error(err)
 		return
 	}
-	log.Print("Successfully posted GIF for tweet ", tweet_id)
+	result.ReplyTweetID = reply.ID
+	logger.stage("reply").Info("Successfully posted GIF", "tweet_id", tweet_id, "reply_tweet_id", result.ReplyTweetID)
+	result.Status = JOB_STATUS_SUCCEEDED
+}
+
+var INCLUDE_REGEX = regexp.MustCompile(`(?m)^\s*#include\s\S*`)
 
+//A part of a tweet's text that gets replaced before the cart is run
+type text_edit struct {
+	indices     twitter.Indices
+	replacement string
+	//user mentions are only removed when they are outside of a string
+	outside_strings_only bool
 }
 
-var PICO_8_EXEC_PATH = func() string {
-	switch runtime.GOOS {
-	case "darwin":
-		return "./PICO-8.app/Contents/MacOS/pico8"
-	case "linux":
-		switch runtime.GOARCH {
-		case "amd64":
-			return "./pico-8-linux/pico8"
-		case "arm":
-			return "./pico-8-rpi/pico8"
-		default:
-			panic("unsupported arch: " + runtime.GOARCH)
-		}
-	default:
-		panic("unsupported os: " + runtime.GOOS)
+//Twitter adds "http://" to anything it thinks is a URL, so "p.io" comes back as "http://p.io".
+//It never adds "https://", and the display URL, which long links get cut short with "…" in,
+//only starts with a scheme if it was typed, so that is what tells us whether to take "http://" off
+func original_url_text(url twitter.URLEntity) string {
+	if len(url.ExpandedURL) == 0 {
+		return url.URL
 	}
-}()
-
-func run_pico8_and_generate_gif(sanitized_tweet, tweet_id_str string) ([]byte, error) {
-	var (
-		output       string
-		buf          [256]byte
-		done_chan    chan bool = make(chan bool)
-		timeout_chan <-chan time.Time
-	)
-	done_str := tweet_id_str + " done"
-	file_contents :=
-		fmt.Sprintf(
-			`pico-8 cartridge // http://www.pico-8.com
-version 18
-__lua__
-load=nil save=nil
-__state_%v__={flip=flip, t=t, extcmd=extcmd, printh=printh, start=t(), did_start_rec=false, count=0}
-function flip()
-    local state = __state_%v__
-    if state.t()-state.start >= 8 then
-        state.extcmd('video')
-        state.printh('%v')
-    end
-    state.count+=1
-    if state.count == 2 then
-        state.extcmd('rec')
-        state.did_start_rec = true
-    end
-    state.flip()
-end
-%v
-if not _draw then
-function finish()
- local state = __state_%v__
- local start = state.t()
- if not state.did_start_rec then
-     while state.t() - start < .5 do
-     end
-     state.extcmd('rec')
- end
- while state.t() - start < 2 do
- end
- state.extcmd('video')
- state.printh('%v')
-end
-finish()
-end`,
-			tweet_id_str,
-			tweet_id_str,
-			done_str,
-			sanitized_tweet,
-			tweet_id_str,
-			done_str)
-	cart_file_name := tweet_id_str + ".p8"
-	err := ioutil.WriteFile(cart_file_name, []byte(file_contents), 0600)
-	if err != nil {
-		log.Print("Error writing cart file! Reason: ", err)
-		return nil, err
-	} else {
-		//log.Print("Wrote tweet to ", cart_file_name)
-	}
-	defer func() {
-		if err := os.Remove(cart_file_name); err != nil {
-			log.Print("Could not delete program ", cart_file_name, ". Reason: ", err)
-		} else {
-			//log.Print("Deleted ", gif_path, " from desktop")
-		}
-	}()
-	user, err := user.Current()
-	pico8_command := exec.Command(PICO_8_EXEC_PATH, "-run", tweet_id_str+".p8", "-desktop", user.HomeDir+"/Desktop/")
-	stdout, err := pico8_command.StdoutPipe()
-	if err != nil {
-		log.Print("Error getting stdout from ", PICO_8_EXEC_PATH, "Reason: ", err)
-		return nil, err
+	if strings.HasPrefix(url.ExpandedURL, "http://") && !strings.HasPrefix(url.DisplayURL, "http://") {
+		return url.ExpandedURL[len("http://"):]
 	}
-	err = pico8_command.Start()
-	//log.Print(script_name, " output:\n", command_output.String())
-	if err != nil {
-		log.Print("Error running ", PICO_8_EXEC_PATH, "Reason: ", err)
-		return nil, err
-	}
-	defer pico8_command.Process.Wait()
-	defer pico8_command.Process.Kill()
-	go func() {
-		defer func() { done_chan <- true }()
-		for {
-			n, err := stdout.Read(buf[:])
-			if err != nil {
-				if err != io.EOF {
-					log.Print("Error occurred reading stdout from pico8.  Error: ", err)
-				}
-				break
-			}
-			if n == 0 {
-				log.Fatal("Stdout return 0 without error!")
-			}
-			output += string(buf[:n])
-			if strings.Contains(output, done_str) {
-				break
-			}
+	return url.ExpandedURL
+}
 
+//Edits that undo what twitter did to the text: t.co links get turned back into what was typed
+//and links to attached media get removed.  If remove_mentions is set, user mentions get removed too.
+//The edits are sorted
+func text_edits_from_entities(entities *twitter.Entities, remove_mentions bool) []text_edit {
+	if entities == nil {
+		return nil
+	}
+	edits := make([]text_edit, 0, len(entities.UserMentions)+len(entities.Urls)+len(entities.Media))
+	if remove_mentions {
+		for _, user_mention := range entities.UserMentions {
+			edits = append(edits, text_edit{indices: user_mention.Indices, outside_strings_only: true})
 		}
-	}()
-	timeout_chan = time.After(30 * time.Second)
-	select {
-	case <-done_chan:
-	case <-timeout_chan:
-		return nil, errors.New("Timed out running cart.  Bailing out...")
-	}
-
-	gif_path := user.HomeDir + "/Desktop/" + tweet_id_str + "_0.gif"
-	defer func() {
-		if err := os.Remove(gif_path); err != nil {
-			log.Print("Could not delete GIF ", gif_path, ". Reason: ", err)
-		} else {
-			//log.Print("Deleted ", gif_path, " from desktop")
-		}
-	}()
-	contents, err := ioutil.ReadFile(gif_path)
-	return contents, err
+	}
+	for _, url := range entities.Urls {
+		edits = append(edits, text_edit{indices: url.Indices, replacement: original_url_text(url)})
+	}
+	for _, media := range entities.Media {
+		edits = append(edits, text_edit{indices: media.Indices})
+	}
+	sort.Slice(edits, func(i, j int) bool {
+		return edits[i].indices[0] < edits[j].indices[0]
+	})
+	return edits
 }
 
-var INCLUDE_REGEX = regexp.MustCompile(`(?m)^\s*#include\s\S*`)
+//Edits must be sorted.  Their indices are in runes of the text after HTML entities
+//such as &lt; are unescaped, which is how twitter counts them
+func sanitize_tweet_text(text string, edits []text_edit) string {
+	text = strings.ReplaceAll(text, "&gt;", ">")
+	text = strings.ReplaceAll(text, "&lt;", "<")
+	text = strings.ReplaceAll(text, "&amp;", "&")
 
-//Indices to remove must be sorted
-func sanitize_tweet_text(text string, indices_to_remove []twitter.Indices) string {
 	sanitized_tweet := ""
-	current_indices_index := 0
-	var indices *twitter.Indices = nil
-	if len(indices_to_remove) > 0 {
-		indices = &indices_to_remove[0]
-	}
+	current_edit_index := 0
 	is_currently_in_string := false
 	head_quote := rune(0)
 
-	for i, c := range []rune(text) {
+	runes := []rune(text)
+	for i := 0; i < len(runes); {
+		//skip edits that overlap the previous one
+		for current_edit_index < len(edits) && edits[current_edit_index].indices[0] < i {
+			current_edit_index++
+		}
+		if current_edit_index < len(edits) && edits[current_edit_index].indices[0] == i {
+			edit := edits[current_edit_index]
+			current_edit_index++
+			if edit.indices[1] > i && (!edit.outside_strings_only || !is_currently_in_string) {
+				sanitized_tweet += edit.replacement
+				i = edit.indices[1]
+				continue
+			}
+		}
+
+		c := runes[i]
+		i++
 		switch c {
 		case '”':
 			fallthrough
@@ -734,18 +794,6 @@ func sanitize_tweet_text(text string, indices_to_remove []twitter.Indices) strin
 		case '‘':
 			c = '\''
 		}
-		if indices != nil {
-			if i >= indices[0] && i < indices[1] && !is_currently_in_string {
-				continue
-			} else if i >= indices[1] {
-				current_indices_index += 1
-				if current_indices_index >= len(indices_to_remove) {
-					indices = nil
-				} else {
-					indices = &indices_to_remove[current_indices_index]
-				}
-			}
-		}
 
 		if c == '\'' || c == '"' {
 			if is_currently_in_string && head_quote == c {
@@ -759,13 +807,10 @@ func sanitize_tweet_text(text string, indices_to_remove []twitter.Indices) strin
 		sanitized_tweet += string(c)
 	}
 
-	sanitized_tweet = strings.ReplaceAll(sanitized_tweet, "&gt;", ">")
-	sanitized_tweet = strings.ReplaceAll(sanitized_tweet, "&lt;", "<")
-	sanitized_tweet = strings.ReplaceAll(sanitized_tweet, "&amp;", "&")
 	sanitized_tweet = INCLUDE_REGEX.ReplaceAllLiteralString(sanitized_tweet, "")
 
 	sanitized_tweet = strings.TrimSpace(sanitized_tweet)
-	if sanitized_tweet[0] == '.' {
+	if len(sanitized_tweet) > 0 && sanitized_tweet[0] == '.' {
 		sanitized_tweet = sanitized_tweet[1:]
 	}
 
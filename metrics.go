@@ -0,0 +1,356 @@
+//Copyright (C) 2020 Daniel Bokser.  See LICENSE file for license
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+//Metrics are written by hand in the Prometheus text exposition format so we do not need the client library.
+//See https://prometheus.io/docs/instrumenting/exposition_formats/
+type metric interface {
+	write_metric(out io.Writer)
+}
+
+func write_metric_header(out io.Writer, name, help, metric_type string) {
+	fmt.Fprintf(out, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, metric_type)
+}
+
+func format_metric_value(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var METRIC_LABEL_ESCAPER = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+//Returns {name="value",...}, or "" if there are no labels
+func format_metric_labels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf(`%v="%v"`, name, METRIC_LABEL_ESCAPER.Replace(values[i]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+//Label values are joined with this to key the maps below.  It can not appear in a label value we use
+const METRIC_LABEL_SEPARATOR = "\xff"
+
+//A counter with labels.  Labels must be passed in the same order as label_names
+type counter_vec struct {
+	name        string
+	help        string
+	label_names []string
+	mutex       sync.Mutex
+	values      map[string]float64
+}
+
+func new_counter_vec(name, help string, label_names ...string) *counter_vec {
+	return &counter_vec{name: name, help: help, label_names: label_names, values: make(map[string]float64)}
+}
+
+func (counter *counter_vec) add(value float64, label_values ...string) {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+	counter.values[strings.Join(label_values, METRIC_LABEL_SEPARATOR)] += value
+}
+
+func (counter *counter_vec) inc(label_values ...string) {
+	counter.add(1, label_values...)
+}
+
+func (counter *counter_vec) value(label_values ...string) float64 {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+	return counter.values[strings.Join(label_values, METRIC_LABEL_SEPARATOR)]
+}
+
+func sorted_metric_keys(keys []string) []string {
+	sort.Strings(keys)
+	return keys
+}
+
+func split_metric_key(key string, label_count int) []string {
+	if label_count == 0 {
+		return nil
+	}
+	return strings.Split(key, METRIC_LABEL_SEPARATOR)
+}
+
+func (counter *counter_vec) write_metric(out io.Writer) {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+	write_metric_header(out, counter.name, counter.help, "counter")
+	keys := make([]string, 0, len(counter.values))
+	for key := range counter.values {
+		keys = append(keys, key)
+	}
+	for _, key := range sorted_metric_keys(keys) {
+		labels := format_metric_labels(counter.label_names, split_metric_key(key, len(counter.label_names)))
+		fmt.Fprintf(out, "%v%v %v\n", counter.name, labels, format_metric_value(counter.values[key]))
+	}
+}
+
+//A gauge that is kept up to date by whoever changes it
+type gauge struct {
+	name  string
+	help  string
+	value int64
+}
+
+func (g *gauge) add(delta int64) {
+	atomic.AddInt64(&g.value, delta)
+}
+
+func (g *gauge) get() int64 {
+	return atomic.LoadInt64(&g.value)
+}
+
+func (g *gauge) write_metric(out io.Writer) {
+	write_metric_header(out, g.name, g.help, "gauge")
+	fmt.Fprintf(out, "%v %v\n", g.name, g.get())
+}
+
+//A gauge with labels whose values are read when the metrics are scraped, e.g. the length of a channel
+type gauge_func_vec struct {
+	name        string
+	help        string
+	label_name  string
+	mutex       sync.Mutex
+	label_funcs map[string]func() float64
+}
+
+func new_gauge_func_vec(name, help, label_name string) *gauge_func_vec {
+	return &gauge_func_vec{name: name, help: help, label_name: label_name, label_funcs: make(map[string]func() float64)}
+}
+
+func (g *gauge_func_vec) set_func(label_value string, value func() float64) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.label_funcs[label_value] = value
+}
+
+func (g *gauge_func_vec) write_metric(out io.Writer) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	write_metric_header(out, g.name, g.help, "gauge")
+	keys := make([]string, 0, len(g.label_funcs))
+	for key := range g.label_funcs {
+		keys = append(keys, key)
+	}
+	for _, key := range sorted_metric_keys(keys) {
+		labels := format_metric_labels([]string{g.label_name}, []string{key})
+		fmt.Fprintf(out, "%v%v %v\n", g.name, labels, format_metric_value(g.label_funcs[key]()))
+	}
+}
+
+type histogram_values struct {
+	//not cumulative.  The last one is for everything above the largest bucket
+	bucket_counts []uint64
+	sum           float64
+	count         uint64
+}
+
+//A histogram with labels.  buckets are the upper bounds and must be sorted
+type histogram_vec struct {
+	name        string
+	help        string
+	buckets     []float64
+	label_names []string
+	mutex       sync.Mutex
+	values      map[string]*histogram_values
+}
+
+func new_histogram_vec(name, help string, buckets []float64, label_names ...string) *histogram_vec {
+	return &histogram_vec{name: name, help: help, buckets: buckets, label_names: label_names, values: make(map[string]*histogram_values)}
+}
+
+func (histogram *histogram_vec) observe(value float64, label_values ...string) {
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+	key := strings.Join(label_values, METRIC_LABEL_SEPARATOR)
+	values, ok := histogram.values[key]
+	if !ok {
+		values = &histogram_values{bucket_counts: make([]uint64, len(histogram.buckets)+1)}
+		histogram.values[key] = values
+	}
+	values.bucket_counts[sort.SearchFloat64s(histogram.buckets, value)]++
+	values.sum += value
+	values.count++
+}
+
+func (histogram *histogram_vec) write_metric(out io.Writer) {
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+	write_metric_header(out, histogram.name, histogram.help, "histogram")
+	keys := make([]string, 0, len(histogram.values))
+	for key := range histogram.values {
+		keys = append(keys, key)
+	}
+	label_names := append(append([]string{}, histogram.label_names...), "le")
+	for _, key := range sorted_metric_keys(keys) {
+		values := histogram.values[key]
+		label_values := split_metric_key(key, len(histogram.label_names))
+		cumulative := uint64(0)
+		for i, count := range values.bucket_counts {
+			cumulative += count
+			upper_bound := math.Inf(1)
+			if i < len(histogram.buckets) {
+				upper_bound = histogram.buckets[i]
+			}
+			labels := format_metric_labels(label_names, append(append([]string{}, label_values...), format_metric_value(upper_bound)))
+			fmt.Fprintf(out, "%v_bucket%v %v\n", histogram.name, labels, cumulative)
+		}
+		labels := format_metric_labels(histogram.label_names, label_values)
+		fmt.Fprintf(out, "%v_sum%v %v\n", histogram.name, labels, format_metric_value(values.sum))
+		fmt.Fprintf(out, "%v_count%v %v\n", histogram.name, labels, values.count)
+	}
+}
+
+//Everything the bot exposes on /metrics
+type BotMetrics struct {
+	cart_handlers_busy     *gauge
+	cart_handlers_capacity *gauge
+	queue_length           *gauge_func_vec
+	run_duration           *histogram_vec
+	media_size             *histogram_vec
+	jobs                   *counter_vec
+	upload_retries         *counter_vec
+	twitter_api_calls      *counter_vec
+	twitter_api_retries    *counter_vec
+	//set by RateLimitTracker as it finds out about endpoints
+	twitter_rate_limit_remaining *gauge_func_vec
+	twitter_rate_limit_reset     *gauge_func_vec
+	twitter_rate_limit_delays    *counter_vec
+	webhook_requests_rejected    *counter_vec
+	moderation_verdicts          *counter_vec
+	framebuffer_restarts         *counter_vec
+	worker_recycles              *counter_vec
+	worker_start_failures        *counter_vec
+	result_cache_lookups         *counter_vec
+	result_cache_size            *gauge
+	media_reuses                 *counter_vec
+}
+
+func new_bot_metrics() *BotMetrics {
+	return &BotMetrics{
+		cart_handlers_busy:     &gauge{name: "tweetcartrunner_cart_handlers_busy", help: "Carts being handled right now, i.e. how much of the handler semaphore is held."},
+		cart_handlers_capacity: &gauge{name: "tweetcartrunner_cart_handlers_capacity", help: "Carts that can be handled at once."},
+		queue_length:           new_gauge_func_vec("tweetcartrunner_queue_length", "Jobs waiting in a queue for a cart handler.", "queue"),
+		run_duration: new_histogram_vec("tweetcartrunner_run_duration_seconds", "How long PICO-8 took to run and record a cart.",
+			[]float64{1, 2, 4, 6, 8, 10, 12, 15, 20, 30, 60}, "type"),
+		media_size: new_histogram_vec("tweetcartrunner_media_size_bytes", "Size of the recorded GIFs and MP4s.",
+			[]float64{256 << 10, 512 << 10, 1 << 20, 2 << 20, 3 << 20, 4 << 20, 5 << 20, 8 << 20, 15 << 20}, "media_type"),
+		jobs:                         new_counter_vec("tweetcartrunner_jobs_total", "Finished jobs by status and error kind.", "type", "status", "error_kind"),
+		upload_retries:               new_counter_vec("tweetcartrunner_upload_retries_total", "Media upload calls that were retried.", "category"),
+		twitter_api_calls:            new_counter_vec("tweetcartrunner_twitter_api_calls_total", "Calls made to the twitter API by endpoint and HTTP status code.", "method", "endpoint", "code"),
+		twitter_api_retries:          new_counter_vec("tweetcartrunner_twitter_api_retries_total", "Twitter API calls retried, by twitter error code, HTTP status code, \"timeout\" or \"connection\".", "reason"),
+		twitter_rate_limit_remaining: new_gauge_func_vec("tweetcartrunner_twitter_rate_limit_remaining", "Calls left in the current rate limit window of a twitter endpoint.", "endpoint"),
+		twitter_rate_limit_reset:     new_gauge_func_vec("tweetcartrunner_twitter_rate_limit_reset_timestamp_seconds", "When the current rate limit window of a twitter endpoint resets, in unix time.", "endpoint"),
+		twitter_rate_limit_delays:    new_counter_vec("tweetcartrunner_twitter_rate_limit_delays_total", "Twitter API calls held back until their rate limit window reset.", "endpoint"),
+		webhook_requests_rejected:    new_counter_vec("tweetcartrunner_webhook_requests_rejected_total", "Webhook requests rejected for a missing or invalid signature."),
+		moderation_verdicts:          new_counter_vec("tweetcartrunner_moderation_verdicts_total", "What moderation decided before carts were run and before they were posted.", "stage", "action"),
+		framebuffer_restarts:         new_counter_vec("tweetcartrunner_framebuffer_restarts_total", "Times an Xvfb server the bot runs died and was started again."),
+		worker_recycles:              new_counter_vec("tweetcartrunner_worker_recycles_total", "PICO-8 workers that were replaced, by why.", "reason"),
+		worker_start_failures:        new_counter_vec("tweetcartrunner_worker_start_failures_total", "PICO-8 workers that could not be started."),
+		result_cache_lookups:         new_counter_vec("tweetcartrunner_result_cache_lookups_total", "Carts looked up in the result cache, by hit, miss or skipped for carts that can not be cached.", "result"),
+		result_cache_size:            &gauge{name: "tweetcartrunner_result_cache_size_bytes", help: "Size of the results in the result cache."},
+		media_reuses:                 new_counter_vec("tweetcartrunner_media_reuses_total", "Uploads skipped because the same media was uploaded recently.", "category"),
+	}
+}
+
+var bot_metrics = new_bot_metrics()
+
+func (metrics *BotMetrics) all() []metric {
+	return []metric{
+		metrics.cart_handlers_busy,
+		metrics.cart_handlers_capacity,
+		metrics.queue_length,
+		metrics.run_duration,
+		metrics.media_size,
+		metrics.jobs,
+		metrics.upload_retries,
+		metrics.twitter_api_calls,
+		metrics.twitter_api_retries,
+		metrics.twitter_rate_limit_remaining,
+		metrics.twitter_rate_limit_reset,
+		metrics.twitter_rate_limit_delays,
+		metrics.webhook_requests_rejected,
+		metrics.moderation_verdicts,
+		metrics.framebuffer_restarts,
+		metrics.worker_recycles,
+		metrics.worker_start_failures,
+		metrics.result_cache_lookups,
+		metrics.result_cache_size,
+		metrics.media_reuses,
+	}
+}
+
+func (metrics *BotMetrics) write_metrics(out io.Writer) {
+	for _, m := range metrics.all() {
+		m.write_metric(out)
+	}
+}
+
+func (metrics *BotMetrics) ServeHTTP(writer http.ResponseWriter, req *http.Request) {
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.write_metrics(writer)
+}
+
+//Called once a job is done, whether it worked or not
+func (metrics *BotMetrics) record_job(job_type JobType, result *JobResult) {
+	metrics.jobs.inc(string(job_type), string(result.Status), result.ErrorKind)
+	if result.RunDuration > 0 {
+		metrics.run_duration.observe(result.RunDuration.Seconds(), string(job_type))
+	}
+	if len(result.MediaData) > 0 {
+		metrics.media_size.observe(float64(len(result.MediaData)), result.MediaType)
+	}
+}
+
+//Numbers in paths, such as webhook IDs, are replaced so every webhook does not get its own series
+var API_PATH_ID_REGEX = regexp.MustCompile(`/\d+(\.json)?$|/\d+/`)
+
+func replace_path_ids(path string) string {
+	return API_PATH_ID_REGEX.ReplaceAllStringFunc(path, func(id string) string {
+		if strings.HasSuffix(id, "/") {
+			return "/:id/"
+		}
+		return "/:id" + strings.TrimLeft(id, "/0123456789")
+	})
+}
+
+func twitter_api_endpoint(req *http.Request) string {
+	return req.URL.Host + replace_path_ids(req.URL.Path)
+}
+
+//Counts every request made with the twitter HTTP client
+type metrics_transport struct {
+	base    http.RoundTripper
+	metrics *BotMetrics
+}
+
+func (transport *metrics_transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := transport.base.RoundTrip(req)
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	transport.metrics.twitter_api_calls.inc(req.Method, twitter_api_endpoint(req), code)
+	return resp, err
+}
@@ -0,0 +1,235 @@
+//Copyright (C) 2020 Daniel Bokser.  See LICENSE file for license
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+type ModerationAction string
+
+const (
+	MODERATION_ALLOW  ModerationAction = "allow"
+	MODERATION_REJECT ModerationAction = "reject"
+	//keep the result until an operator approves or rejects it with the admin API.  Only works before posting
+	MODERATION_HOLD ModerationAction = "hold"
+)
+
+type ModerationVerdict struct {
+	Action ModerationAction
+	//recorded as the job's error, never shown to the user
+	Reason string
+}
+
+//What a moderator gets to look at
+type ModerationRequest struct {
+	JobType  JobType
+	Author   string
+	AuthorID string
+	Source   string
+	//the result will be tweeted rather than only DMed back
+	Public bool
+	//only set before posting
+	MediaData []byte
+	MediaType string
+}
+
+//Decides whether a cart gets run, and whether what it made gets posted
+type Moderator interface {
+	//Called with the source before the cart is run.  A hold is treated as a reject since there is nothing to hold yet
+	BeforeRun(request *ModerationRequest) ModerationVerdict
+	//Called with the source and media before anything is posted
+	BeforePost(request *ModerationRequest) ModerationVerdict
+}
+
+//Asks every moderator in order.  The first one that does not allow decides
+type ModerationChain []Moderator
+
+func (chain ModerationChain) BeforeRun(request *ModerationRequest) ModerationVerdict {
+	for _, moderator := range chain {
+		if verdict := moderator.BeforeRun(request); verdict.Action != MODERATION_ALLOW {
+			return verdict
+		}
+	}
+	return ModerationVerdict{Action: MODERATION_ALLOW}
+}
+
+func (chain ModerationChain) BeforePost(request *ModerationRequest) ModerationVerdict {
+	for _, moderator := range chain {
+		if verdict := moderator.BeforePost(request); verdict.Action != MODERATION_ALLOW {
+			return verdict
+		}
+	}
+	return ModerationVerdict{Action: MODERATION_ALLOW}
+}
+
+//Rejects carts whose source matches any of its patterns
+type WordlistModerator struct {
+	patterns []*regexp.Regexp
+}
+
+//One entry per line.  Lines like /regex/ are regular expressions, anything else is a word that is matched
+//case insensitively and only as a whole word.  Blank lines and lines starting with # are skipped
+func load_wordlist_moderator(file_name string) (*WordlistModerator, error) {
+	f, err := os.Open(file_name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	moderator := &WordlistModerator{}
+	scanner := bufio.NewScanner(f)
+	for line_number := 1; scanner.Scan(); line_number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var pattern string
+		if len(line) > 2 && strings.HasPrefix(line, "/") && strings.HasSuffix(line, "/") {
+			pattern = line[1 : len(line)-1]
+		} else {
+			pattern = `(?i)\b` + regexp.QuoteMeta(line) + `\b`
+		}
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%v:%v: %v", file_name, line_number, err)
+		}
+		moderator.patterns = append(moderator.patterns, compiled)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return moderator, nil
+}
+
+func (moderator *WordlistModerator) BeforeRun(request *ModerationRequest) ModerationVerdict {
+	for _, pattern := range moderator.patterns {
+		if pattern.MatchString(request.Source) {
+			return ModerationVerdict{Action: MODERATION_REJECT, Reason: fmt.Sprintf("source matches %q", pattern.String())}
+		}
+	}
+	return ModerationVerdict{Action: MODERATION_ALLOW}
+}
+
+func (moderator *WordlistModerator) BeforePost(request *ModerationRequest) ModerationVerdict {
+	return ModerationVerdict{Action: MODERATION_ALLOW}
+}
+
+//Holds the results of DMed carts that would be tweeted until an operator approves them.
+//Tweets are not held since the cart is already public
+type ApprovalModerator struct{}
+
+func (ApprovalModerator) BeforeRun(request *ModerationRequest) ModerationVerdict {
+	return ModerationVerdict{Action: MODERATION_ALLOW}
+}
+
+func (ApprovalModerator) BeforePost(request *ModerationRequest) ModerationVerdict {
+	if request.JobType == JOB_TYPE_DM && request.Public {
+		return ModerationVerdict{Action: MODERATION_HOLD, Reason: "DMed carts need approval before they are tweeted"}
+	}
+	return ModerationVerdict{Action: MODERATION_ALLOW}
+}
+
+//Everything needed to post a held result once it is approved
+type HeldPost struct {
+	Reason string
+	HeldAt time.Time
+	//for tweets, the tweet to reply to
+	ReplyToTweetID int64 `json:",omitempty"`
+	//the text that goes with the media, describing how the cart was recorded
+	ParamsDescription string
+	MediaType         string
+	MediaFile         string
+}
+
+//What handle_tweet and handle_dm use to moderate carts.  A nil Moderation allows everything
+type Moderation struct {
+	moderator Moderator
+	//media of held posts is kept here until they are approved or rejected
+	held_media_dir string
+}
+
+//Sets up the moderators that are turned on in the config
+func load_moderation(config *Config) (*Moderation, error) {
+	chain := ModerationChain{}
+	if len(config.ModerationWordlistFile) > 0 {
+		wordlist, err := load_wordlist_moderator(config.ModerationWordlistFile)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, wordlist)
+	}
+	if config.HoldDMTweetsForApproval {
+		chain = append(chain, ApprovalModerator{})
+	}
+	return &Moderation{moderator: chain, held_media_dir: config.HeldMediaDir}, nil
+}
+
+func (moderation *Moderation) before_run(request *ModerationRequest, logger *Logger) ModerationVerdict {
+	if moderation == nil || moderation.moderator == nil {
+		return ModerationVerdict{Action: MODERATION_ALLOW}
+	}
+	verdict := moderation.moderator.BeforeRun(request)
+	if verdict.Action == MODERATION_HOLD {
+		verdict.Action = MODERATION_REJECT
+	}
+	moderation.record("before_run", verdict, logger)
+	return verdict
+}
+
+func (moderation *Moderation) before_post(request *ModerationRequest, logger *Logger) ModerationVerdict {
+	if moderation == nil || moderation.moderator == nil {
+		return ModerationVerdict{Action: MODERATION_ALLOW}
+	}
+	verdict := moderation.moderator.BeforePost(request)
+	moderation.record("before_post", verdict, logger)
+	return verdict
+}
+
+func (moderation *Moderation) record(stage string, verdict ModerationVerdict, logger *Logger) {
+	bot_metrics.moderation_verdicts.inc(stage, string(verdict.Action))
+	if verdict.Action != MODERATION_ALLOW {
+		logger.Info("Moderation did not allow cart", "moderation_stage", stage, "action", verdict.Action, "reason", verdict.Reason)
+	}
+}
+
+//Saves the media so the post can be made once it is approved, and marks the result as held
+func (moderation *Moderation) hold(post *HeldPost, media_data []byte, result *JobResult) error {
+	if err := os.MkdirAll(moderation.held_media_dir, 0700); err != nil {
+		return err
+	}
+	extension := MEDIA_FORMAT_GIF
+	if post.MediaType == MEDIA_TYPE_MP4 {
+		extension = MEDIA_FORMAT_MP4
+	}
+	f, err := ioutil.TempFile(moderation.held_media_dir, "held-*."+extension)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(media_data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	post.MediaFile = f.Name()
+	post.HeldAt = time.Now().UTC()
+	result.Status = JOB_STATUS_HELD
+	result.Error = post.Reason
+	result.Held = post
+	return nil
+}
+
+//Records that moderation rejected the cart
+func (result *JobResult) set_rejected(verdict ModerationVerdict) {
+	result.Status = JOB_STATUS_REJECTED
+	result.Error = verdict.Reason
+	result.ErrorKind = ""
+}
@@ -0,0 +1,218 @@
+//Copyright (C) 2020 Daniel Bokser.  See LICENSE file for license
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"twitter"
+)
+
+//Twitter sends these on every response from a rate limited endpoint.
+//See https://developer.twitter.com/en/docs/basics/rate-limiting
+const (
+	RATE_LIMIT_LIMIT_HEADER     = "x-rate-limit-limit"
+	RATE_LIMIT_REMAINING_HEADER = "x-rate-limit-remaining"
+	RATE_LIMIT_RESET_HEADER     = "x-rate-limit-reset"
+)
+
+const DEFAULT_TWITTER_RATE_LIMIT_RESERVE = 1
+
+//Calls are let through a little after the reset time in case our clock is ahead of twitter's
+const RATE_LIMIT_RESET_MARGIN = time.Second
+
+//What is left of one endpoint's rate limit window
+type RateLimitBucket struct {
+	Endpoint  string    `json:"endpoint"`
+	Limit     int       `json:"limit"`
+	Remaining int       `json:"remaining"`
+	Reset     time.Time `json:"reset"`
+}
+
+//Keeps track of the rate limits of every twitter endpoint the bot has called,
+//and holds calls back when an endpoint is about to run out
+type RateLimitTracker struct {
+	mutex   sync.Mutex
+	buckets map[string]*RateLimitBucket
+	//calls wait for the window to reset once remaining gets down to this
+	reserve int
+	clock   Clock
+	metrics *BotMetrics
+}
+
+func new_rate_limit_tracker(reserve int, clock Clock, metrics *BotMetrics) *RateLimitTracker {
+	return &RateLimitTracker{buckets: make(map[string]*RateLimitBucket), reserve: reserve, clock: clock, metrics: metrics}
+}
+
+var API_VERSION_PREFIX_REGEX = regexp.MustCompile(`^/\d+(\.\d+)?/`)
+
+//The names the RateLimits API uses for endpoints whose path does not give it away
+var RATE_LIMIT_RESOURCE_ALIASES = map[string]string{
+	"/statuses/show": "/statuses/show/:id",
+}
+
+//Returns the endpoint as the RateLimits API names it, e.g. "/statuses/mentions_timeline"
+func rate_limit_resource(req *http.Request) string {
+	path := strings.TrimSuffix(replace_path_ids(API_VERSION_PREFIX_REGEX.ReplaceAllString(req.URL.Path, "/")), ".json")
+	if alias, ok := RATE_LIMIT_RESOURCE_ALIASES[path]; ok {
+		return alias
+	}
+	return path
+}
+
+//Returns false if the response did not come from a rate limited endpoint
+func parse_rate_limit_headers(header http.Header) (limit, remaining int, reset time.Time, ok bool) {
+	remaining, err := strconv.Atoi(header.Get(RATE_LIMIT_REMAINING_HEADER))
+	if err != nil {
+		return 0, 0, time.Time{}, false
+	}
+	reset_unix, err := strconv.ParseInt(header.Get(RATE_LIMIT_RESET_HEADER), 10, 64)
+	if err != nil {
+		return 0, 0, time.Time{}, false
+	}
+	limit, err = strconv.Atoi(header.Get(RATE_LIMIT_LIMIT_HEADER))
+	if err != nil {
+		limit = remaining
+	}
+	return limit, remaining, time.Unix(reset_unix, 0), true
+}
+
+//Call with the mutex held
+func (tracker *RateLimitTracker) bucket(endpoint string) *RateLimitBucket {
+	bucket, ok := tracker.buckets[endpoint]
+	if !ok {
+		bucket = &RateLimitBucket{Endpoint: endpoint}
+		tracker.buckets[endpoint] = bucket
+		if tracker.metrics != nil {
+			tracker.metrics.twitter_rate_limit_remaining.set_func(endpoint, func() float64 {
+				tracker.mutex.Lock()
+				defer tracker.mutex.Unlock()
+				return float64(bucket.Remaining)
+			})
+			tracker.metrics.twitter_rate_limit_reset.set_func(endpoint, func() float64 {
+				tracker.mutex.Lock()
+				defer tracker.mutex.Unlock()
+				return float64(bucket.Reset.Unix())
+			})
+		}
+	}
+	return bucket
+}
+
+func (tracker *RateLimitTracker) update(endpoint string, limit, remaining int, reset time.Time) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	bucket := tracker.bucket(endpoint)
+	bucket.Limit, bucket.Remaining, bucket.Reset = limit, remaining, reset
+}
+
+//Returns how long a call to endpoint has to wait for its window to reset, and counts the call against the window if it does not.
+//Call it again after waiting
+func (tracker *RateLimitTracker) reserve_call(endpoint string) time.Duration {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	bucket, ok := tracker.buckets[endpoint]
+	if !ok {
+		return 0
+	}
+	now := tracker.clock.Now()
+	if !now.Before(bucket.Reset.Add(RATE_LIMIT_RESET_MARGIN)) {
+		//a new window has started, but we do not know when it ends until twitter tells us
+		bucket.Remaining = bucket.Limit
+		bucket.Reset = time.Time{}
+	} else if bucket.Remaining <= tracker.reserve {
+		return bucket.Reset.Add(RATE_LIMIT_RESET_MARGIN).Sub(now)
+	}
+	if bucket.Remaining > 0 {
+		bucket.Remaining--
+	}
+	return 0
+}
+
+//Blocks until endpoint can be called, or ctx is done
+func (tracker *RateLimitTracker) wait(ctx context.Context, endpoint string) error {
+	for {
+		wait := tracker.reserve_call(endpoint)
+		if wait <= 0 {
+			return nil
+		}
+		root_logger.Warn("Rate limit is almost used up.  Waiting for it to reset", "endpoint", endpoint, "wait", wait)
+		if tracker.metrics != nil {
+			tracker.metrics.twitter_rate_limit_delays.inc(endpoint)
+		}
+		select {
+		case <-tracker.clock.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+//Returns every endpoint the bot knows the rate limit of, sorted by endpoint
+func (tracker *RateLimitTracker) buckets_snapshot() []RateLimitBucket {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	snapshot := make([]RateLimitBucket, 0, len(tracker.buckets))
+	for _, bucket := range tracker.buckets {
+		snapshot = append(snapshot, *bucket)
+	}
+	sort.Slice(snapshot, func(i, j int) bool { return snapshot[i].Endpoint < snapshot[j].Endpoint })
+	return snapshot
+}
+
+//Loads the rate limits of every endpoint from the RateLimits API, so the bot knows how much
+//is left before it has called anything.  Only endpoints that have been used in this window are kept
+func (tracker *RateLimitTracker) seed(ctx context.Context, tc *twitter.Client, logger *Logger) error {
+	rate_limit, err := call_twitter_api(ctx, "", logger, func() (*twitter.RateLimit, *http.Response, error) {
+		return tc.RateLimits.Status(nil)
+	})
+	if err != nil {
+		return err
+	}
+	if rate_limit.Resources == nil {
+		return nil
+	}
+	resources := rate_limit.Resources
+	seeded := 0
+	for _, family := range []map[string]*twitter.RateLimitResource{
+		resources.Application, resources.Favorites, resources.Followers, resources.Friends, resources.Friendships,
+		resources.Geo, resources.Help, resources.Lists, resources.Search, resources.Statuses, resources.Trends, resources.Users,
+	} {
+		for endpoint, resource := range family {
+			if resource == nil || resource.Remaining == resource.Limit {
+				continue
+			}
+			tracker.update(endpoint, resource.Limit, resource.Remaining, time.Unix(int64(resource.Reset), 0))
+			seeded++
+		}
+	}
+	logger.Info("Loaded rate limits", "endpoints_in_use", seeded)
+	return nil
+}
+
+//Holds calls back when their endpoint is almost out of calls, and updates the tracker from every response
+type rate_limit_transport struct {
+	base    http.RoundTripper
+	tracker *RateLimitTracker
+}
+
+func (transport *rate_limit_transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoint := rate_limit_resource(req)
+	if err := transport.tracker.wait(req.Context(), endpoint); err != nil {
+		return nil, err
+	}
+	resp, err := transport.base.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	if limit, remaining, reset, ok := parse_rate_limit_headers(resp.Header); ok {
+		transport.tracker.update(endpoint, limit, remaining, reset)
+	}
+	return resp, err
+}
@@ -0,0 +1,312 @@
+//Copyright (C) 2020 Daniel Bokser.  See LICENSE file for license
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Bump this when a change to the runner would change what a cart makes, so old results are not used
+const RESULT_CACHE_VERSION = 1
+
+//What is kept next to the media of a cached result
+type CachedResult struct {
+	MediaType string
+	Params    RunParams
+	Output    string `json:",omitempty"`
+	CachedAt  time.Time
+}
+
+//What carts made, kept on disk so popular carts are not run again every time they are mentioned.
+//Every result is a <key>.json and <key>.media file, and the least recently used are removed once they take up more than max_size
+type ResultCache struct {
+	mutex    sync.Mutex
+	dir      string
+	max_size int64
+	size     int64
+	//of *result_cache_entry, most recently used first
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type result_cache_entry struct {
+	key  string
+	size int64
+}
+
+//Picks up the results already in dir.  How recently they were used is taken from their modification times
+func open_result_cache(dir string, max_size int64) (*ResultCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	cache := &ResultCache{dir: dir, max_size: max_size, lru: list.New(), entries: make(map[string]*list.Element)}
+	//left behind by write_file_atomically if we crashed
+	tmp_paths, err := filepath.Glob(filepath.Join(dir, "*.tmp*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range tmp_paths {
+		os.Remove(path)
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	type found_entry struct {
+		result_cache_entry
+		used_at time.Time
+	}
+	found := []found_entry{}
+	for _, path := range paths {
+		key := strings.TrimSuffix(filepath.Base(path), ".json")
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		media_info, err := os.Stat(cache.media_path(key))
+		if err != nil {
+			//half written, e.g. if we crashed
+			os.Remove(path)
+			continue
+		}
+		found = append(found, found_entry{result_cache_entry{key, info.Size() + media_info.Size()}, media_info.ModTime()})
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].used_at.Before(found[j].used_at) })
+	for _, entry := range found {
+		cache.add(entry.key, entry.size)
+	}
+	cache.evict()
+	return cache, nil
+}
+
+func (cache *ResultCache) media_path(key string) string {
+	return filepath.Join(cache.dir, key+".media")
+}
+
+func (cache *ResultCache) meta_path(key string) string {
+	return filepath.Join(cache.dir, key+".json")
+}
+
+//Identifies what a cart would make with params
+func result_cache_key(cart_source string, params RunParams) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%v\x00%v\x00%v\x00%v\x00%v\x00%v\x00%v", RESULT_CACHE_VERSION, params.RecordingLength, params.StaticRecordingLength,
+		params.FrameRate, params.StartFrame, params.Format, cart_source)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+var RNG_FUNCTION_REGEX = regexp.MustCompile(`\brnd\b`)
+var SRAND_FUNCTION_REGEX = regexp.MustCompile(`\bsrand\b`)
+var STAT_FUNCTION_REGEX = regexp.MustCompile(`\bstat\b`)
+
+//Whether a cart makes the same recording every time it is run.  rnd is seeded differently on every run unless
+//the cart calls srand, and stat can read the clock.  t() counts frames, so it is the same every run.
+//Carts that only mention these, e.g. in a comment, are taken to be random too
+func is_deterministic_cart(cart_source string) bool {
+	if STAT_FUNCTION_REGEX.MatchString(cart_source) {
+		return false
+	}
+	return !RNG_FUNCTION_REGEX.MatchString(cart_source) || SRAND_FUNCTION_REGEX.MatchString(cart_source)
+}
+
+//Call with the mutex held
+func (cache *ResultCache) add(key string, size int64) {
+	if element, ok := cache.entries[key]; ok {
+		cache.remove(element)
+	}
+	cache.entries[key] = cache.lru.PushFront(&result_cache_entry{key, size})
+	cache.size += size
+	bot_metrics.result_cache_size.add(size)
+}
+
+//Call with the mutex held
+func (cache *ResultCache) remove(element *list.Element) {
+	entry := cache.lru.Remove(element).(*result_cache_entry)
+	delete(cache.entries, entry.key)
+	cache.size -= entry.size
+	bot_metrics.result_cache_size.add(-entry.size)
+	os.Remove(cache.meta_path(entry.key))
+	os.Remove(cache.media_path(entry.key))
+}
+
+//Call with the mutex held
+func (cache *ResultCache) evict() {
+	for cache.size > cache.max_size && cache.lru.Len() > 0 {
+		cache.remove(cache.lru.Back())
+	}
+}
+
+//Returns nil if key is not cached
+func (cache *ResultCache) get(key string) (*RunResult, error) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	element, ok := cache.entries[key]
+	if !ok {
+		return nil, nil
+	}
+	contents, err := ioutil.ReadFile(cache.meta_path(key))
+	if err != nil {
+		cache.remove(element)
+		return nil, err
+	}
+	cached := CachedResult{}
+	if err := json.Unmarshal(contents, &cached); err != nil {
+		cache.remove(element)
+		return nil, err
+	}
+	media_data, err := ioutil.ReadFile(cache.media_path(key))
+	if err != nil {
+		cache.remove(element)
+		return nil, err
+	}
+	cache.lru.MoveToFront(element)
+	now := time.Now()
+	os.Chtimes(cache.media_path(key), now, now)
+	return &RunResult{MediaData: media_data, MediaType: cached.MediaType, Output: cached.Output, Params: cached.Params, Cached: true}, nil
+}
+
+//Results bigger than the whole cache are not kept
+func (cache *ResultCache) put(key string, result *RunResult) error {
+	meta, err := json.Marshal(&CachedResult{MediaType: result.MediaType, Params: result.Params, Output: result.Output, CachedAt: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	size := int64(len(meta) + len(result.MediaData))
+	if size > cache.max_size {
+		return nil
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	//the media goes first, since entries without it are thrown away on start up
+	if err := write_file_atomically(cache.media_path(key), result.MediaData); err != nil {
+		return err
+	}
+	if err := write_file_atomically(cache.meta_path(key), meta); err != nil {
+		os.Remove(cache.media_path(key))
+		return err
+	}
+	cache.add(key, size)
+	cache.evict()
+	return nil
+}
+
+//Replaces the file all at once, so readers never see half of it
+func write_file_atomically(path string, contents []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(contents); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+//Answers carts that were run before from the cache, and caches what deterministic carts make
+type CachingRunner struct {
+	runner CartRunner
+	cache  *ResultCache
+}
+
+func (runner *CachingRunner) Run(ctx context.Context, cart_source, job_id string, params RunParams, logger *Logger) (*RunResult, error) {
+	if !is_deterministic_cart(cart_source) {
+		record_result_cache_lookup("skipped", logger)
+		return runner.runner.Run(ctx, cart_source, job_id, params, logger)
+	}
+	key := result_cache_key(cart_source, params)
+	result, err := runner.cache.get(key)
+	if err != nil {
+		logger.Warn("Could not read cached result", "key", key, "err", err)
+	}
+	if result != nil {
+		record_result_cache_lookup("hit", logger)
+		return result, nil
+	}
+	record_result_cache_lookup("miss", logger)
+	result, err = runner.runner.Run(ctx, cart_source, job_id, params, logger)
+	if err == nil {
+		if err := runner.cache.put(key, result); err != nil {
+			logger.Warn("Could not cache result", "key", key, "err", err)
+		}
+	}
+	return result, err
+}
+
+//result is hit, miss or skipped for carts that can not be cached
+func record_result_cache_lookup(result string, logger *Logger) {
+	bot_metrics.result_cache_lookups.inc(result)
+	hits, misses := bot_metrics.result_cache_lookups.value("hit"), bot_metrics.result_cache_lookups.value("miss")
+	logger.Info("Looked up result cache", "result", result, "hit_rate", fmt.Sprintf("%.2f", hits/(hits+misses+1e-9)))
+}
+
+//Media uploaded for tweets, so cached results can be tweeted again without uploading them again
+type UploadedMedia struct {
+	mutex sync.Mutex
+	//keyed by uploaded_media_key
+	ids map[string]uploaded_media_id
+}
+
+type uploaded_media_id struct {
+	id         int64
+	expires_at time.Time
+}
+
+//Only set if the result cache is on
+var uploaded_media *UploadedMedia
+
+func new_uploaded_media() *UploadedMedia {
+	return &UploadedMedia{ids: make(map[string]uploaded_media_id)}
+}
+
+func uploaded_media_key(media_data []byte, category string) string {
+	hash := sha256.Sum256(media_data)
+	return category + ":" + hex.EncodeToString(hash[:])
+}
+
+//Returns 0 if the media was not uploaded, or can not be used any more.  Only media in tweets can be used again
+func (uploaded *UploadedMedia) lookup(media_data []byte, category string) int64 {
+	if uploaded == nil || !strings.HasPrefix(category, "tweet_") {
+		return 0
+	}
+	uploaded.mutex.Lock()
+	defer uploaded.mutex.Unlock()
+	media_id, ok := uploaded.ids[uploaded_media_key(media_data, category)]
+	if !ok || time.Now().After(media_id.expires_at) {
+		return 0
+	}
+	return media_id.id
+}
+
+func (uploaded *UploadedMedia) remember(media_data []byte, category string, id int64, expires_after time.Duration) {
+	//leave time to post it before twitter forgets it
+	const safety_margin = 10 * time.Minute
+	if uploaded == nil || !strings.HasPrefix(category, "tweet_") || expires_after <= safety_margin {
+		return
+	}
+	uploaded.mutex.Lock()
+	defer uploaded.mutex.Unlock()
+	now := time.Now()
+	for key, media_id := range uploaded.ids {
+		if now.After(media_id.expires_at) {
+			delete(uploaded.ids, key)
+		}
+	}
+	uploaded.ids[uploaded_media_key(media_data, category)] = uploaded_media_id{id, now.Add(expires_after - safety_margin)}
+}
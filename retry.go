@@ -0,0 +1,280 @@
+//Copyright (C) 2020 Daniel Bokser.  See LICENSE file for license
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+
+	"twitter"
+)
+
+//Lets tests control time instead of actually sleeping
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type real_clock struct{}
+
+func (real_clock) Now() time.Time {
+	return time.Now()
+}
+
+func (real_clock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+//How long to wait between attempts and when to give up
+type RetryPolicy struct {
+	initial_backoff time.Duration
+	max_backoff     time.Duration
+	multiplier      float64
+	//between 0 and 1.  Each wait is randomly shortened by up to this fraction of it so callers do not retry in lock step
+	jitter float64
+	//0 means no limit
+	max_attempts int
+	//give up instead of waiting past this much time after the first attempt.  0 means no limit
+	max_elapsed time.Duration
+	clock       Clock
+	//returns a number in [0, 1)
+	random func() float64
+}
+
+//What to do about an error
+type retry_verdict struct {
+	retriable bool
+	//why it is retried, used as a metric label
+	reason string
+	//the wait before the next attempt is at least this long, e.g. for rate limits
+	wait_at_least time.Duration
+}
+
+//Returned when the policy gives up on an error that could have been retried
+type RetryExhaustedError struct {
+	Attempts int
+	Elapsed  time.Duration
+	Err      error
+}
+
+func (err *RetryExhaustedError) Error() string {
+	return fmt.Sprintf("gave up after %v attempts in %v: %v", err.Attempts, err.Elapsed.Round(time.Millisecond), err.Err)
+}
+
+func (err *RetryExhaustedError) Unwrap() error {
+	return err.Err
+}
+
+//Returns the wait before attempt number attempt+1, not counting wait_at_least
+func (policy *RetryPolicy) backoff(attempt int) time.Duration {
+	wait := float64(policy.initial_backoff)
+	for i := 1; i < attempt && wait < float64(policy.max_backoff); i++ {
+		wait *= policy.multiplier
+	}
+	if wait > float64(policy.max_backoff) {
+		wait = float64(policy.max_backoff)
+	}
+	wait -= wait * policy.jitter * policy.random()
+	return time.Duration(wait)
+}
+
+//Calls op until it works, it fails with an error that classify says can not be retried, the policy gives up or ctx is done.
+//on_retry, if not nil, is called before every wait
+func retry[T any](ctx context.Context, policy *RetryPolicy, op func() (T, error),
+	classify func(err error) retry_verdict, on_retry func(attempt int, wait time.Duration, verdict retry_verdict, err error)) (T, error) {
+	var zero T
+	start := policy.clock.Now()
+	for attempt := 1; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return zero, err
+		}
+		ret, err := op()
+		if err == nil {
+			return ret, nil
+		}
+		verdict := classify(err)
+		if !verdict.retriable {
+			return zero, err
+		}
+		elapsed := policy.clock.Now().Sub(start)
+		if policy.max_attempts > 0 && attempt >= policy.max_attempts {
+			return zero, &RetryExhaustedError{Attempts: attempt, Elapsed: elapsed, Err: err}
+		}
+		wait := policy.backoff(attempt)
+		if wait < verdict.wait_at_least {
+			wait = verdict.wait_at_least
+		}
+		if policy.max_elapsed > 0 && elapsed+wait > policy.max_elapsed {
+			return zero, &RetryExhaustedError{Attempts: attempt, Elapsed: elapsed, Err: err}
+		}
+		//context deadlines are always in real time
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return zero, &RetryExhaustedError{Attempts: attempt, Elapsed: elapsed, Err: err}
+		}
+		if on_retry != nil {
+			on_retry(attempt, wait, verdict, err)
+		}
+		select {
+		case <-policy.clock.After(wait):
+		case <-ctx.Done():
+			return zero, fmt.Errorf("%w while retrying: %v", ctx.Err(), err)
+		}
+	}
+}
+
+const (
+	DEFAULT_TWITTER_API_MAX_ATTEMPTS  = 8
+	DEFAULT_TWITTER_API_RETRY_TIMEOUT = 10 * time.Minute
+	//rate limits last for minutes, so there is no point retrying those sooner, even if twitter did not say when the limit resets
+	TWITTER_RATE_LIMIT_BACKOFF = 20 * time.Second
+)
+
+func new_twitter_retry_policy(max_attempts int, max_elapsed time.Duration) *RetryPolicy {
+	return &RetryPolicy{
+		initial_backoff: time.Second,
+		max_backoff:     2 * time.Minute,
+		multiplier:      2,
+		jitter:          0.5,
+		max_attempts:    max_attempts,
+		max_elapsed:     max_elapsed,
+		clock:           real_clock{},
+		random:          rand.Float64,
+	}
+}
+
+//Replaced in main with the configured limits
+var twitter_retry_policy = new_twitter_retry_policy(DEFAULT_TWITTER_API_MAX_ATTEMPTS, DEFAULT_TWITTER_API_RETRY_TIMEOUT)
+
+//Twitter responded with a 5xx.  Err is whatever the twitter client made of the body, which may be nil
+type TwitterServerError struct {
+	StatusCode int
+	Err        error
+}
+
+func (err *TwitterServerError) Error() string {
+	if err.Err == nil {
+		return fmt.Sprintf("twitter responded with %v", err.StatusCode)
+	}
+	return fmt.Sprintf("twitter responded with %v: %v", err.StatusCode, err.Err)
+}
+
+func (err *TwitterServerError) Unwrap() error {
+	return err.Err
+}
+
+func is_rate_limit_error(err error) bool {
+	var api_err twitter.APIError
+	if !errors.As(err, &api_err) || len(api_err.Errors) != 1 {
+		//if there is more than one error, we shouldn't retry.  Just bail out
+		return false
+	}
+	code := api_err.Errors[0].Code
+	return code == 420 || code == 429 || code == 88
+}
+
+//Twitter said the endpoint is out of calls until Reset
+type RateLimitedError struct {
+	Reset time.Time
+	Err   error
+}
+
+func (err *RateLimitedError) Error() string {
+	return fmt.Sprintf("%v (rate limit resets at %v)", err.Err, err.Reset.Format(time.RFC3339))
+}
+
+func (err *RateLimitedError) Unwrap() error {
+	return err.Err
+}
+
+func twitter_retry_verdict(err error) retry_verdict {
+	var (
+		rate_limited_err *RateLimitedError
+		server_err       *TwitterServerError
+		net_err          net.Error
+		url_err          *url.Error
+	)
+	switch {
+	case errors.As(err, &rate_limited_err) && is_rate_limit_error(err):
+		var api_err twitter.APIError
+		errors.As(err, &api_err)
+		return retry_verdict{retriable: true, reason: strconv.Itoa(api_err.Errors[0].Code),
+			wait_at_least: time.Until(rate_limited_err.Reset) + RATE_LIMIT_RESET_MARGIN}
+	case is_rate_limit_error(err):
+		var api_err twitter.APIError
+		errors.As(err, &api_err)
+		return retry_verdict{retriable: true, reason: strconv.Itoa(api_err.Errors[0].Code), wait_at_least: TWITTER_RATE_LIMIT_BACKOFF}
+	case errors.As(err, &server_err):
+		return retry_verdict{retriable: true, reason: strconv.Itoa(server_err.StatusCode)}
+	case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+		return retry_verdict{}
+	case errors.As(err, &net_err) && net_err.Timeout():
+		return retry_verdict{retriable: true, reason: "timeout"}
+	case errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, io.ErrUnexpectedEOF):
+		return retry_verdict{retriable: true, reason: "connection"}
+	case errors.As(err, &url_err) && errors.Is(url_err.Err, io.EOF):
+		//the connection was closed before there was a response
+		return retry_verdict{retriable: true, reason: "connection"}
+	}
+	return retry_verdict{}
+}
+
+//Like twitter_retry_verdict, but for calls that post something.  These are only retried if twitter can not have acted on them:
+//it rate limited them, or there was never a connection to send them over.  A timeout, reset connection or 5xx could come
+//after the tweet or DM was posted, so trying again could post it twice
+func twitter_write_retry_verdict(err error) retry_verdict {
+	var op_err *net.OpError
+	switch {
+	case is_rate_limit_error(err):
+		return twitter_retry_verdict(err)
+	case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+		return retry_verdict{}
+	case errors.As(err, &op_err) && op_err.Op == "dial":
+		return retry_verdict{retriable: true, reason: "connection"}
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return retry_verdict{retriable: true, reason: "connection"}
+	}
+	return retry_verdict{}
+}
+
+//Calls the twitter API with twitter_retry_policy.  error_msg is logged if the call fails for good, unless it is empty.
+//Only for calls that can be made twice without doing anything twice, see call_twitter_write_api for the rest
+func call_twitter_api[T any](ctx context.Context, error_msg string, logger *Logger, api func() (T, *http.Response, error)) (T, error) {
+	return call_twitter_api_with(ctx, error_msg, logger, twitter_retry_verdict, api)
+}
+
+//Like call_twitter_api, but for calls that post tweets or DMs, which are only retried when they can not have been posted
+func call_twitter_write_api[T any](ctx context.Context, error_msg string, logger *Logger, api func() (T, *http.Response, error)) (T, error) {
+	return call_twitter_api_with(ctx, error_msg, logger, twitter_write_retry_verdict, api)
+}
+
+func call_twitter_api_with[T any](ctx context.Context, error_msg string, logger *Logger, classify func(err error) retry_verdict,
+	api func() (T, *http.Response, error)) (T, error) {
+	op := func() (T, error) {
+		ret, resp, err := api()
+		if resp != nil && resp.StatusCode >= 500 {
+			err = &TwitterServerError{StatusCode: resp.StatusCode, Err: err}
+		} else if resp != nil && is_rate_limit_error(err) {
+			if _, _, reset, ok := parse_rate_limit_headers(resp.Header); ok {
+				err = &RateLimitedError{Reset: reset, Err: err}
+			}
+		}
+		return ret, err
+	}
+	on_retry := func(attempt int, wait time.Duration, verdict retry_verdict, err error) {
+		bot_metrics.twitter_api_retries.inc(verdict.reason)
+		logger.Warn("Retrying twitter API call", "err", err, "reason", verdict.reason, "attempt", attempt, "retry_in", wait)
+	}
+	ret, err := retry(ctx, twitter_retry_policy, op, classify, on_retry)
+	if err != nil && len(error_msg) > 0 {
+		logger.Error(error_msg, "err", err)
+	}
+	return ret, err
+}
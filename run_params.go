@@ -0,0 +1,133 @@
+//Copyright (C) 2020 Daniel Bokser.  See LICENSE file for license
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//How a cart gets recorded
+type RunParams struct {
+	RecordingLength time.Duration
+	//how long carts without a _draw() function are recorded for after they finish
+	StaticRecordingLength time.Duration
+	FrameRate             int
+	//recording starts on this call to flip()
+	StartFrame int
+	//MEDIA_FORMAT_GIF or MEDIA_FORMAT_MP4
+	Format string
+}
+
+//Server-side bounds on what users can ask for with directives
+type RunLimits struct {
+	Default RunParams
+	Min     RunParams
+	Max     RunParams
+}
+
+//PICO-8 records GIFs at 30 frames per second, so asking for more does nothing
+const PICO_8_GIF_FRAME_RATE = 30
+
+//Directives are in the comment lines at the top of a cart, e.g. "--len=4 fps=15" or "--notweet"
+var CART_DIRECTIVE_REGEX = regexp.MustCompile(`(?i)^(?:(len|fps|start|format)=(\S+)|(notweet))$`)
+
+//Reads the directives at the top of the cart.  Directives without a value, such as notweet,
+//map to "".  Only the comment lines before the first line of code count, and only lines with nothing
+//but directives, so words in an ordinary comment such as "-- my notweet demo" are not taken for directives
+func parse_cart_directives(cart_source string) map[string]string {
+	directives := make(map[string]string)
+	for _, line := range strings.Split(cart_source, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		if !strings.HasPrefix(line, "--") {
+			break
+		}
+		line_directives := make(map[string]string)
+		tokens := strings.Fields(line[2:])
+		for _, token := range tokens {
+			match := CART_DIRECTIVE_REGEX.FindStringSubmatch(token)
+			if match == nil {
+				line_directives = nil
+				break
+			}
+			if len(match[1]) > 0 {
+				line_directives[strings.ToLower(match[1])] = match[2]
+			} else {
+				line_directives[strings.ToLower(match[3])] = ""
+			}
+		}
+		for name, value := range line_directives {
+			directives[name] = value
+		}
+	}
+	return directives
+}
+
+//Returns the params the cart asked for with its directives, clamped to the limits.
+//Directives with invalid values are ignored
+func resolve_run_params(cart_source string, limits *RunLimits) RunParams {
+	params := limits.Default
+	directives := parse_cart_directives(cart_source)
+	if value, ok := directives["len"]; ok {
+		if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+			params.RecordingLength = time.Duration(seconds * float64(time.Second))
+		}
+	}
+	if value, ok := directives["fps"]; ok {
+		if fps, err := strconv.Atoi(value); err == nil {
+			params.FrameRate = fps
+		}
+	}
+	if value, ok := directives["start"]; ok {
+		if start, err := strconv.Atoi(value); err == nil {
+			params.StartFrame = start
+		}
+	}
+	if value, ok := directives["format"]; ok && is_valid_media_format(strings.ToLower(value)) {
+		params.Format = strings.ToLower(value)
+	}
+
+	params.RecordingLength = clamp_duration(params.RecordingLength, limits.Min.RecordingLength, limits.Max.RecordingLength)
+	params.StaticRecordingLength = clamp_duration(params.StaticRecordingLength, limits.Min.StaticRecordingLength, limits.Max.StaticRecordingLength)
+	params.FrameRate = clamp_int(params.FrameRate, limits.Min.FrameRate, limits.Max.FrameRate)
+	params.StartFrame = clamp_int(params.StartFrame, limits.Min.StartFrame, limits.Max.StartFrame)
+	return params
+}
+
+func clamp_duration(value, min, max time.Duration) time.Duration {
+	if value < min {
+		return min
+	}
+	if value > max {
+		return max
+	}
+	return value
+}
+
+func clamp_int(value, min, max int) int {
+	if value < min {
+		return min
+	}
+	if value > max {
+		return max
+	}
+	return value
+}
+
+//e.g. "Recorded 4s at 15fps" or "Recorded 4s at 15fps from frame 60 as MP4".
+//params are what the cart was recorded with, and the start frame is only mentioned if it is not the default
+func describe_run_params(params RunParams, limits *RunLimits) string {
+	description := fmt.Sprintf("Recorded %vs at %vfps", strconv.FormatFloat(params.RecordingLength.Seconds(), 'f', -1, 64), params.FrameRate)
+	if params.StartFrame != limits.Default.StartFrame {
+		description += fmt.Sprintf(" from frame %v", params.StartFrame)
+	}
+	if params.Format == MEDIA_FORMAT_MP4 {
+		description += " as MP4"
+	}
+	return description
+}
@@ -0,0 +1,372 @@
+//Copyright (C) 2020 Daniel Bokser.  See LICENSE file for license
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+//A CartRunner runs the source code of a cart and records it.
+//handle_tweet and handle_dm only talk to PICO-8 through this interface
+type CartRunner interface {
+	Run(ctx context.Context, cart_source, job_id string, params RunParams, logger *Logger) (*RunResult, error)
+}
+
+type RunResult struct {
+	//the recorded media, e.g. the bytes of a GIF
+	MediaData []byte
+	MediaType string
+	//everything the cart printed to stdout while running
+	Output   string
+	Duration time.Duration
+	//the params the cart was actually recorded with
+	Params RunParams
+	//set if the result came from the result cache instead of running the cart
+	Cached bool
+}
+
+var PICO_8_EXEC_PATH = func() string {
+	switch runtime.GOOS {
+	case "darwin":
+		return "./PICO-8.app/Contents/MacOS/pico8"
+	case "linux":
+		switch runtime.GOARCH {
+		case "amd64":
+			return "./pico-8-linux/pico8"
+		case "arm":
+			return "./pico-8-rpi/pico8"
+		default:
+			panic("unsupported arch: " + runtime.GOARCH)
+		}
+	default:
+		panic("unsupported os: " + runtime.GOOS)
+	}
+}()
+
+//Runs carts on a real PICO-8 install
+type Pico8Runner struct {
+	exec_path string
+	//every run gets its own directory under here for the cart, GIF and PICO-8 config files
+	scratch_root string
+	timeout      time.Duration
+	//used to encode MP4s.  Can be empty if only GIFs are wanted
+	ffmpeg_path string
+	//limits on the PICO-8 process.  nil means none
+	sandbox *Sandbox
+	//displays for PICO-8 to draw to.  nil means it uses the bot's DISPLAY
+	framebuffers *Framebuffers
+	//added to the bot's environment for PICO-8, e.g. SDL_AUDIODRIVER=dummy
+	env []string
+}
+
+const SCRATCH_DIR_PREFIX = "job_"
+
+func default_scratch_root() string {
+	return filepath.Join(os.TempDir(), "tweetcartrunner")
+}
+
+//Removes scratch directories left behind by runs that never finished, e.g. if we crashed
+func clean_scratch_dirs(scratch_root string) {
+	entries, err := ioutil.ReadDir(scratch_root)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			root_logger.Warn("Could not read scratch directory", "dir", scratch_root, "err", err)
+		}
+		return
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), SCRATCH_DIR_PREFIX) {
+			continue
+		}
+		dir := filepath.Join(scratch_root, entry.Name())
+		if err := os.RemoveAll(dir); err != nil {
+			root_logger.Warn("Could not delete stale scratch directory", "dir", dir, "err", err)
+		} else {
+			root_logger.Info("Deleted stale scratch directory", "dir", dir)
+		}
+	}
+}
+
+//The lua that runs before the user's cart.  It starts recording on the StartFrame'th flip()
+//and stops recording after the RecordingLength.
+//
+//Carts can read and replace any global, so the real flip, extcmd and printh are only kept in locals named after
+//a random per-run secret.  Functions that can touch the host, restart the cart or stop recording are removed,
+//and printh, cstore and reload are wrapped so they can not be given a file name.
+//Once the recording is saved, the cart runs the lua given as the fifth argument, e.g. to go back to a worker's supervisor
+const CART_PREAMBLE = `do
+local %[1]v_flip,%[1]v_t,%[1]v_extcmd,%[1]v_printh,%[1]v_cstore,%[1]v_reload,%[1]v_load=flip,t,extcmd,printh,cstore,reload,load
+load,save,ls,cd,folder,extcmd,reset,run,stop,import,export,serial=nil
+local %[1]v_start,%[1]v_did_start_rec,%[1]v_count=%[1]v_t(),false,0
+function printh(str) %[1]v_printh(str) end
+function cstore(dest,src,len) %[1]v_cstore(dest,src,len) end
+function reload(dest,src,len) %[1]v_reload(dest,src,len) end
+function flip()
+    if %[1]v_t()-%[1]v_start >= %[3]v then
+        %[1]v_extcmd('video')
+        %[1]v_printh('%[2]v')
+        %[5]v
+    end
+    %[1]v_count+=1
+    if %[1]v_count == %[4]v then
+        %[1]v_extcmd('rec')
+        %[1]v_did_start_rec = true
+    end
+    %[1]v_flip()
+end
+local function %[1]v_cart(...)
+`
+
+//The lua that runs after the user's cart.  Carts without a _draw() function
+//get recorded for the StaticRecordingLength after they are done.  The fourth argument is the same as the preamble's fifth
+const CART_POSTAMBLE = `
+end
+%[1]v_cart()
+if not _draw then
+ %[1]v_printh('%[1]v static')
+ local start = %[1]v_t()
+ if not %[1]v_did_start_rec then
+     while %[1]v_t() - start < .5 do
+     end
+     %[1]v_extcmd('rec')
+ end
+ while %[1]v_t() - start < %[3]v do
+ end
+ %[1]v_extcmd('video')
+ %[1]v_printh('%[2]v')
+ %[4]v
+end
+end`
+
+//Number of lines of lua before the user's cart.
+//PICO-8 line numbers need this subtracted to match the user's code
+var CART_PREAMBLE_LINE_COUNT = strings.Count(CART_PREAMBLE, "\n")
+
+//Returns a random lowercase identifier.  Carts can not read their own source, so they can not find it out
+func new_run_secret() (string, error) {
+	var secret [16]byte
+	if _, err := rand.Read(secret[:]); err != nil {
+		return "", err
+	}
+	return "_" + hex.EncodeToString(secret[:]), nil
+}
+
+//What the cart prints once the recording is saved
+func run_done_token(secret string) string {
+	return secret + " done"
+}
+
+//Carts without a _draw() function are recorded for the StaticRecordingLength instead of the RecordingLength,
+//which the postamble tells us by printing this
+func run_static_token(secret string) string {
+	return secret + " static"
+}
+
+//The params the cart was really recorded with, given what it printed
+func recorded_params(output, secret string, params RunParams) RunParams {
+	if strings.Contains(output, run_static_token(secret)) {
+		params.RecordingLength = params.StaticRecordingLength
+	}
+	return params
+}
+
+func build_cart_file(cart_source, secret string, params RunParams) string {
+	return build_cart_file_with_epilogue(cart_source, secret, params, "")
+}
+
+//epilogue is lua that runs once the recording is saved
+func build_cart_file_with_epilogue(cart_source, secret string, params RunParams, epilogue string) string {
+	done_token := run_done_token(secret)
+	return "pico-8 cartridge // http://www.pico-8.com\nversion 18\n__lua__\n" +
+		fmt.Sprintf(CART_PREAMBLE, secret, done_token, params.RecordingLength.Seconds(), params.StartFrame, epilogue) +
+		cart_source +
+		fmt.Sprintf(CART_POSTAMBLE, secret, done_token, params.StaticRecordingLength.Seconds(), epilogue)
+}
+
+func (runner *Pico8Runner) Run(ctx context.Context, sanitized_tweet, tweet_id_str string, params RunParams, logger *Logger) (*RunResult, error) {
+	var (
+		buf          [256]byte
+		done_chan    chan string = make(chan string, 1)
+		timeout_chan <-chan time.Time
+	)
+	start_time := time.Now()
+	secret, err := new_run_secret()
+	if err != nil {
+		logger.Error("Error generating run secret!", "err", err)
+		return nil, err
+	}
+	done_str := run_done_token(secret)
+	file_contents := build_cart_file(sanitized_tweet, secret, params)
+	if err := os.MkdirAll(runner.scratch_root, 0700); err != nil {
+		logger.Error("Error creating scratch directory!", "err", err)
+		return nil, err
+	}
+	job_dir, err := ioutil.TempDir(runner.scratch_root, SCRATCH_DIR_PREFIX+tweet_id_str+"_")
+	if err != nil {
+		logger.Error("Error creating job directory!", "err", err)
+		return nil, err
+	}
+	defer func() {
+		if err := os.RemoveAll(job_dir); err != nil {
+			logger.Warn("Could not delete job directory", "dir", job_dir, "err", err)
+		}
+	}()
+	desktop_dir := filepath.Join(job_dir, "desktop")
+	home_dir := filepath.Join(job_dir, "home")
+	for _, dir := range []string{desktop_dir, home_dir} {
+		if err := os.Mkdir(dir, 0700); err != nil {
+			logger.Error("Error creating directory!", "dir", dir, "err", err)
+			return nil, err
+		}
+	}
+
+	cart_file_name := filepath.Join(job_dir, tweet_id_str+".p8")
+	err = ioutil.WriteFile(cart_file_name, []byte(file_contents), 0600)
+	if err != nil {
+		logger.Error("Error writing cart file!", "err", err)
+		return nil, err
+	}
+	exec_path, err := filepath.Abs(runner.exec_path)
+	if err != nil {
+		return nil, err
+	}
+	pico8_args := []string{"-run", cart_file_name, "-desktop", desktop_dir, "-home", home_dir}
+	pico8_command, sandboxed, err := runner.sandbox.command(ctx, exec_path, pico8_args, filepath.Base(job_dir), logger)
+	if err != nil {
+		logger.Error("Error setting up PICO-8 sandbox", "err", err)
+		return nil, err
+	}
+	defer sandboxed.close()
+	display_ctx, cancel_display := context.WithTimeout(ctx, runner.timeout)
+	defer cancel_display()
+	display_env, release_display, err := runner.framebuffers.acquire(display_ctx)
+	if err != nil {
+		logger.Error("Error getting a display for PICO-8", "err", err)
+		return nil, err
+	}
+	defer release_display()
+	if len(runner.env) > 0 || len(display_env) > 0 {
+		pico8_command.Env = append(append(os.Environ(), runner.env...), display_env...)
+	}
+	pico8_command.Dir = job_dir
+	stdout, err := pico8_command.StdoutPipe()
+	if err != nil {
+		logger.Error("Error getting stdout from PICO-8", "exec_path", runner.exec_path, "err", err)
+		return nil, err
+	}
+	//PICO-8 prints some errors to stderr, so read both together
+	pico8_command.Stderr = pico8_command.Stdout
+	err = pico8_command.Start()
+	//log.Print(script_name, " output:\n", command_output.String())
+	if err != nil {
+		logger.Error("Error running PICO-8", "exec_path", runner.exec_path, "err", err)
+		return nil, err
+	}
+	var exit_state *os.ProcessState
+	exited := make(chan struct{})
+	go func() {
+		exit_state, _ = pico8_command.Process.Wait()
+		close(exited)
+	}()
+	defer func() { <-exited }()
+	//kill the whole process group, so nothing PICO-8 started can outlive it
+	defer kill_process_group(pico8_command.Process)
+	user_line_count := strings.Count(sanitized_tweet, "\n") + 1
+	go func() {
+		output := ""
+		defer func() { done_chan <- output }()
+		for {
+			n, err := stdout.Read(buf[:])
+			if err != nil {
+				if err != io.EOF {
+					logger.Warn("Error occurred reading stdout from pico8", "err", err)
+				}
+				break
+			}
+			if n == 0 {
+				logger.Fatal("Stdout return 0 without error!")
+			}
+			output += string(buf[:n])
+			if strings.Contains(output, done_str) {
+				break
+			}
+			//PICO-8 does not exit on errors, so stop waiting as soon as we see one
+			if parse_cart_error(output, CART_PREAMBLE_LINE_COUNT, user_line_count) != nil {
+				break
+			}
+
+		}
+	}()
+	timeout_chan = time.After(runner.timeout)
+	output := ""
+	select {
+	case output = <-done_chan:
+	case <-timeout_chan:
+		return &RunResult{Duration: time.Since(start_time), Params: params}, &CartError{Kind: CART_ERROR_TIMEOUT, Message: "Timed out running cart.  Bailing out..."}
+	case <-ctx.Done():
+		logger.Warn("Killed PICO-8 because we are going down")
+		return &RunResult{Duration: time.Since(start_time), Params: params}, ctx.Err()
+	}
+	if cart_error := parse_cart_error(output, CART_PREAMBLE_LINE_COUNT, user_line_count); cart_error != nil {
+		return &RunResult{Output: output, Duration: time.Since(start_time), Params: params}, cart_error
+	}
+	if !strings.Contains(output, done_str) {
+		//stdout was closed without the cart finishing, so see if PICO-8 went over a limit
+		select {
+		case <-exited:
+			if cart_error := sandboxed.limit_error(exit_state); cart_error != nil && ctx.Err() == nil {
+				logger.Info("PICO-8 went over a limit", "exit_state", exit_state.String())
+				return &RunResult{Output: output, Duration: time.Since(start_time), Params: params}, cart_error
+			}
+		case <-time.After(time.Second):
+		}
+	}
+
+	params = recorded_params(output, secret, params)
+	result, err := runner.read_recording(desktop_dir, job_dir, params, logger)
+	if err != nil {
+		//what PICO-8 printed is the best clue to why there is no recording
+		return &RunResult{Output: output, Duration: time.Since(start_time), Params: params}, err
+	}
+	result.Output = output
+	result.Duration = time.Since(start_time)
+	return result, nil
+}
+
+//Reads the GIF PICO-8 saved to desktop_dir and encodes it the way params asks.  work_dir is used for temporary files
+func (runner *Pico8Runner) read_recording(desktop_dir, work_dir string, params RunParams, logger *Logger) (*RunResult, error) {
+	//PICO-8 names the GIF after the cart, but it is the only file that should be on the desktop
+	gif_paths, err := filepath.Glob(filepath.Join(desktop_dir, "*.gif"))
+	if err != nil {
+		return nil, err
+	}
+	if len(gif_paths) == 0 {
+		return nil, errors.New("PICO-8 did not save a GIF")
+	}
+	contents, err := ioutil.ReadFile(gif_paths[0])
+	if err != nil {
+		return nil, err
+	}
+	contents, err = set_gif_frame_rate(contents, params.FrameRate)
+	if err != nil {
+		return nil, err
+	}
+	contents, media_type, format := encode_recording(contents, params.Format, runner.ffmpeg_path, work_dir, logger)
+	params.Format = format
+
+	return &RunResult{
+		MediaData: contents,
+		MediaType: media_type,
+		Params:    params,
+	}, nil
+}
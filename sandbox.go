@@ -0,0 +1,40 @@
+//Copyright (C) 2020 Daniel Bokser.  See LICENSE file for license
+package main
+
+//PICO-8 is started through the bot's own executable with this as the first argument,
+//so limits can be applied to it before it becomes PICO-8.  See run_sandbox_exec
+const SANDBOX_EXEC_COMMAND = "sandbox-exec"
+
+//OS level limits on each PICO-8 process, so a cart can not starve the host.  Only enforced on Linux.
+//0 or empty means no limit
+type Sandbox struct {
+	cpu_seconds    uint64
+	max_memory     uint64
+	max_open_files uint64
+	//a cgroup v2 directory the bot can write to.  Every run gets its own cgroup under it
+	cgroup_dir        string
+	cgroup_cpu_max    string
+	cgroup_memory_max uint64
+	//run PICO-8 in its own network namespace, which has no way out
+	isolate_network bool
+}
+
+//What Sandbox.command set up for one PICO-8
+type SandboxedProcess struct {
+	//the process's cgroup, or empty if it does not have one
+	cgroup string
+	//the cgroup's OOM kill count when the current cart started
+	oom_kills_at_start uint64
+	cleanup            func()
+}
+
+//Undoes what Sandbox.command set up.  Call once the process has exited
+func (process *SandboxedProcess) close() {
+	process.cleanup()
+}
+
+//Returns false if nothing has to be done before PICO-8 is started
+func (sandbox *Sandbox) is_enabled() bool {
+	return sandbox != nil && (sandbox.cpu_seconds > 0 || sandbox.max_memory > 0 || sandbox.max_open_files > 0 ||
+		len(sandbox.cgroup_dir) > 0 || sandbox.isolate_network)
+}
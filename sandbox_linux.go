@@ -0,0 +1,217 @@
+//Copyright (C) 2020 Daniel Bokser.  See LICENSE file for license
+
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+//Enables the cpu and memory controllers for the cgroups of runs.  Called once on start up
+func (sandbox *Sandbox) setup() error {
+	if sandbox == nil || len(sandbox.cgroup_dir) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(sandbox.cgroup_dir, 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(sandbox.cgroup_dir, "cgroup.subtree_control"), []byte("+cpu +memory"), 0); err != nil {
+		return fmt.Errorf("could not enable the cpu and memory controllers in %v: %v", sandbox.cgroup_dir, err)
+	}
+	return nil
+}
+
+//Returns the command that runs PICO-8 in its own process group, so the whole group can be killed.
+//Call close on the process once it has exited
+func (sandbox *Sandbox) command(ctx context.Context, exec_path string, args []string, run_name string, logger *Logger) (*exec.Cmd, *SandboxedProcess, error) {
+	process := &SandboxedProcess{cleanup: func() {}}
+	attr := &syscall.SysProcAttr{Setpgid: true, Pdeathsig: syscall.SIGKILL}
+	if !sandbox.is_enabled() {
+		cmd := exec.CommandContext(ctx, exec_path, args...)
+		cmd.SysProcAttr = attr
+		return cmd, process, nil
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return nil, nil, err
+	}
+	helper_args := []string{SANDBOX_EXEC_COMMAND,
+		"-cpu_seconds", strconv.FormatUint(sandbox.cpu_seconds, 10),
+		"-max_memory", strconv.FormatUint(sandbox.max_memory, 10),
+		"-max_open_files", strconv.FormatUint(sandbox.max_open_files, 10),
+	}
+	if len(sandbox.cgroup_dir) > 0 {
+		cgroup, err := sandbox.create_cgroup(run_name)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not create cgroup: %v", err)
+		}
+		helper_args = append(helper_args, "-cgroup", cgroup)
+		process.cgroup = cgroup
+		process.cleanup = func() { remove_cgroup(cgroup, logger) }
+	}
+	helper_args = append(append(helper_args, "--", exec_path), args...)
+
+	if sandbox.isolate_network {
+		attr.Cloneflags = syscall.CLONE_NEWNET
+		if uid, gid := os.Geteuid(), os.Getegid(); uid != 0 {
+			//users other than root need their own user namespace to get a network namespace
+			attr.Cloneflags |= syscall.CLONE_NEWUSER
+			attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: uid, HostID: uid, Size: 1}}
+			attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: gid, HostID: gid, Size: 1}}
+		}
+	}
+	cmd := exec.CommandContext(ctx, self, helper_args...)
+	cmd.SysProcAttr = attr
+	return cmd, process, nil
+}
+
+//Makes sure cmd does not outlive the bot, even if the bot exits without killing it
+func kill_with_bot(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Pdeathsig: syscall.SIGKILL}
+}
+
+//Kills PICO-8 and anything it started
+func kill_process_group(process *os.Process) {
+	syscall.Kill(-process.Pid, syscall.SIGKILL)
+}
+
+//Call before every cart, so only OOM kills from then on are put down to the cart
+func (process *SandboxedProcess) cart_started() {
+	process.oom_kills_at_start, _ = cgroup_oom_kills(process.cgroup)
+}
+
+//Returns a CartError if PICO-8 was killed for going over a limit, or nil if it exited some other way
+func (process *SandboxedProcess) limit_error(state *os.ProcessState) *CartError {
+	status, ok := state.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() {
+		return nil
+	}
+	switch status.Signal() {
+	case syscall.SIGXCPU:
+		return &CartError{Kind: CART_ERROR_LIMIT, Message: "Your cart used more CPU time than it is allowed."}
+	case syscall.SIGKILL:
+		//anyone can send SIGKILL, so it is only down to the cart if the cgroup's OOM killer ran during it
+		if oom_kills, ok := cgroup_oom_kills(process.cgroup); ok && oom_kills > process.oom_kills_at_start {
+			return &CartError{Kind: CART_ERROR_LIMIT, Message: "Your cart used more memory than it is allowed."}
+		}
+	}
+	return nil
+}
+
+//Reads oom_kill from the cgroup's memory.events.  Returns false if there is no cgroup or the count can not be read
+func cgroup_oom_kills(cgroup string) (uint64, bool) {
+	if len(cgroup) == 0 {
+		return 0, false
+	}
+	events, err := ioutil.ReadFile(filepath.Join(cgroup, "memory.events"))
+	if err != nil {
+		return 0, false
+	}
+	for _, line := range strings.Split(string(events), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			count, err := strconv.ParseUint(fields[1], 10, 64)
+			return count, err == nil
+		}
+	}
+	return 0, false
+}
+
+//Makes a cgroup for one run with the configured caps
+func (sandbox *Sandbox) create_cgroup(run_name string) (string, error) {
+	cgroup, err := ioutil.TempDir(sandbox.cgroup_dir, run_name+"_")
+	if err != nil {
+		return "", err
+	}
+	limits := map[string]string{}
+	if sandbox.cgroup_memory_max > 0 {
+		limits["memory.max"] = strconv.FormatUint(sandbox.cgroup_memory_max, 10)
+	}
+	if len(sandbox.cgroup_cpu_max) > 0 {
+		limits["cpu.max"] = sandbox.cgroup_cpu_max
+	}
+	for file, value := range limits {
+		if err := ioutil.WriteFile(filepath.Join(cgroup, file), []byte(value), 0); err != nil {
+			os.Remove(cgroup)
+			return "", fmt.Errorf("could not set %v: %v", file, err)
+		}
+	}
+	//not every kernel has swap accounting
+	ioutil.WriteFile(filepath.Join(cgroup, "memory.swap.max"), []byte("0"), 0)
+	return cgroup, nil
+}
+
+func remove_cgroup(cgroup string, logger *Logger) {
+	//cgroup.kill is only in newer kernels.  The process group has already been killed anyway
+	ioutil.WriteFile(filepath.Join(cgroup, "cgroup.kill"), []byte("1"), 0)
+	//the cgroup can only be removed once the kernel is done with every process in it
+	for attempt := 1; ; attempt++ {
+		err := os.Remove(cgroup)
+		if err == nil || os.IsNotExist(err) {
+			return
+		}
+		if attempt == 50 {
+			logger.Warn("Could not remove cgroup", "cgroup", cgroup, "err", err)
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+//Runs in the process that becomes PICO-8.  Joins the run's cgroup and sets the rlimits, then execs PICO-8.
+//Only returns if something went wrong
+func run_sandbox_exec(args []string) error {
+	flags := flag.NewFlagSet(SANDBOX_EXEC_COMMAND, flag.ContinueOnError)
+	cpu_seconds := flags.Uint64("cpu_seconds", 0, "RLIMIT_CPU")
+	max_memory := flags.Uint64("max_memory", 0, "RLIMIT_AS in bytes")
+	max_open_files := flags.Uint64("max_open_files", 0, "RLIMIT_NOFILE")
+	cgroup := flags.String("cgroup", "", "cgroup to join")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	command := flags.Args()
+	if len(command) == 0 {
+		return errors.New("no command to run")
+	}
+	if len(*cgroup) > 0 {
+		if err := ioutil.WriteFile(filepath.Join(*cgroup, "cgroup.procs"), []byte("0"), 0); err != nil {
+			return fmt.Errorf("could not join cgroup %v: %v", *cgroup, err)
+		}
+	}
+	limits := []struct {
+		name     string
+		resource int
+		value    uint64
+	}{
+		{"cpu_seconds", syscall.RLIMIT_CPU, *cpu_seconds},
+		{"max_memory", syscall.RLIMIT_AS, *max_memory},
+		{"max_open_files", syscall.RLIMIT_NOFILE, *max_open_files},
+	}
+	for _, limit := range limits {
+		if limit.value == 0 {
+			continue
+		}
+		rlimit := syscall.Rlimit{Cur: limit.value, Max: limit.value}
+		if limit.resource == syscall.RLIMIT_CPU {
+			//the kernel sends SIGKILL at the hard limit, so leave room for SIGXCPU to come first
+			rlimit.Max++
+		}
+		if err := syscall.Setrlimit(limit.resource, &rlimit); err != nil {
+			return fmt.Errorf("could not set %v: %v", limit.name, err)
+		}
+	}
+	return syscall.Exec(command[0], command, os.Environ())
+}
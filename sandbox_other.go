@@ -0,0 +1,39 @@
+//Copyright (C) 2020 Daniel Bokser.  See LICENSE file for license
+
+//go:build !linux
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+)
+
+func (sandbox *Sandbox) setup() error {
+	if sandbox.is_enabled() {
+		root_logger.Warn("Limits on PICO-8 are only enforced on Linux")
+	}
+	return nil
+}
+
+func (sandbox *Sandbox) command(ctx context.Context, exec_path string, args []string, run_name string, logger *Logger) (*exec.Cmd, *SandboxedProcess, error) {
+	return exec.CommandContext(ctx, exec_path, args...), &SandboxedProcess{cleanup: func() {}}, nil
+}
+
+func kill_with_bot(cmd *exec.Cmd) {}
+
+func kill_process_group(process *os.Process) {
+	process.Kill()
+}
+
+func (process *SandboxedProcess) cart_started() {}
+
+func (process *SandboxedProcess) limit_error(state *os.ProcessState) *CartError {
+	return nil
+}
+
+func run_sandbox_exec(args []string) error {
+	return errors.New(SANDBOX_EXEC_COMMAND + " is only supported on Linux")
+}
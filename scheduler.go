@@ -0,0 +1,189 @@
+//Copyright (C) 2020 Daniel Bokser.  See LICENSE file for license
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+//Quotas count the carts a user started in the last QUOTA_WINDOW
+const QUOTA_WINDOW = time.Hour
+
+const DEFAULT_CARTS_PER_USER_PER_HOUR = 10
+
+//Screen names are not case sensitive, and people write them with or without the @
+func normalize_screen_name(screen_name string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(screen_name), "@"))
+}
+
+//Limits how many carts each user can run per hour so no one can hog the cart handlers
+type UserQuota struct {
+	mutex sync.Mutex
+	//0 means no limit
+	carts_per_hour int
+	//these users have no limit
+	allowlist map[string]bool
+	//when each user's carts in the current window were let in, oldest first
+	admitted map[string][]time.Time
+	//users that were told they are over quota are not told again until then
+	notified_until map[string]time.Time
+	clock          Clock
+}
+
+func new_user_quota(carts_per_hour int, allowlist []string, clock Clock) *UserQuota {
+	quota := &UserQuota{
+		carts_per_hour: carts_per_hour,
+		allowlist:      make(map[string]bool, len(allowlist)),
+		admitted:       make(map[string][]time.Time),
+		notified_until: make(map[string]time.Time),
+		clock:          clock,
+	}
+	for _, screen_name := range allowlist {
+		quota.allowlist[normalize_screen_name(screen_name)] = true
+	}
+	return quota
+}
+
+//Counts a cart against the user's quota if they have any left.  If not, returns how long until they do,
+//and whether they should be told.  They are only told once per window so replies can not be used to spam
+func (quota *UserQuota) admit(screen_name string) (ok bool, retry_after time.Duration, notify bool) {
+	user := normalize_screen_name(screen_name)
+	if quota.carts_per_hour <= 0 || quota.allowlist[user] {
+		return true, 0, false
+	}
+	quota.mutex.Lock()
+	defer quota.mutex.Unlock()
+	now := quota.clock.Now()
+	admitted := quota.admitted[user]
+	for len(admitted) > 0 && !now.Before(admitted[0].Add(QUOTA_WINDOW)) {
+		admitted = admitted[1:]
+	}
+	if len(admitted) < quota.carts_per_hour {
+		quota.admitted[user] = append(admitted, now)
+		return true, 0, false
+	}
+	quota.admitted[user] = admitted
+	retry_after = admitted[0].Add(QUOTA_WINDOW).Sub(now)
+	if now.Before(quota.notified_until[user]) {
+		return false, retry_after, false
+	}
+	quota.notified_until[user] = now.Add(retry_after)
+	return false, retry_after, true
+}
+
+func (quota *UserQuota) over_quota_message(retry_after time.Duration) string {
+	minutes := int(retry_after.Round(time.Minute) / time.Minute)
+	if minutes < 1 {
+		minutes = 1
+	}
+	return fmt.Sprintf("You have run %v carts in the last hour, which is as many as I can run for one person.  Please try again in %v minutes!",
+		quota.carts_per_hour, minutes)
+}
+
+//A tweet or DM that was let in and is waiting for a cart handler
+type ScheduledCart struct {
+	job_id   string
+	job_type JobType
+	user     string
+	//runs the cart and replies.  Called with a cart handler held
+	run func(ctx context.Context, logger *Logger) *JobResult
+}
+
+//Hands out carts round-robin between users, so someone with a lot of carts queued can not keep everyone else waiting
+type FairScheduler struct {
+	mutex   sync.Mutex
+	changed *sync.Cond
+	queues  map[string][]*ScheduledCart
+	//users with carts queued, in the order they get their next turn
+	turns  []string
+	queued int
+}
+
+func new_fair_scheduler() *FairScheduler {
+	scheduler := &FairScheduler{queues: make(map[string][]*ScheduledCart)}
+	scheduler.changed = sync.NewCond(&scheduler.mutex)
+	return scheduler
+}
+
+func (scheduler *FairScheduler) push(cart *ScheduledCart) {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	user := normalize_screen_name(cart.user)
+	if len(scheduler.queues[user]) == 0 {
+		scheduler.turns = append(scheduler.turns, user)
+	}
+	scheduler.queues[user] = append(scheduler.queues[user], cart)
+	scheduler.queued++
+	scheduler.changed.Signal()
+}
+
+//Blocks until there is a cart, then returns the oldest cart of the user whose turn it is
+func (scheduler *FairScheduler) pop() *ScheduledCart {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	for scheduler.queued == 0 {
+		scheduler.changed.Wait()
+	}
+	user := scheduler.turns[0]
+	scheduler.turns = scheduler.turns[1:]
+	queue := scheduler.queues[user]
+	cart := queue[0]
+	if len(queue) > 1 {
+		scheduler.queues[user] = queue[1:]
+		scheduler.turns = append(scheduler.turns, user)
+	} else {
+		delete(scheduler.queues, user)
+	}
+	scheduler.queued--
+	return cart
+}
+
+func (scheduler *FairScheduler) length() int {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	return scheduler.queued
+}
+
+//Runs scheduled tweets and DMs as cart handlers free up
+func run_scheduled_carts(scheduler *FairScheduler, jobs *JobStore, intake *IntakeControl,
+	goroutine_context context.Context, processing_tweet_semaphore *semaphore.Weighted) {
+	for {
+		cart := scheduler.pop()
+		intake.job_started()
+		if err := processing_tweet_semaphore.Acquire(goroutine_context, 1); err != nil {
+			root_logger.Error("Error acquiring semaphore", "err", err)
+			intake.job_finished()
+			continue
+		}
+		bot_metrics.cart_handlers_busy.add(1)
+		go func() {
+			logger := root_logger.for_job(cart.job_id, cart.job_type, cart.user)
+			if err := jobs.start(cart.job_id); err != nil {
+				logger.stage("start").Error("Could not record start of job", "err", err)
+			}
+			result := cart.run(goroutine_context, logger)
+			if goroutine_context.Err() != nil {
+				//leave it running in the journal so it gets run again when the bot comes back up
+				logger.stage("finish").Warn("Job was interrupted by shutdown.  It will be run again on start up")
+			} else {
+				finish_job(jobs, cart.job_id, cart.job_type, result, logger)
+			}
+			bot_metrics.cart_handlers_busy.add(-1)
+			processing_tweet_semaphore.Release(1)
+			intake.job_finished()
+		}()
+	}
+}
+
+func finish_job(jobs *JobStore, job_id string, job_type JobType, result *JobResult, logger *Logger) {
+	if err := jobs.finish(job_id, result); err != nil {
+		logger.stage("finish").Error("Could not record result of job", "err", err)
+	}
+	logger.stage("finish").Info("Finished job", "status", result.Status, "run_duration", result.RunDuration)
+	bot_metrics.record_job(job_type, result)
+}
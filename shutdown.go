@@ -0,0 +1,60 @@
+//Copyright (C) 2020 Daniel Bokser.  See LICENSE file for license
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+//How long to wait for carts to notice they were killed and for the webhook server to close
+const SHUTDOWN_CLEANUP_TIMEOUT = 10 * time.Second
+
+//Calls stop_intake on the first SIGINT or SIGTERM.  A second one exits right away
+func handle_shutdown_signals(stop_intake func()) {
+	signal_channel := make(chan os.Signal, 2)
+	signal.Notify(signal_channel, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signal_channel
+		root_logger.Info("Received signal.  Going down...", "signal", sig)
+		stop_intake()
+		sig = <-signal_channel
+		root_logger.Fatal("Received second signal.  Exiting without waiting for carts...", "signal", sig)
+	}()
+}
+
+//Stops taking new tweets and DMs, waits up to the grace period for running carts to finish,
+//then kills the rest.  Killed jobs are left as running in the job journal so they are run again on start up
+func graceful_shutdown(config *Config, http_client *http.Client, webhook_server *http.Server,
+	intake *IntakeControl, kill_running_carts func()) {
+	set_readiness_flag(&bot_readiness.webhook_registered, false)
+	set_readiness_flag(&bot_readiness.subscribed, false)
+	intake.pause()
+
+	root_logger.Info("Deleting all webhooks...")
+	delete_all_current_webhooks(http_client, config)
+	server_context, cancel_server_context := context.WithTimeout(context.Background(), SHUTDOWN_CLEANUP_TIMEOUT)
+	defer cancel_server_context()
+	if err := webhook_server.Shutdown(server_context); err != nil {
+		root_logger.Warn("Could not shut down webhook server cleanly", "err", err)
+	}
+
+	_, running := intake.status()
+	root_logger.Info("Waiting for running carts to finish...", "running", running, "grace_period", config.ShutdownGracePeriod.Duration)
+	grace_context, cancel_grace_context := context.WithTimeout(context.Background(), config.ShutdownGracePeriod.Duration)
+	defer cancel_grace_context()
+	running, err := intake.drain(grace_context)
+	if err != nil {
+		root_logger.Warn("Grace period is over.  Killing running carts", "running", running)
+		kill_running_carts()
+		cleanup_context, cancel_cleanup_context := context.WithTimeout(context.Background(), SHUTDOWN_CLEANUP_TIMEOUT)
+		defer cancel_cleanup_context()
+		if running, err := intake.drain(cleanup_context); err != nil {
+			root_logger.Error("Carts did not stop after being killed", "running", running)
+		}
+	}
+	root_logger.Info("Shut down cleanly")
+}
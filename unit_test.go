@@ -3,14 +3,35 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
 	"image/gif"
+	"io"
 	"io/ioutil"
 	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
+	"unicode/utf8"
 
 	"twitter"
+
+	"golang.org/x/sync/semaphore"
 )
 
 func test_assert_eq(expected, actual interface{}, msg string, t *testing.T) {
@@ -42,9 +63,141 @@ func test_assert_no_err(err error, msg string, t *testing.T) {
 	}
 }
 
-func BenchmarkGenerateGIF(b *testing.B) {
-	cart_contents :=
-		`
+//Sandboxed runs start the test binary in place of the bot, so it has to do what main does
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 && os.Args[1] == SANDBOX_EXEC_COMMAND {
+		fmt.Fprintln(os.Stderr, run_sandbox_exec(os.Args[2:]))
+		os.Exit(127)
+	}
+	os.Exit(m.Run())
+}
+
+//Holds ForkLock while the file is open for writing, so processes started by other tests at the same time do not inherit it.
+//Running the script would fail with ETXTBSY for as long as one of them had it open
+func write_test_executable(path, script, msg string, t *testing.T) {
+	syscall.ForkLock.Lock()
+	err := ioutil.WriteFile(path, []byte(script), 0700)
+	syscall.ForkLock.Unlock()
+	test_assert_no_err(err, msg, t)
+}
+
+//Uses PICO-8 if it is installed, otherwise falls back to the fake runner
+func test_runner() CartRunner {
+	if _, err := os.Stat(PICO_8_EXEC_PATH); err == nil {
+		return &Pico8Runner{
+			exec_path:    PICO_8_EXEC_PATH,
+			scratch_root: default_scratch_root(),
+			timeout:      30 * time.Second,
+		}
+	}
+	return &FakeRunner{}
+}
+
+func test_run_limits() *RunLimits {
+	return default_config().run_limits()
+}
+
+func test_tweet_handler(tc *twitter.Client, runner CartRunner) *TweetHandlerContext {
+	return &TweetHandlerContext{
+		twitter_client: tc,
+		runner:         runner,
+		run_limits:     test_run_limits(),
+	}
+}
+
+//Serves just enough of the twitter API for handle_tweet and handle_dm.
+//Every request is recorded as "METHOD path"
+type fake_twitter_server struct {
+	server   *httptest.Server
+	mutex    sync.Mutex
+	requests []string
+	statuses []string
+	dms      []string
+	tweets   map[string]string
+}
+
+//The caller must close fake.server
+func new_fake_twitter() (*fake_twitter_server, *twitter.Client) {
+	fake := &fake_twitter_server{tweets: make(map[string]string)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/1.1/statuses/show.json", func(w http.ResponseWriter, r *http.Request) {
+		fake.record(r)
+		tweet_json, ok := fake.tweets[r.URL.Query().Get("id")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"errors":[{"message":"No status found with that ID.","code":144}]}`)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, tweet_json)
+	})
+	mux.HandleFunc("/1.1/statuses/update.json", func(w http.ResponseWriter, r *http.Request) {
+		fake.record(r)
+		r.ParseForm()
+		fake.mutex.Lock()
+		fake.statuses = append(fake.statuses, r.PostForm.Get("status"))
+		id := 1000 + len(fake.statuses)
+		fake.mutex.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"id":%v,"id_str":"%v"}`, id, id)
+	})
+	mux.HandleFunc("/1.1/media/upload.json", func(w http.ResponseWriter, r *http.Request) {
+		fake.record(r)
+		r.ParseForm()
+		if r.PostForm.Get("command") == "APPEND" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"media_id":42,"media_id_string":"42","expires_after_secs":86400}`)
+	})
+	mux.HandleFunc("/1.1/direct_messages/events/new.json", func(w http.ResponseWriter, r *http.Request) {
+		fake.record(r)
+		body, _ := ioutil.ReadAll(r.Body)
+		fake.mutex.Lock()
+		fake.dms = append(fake.dms, string(body))
+		fake.mutex.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"event":{"type":"message_create","id":"1"}}`)
+	})
+	fake.server = httptest.NewServer(mux)
+
+	server_url, _ := url.Parse(fake.server.URL)
+	http_client := &http.Client{
+		Transport: &rewrite_to_http_transport{&http.Transport{Proxy: http.ProxyURL(server_url)}},
+	}
+	return fake, twitter.NewClient(http_client)
+}
+
+func (fake *fake_twitter_server) record(r *http.Request) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	fake.requests = append(fake.requests, r.Method+" "+r.URL.Path)
+}
+
+func (fake *fake_twitter_server) request_count(request string) int {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	count := 0
+	for _, r := range fake.requests {
+		if r == request {
+			count++
+		}
+	}
+	return count
+}
+
+type rewrite_to_http_transport struct {
+	transport http.RoundTripper
+}
+
+func (t *rewrite_to_http_transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.URL.Scheme = "http"
+	return t.transport.RoundTrip(req)
+}
+
+//A busy cart, so the benchmarks spend their time the way real runs do
+const BENCHMARK_CART = `
     p={129,1,140,12,7}
     for i=1,#p do
     pal(i,p[i],1)
@@ -65,8 +218,28 @@ func BenchmarkGenerateGIF(b *testing.B) {
     end
     flip()goto _
     `
+
+func BenchmarkGenerateGIF(b *testing.B) {
+	runner := test_runner()
 	for n := 0; n < b.N; n += 1 {
-		run_pico8_and_generate_gif(cart_contents, strconv.Itoa(n))
+		runner.Run(context.Background(), BENCHMARK_CART, strconv.Itoa(n), test_run_limits().Default, root_logger)
+	}
+}
+
+//Compare with BenchmarkGenerateGIF to see how much a warm PICO-8 saves
+func BenchmarkGenerateGIFWorkerPool(b *testing.B) {
+	if _, err := os.Stat(PICO_8_EXEC_PATH); err != nil {
+		b.Skip("PICO-8 is not installed")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runner := &Pico8Runner{exec_path: PICO_8_EXEC_PATH, scratch_root: default_scratch_root(), timeout: 30 * time.Second}
+	pool := start_worker_pool(ctx, runner, 1, 50)
+	//the first run waits for the worker to start
+	pool.Run(ctx, BENCHMARK_CART, "warm_up", test_run_limits().Default, root_logger)
+	b.ResetTimer()
+	for n := 0; n < b.N; n += 1 {
+		pool.Run(ctx, BENCHMARK_CART, strconv.Itoa(n), test_run_limits().Default, root_logger)
 	}
 }
 func BenchmarkTokenize(b *testing.B) {
@@ -184,39 +357,47 @@ func TestSanitizeTweet(t *testing.T) {
 	//also replaces non-ASCII tick with ascii quote
 	{
 		expected := "s=' @TweetCartRunner '\n  "
-		indices := []twitter.Indices{twitter.Indices{4, 20}}
-		actual := sanitize_tweet_text("s=‘ @TweetCartRunner ’\n  #include test  ", indices)
+		edits := []text_edit{{indices: twitter.Indices{4, 20}, outside_strings_only: true}}
+		actual := sanitize_tweet_text("s=‘ @TweetCartRunner ’\n  #include test  ", edits)
 
 		test_assert_eq(expected, actual, "", t)
 	}
 	//no erasure since its in quotes
 	{
 		expected := "s=\"@TweetCartRunner\""
-		indices := []twitter.Indices{twitter.Indices{3, 19}}
-		actual := sanitize_tweet_text("s=\"@TweetCartRunner\"", indices)
+		edits := []text_edit{{indices: twitter.Indices{3, 19}, outside_strings_only: true}}
+		actual := sanitize_tweet_text("s=\"@TweetCartRunner\"", edits)
 		test_assert_eq(expected, actual, "", t)
 	}
 	//no erasure since its right after a quote
 	{
 		expected := "s='@TweetCartRunner\""
-		indices := []twitter.Indices{twitter.Indices{3, 19}}
-		actual := sanitize_tweet_text("s='@TweetCartRunner\"", indices)
+		edits := []text_edit{{indices: twitter.Indices{3, 19}, outside_strings_only: true}}
+		actual := sanitize_tweet_text("s='@TweetCartRunner\"", edits)
 		test_assert_eq(expected, actual, "", t)
 	}
 
 	//erases the second mention
 	{
 		expected := "s=\"@TweetCartRunner\""
-		indices := []twitter.Indices{twitter.Indices{3, 19}, twitter.Indices{20, 36}}
-		actual := sanitize_tweet_text("s=\"@TweetCartRunner\"@TweetCartRunner", indices)
+		edits := []text_edit{
+			{indices: twitter.Indices{3, 19}, outside_strings_only: true},
+			{indices: twitter.Indices{20, 36}, outside_strings_only: true},
+		}
+		actual := sanitize_tweet_text("s=\"@TweetCartRunner\"@TweetCartRunner", edits)
 		test_assert_eq(expected, actual, "", t)
 	}
 
 }
-func commonGenerateGif(cart_contents string, t *testing.T) {
+func commonGenerateGif(runner CartRunner, cart_contents string, t *testing.T) {
 
-	image_data, err := run_pico8_and_generate_gif(cart_contents, strconv.Itoa(rand.Int()))
+	result, err := runner.Run(context.Background(), cart_contents, strconv.Itoa(rand.Int()), test_run_limits().Default, root_logger)
 	test_assert_no_err(err, "Could not generate GIF", t)
+	if err != nil {
+		return
+	}
+	image_data := result.MediaData
+	test_assert_eq("image/gif", result.MediaType, "Unexpected media type", t)
 
 	bytes_reader := bytes.NewReader(image_data)
 	image, err := gif.DecodeAll(bytes_reader)
@@ -235,6 +416,7 @@ func commonGenerateGif(cart_contents string, t *testing.T) {
 }
 
 func TestGenerateGif(t *testing.T) {
+	runner := test_runner()
 	long_running_cart :=
 		`
     p={129,1,140,12,7}
@@ -257,10 +439,10 @@ func TestGenerateGif(t *testing.T) {
     end
     flip()goto _
     `
-	commonGenerateGif(long_running_cart, t)
+	commonGenerateGif(runner, long_running_cart, t)
 
 	quick_cart := "print('hello!')"
-	commonGenerateGif(quick_cart, t)
+	commonGenerateGif(runner, quick_cart, t)
 
 	large_gif := `
     ::_::
@@ -269,87 +451,2234 @@ func TestGenerateGif(t *testing.T) {
     end
     flip()
     goto _`
-	commonGenerateGif(large_gif, t)
+	commonGenerateGif(runner, large_gif, t)
+}
+
+func test_job_store(t *testing.T) (*JobStore, string) {
+	dir, err := ioutil.TempDir("", "job_store_test")
+	test_assert_no_err(err, "Could not create temp dir", t)
+	store, err := open_job_store(filepath.Join(dir, "jobs.journal"), filepath.Join(dir, "persistent_state.json"), 0)
+	test_assert_no_err(err, "Could not open job store", t)
+	return store, dir
+}
+
+func TestJobStore(t *testing.T) {
+	store, dir := test_job_store(t)
+	defer os.RemoveAll(dir)
+	test_assert_eq(int64(0), store.last_processed_tweet_id(), "Initial tweet should be 0", t)
+
+	is_new, err := store.enqueue(&Job{ID: tweet_job_id(123), Type: JOB_TYPE_TWEET, SourceID: "123", ParentTweetID: 100, Author: "test_user"})
+	test_assert_no_err(err, "Could not enqueue job", t)
+	test_assert_eq(true, is_new, "Job should be new", t)
+	is_new, err = store.enqueue(&Job{ID: tweet_job_id(123), Type: JOB_TYPE_TWEET, SourceID: "123"})
+	test_assert_no_err(err, "Could not enqueue job", t)
+	test_assert_eq(false, is_new, "Job should already be known", t)
+
+	test_assert_no_err(store.start(tweet_job_id(123)), "Could not start job", t)
+	job, ok := store.job(tweet_job_id(123))
+	test_assert_eq(true, ok, "Job should exist", t)
+	test_assert_eq(JOB_STATUS_RUNNING, job.Status, "Job should be running", t)
+	test_assert_eq(1, job.Attempts, "Job should have 1 attempt", t)
+	test_assert_eq(int64(0), store.last_processed_tweet_id(), "Should not be updated for in progress tweets", t)
+	test_assert_eq(1, len(store.unfinished_jobs(JOB_TYPE_TWEET)), "Running job is unfinished", t)
+
+	//reopening the journal is the same as the bot going down
+	test_assert_no_err(store.Close(), "Could not close job store", t)
+	store, err = open_job_store(filepath.Join(dir, "jobs.journal"), "", 0)
+	test_assert_no_err(err, "Could not reopen job store", t)
+	unfinished := store.unfinished_jobs(JOB_TYPE_TWEET)
+	test_assert_eq(1, len(unfinished), "Running job should survive a restart", t)
+	test_assert_eq(int64(100), unfinished[0].ParentTweetID, "Parent tweet should survive a restart", t)
+
+	test_assert_no_err(store.start(tweet_job_id(123)), "Could not start job", t)
+	err = store.finish(tweet_job_id(123), &JobResult{Status: JOB_STATUS_SUCCEEDED, CartSource: "?1", MediaIDs: []int64{42}})
+	test_assert_no_err(err, "Could not finish job", t)
+	job, _ = store.job(tweet_job_id(123))
+	test_assert_eq(JOB_STATUS_SUCCEEDED, job.Status, "Job should have succeeded", t)
+	test_assert_eq(2, job.Attempts, "Job should have 2 attempts", t)
+	test_assert_eq(1, len(job.MediaIDs), "Media IDs should be recorded", t)
+	test_assert_eq(int64(42), job.MediaIDs[0], "Media IDs should be recorded", t)
+	test_assert_eq("test_user", job.Author, "Author should be kept", t)
+	test_assert_eq(int64(123), store.last_processed_tweet_id(), "Should be updated for processed tweets", t)
+	test_assert_eq(0, len(store.unfinished_jobs(JOB_TYPE_TWEET)), "No jobs should be unfinished", t)
+
+	dm_cart := &DMCart{DMID: "321", DMText: "Hello!", Sender: User{Id: "abc", ScreenName: "TestUser"}}
+	_, err = store.enqueue(&Job{ID: dm_job_id("321"), Type: JOB_TYPE_DM, SourceID: "321", DM: dm_cart})
+	test_assert_no_err(err, "Could not enqueue job", t)
+	test_assert_no_err(store.Close(), "Could not close job store", t)
+
+	//a crash in the middle of writing a record leaves part of a line at the end
+	journal, err := os.OpenFile(filepath.Join(dir, "jobs.journal"), os.O_WRONLY|os.O_APPEND, 0600)
+	test_assert_no_err(err, "Could not open journal", t)
+	_, err = journal.WriteString(`{"Job":{"ID":"dm-321","Status":"runn`)
+	test_assert_no_err(err, "Could not write to journal", t)
+	journal.Close()
+
+	store, err = open_job_store(filepath.Join(dir, "jobs.journal"), "", 0)
+	test_assert_no_err(err, "Partial record should not stop the journal from opening", t)
+	defer store.Close()
+	unfinished = store.unfinished_jobs(JOB_TYPE_DM)
+	test_assert_eq(1, len(unfinished), "DM should be unfinished", t)
+	test_assert_eq(JOB_STATUS_QUEUED, unfinished[0].Status, "Partial record should be dropped", t)
+	test_assert_eq(*dm_cart, *unfinished[0].DM, "DM should survive a restart", t)
+	test_assert_eq(int64(123), store.last_processed_tweet_id(), "Cursor should survive a restart", t)
+}
+
+func TestJobStoreCompaction(t *testing.T) {
+	store, dir := test_job_store(t)
+	defer os.RemoveAll(dir)
+	defer store.Close()
+	store.compact_at_min = 10
+
+	for i := int64(1); i <= 5; i++ {
+		store.enqueue(&Job{ID: tweet_job_id(i), Type: JOB_TYPE_TWEET, SourceID: strconv.Itoa(int(i))})
+		store.start(tweet_job_id(i))
+		store.finish(tweet_job_id(i), &JobResult{Status: JOB_STATUS_FAILED, Error: "syntax error"})
+	}
+	journal, err := ioutil.ReadFile(filepath.Join(dir, "jobs.journal"))
+	test_assert_no_err(err, "Could not read journal", t)
+	test_assert_less(strings.Count(string(journal), "\n"), 11, "Journal should have been compacted", t)
+
+	reopened, err := open_job_store(filepath.Join(dir, "jobs.journal"), "", 0)
+	test_assert_no_err(err, "Could not reopen job store", t)
+	defer reopened.Close()
+	for i := int64(1); i <= 5; i++ {
+		job, ok := reopened.job(tweet_job_id(i))
+		test_assert_eq(true, ok, "Job should survive compaction", t)
+		test_assert_eq(JOB_STATUS_FAILED, job.Status, "Latest version of the job should be kept", t)
+	}
+	test_assert_eq(int64(5), reopened.last_processed_tweet_id(), "Cursor should survive compaction", t)
+
+	long_ago := time.Now().Add(-60 * 24 * time.Hour)
+	reopened.jobs[tweet_job_id(1)].FinishedAt = long_ago
+	reopened.jobs[tweet_job_id(2)].FinishedAt = long_ago
+	reopened.jobs[tweet_job_id(2)].Status = JOB_STATUS_HELD
+	reopened.enqueue(&Job{ID: tweet_job_id(6), Type: JOB_TYPE_TWEET, SourceID: "6", CreatedAt: long_ago})
+	test_assert_no_err(reopened.compact(), "Could not compact", t)
+	expiring, err := open_job_store(filepath.Join(dir, "jobs.journal"), "", 30*24*time.Hour)
+	test_assert_no_err(err, "Could not reopen job store", t)
+	defer expiring.Close()
+	_, ok := expiring.job(tweet_job_id(1))
+	test_assert_eq(false, ok, "Old finished jobs should be dropped", t)
+	for _, i := range []int64{2, 3, 6} {
+		_, ok := expiring.job(tweet_job_id(i))
+		test_assert_eq(true, ok, fmt.Sprintf("Job %v should be kept", i), t)
+	}
+	test_assert_eq(int64(5), expiring.last_processed_tweet_id(), "Cursor should survive dropping jobs", t)
+}
+
+func TestJobStoreMigration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "job_store_test")
+	test_assert_no_err(err, "Could not create temp dir", t)
+	defer os.RemoveAll(dir)
+	legacy_state := `{"LastTweetID":123,"TweetIDsInProgress":{"456":true},"LastDMID":321,"DMsInProgress":{"654":{"DMID":"654","DMText":"Hello!","Sender":{"id":"abc","screen_name":"TestUser"}}}}`
+	test_assert_no_err(ioutil.WriteFile(filepath.Join(dir, "persistent_state.json"), []byte(legacy_state), 0600), "Could not write state", t)
+
+	store, err := open_job_store(filepath.Join(dir, "jobs.journal"), filepath.Join(dir, "persistent_state.json"), 0)
+	test_assert_no_err(err, "Could not open job store", t)
+	defer store.Close()
+	test_assert_eq(int64(123), store.last_processed_tweet_id(), "Tweet cursor should be imported", t)
+	test_assert_eq(int64(321), store.last_processed_dm_id(), "DM cursor should be imported", t)
+	tweets := store.unfinished_jobs(JOB_TYPE_TWEET)
+	test_assert_eq(1, len(tweets), "In progress tweet should be imported", t)
+	test_assert_eq("456", tweets[0].SourceID, "Unexpected tweet", t)
+	dms := store.unfinished_jobs(JOB_TYPE_DM)
+	test_assert_eq(1, len(dms), "In progress DM should be imported", t)
+	test_assert_eq("Hello!", dms[0].DM.DMText, "Unexpected DM", t)
+
+	//the state file is only imported into a new journal
+	test_assert_no_err(store.finish(tweets[0].ID, &JobResult{Status: JOB_STATUS_SUCCEEDED}), "Could not finish job", t)
+	reopened, err := open_job_store(filepath.Join(dir, "jobs.journal"), filepath.Join(dir, "persistent_state.json"), 0)
+	test_assert_no_err(err, "Could not reopen job store", t)
+	defer reopened.Close()
+	test_assert_eq(0, len(reopened.unfinished_jobs(JOB_TYPE_TWEET)), "State file should not be imported twice", t)
+	test_assert_eq(int64(456), reopened.last_processed_tweet_id(), "Unexpected tweet cursor", t)
+}
+
+func TestFakeRunnerIsDeterministic(t *testing.T) {
+	runner := &FakeRunner{}
+	first, err := runner.Run(context.Background(), "print('hello!')", "1", test_run_limits().Default, root_logger)
+	test_assert_no_err(err, "Fake runner failed", t)
+	second, err := runner.Run(context.Background(), "print('hello!')", "2", test_run_limits().Default, root_logger)
+	test_assert_no_err(err, "Fake runner failed", t)
+	other, err := runner.Run(context.Background(), "print('bye!')", "3", test_run_limits().Default, root_logger)
+	test_assert_no_err(err, "Fake runner failed", t)
+
+	test_assert_eq(true, bytes.Equal(first.MediaData, second.MediaData), "Same cart should generate the same GIF", t)
+	test_assert_eq(false, bytes.Equal(first.MediaData, other.MediaData), "Different carts should generate different GIFs", t)
+}
+
+func TestHandleTweet(t *testing.T) {
+	fake, tc := new_fake_twitter()
+	defer fake.server.Close()
+	fake.tweets["123"] = `{"id":123,"id_str":"123","full_text":"@TweetCartRunner ?\"hello!\"",
+		"user":{"id":7,"id_str":"7","screen_name":"test_user"},
+		"entities":{"user_mentions":[{"indices":[0,16],"screen_name":"TweetCartRunner"}]}}`
+
+	result := handle_tweet(context.Background(), 123, 123, test_tweet_handler(tc, &FakeRunner{}), root_logger)
+
+	test_assert_eq(JOB_STATUS_SUCCEEDED, result.Status, "Job should have succeeded", t)
+	test_assert_eq("?\"hello!\"", result.CartSource, "Unexpected cart source", t)
+	test_assert_eq(1, len(result.MediaIDs), "Should have recorded the media ID", t)
+	test_assert_eq(1, fake.request_count("GET /1.1/statuses/show.json"), "Should have looked up the tweet", t)
+	test_assert_eq(3, fake.request_count("POST /1.1/media/upload.json"), "Should have uploaded the GIF", t)
+	test_assert_eq(1, len(fake.statuses), "Should have replied once", t)
+	test_assert_eq("@test_user Recorded 8s at 30fps", fake.statuses[0], "Unexpected reply", t)
+}
+
+func TestHandleTweetRunnerError(t *testing.T) {
+	fake, tc := new_fake_twitter()
+	defer fake.server.Close()
+	fake.tweets["123"] = `{"id":123,"id_str":"123","full_text":"@TweetCartRunner x=",
+		"user":{"id":7,"id_str":"7","screen_name":"test_user"},
+		"entities":{"user_mentions":[{"indices":[0,16],"screen_name":"TweetCartRunner"}]}}`
+
+	result := handle_tweet(context.Background(), 123, 123, test_tweet_handler(tc, &FakeRunner{err: errors.New("syntax error")}), root_logger)
+
+	test_assert_eq(JOB_STATUS_FAILED, result.Status, "Job should have failed", t)
+	test_assert_eq("syntax error", result.Error, "Unexpected error", t)
+	test_assert_eq(0, fake.request_count("POST /1.1/media/upload.json"), "Should not upload anything", t)
+	test_assert_eq(1, len(fake.statuses), "Should have replied once", t)
+	test_assert_eq(true, strings.HasPrefix(fake.statuses[0], "@test_user\nI was unable to generate the GIF"), "Unexpected reply", t)
+}
+
+func TestHandleDM(t *testing.T) {
+	fake, tc := new_fake_twitter()
+	defer fake.server.Close()
+	handler := &DMHanderContext{
+		twitter_client: tc,
+		my_user:        &twitter.User{ScreenName: "TweetCartRunner"},
+		runner:         &FakeRunner{},
+		run_limits:     test_run_limits(),
+	}
+	sender := User{Id: "7", ScreenName: "test_user"}
+
+	handle_dm(context.Background(), "321", "?\"hello!\"", nil, sender, handler, root_logger)
+
+	test_assert_eq(3, fake.request_count("POST /1.1/media/upload.json"), "Should have uploaded the GIF", t)
+	test_assert_eq(2, len(fake.statuses), "Should have posted the GIF and the source", t)
+	test_assert_eq("By @test_user\nRecorded 8s at 30fps", fake.statuses[0], "Unexpected GIF tweet", t)
+	test_assert_eq("@TweetCartRunner ?\"hello!\"", fake.statuses[1], "Unexpected source tweet", t)
+}
+
+func TestScratchDirs(t *testing.T) {
+	scratch_root, err := ioutil.TempDir("", "scratch_test")
+	test_assert_no_err(err, "Could not create scratch root", t)
+	defer os.RemoveAll(scratch_root)
+
+	//a failed run should not leave its job directory behind
+	runner := &Pico8Runner{exec_path: "./does-not-exist/pico8", scratch_root: scratch_root}
+	_, err = runner.Run(context.Background(), "print('hello!')", "123", test_run_limits().Default, root_logger)
+	test_assert_eq(true, err != nil, "Run should fail without PICO-8", t)
+	entries, err := ioutil.ReadDir(scratch_root)
+	test_assert_no_err(err, "Could not read scratch root", t)
+	test_assert_eq(0, len(entries), "Job directory should have been deleted", t)
+
+	//stale job directories get cleaned up on startup, everything else is left alone
+	stale_dir := scratch_root + "/" + SCRATCH_DIR_PREFIX + "456_789"
+	test_assert_no_err(os.MkdirAll(stale_dir+"/desktop", 0700), "Could not create stale dir", t)
+	test_assert_no_err(ioutil.WriteFile(stale_dir+"/456.p8", []byte("x=1"), 0600), "Could not create stale cart", t)
+	test_assert_no_err(ioutil.WriteFile(scratch_root+"/keep.txt", []byte("keep"), 0600), "Could not create file", t)
+
+	clean_scratch_dirs(scratch_root)
+	_, err = os.Stat(stale_dir)
+	test_assert_eq(true, os.IsNotExist(err), "Stale job directory should be deleted", t)
+	_, err = os.Stat(scratch_root + "/keep.txt")
+	test_assert_no_err(err, "Other files should be left alone", t)
+}
+
+func TestWebhookSignature(t *testing.T) {
+	consumer_secret := []byte("test_consumer_secret")
+	//recorded from a real DM webhook, with the ids changed
+	payload := `{"for_user_id":"1000","direct_message_events":[{"type":"message_create","id":"1234567890","created_timestamp":"1586049421000","message_create":{"target":{"recipient_id":"1000"},"sender_id":"2000","message_data":{"text":"?\"hello!\"","entities":{"hashtags":[],"symbols":[],"user_mentions":[],"urls":[]}}}}],"users":{"1000":{"id":"1000","screen_name":"TweetCartRunner"},"2000":{"id":"2000","screen_name":"test_user"}}}`
+	valid_signature := compute_webhook_signature([]byte(payload), consumer_secret)
+
+	tests := []struct {
+		name            string
+		signature       string
+		body            string
+		expected_status int
+		expected_dms    int
+	}{
+		{"valid signature", valid_signature, payload, http.StatusOK, 1},
+		{"missing signature", "", payload, http.StatusUnauthorized, 0},
+		{"signature with different secret", compute_webhook_signature([]byte(payload), []byte("wrong secret")), payload, http.StatusUnauthorized, 0},
+		{"tampered body", valid_signature, strings.Replace(payload, "hello!", "pwned!", 1), http.StatusUnauthorized, 0},
+		{"signature without prefix", strings.TrimPrefix(valid_signature, "sha256="), payload, http.StatusUnauthorized, 0},
+		{"garbage signature", "sha256=garbage", payload, http.StatusUnauthorized, 0},
+	}
+
+	jobs, dir := test_job_store(t)
+	defer os.RemoveAll(dir)
+	defer jobs.Close()
+	dm_context := &DMHanderContext{
+		consumer_secret: consumer_secret,
+		my_user:         &twitter.User{ScreenName: "TweetCartRunner"},
+		dm_channel:      make(chan *DMCart, 16),
+		jobs:            jobs,
+	}
+	expected_rejections := bot_metrics.webhook_requests_rejected.value()
+	for _, test := range tests {
+		req := httptest.NewRequest("POST", WEBHOOK_PATH, strings.NewReader(test.body))
+		if len(test.signature) > 0 {
+			req.Header.Set(WEBHOOK_SIGNATURE_HEADER, test.signature)
+		}
+		recorder := httptest.NewRecorder()
+		dm_context.ServeHTTP(recorder, req)
+
+		test_assert_eq(test.expected_status, recorder.Code, test.name+": unexpected status", t)
+		test_assert_eq(test.expected_dms, len(dm_context.dm_channel), test.name+": unexpected number of DMs queued", t)
+		if test.expected_status == http.StatusUnauthorized {
+			expected_rejections++
+		}
+		for len(dm_context.dm_channel) > 0 {
+			dm := <-dm_context.dm_channel
+			test_assert_eq("1234567890", dm.DMID, test.name+": unexpected DM ID", t)
+			test_assert_eq("test_user", dm.Sender.ScreenName, test.name+": unexpected sender", t)
+		}
+	}
+	test_assert_eq(expected_rejections, bot_metrics.webhook_requests_rejected.value(), "Rejected requests should be counted", t)
+
+	//the crc challenge is not signed, but must be answered with our signature of the token
+	req := httptest.NewRequest("GET", WEBHOOK_PATH+"?crc_token=abc", nil)
+	recorder := httptest.NewRecorder()
+	dm_context.ServeHTTP(recorder, req)
+	test_assert_eq(http.StatusOK, recorder.Code, "crc challenge should succeed", t)
+	test_assert_eq(`{"response_token": "`+compute_webhook_signature([]byte("abc"), consumer_secret)+`"}`, recorder.Body.String(), "Bad crc response", t)
+
+	//huge bodies are refused before they are read, or once too much has been read if their size is not given
+	for _, content_length := range []int64{MAX_WEBHOOK_BODY_SIZE + 1, -1} {
+		req = httptest.NewRequest("POST", WEBHOOK_PATH, strings.NewReader(strings.Repeat("x", MAX_WEBHOOK_BODY_SIZE+1)))
+		req.ContentLength = content_length
+		recorder = httptest.NewRecorder()
+		dm_context.ServeHTTP(recorder, req)
+		test_assert_eq(http.StatusRequestEntityTooLarge, recorder.Code, fmt.Sprintf("Body too large with length %v should be refused", content_length), t)
+	}
+}
+
+func TestParseCartError(t *testing.T) {
+	offset := CART_PREAMBLE_LINE_COUNT
+	tests := []struct {
+		name            string
+		output          string
+		user_line_count int
+		expected        *CartError
+	}{
+		{"no error", "hello\n123 done\n", 3, nil},
+		{"syntax error",
+			fmt.Sprintf("syntax error line %v (tab 0)\nx=\nunexpected symbol near '<eof>'\n", offset+2), 2,
+			&CartError{Kind: CART_ERROR_SYNTAX, Line: 2, Message: "unexpected symbol near '<eof>'"}},
+		{"syntax error referencing another line",
+			fmt.Sprintf("syntax error line %v (tab 0)\nprint(\"hi\"\n')' expected (to close '(' at line %v) near '<eof>'\n", offset+5, offset+4), 5,
+			&CartError{Kind: CART_ERROR_SYNTAX, Line: 5, Message: "')' expected (to close '(' at line 4) near '<eof>'"}},
+		{"runtime error",
+			fmt.Sprintf("runtime error line %v tab 0\nfoo()\nattempt to call global 'foo' (a nil value)\nat line %v (tab 0)\n", offset+1, offset+1), 3,
+			&CartError{Kind: CART_ERROR_RUNTIME, Line: 1, Message: "attempt to call global 'foo' (a nil value)"}},
+		{"missing end reported after the cart",
+			fmt.Sprintf("syntax error line %v (tab 0)\nfinish()\n'end' expected near '<eof>'\n", offset+30), 4,
+			&CartError{Kind: CART_ERROR_SYNTAX, Line: 4, Message: "'end' expected near '<eof>'"}},
+		{"error message not finished printing",
+			fmt.Sprintf("runtime error line %v tab 0\nfoo()\nattempt to c", offset+1), 3,
+			nil},
+	}
+	for _, test := range tests {
+		actual := parse_cart_error(test.output, offset, test.user_line_count)
+		if test.expected == nil || actual == nil {
+			test_assert_eq(test.expected == nil, actual == nil, test.name+": unexpected error", t)
+			continue
+		}
+		test_assert_eq(*test.expected, *actual, test.name, t)
+	}
+}
+
+func TestDescribeLongCartError(t *testing.T) {
+	//"runtime error on line 1: " is an odd number of bytes, so the cut lands in the middle of a character
+	message := strings.Repeat("é", 200)
+	description := describe_cart_error(&CartError{Kind: CART_ERROR_RUNTIME, Line: 1, Message: message})
+	test_assert_eq(true, utf8.ValidString(description), "Truncated error should be valid UTF-8: "+description, t)
+	test_assert_eq(true, strings.HasSuffix(description, "é..."), "Truncated error should end with a whole character", t)
+}
+
+func TestHandleTweetReportsCartError(t *testing.T) {
+	fake, tc := new_fake_twitter()
+	defer fake.server.Close()
+	fake.tweets["123"] = `{"id":123,"id_str":"123","full_text":"@TweetCartRunner x=",
+		"user":{"id":7,"id_str":"7","screen_name":"test_user"},
+		"entities":{"user_mentions":[{"indices":[0,16],"screen_name":"TweetCartRunner"}]}}`
+
+	cart_error := &CartError{Kind: CART_ERROR_SYNTAX, Line: 1, Message: "unexpected symbol near '<eof>'"}
+	handle_tweet(context.Background(), 123, 123, test_tweet_handler(tc, &FakeRunner{err: cart_error}), root_logger)
+
+	test_assert_eq(1, len(fake.statuses), "Should have replied once", t)
+	test_assert_eq("@test_user\nI was unable to generate the GIF of your tweetcart. PICO-8 reported a syntax error on line 1: unexpected symbol near '<eof>'",
+		fake.statuses[0], "Reply should contain the error", t)
 }
 
-func TestPersistThread(t *testing.T) {
-	test_file := "test_persist.json"
-	os.Remove(test_file)
-	state := load_persistent_state_file(test_file)
-	test_assert_eq(int64(0), state.LastTweetID, "Initial tweet should be 0", t)
+func TestLoadConfig(t *testing.T) {
+	no_env := func(string) string { return "" }
 
-	tweet_ids_in_progress := make(chan int64)
-	processed_tweet_ids := make(chan int64)
-	status_channel := make(chan int)
+	//the original positional arguments still work
+	config, err := load_config([]string{"tcr", "keys.txt", "8", "my_domain.com", "my_dev_env", "tcr.log"}, no_env)
+	test_assert_no_err(err, "Positional arguments should be valid", t)
+	if err == nil {
+		test_assert_eq("keys.txt", config.KeysFile, "Bad keys file", t)
+		test_assert_eq(int64(8), config.ConcurrentCartHandlers, "Bad number of handlers", t)
+		test_assert_eq("my_domain.com", config.WebhookDomainName, "Bad domain name", t)
+		test_assert_eq("my_dev_env", config.WebhookEnvName, "Bad env name", t)
+		test_assert_eq("tcr.log", config.LogFile, "Bad log file", t)
+		test_assert_eq(":443", config.ListenAddress, "Should use default listen address", t)
+		test_assert_eq(8*time.Second, config.RecordingLength.Duration, "Should use default recording length", t)
+		test_assert_eq("https://my_domain.com/webhook", config.webhook_url(), "Bad webhook url", t)
+		test_assert_eq("https://api.twitter.com/1.1/account_activity/all/my_dev_env", config.twitter_account_activity_url(), "Bad account activity url", t)
+	}
+
+	//flags override environment variables which override the config file
+	config_file, err := ioutil.TempFile("", "config_test")
+	test_assert_no_err(err, "Could not create config file", t)
+	defer os.Remove(config_file.Name())
+	config_file.WriteString(`{"keys_file": "file_keys.txt", "concurrent_cart_handlers": 2, "webhook_domain_name": "file.com",
+		"webhook_env_name": "file_env", "listen_address": ":8443", "recording_length": "4s", "cart_timeout": "40s"}`)
+	config_file.Close()
+	env := map[string]string{
+		"TWEETCARTRUNNER_CONFIG":           config_file.Name(),
+		"TWEETCARTRUNNER_WEBHOOK_ENV_NAME": "env_env",
+		"TWEETCARTRUNNER_CART_TIMEOUT":     "45s",
+		"TWEETCARTRUNNER_LISTEN_ADDRESS":   ":9443",
+	}
+	getenv := func(name string) string { return env[name] }
+	config, err = load_config([]string{"tcr", "-listen_address", ":10443", "-pico8_path", "/opt/pico8", "-quota_allowlist", "alice, @bob,",
+		"-hold_dm_tweets_for_approval", "true"}, getenv)
+	test_assert_no_err(err, "Config should be valid", t)
+	if err == nil {
+		test_assert_eq("file_keys.txt", config.KeysFile, "Should come from the config file", t)
+		test_assert_eq(int64(2), config.ConcurrentCartHandlers, "Should come from the config file", t)
+		test_assert_eq(4*time.Second, config.RecordingLength.Duration, "Should come from the config file", t)
+		test_assert_eq("env_env", config.WebhookEnvName, "Environment should override config file", t)
+		test_assert_eq(45*time.Second, config.CartTimeout.Duration, "Environment should override config file", t)
+		test_assert_eq(":10443", config.ListenAddress, "Flags should override everything", t)
+		test_assert_eq("/opt/pico8", config.Pico8Path, "Flags should override everything", t)
+		test_assert_eq("[alice @bob]", fmt.Sprint(config.QuotaAllowlist), "Lists should be split on commas", t)
+		test_assert_eq(true, config.HoldDMTweetsForApproval, "Bools should be parsed", t)
+	}
+
+	invalid_args := [][]string{
+		{"tcr"},
+		{"tcr", "keys.txt", "8", "my_domain.com"},
+		{"tcr", "keys.txt", "0", "my_domain.com", "my_dev_env"},
+		{"tcr", "keys.txt", "eight", "my_domain.com", "my_dev_env"},
+		{"tcr", "-recording_length", "40s", "keys.txt", "8", "my_domain.com", "my_dev_env"},
+		{"tcr", "-cart_timeout", "thirty", "keys.txt", "8", "my_domain.com", "my_dev_env"},
+		//15s of recording after 300 frames could not finish
+		{"tcr", "-cart_timeout", "30s", "keys.txt", "8", "my_domain.com", "my_dev_env"},
+		{"tcr", "-config", "does_not_exist.json"},
+		{"tcr", "-hold_dm_tweets_for_approval", "maybe", "keys.txt", "8", "my_domain.com", "my_dev_env"},
+	}
+	for _, args := range invalid_args {
+		_, err := load_config(args, no_env)
+		test_assert_eq(true, err != nil, fmt.Sprintf("%v should be invalid", args), t)
+	}
+}
+
+func TestResolveRunParams(t *testing.T) {
+	limits := test_run_limits()
+	tests := []struct {
+		name     string
+		cart     string
+		expected RunParams
+	}{
+		{"no directives", "print('hello!')", limits.Default},
+		{"all directives", "--len=4 fps=15\n--start=10\nprint('hello!')",
+			RunParams{RecordingLength: 4 * time.Second, StaticRecordingLength: 2 * time.Second, FrameRate: 15, StartFrame: 10, Format: "gif"}},
+		{"fractional length", "--len=2.5\nprint('hello!')",
+			RunParams{RecordingLength: 2500 * time.Millisecond, StaticRecordingLength: 2 * time.Second, FrameRate: 30, StartFrame: 2, Format: "gif"}},
+		{"clamped to the limits", "--len=600 fps=60 start=0\nprint('hello!')",
+			RunParams{RecordingLength: 15 * time.Second, StaticRecordingLength: 2 * time.Second, FrameRate: 30, StartFrame: 1, Format: "gif"}},
+		{"clamped to the minimums", "--len=0.1 fps=1\nprint('hello!')",
+			RunParams{RecordingLength: 1 * time.Second, StaticRecordingLength: 2 * time.Second, FrameRate: 5, StartFrame: 2, Format: "gif"}},
+		{"not numbers", "--len=long fps=fast\nprint('hello!')", limits.Default},
+		{"mp4", "--format=MP4\nprint('hello!')",
+			RunParams{RecordingLength: 8 * time.Second, StaticRecordingLength: 2 * time.Second, FrameRate: 30, StartFrame: 2, Format: "mp4"}},
+		{"unknown format", "--format=avi\nprint('hello!')", limits.Default},
+		{"only leading comments count", "print('hello!')\n--len=4", limits.Default},
+		{"prose is not a directive", "-- by len\n-- my fps=15 demo\nprint('hello!')", limits.Default},
+		{"directives after a header comment", "-- my demo\n--len=4\nprint('hello!')",
+			RunParams{RecordingLength: 4 * time.Second, StaticRecordingLength: 2 * time.Second, FrameRate: 30, StartFrame: 2, Format: "gif"}},
+	}
+	for _, test := range tests {
+		test_assert_eq(test.expected, resolve_run_params(test.cart, limits), test.name, t)
+	}
+
+	_, is_notweet := parse_cart_directives("--len=4\n--notweet\nprint('hello!')")["notweet"]
+	test_assert_eq(true, is_notweet, "notweet should be a directive", t)
+	_, is_notweet = parse_cart_directives("-- my notweet demo\nprint('hello!')")["notweet"]
+	test_assert_eq(false, is_notweet, "notweet in a comment should not be a directive", t)
+	test_assert_eq("Recorded 2.5s at 15fps", describe_run_params(RunParams{RecordingLength: 2500 * time.Millisecond, FrameRate: 15, StartFrame: 2}, limits), "Bad description", t)
+	test_assert_eq("Recorded 4s at 30fps from frame 10 as MP4", describe_run_params(RunParams{RecordingLength: 4 * time.Second, FrameRate: 30, StartFrame: 10, Format: "mp4"}, limits), "Bad description", t)
+
+	params := limits.Default
+	test_assert_eq(params, recorded_params("_abc done", "_abc", params), "Carts with _draw() are recorded for the RecordingLength", t)
+	params.RecordingLength = params.StaticRecordingLength
+	test_assert_eq(params, recorded_params("_abc static\n_abc done", "_abc", limits.Default), "Carts without _draw() are recorded for the StaticRecordingLength", t)
+}
+
+func TestSetGifFrameRate(t *testing.T) {
+	result, err := (&FakeRunner{frame_count: 30}).Run(context.Background(), "print('hello!')", "1", test_run_limits().Default, root_logger)
+	test_assert_no_err(err, "Fake runner failed", t)
+
+	resampled, err := set_gif_frame_rate(result.MediaData, 10)
+	test_assert_no_err(err, "Could not change frame rate", t)
+	anim, err := gif.DecodeAll(bytes.NewReader(resampled))
+	test_assert_no_err(err, "Resampled GIF is not valid", t)
+	//the fake runner records at 100/3 fps
+	test_assert_eq(9, len(anim.Image), "Should keep about 1 out of every 3 frames", t)
+	total_delay := 0
+	for _, delay := range anim.Delay {
+		total_delay += delay
+	}
+	test_assert_eq(90, total_delay, "Length of the GIF should not change", t)
+
+	unchanged, err := set_gif_frame_rate(result.MediaData, 40)
+	test_assert_no_err(err, "Could not change frame rate", t)
+	test_assert_eq(true, bytes.Equal(result.MediaData, unchanged), "GIF should not change if already at the frame rate", t)
+}
+
+func TestMP4Output(t *testing.T) {
+	test_assert_eq("tweet_video", media_category(MEDIA_TYPE_MP4, false), "Bad category", t)
+	test_assert_eq("dm_video", media_category(MEDIA_TYPE_MP4, true), "Bad category", t)
+	test_assert_eq("tweet_gif", media_category(MEDIA_TYPE_GIF, false), "Bad category", t)
+	test_assert_eq("dm_gif", media_category(MEDIA_TYPE_GIF, true), "Bad category", t)
+
+	params := test_run_limits().Default
+	params.Format = MEDIA_FORMAT_MP4
+
+	//falls back to GIF without ffmpeg
+	result, err := (&FakeRunner{ffmpeg_path: "./does-not-exist/ffmpeg"}).Run(context.Background(), "print('hello!')", "1", params, root_logger)
+	test_assert_no_err(err, "Fake runner failed", t)
+	test_assert_eq(MEDIA_TYPE_GIF, result.MediaType, "Should fall back to GIF", t)
+	test_assert_eq(MEDIA_FORMAT_GIF, result.Params.Format, "Should report the format actually used", t)
+
+	ffmpeg_path, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		t.Skip("ffmpeg is not installed")
+	}
+	result, err = (&FakeRunner{ffmpeg_path: ffmpeg_path}).Run(context.Background(), "print('hello!')", "1", params, root_logger)
+	test_assert_no_err(err, "Fake runner failed", t)
+	test_assert_eq(MEDIA_TYPE_MP4, result.MediaType, "Should be an MP4", t)
+	test_assert_eq("ftyp", string(result.MediaData[4:8]), "Not an MP4 file", t)
+}
+
+//A GIF that does not compress well, like the large_gif cart in TestGenerateGif
+func noisy_test_gif(size, frame_count int, duplicate_frames bool) []byte {
+	random := rand.New(rand.NewSource(1))
+	anim := gif.GIF{}
+	for frame := 0; frame < frame_count; frame++ {
+		img := image.NewPaletted(image.Rect(0, 0, size, size), PICO_8_PALETTE)
+		if duplicate_frames && frame%2 == 1 {
+			copy(img.Pix, anim.Image[frame-1].Pix)
+		} else {
+			//noise in 4x4 blocks, like PICO-8 pixels scaled up to 4x
+			for y := 0; y < size; y += 4 {
+				for x := 0; x < size; x += 4 {
+					c := uint8(random.Intn(len(PICO_8_PALETTE)))
+					for i := 0; i < 16; i++ {
+						img.SetColorIndex(x+i%4, y+i/4, c)
+					}
+				}
+			}
+		}
+		anim.Image = append(anim.Image, img)
+		anim.Delay = append(anim.Delay, 3)
+	}
+	buf := bytes.Buffer{}
+	gif.EncodeAll(&buf, &anim)
+	return buf.Bytes()
+}
+
+func TestOptimizeGif(t *testing.T) {
+	small_gif := noisy_test_gif(128, 2, false)
+	optimized, strategies, err := optimize_gif(small_gif, len(small_gif))
+	test_assert_no_err(err, "Should not fail", t)
+	test_assert_eq(0, len(strategies), "GIF already fits", t)
+	test_assert_eq(true, bytes.Equal(small_gif, optimized), "GIF already fits", t)
+
+	tests := []struct {
+		name                string
+		gif_data            []byte
+		max_size_percentage int
+		expected_strategy   string
+		expected_frames     int
+		expected_size       int
+	}{
+		{"duplicate frames", noisy_test_gif(512, 8, true), 60, "frame dedup", 4, 512},
+		{"noise", noisy_test_gif(512, 8, false), 50, "downscale", 8, 256},
+		{"too much noise", noisy_test_gif(512, 8, false), 8, "frame dropping", 4, 128},
+	}
+	for _, test := range tests {
+		max_size := len(test.gif_data) * test.max_size_percentage / 100
+		optimized, strategies, err := optimize_gif(test.gif_data, max_size)
+		test_assert_no_err(err, test.name+": should be able to shrink", t)
+		if err != nil {
+			continue
+		}
+		test_assert_less(len(optimized), max_size+1, test.name+": GIF is still too big", t)
+		test_assert_eq(test.expected_strategy, strategies[len(strategies)-1], test.name+": unexpected strategy", t)
+
+		anim, err := gif.DecodeAll(bytes.NewReader(optimized))
+		test_assert_no_err(err, test.name+": optimized GIF is not valid", t)
+		test_assert_eq(test.expected_frames, len(anim.Image), test.name+": unexpected frame count", t)
+		test_assert_eq(test.expected_size, anim.Config.Width, test.name+": unexpected width", t)
+		total_delay := 0
+		for _, delay := range anim.Delay {
+			total_delay += delay
+		}
+		test_assert_eq(24, total_delay, test.name+": length of the GIF should not change", t)
+	}
+
+	_, _, err = optimize_gif(noisy_test_gif(128, 8, false), 100)
+	test_assert_eq(true, err != nil, "Should not be able to shrink a GIF this much", t)
+}
+
+//Runs carts with a FakeRunner and remembers the source of the last one
+type recording_runner struct {
+	FakeRunner
+	cart_source string
+}
+
+func (runner *recording_runner) Run(ctx context.Context, cart_source, job_id string, params RunParams, logger *Logger) (*RunResult, error) {
+	runner.cart_source = cart_source
+	return runner.FakeRunner.Run(ctx, cart_source, job_id, params, logger)
+}
+
+//Turns the output of divide_cart_up_into_tweets into a thread of replies, starting with ID 201
+func test_cart_thread(tweet_texts []string, mention string) []*twitter.Tweet {
+	user := &twitter.User{ID: 7, IDStr: "7", ScreenName: "test_user"}
+	thread := make([]*twitter.Tweet, 0, len(tweet_texts))
+	for i, text := range tweet_texts {
+		tweet := &twitter.Tweet{
+			ID:       int64(201 + i),
+			IDStr:    strconv.Itoa(201 + i),
+			FullText: text,
+			User:     user,
+			Entities: &twitter.Entities{UserMentions: []twitter.MentionEntity{
+				{Indices: twitter.Indices{0, len([]rune(mention)) + 1}, ScreenName: mention},
+			}},
+		}
+		if i > 0 {
+			tweet.InReplyToStatusID = thread[i-1].ID
+			tweet.InReplyToStatusIDStr = thread[i-1].IDStr
+			tweet.InReplyToUserID = user.ID
+		}
+		thread = append(thread, tweet)
+	}
+	return thread
+}
+
+func TestSplitCartPartCounter(t *testing.T) {
+	part, ok := split_cart_part_counter("@TweetCartRunner cls()\n--2/3")
+	test_assert_eq(true, ok, "Should have a counter", t)
+	test_assert_eq(cart_part{text: "@TweetCartRunner cls()", separator: "\n", part: 2, total: 3}, part, "Unexpected part", t)
+
+	part, ok = split_cart_part_counter("goto _ --3/3 ")
+	test_assert_eq(true, ok, "Trailing whitespace should be ignored", t)
+	test_assert_eq(cart_part{text: "goto _", separator: " ", part: 3, total: 3}, part, "Unexpected part", t)
+
+	_, ok = split_cart_part_counter("x=1--2")
+	test_assert_eq(false, ok, "Comments are not counters", t)
+	_, ok = split_cart_part_counter("x=1 --4/3")
+	test_assert_eq(false, ok, "Part cannot be past the total", t)
+}
+
+func TestReassembleCart(t *testing.T) {
+	cart := `r=rnd f=flr m={-1,1}
+srand(2)
+s='@tweetcartrunner'l={}
+for i=1,#s do
+add(l,{
+vx=(r(4)+1)*m[f(r(2))+1],
+vy=(r(4)+1)*m[f(r(2))+1],
+x=i*4,y=0,
+l=sub(s,i,i),
+c=r(15)+1})
+end
+::_:: cls()
+for l in all(l) do
+l.x+=l.vx l.y+=l.vy
+if(l.x<0 or l.x>128)l.vx*=-1
+if(l.y<0 or l.y>128)l.vy*=-1
+? l.l,l.x,l.y,l.c
+end
+flip()
+goto _`
+	tweets := divide_cart_up_into_tweets(cart, "TweetCartRunner")
+	test_assert_eq(2, len(tweets), "Should be 2 tweets", t)
+
+	thread := test_cart_thread(tweets, "TweetCartRunner")
+	test_assert_eq(cart, reassemble_cart(thread), "Reassembled cart should match the original", t)
+	test_assert_eq(int64(202), tweet_id_to_run(thread[1]), "Last part should be run itself, not its parent", t)
+}
+
+func TestHandleTweetThread(t *testing.T) {
+	fake, tc := new_fake_twitter()
+	defer fake.server.Close()
+	thread := test_cart_thread([]string{
+		"@TweetCartRunner x=64\n--1/3",
+		"@TweetCartRunner ::_:: cls()\n--2/3",
+		"@TweetCartRunner circ(x,x,8) flip() goto _ --3/3",
+	}, "TweetCartRunner")
+	for _, tweet := range thread {
+		tweet_json, err := json.Marshal(tweet)
+		test_assert_no_err(err, "Could not encode tweet", t)
+		fake.tweets[tweet.IDStr] = string(tweet_json)
+	}
+	//a reply from someone else that looks like part of the thread should stop the walk
+	stranger := test_cart_thread([]string{"@TweetCartRunner x=0\n--2/3"}, "TweetCartRunner")[0]
+	stranger.ID, stranger.IDStr = 300, "300"
+	stranger.User = &twitter.User{ID: 8, IDStr: "8", ScreenName: "stranger"}
+	stranger.InReplyToStatusID, stranger.InReplyToUserID = 201, 7
 
-	dms_in_progress := make(chan *DMCart)
-	processed_dm_ids := make(chan string)
+	runner := &recording_runner{}
+	handle_tweet(context.Background(), 203, 203, test_tweet_handler(tc, runner), root_logger)
+	test_assert_eq("x=64\n::_:: cls()\ncirc(x,x,8) flip() goto _", runner.cart_source, "Should run the whole thread", t)
+	test_assert_eq(3, fake.request_count("GET /1.1/statuses/show.json"), "Should have looked up every part", t)
+	test_assert_eq(1, len(fake.statuses), "Should have replied once", t)
 
-	//TODO need some sort of sync channel
-	go perstisting_thread(tweet_ids_in_progress, processed_tweet_ids, dms_in_progress, processed_dm_ids, state, status_channel, test_file)
+	stranger_json, err := json.Marshal(stranger)
+	test_assert_no_err(err, "Could not encode tweet", t)
+	fake.tweets["300"] = string(stranger_json)
+	runner = &recording_runner{}
+	handle_tweet(context.Background(), 300, 300, test_tweet_handler(tc, runner), root_logger)
+	test_assert_eq("x=0", runner.cart_source, "Should not use parts written by someone else", t)
 
-	current_tweet_id := int64(123)
-	tweet_ids_in_progress <- current_tweet_id
+	//the author mentioned us on every part, so the middle one is left for the last one
+	runner = &recording_runner{}
+	result := handle_tweet(context.Background(), 202, 202, test_tweet_handler(tc, runner), root_logger)
+	test_assert_eq(JOB_STATUS_IGNORED, result.Status, "Middle part should be ignored", t)
+	test_assert_eq("", runner.cart_source, "Middle part should not be run", t)
+	test_assert_eq(1, len(fake.statuses), "Should not reply to the middle part", t)
 
-	status := <-status_channel
-	test_assert_eq(PTS_STATE_PERSISTED, status, "", t)
+	mention := &twitter.Tweet{ID: 400, IDStr: "400", FullText: "@TweetCartRunner", User: thread[0].User, InReplyToStatusID: 202, InReplyToUserID: 7}
+	test_assert_eq(int64(202), tweet_id_to_run(mention), "Should run the tweet being replied to", t)
+	result = handle_tweet(context.Background(), tweet_id_to_run(mention), mention.ID, test_tweet_handler(tc, runner), root_logger)
+	test_assert_eq(JOB_STATUS_IGNORED, result.Status, "Middle part should not be run", t)
+	test_assert_eq("", runner.cart_source, "Middle part should not be run", t)
+	test_assert_eq(2, len(fake.statuses), "Should reply to the mention", t)
+	test_assert_eq(true, strings.Contains(fake.statuses[1], "last part, 3/3"), "Should ask for a mention on the last part", t)
+}
 
-	test_assert_eq(int64(0), state.LastTweetID, "Should not be updated for in progress tweets", t)
-	v, ok := state.TweetIDsInProgress[current_tweet_id]
-	test_assert_eq(true, ok, "Should be recorded as in progress", t)
-	test_assert_eq(true, v, "Should be recorded as in progress", t)
+func load_test_tweet(name string, t *testing.T) *twitter.Tweet {
+	tweet_json, err := ioutil.ReadFile("testdata/tweets/" + name + ".json")
+	test_assert_no_err(err, "Could not read tweet fixture", t)
+	tweet := &twitter.Tweet{}
+	test_assert_no_err(json.Unmarshal(tweet_json, tweet), "Could not decode tweet fixture", t)
+	return tweet
+}
 
-	file_contents, err := ioutil.ReadFile(test_file)
-	test_assert_eq(nil, err, "persist file should exist", t)
-	test_assert_eq(`{"LastTweetID":0,"TweetIDsInProgress":{"123":true},"LastDMID":0,"DMsInProgress":{}}`, string(file_contents), "Bad file contents in persist file", t)
+func TestRestoreURLs(t *testing.T) {
+	tests := []struct {
+		fixture  string
+		expected string
+	}{
+		{"field_access_urls", "p={io=2,tv=3}\n?p.io..\" \"..p.tv"},
+		{"url_after_escaped_text", "c={}\nfor i=0,3 do if(i<2 and i>=0)c.co=i end\n?c.co"},
+		{"urls_in_strings_and_media", "?\"https://www.lexaloffle.com/pico-8.php\"\n?\"see @TweetCartRunner or pico-8.com\""},
+		{"truncated_urls", "?\"pico-8.com/bbs/a/very/long/path/to/a/cart\"\n?\"https://www.lexaloffle.com/bbs/?tid=12345678901234\""},
+	}
+	for _, test := range tests {
+		tweet := load_test_tweet(test.fixture, t)
+		actual := sanitize_tweet_text(tweet.FullText, text_edits_from_entities(tweet.Entities, true))
+		test_assert_eq(test.expected, actual, "Unexpected cart for "+test.fixture, t)
+	}
 
-	processed_tweet_ids <- current_tweet_id
+	//DMs keep their mentions
+	tweet := load_test_tweet("urls_in_strings_and_media", t)
+	actual := sanitize_tweet_text(tweet.FullText, text_edits_from_entities(tweet.Entities, false))
+	test_assert_eq(true, strings.HasPrefix(actual, "@TweetCartRunner ?\"https://www.lexaloffle.com"), "Unexpected DM cart", t)
 
-	status = <-status_channel
-	test_assert_eq(PTS_STATE_PERSISTED, status, "", t)
+	//links truncated for display get restored from the expanded URL
+	url := twitter.URLEntity{URL: "https://t.co/abc", ExpandedURL: "http://example.com/a/very/long/path", DisplayURL: "example.com/a/very/long/…"}
+	test_assert_eq("example.com/a/very/long/path", original_url_text(url), "Unexpected URL", t)
+	url = twitter.URLEntity{URL: "https://t.co/abc", ExpandedURL: "http://www.example.com", DisplayURL: "example.com"}
+	test_assert_eq("www.example.com", original_url_text(url), "Unexpected URL", t)
+}
+
+func TestHandleTweetRestoresURLs(t *testing.T) {
+	fake, tc := new_fake_twitter()
+	defer fake.server.Close()
+	tweet_json, err := ioutil.ReadFile("testdata/tweets/field_access_urls.json")
+	test_assert_no_err(err, "Could not read tweet fixture", t)
+	fake.tweets["1001"] = string(tweet_json)
 
-	test_assert_eq(current_tweet_id, state.LastTweetID, "Should be updated for processed tweets", t)
-	v, ok = state.TweetIDsInProgress[current_tweet_id]
-	test_assert_eq(false, ok, "Should no longer be in progress", t)
-	test_assert_eq(false, v, "Should no longer be in progress", t)
+	runner := &recording_runner{}
+	handle_tweet(context.Background(), 1001, 1001, test_tweet_handler(tc, runner), root_logger)
+	test_assert_eq("p={io=2,tv=3}\n?p.io..\" \"..p.tv", runner.cart_source, "URLs should be restored before running", t)
+}
 
-	file_contents, err = ioutil.ReadFile(test_file)
-	test_assert_eq(nil, err, "persist file should exist", t)
-	test_assert_eq(`{"LastTweetID":123,"TweetIDsInProgress":{},"LastDMID":0,"DMsInProgress":{}}`, string(file_contents), "Bad file contents in persist file", t)
+func TestJobHistory(t *testing.T) {
+	store, dir := test_job_store(t)
+	defer os.RemoveAll(dir)
+	store.archive_dir = filepath.Join(dir, "archive")
 
-	current_dm := DMCart{
-		DMID:   "321",
-		DMText: "Hello!",
-		Sender: User{Id: "abc", ScreenName: "TestUser"},
+	yesterday := time.Now().Add(-24 * time.Hour)
+	store.enqueue(&Job{ID: tweet_job_id(1), Type: JOB_TYPE_TWEET, SourceID: "1", Author: "alice", CreatedAt: yesterday})
+	store.start(tweet_job_id(1))
+	store.finish(tweet_job_id(1), &JobResult{Status: JOB_STATUS_SUCCEEDED, CartSource: "?1", ReplyTweetID: 1001,
+		MediaIDs: []int64{42}, MediaData: []byte("GIF89a"), MediaType: MEDIA_TYPE_GIF, Output: "1 done\n"})
+	store.enqueue(&Job{ID: dm_job_id("2"), Type: JOB_TYPE_DM, SourceID: "2", Author: "bob"})
+	store.start(dm_job_id("2"))
+	result := &JobResult{CartSource: "x=", Output: "syntax error line 1\n"}
+	result.set_error(&CartError{Kind: CART_ERROR_SYNTAX, Line: 1, Message: "unexpected symbol near <eof>"})
+	store.finish(dm_job_id("2"), result)
+	store.Close()
+
+	job, _ := store.job(tweet_job_id(1))
+	archived, err := ioutil.ReadFile(job.MediaFile)
+	test_assert_no_err(err, "GIF should have been archived", t)
+	test_assert_eq("GIF89a", string(archived), "Unexpected archived GIF", t)
+
+	run_history := func(args ...string) string {
+		out := bytes.Buffer{}
+		args = append([]string{"-job_journal_file", filepath.Join(dir, "jobs.journal")}, args...)
+		test_assert_no_err(run_history_command(args, func(string) string { return "" }, &out), "history failed", t)
+		return out.String()
+	}
+
+	list := run_history()
+	test_assert_eq(3, strings.Count(list, "\n"), "Should list both jobs", t)
+	test_assert_less(strings.Index(list, "dm-2"), strings.Index(list, "tweet-1"), "Newest job should be first", t)
+	list = run_history("-user", "@Alice")
+	test_assert_eq(true, strings.Contains(list, "tweet-1") && !strings.Contains(list, "dm-2"), "Should only list alice's job", t)
+	list = run_history("-status", "failed")
+	test_assert_eq(true, strings.Contains(list, "syntax error") && !strings.Contains(list, "tweet-1"), "Should only list the failed job", t)
+	list = run_history("-since", time.Now().Format("2006-01-02"))
+	test_assert_eq(false, strings.Contains(list, "tweet-1"), "Should not list yesterday's job", t)
+
+	dump := run_history("2")
+	test_assert_eq(true, strings.Contains(dump, "Error kind:  syntax error"), "Should show the error kind", t)
+	test_assert_eq(true, strings.Contains(dump, "Cart source:\nx=\n"), "Should show the cart source", t)
+	test_assert_eq(true, strings.Contains(dump, "Output:\nsyntax error line 1\n"), "Should show the output", t)
+	dump = run_history("tweet-1")
+	test_assert_eq(true, strings.Contains(dump, "Reply:       https://twitter.com/i/web/status/1001"), "Should show the reply", t)
+}
+
+func test_logger(format string, level LogLevel) (*Logger, *bytes.Buffer) {
+	buf := &bytes.Buffer{}
+	logger := new_logger(buf, format, level)
+	logger.sink.now = func() time.Time { return time.Date(2020, 8, 1, 12, 0, 0, 0, time.UTC) }
+	return logger, buf
+}
+
+func TestLogger(t *testing.T) {
+	logger, buf := test_logger(LOG_FORMAT_LOGFMT, LOG_LEVEL_INFO)
+	job_logger := logger.for_job("tweet-123", JOB_TYPE_TWEET, "test_user").stage("run")
+	job_logger.Debug("Not logged")
+	job_logger.Warn("Error generating gif", "err", errors.New("syntax error"), "duration", 2*time.Second)
+	test_assert_eq(`time=2020-08-01T12:00:00Z level=warn msg="Error generating gif" job=tweet-123 type=tweet user=test_user stage=run err="syntax error" duration=2s`+"\n",
+		buf.String(), "Unexpected logfmt line", t)
+
+	logger, buf = test_logger(LOG_FORMAT_JSON, LOG_LEVEL_DEBUG)
+	logger.for_job("dm-321", JOB_TYPE_DM, "test_user").Debug("Sent \"DM\"", "count", 2)
+	test_assert_eq(`{"time":"2020-08-01T12:00:00Z","level":"debug","msg":"Sent \"DM\"","job":"dm-321","type":"dm","user":"test_user","count":2}`+"\n",
+		buf.String(), "Unexpected JSON line", t)
+	var fields map[string]interface{}
+	test_assert_no_err(json.Unmarshal(buf.Bytes(), &fields), "JSON line should parse", t)
+
+	_, err := parse_log_level("verbose")
+	test_assert_eq(true, err != nil, "Unknown level should be rejected", t)
+	level, err := parse_log_level("WARN")
+	test_assert_no_err(err, "Level should parse", t)
+	test_assert_eq(LOG_LEVEL_WARN, level, "Unexpected level", t)
+}
+
+func TestHandleTweetLogsJobFields(t *testing.T) {
+	fake, tc := new_fake_twitter()
+	defer fake.server.Close()
+	fake.tweets["123"] = `{"id":123,"id_str":"123","full_text":"@TweetCartRunner x=",
+		"user":{"id":7,"id_str":"7","screen_name":"test_user"},
+		"entities":{"user_mentions":[{"indices":[0,16],"screen_name":"TweetCartRunner"}]}}`
+	logger, buf := test_logger(LOG_FORMAT_LOGFMT, LOG_LEVEL_DEBUG)
+
+	handle_tweet(context.Background(), 123, 123, test_tweet_handler(tc, &FakeRunner{err: errors.New("syntax error")}),
+		logger.for_job("tweet-123", JOB_TYPE_TWEET, "test_user"))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	test_assert_eq(true, len(lines) > 0, "Should have logged something", t)
+	for _, line := range lines {
+		test_assert_eq(true, strings.Contains(line, "job=tweet-123 type=tweet user=test_user stage="), "Line is missing job fields: "+line, t)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotating_file_test")
+	test_assert_no_err(err, "Could not create temp dir", t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "bot.log")
+
+	now := time.Date(2020, 8, 1, 12, 0, 0, 0, time.UTC)
+	rotating, err := open_rotating_file(path, 10, time.Hour, 2)
+	test_assert_no_err(err, "Could not open log file", t)
+	defer rotating.Close()
+	rotating.now = func() time.Time { return now }
+	rotating.opened_at = now
+
+	rotating.Write([]byte("12345678\n"))
+	now = now.Add(time.Second)
+	//too big
+	rotating.Write([]byte("abc\n"))
+	now = now.Add(time.Hour)
+	//too old
+	rotating.Write([]byte("def\n"))
+	now = now.Add(time.Hour)
+	rotating.Write([]byte("ghi\n"))
+
+	contents, err := ioutil.ReadFile(path)
+	test_assert_no_err(err, "Could not read log file", t)
+	test_assert_eq("ghi\n", string(contents), "Current log file should only have the newest line", t)
+	backups, _ := filepath.Glob(path + ".*")
+	test_assert_eq(2, len(backups), "Only max_backups rotated files should be kept", t)
+	oldest, err := ioutil.ReadFile(backups[0])
+	test_assert_no_err(err, "Could not read rotated file", t)
+	test_assert_eq("abc\n", string(oldest), "Oldest rotated file should have been deleted", t)
+}
+
+func TestRotatingFileKeepsEveryBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotating_file_test")
+	test_assert_no_err(err, "Could not create temp dir", t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "bot.log")
+	test_assert_no_err(ioutil.WriteFile(path+".old", []byte("keep me\n"), 0600), "Could not write unrelated file", t)
+	test_assert_no_err(ioutil.WriteFile(path+".20200101T000000", []byte("keep me\n"), 0600), "Could not write unrelated file", t)
+
+	now := time.Date(2020, 8, 1, 12, 0, 0, 0, time.UTC)
+	rotating, err := open_rotating_file(path, 4, 0, 3)
+	test_assert_no_err(err, "Could not open log file", t)
+	defer rotating.Close()
+	rotating.now = func() time.Time { return now }
+	//every write rotates, all at the same time
+	for _, line := range []string{"aaa\n", "bbb\n", "ccc\n", "ddd\n", "eee\n"} {
+		rotating.Write([]byte(line))
 	}
 
-	dms_in_progress <- &current_dm
+	backups, err := rotating.backups()
+	test_assert_no_err(err, "Could not list rotated files", t)
+	contents := []string{}
+	for _, backup := range backups {
+		content, err := ioutil.ReadFile(backup)
+		test_assert_no_err(err, "Could not read rotated file", t)
+		contents = append(contents, string(content))
+	}
+	test_assert_eq(fmt.Sprint([]string{"bbb\n", "ccc\n", "ddd\n"}), fmt.Sprint(contents), "Files rotated at the same time should not replace each other", t)
+	_, err = os.Stat(path + ".old")
+	test_assert_no_err(err, "Files that were not rotated should not be deleted", t)
+	_, err = os.Stat(path + ".20200101T000000")
+	test_assert_no_err(err, "Files without the fraction of a second were not rotated by us and should not be deleted", t)
 
-	status = <-status_channel
-	test_assert_eq(PTS_STATE_PERSISTED, status, "", t)
+	//logs go to stderr rather than a closed file if the log file can not be opened again
+	test_assert_no_err(os.RemoveAll(dir), "Could not remove log directory", t)
+	n, err := rotating.Write([]byte("fff\n"))
+	test_assert_eq(true, n == 4 && err == nil, fmt.Sprintf("Write should fall back to stderr, got %v", err), t)
+	test_assert_no_err(os.MkdirAll(dir, 0700), "Could not create log directory", t)
+	rotating.Write([]byte("ggg\n"))
+	content, err := ioutil.ReadFile(path)
+	test_assert_no_err(err, "Log file should be opened again", t)
+	test_assert_eq("ggg\n", string(content), "Log file should be written to again", t)
+}
 
-	test_assert_eq(int64(0), state.LastDMID, "Should not be updated for in progress dms", t)
-	dm, ok := state.DMsInProgress[current_dm.DMID]
-	test_assert_eq(true, ok, "Should be recorded as in progress", t)
-	test_assert_eq(dm, &current_dm, "Should be recorded as in progress", t)
+func TestMetrics(t *testing.T) {
+	metrics := new_bot_metrics()
+	metrics.cart_handlers_capacity.add(4)
+	metrics.cart_handlers_busy.add(1)
+	metrics.queue_length.set_func("tweet", func() float64 { return 3 })
+	metrics.record_job(JOB_TYPE_TWEET, &JobResult{Status: JOB_STATUS_SUCCEEDED, RunDuration: 5 * time.Second,
+		MediaData: make([]byte, 1000), MediaType: MEDIA_TYPE_GIF})
+	metrics.record_job(JOB_TYPE_DM, &JobResult{Status: JOB_STATUS_FAILED, ErrorKind: "syntax error", RunDuration: 500 * time.Millisecond})
+	metrics.twitter_api_retries.inc("429")
 
-	file_contents, err = ioutil.ReadFile(test_file)
-	test_assert_eq(nil, err, "persist file should exist", t)
-	test_assert_eq(`{"LastTweetID":123,"TweetIDsInProgress":{},"LastDMID":0,"DMsInProgress":{"321":{"DMID":"321","DMText":"Hello!","Sender":{"id":"abc","screen_name":"TestUser"}}}}`, string(file_contents), "Bad file contents in persist file", t)
+	buf := bytes.Buffer{}
+	metrics.write_metrics(&buf)
+	output := buf.String()
+	for _, line := range []string{
+		"# TYPE tweetcartrunner_cart_handlers_busy gauge",
+		"tweetcartrunner_cart_handlers_busy 1",
+		"tweetcartrunner_cart_handlers_capacity 4",
+		`tweetcartrunner_queue_length{queue="tweet"} 3`,
+		"# TYPE tweetcartrunner_run_duration_seconds histogram",
+		`tweetcartrunner_run_duration_seconds_bucket{type="tweet",le="4"} 0`,
+		`tweetcartrunner_run_duration_seconds_bucket{type="tweet",le="6"} 1`,
+		`tweetcartrunner_run_duration_seconds_bucket{type="tweet",le="+Inf"} 1`,
+		`tweetcartrunner_run_duration_seconds_sum{type="tweet"} 5`,
+		`tweetcartrunner_run_duration_seconds_count{type="dm"} 1`,
+		`tweetcartrunner_media_size_bytes_count{media_type="image/gif"} 1`,
+		`tweetcartrunner_jobs_total{type="dm",status="failed",error_kind="syntax error"} 1`,
+		`tweetcartrunner_jobs_total{type="tweet",status="succeeded",error_kind=""} 1`,
+		`tweetcartrunner_twitter_api_retries_total{reason="429"} 1`,
+	} {
+		test_assert_eq(true, strings.Contains(output, line+"\n"), "Metrics are missing: "+line, t)
+	}
+}
 
-	processed_dm_ids <- current_dm.DMID
+func TestMetricsTransport(t *testing.T) {
+	fake, _ := new_fake_twitter()
+	defer fake.server.Close()
+	metrics := new_bot_metrics()
+	server_url, _ := url.Parse(fake.server.URL)
+	tc := twitter.NewClient(&http.Client{
+		Transport: &metrics_transport{
+			base:    &rewrite_to_http_transport{&http.Transport{Proxy: http.ProxyURL(server_url)}},
+			metrics: metrics,
+		},
+	})
+	fake.tweets["123"] = `{"id":123,"id_str":"123","full_text":"hi","user":{"id":7,"id_str":"7","screen_name":"test_user"}}`
 
-	status = <-status_channel
-	test_assert_eq(PTS_STATE_PERSISTED, status, "", t)
+	fetch_tweet(context.Background(), 123, tc, root_logger)
+	fetch_tweet(context.Background(), 124, tc, root_logger)
 
-	test_assert_eq(current_dm.DMID, strconv.Itoa(int(state.LastDMID)), "Should be updated for processed dms", t)
-	dm, ok = state.DMsInProgress[current_dm.DMID]
-	test_assert_eq(false, ok, "Should no longer be in progress", t)
-	var nil_cart *DMCart
-	test_assert_eq(nil_cart, dm, "Should no longer be in progress", t)
+	test_assert_eq(1.0, metrics.twitter_api_calls.value("GET", "api.twitter.com/1.1/statuses/show.json", "200"), "Should count the call that worked", t)
+	test_assert_eq(1.0, metrics.twitter_api_calls.value("GET", "api.twitter.com/1.1/statuses/show.json", "404"), "Should count the call that failed", t)
 
-	file_contents, err = ioutil.ReadFile(test_file)
-	test_assert_eq(nil, err, "persist file should exist", t)
-	test_assert_eq(`{"LastTweetID":123,"TweetIDsInProgress":{},"LastDMID":321,"DMsInProgress":{}}`, string(file_contents), "Bad file contents in persist file", t)
+	req, _ := http.NewRequest("DELETE", "https://api.twitter.com/1.1/account_activity/all/dev/webhooks/1234.json", nil)
+	test_assert_eq("api.twitter.com/1.1/account_activity/all/dev/webhooks/:id.json", twitter_api_endpoint(req), "IDs should be removed from endpoints", t)
+}
+
+func admin_request(server *httptest.Server, method, path, token string) (int, string) {
+	req, _ := http.NewRequest(method, server.URL+path, nil)
+	if len(token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err.Error()
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestHealthAndReadiness(t *testing.T) {
+	server := httptest.NewServer(new_admin_mux(&AdminContext{}))
+	defer server.Close()
+	defer func() { *bot_readiness = Readiness{} }()
+
+	status, _ := admin_request(server, "GET", "/healthz", "")
+	test_assert_eq(http.StatusOK, status, "Should be healthy", t)
+	status, body := admin_request(server, "GET", "/readyz", "")
+	test_assert_eq(http.StatusServiceUnavailable, status, "Should not be ready", t)
+	test_assert_eq(true, strings.Contains(body, "webhook not registered"), "Should say what is not ready", t)
+
+	set_readiness_flag(&bot_readiness.webhook_registered, true)
+	set_readiness_flag(&bot_readiness.subscribed, true)
+	status, body = admin_request(server, "GET", "/readyz", "")
+	test_assert_eq(http.StatusServiceUnavailable, status, "Should not be ready without the stream", t)
+	test_assert_eq("not ready: filter stream not connected\n", body, "Unexpected readiness", t)
+
+	set_readiness_flag(&bot_readiness.stream_connected, true)
+	status, _ = admin_request(server, "GET", "/readyz", "")
+	test_assert_eq(http.StatusOK, status, "Should be ready", t)
+}
+
+func TestAdminAPI(t *testing.T) {
+	store, dir := test_job_store(t)
+	defer os.RemoveAll(dir)
+	admin := &AdminContext{
+		token:              "secret",
+		jobs:               store,
+		intake:             new_intake_control(),
+		cart_tweet_channel: make(chan TweetCart, 1),
+		dm_channel:         make(chan *DMCart, 1),
+	}
+	server := httptest.NewServer(new_admin_mux(admin))
+	defer server.Close()
+
+	status, _ := admin_request(server, "GET", "/admin/jobs", "")
+	test_assert_eq(http.StatusUnauthorized, status, "Should require a token", t)
+	status, _ = admin_request(server, "GET", "/admin/jobs", "wrong")
+	test_assert_eq(http.StatusUnauthorized, status, "Should reject the wrong token", t)
+	status, _ = admin_request(server, "GET", "/admin/pause", "secret")
+	test_assert_eq(http.StatusMethodNotAllowed, status, "Pause should require POST", t)
+
+	store.enqueue(&Job{ID: tweet_job_id(123), Type: JOB_TYPE_TWEET, SourceID: "123", ParentTweetID: 100, Author: "test_user"})
+	store.start(tweet_job_id(123))
+	status, body := admin_request(server, "GET", "/admin/jobs", "secret")
+	test_assert_eq(http.StatusOK, status, "Should list jobs", t)
+	var jobs admin_jobs_response
+	test_assert_no_err(json.Unmarshal([]byte(body), &jobs), "Could not parse jobs", t)
+	test_assert_eq(1, len(jobs.Jobs), "Should list the running job", t)
+
+	status, _ = admin_request(server, "POST", "/admin/rerun?id=123", "secret")
+	test_assert_eq(http.StatusConflict, status, "Running jobs can not be rerun", t)
+	store.finish(tweet_job_id(123), &JobResult{Status: JOB_STATUS_FAILED})
+	status, _ = admin_request(server, "POST", "/admin/rerun?id=123", "secret")
+	test_assert_eq(http.StatusAccepted, status, "Finished jobs can be rerun", t)
+	tweet := <-admin.cart_tweet_channel
+	test_assert_eq(int64(100), tweet.parent_tweet_id, "Rerun should run the same tweet", t)
+	job, _ := store.job(tweet_job_id(123))
+	test_assert_eq(JOB_STATUS_QUEUED, job.Status, "Rerun job should be queued", t)
+
+	//a full queue should not hold up the request
+	store.finish(tweet_job_id(123), &JobResult{Status: JOB_STATUS_FAILED, Error: "syntax error"})
+	admin.cart_tweet_channel <- TweetCart{}
+	status, _ = admin_request(server, "POST", "/admin/rerun?id=123", "secret")
+	test_assert_eq(http.StatusServiceUnavailable, status, "Rerun should fail while the queue is full", t)
+	<-admin.cart_tweet_channel
+	job, _ = store.job(tweet_job_id(123))
+	test_assert_eq(JOB_STATUS_FAILED, job.Status, "Job should be put back the way it was", t)
+	test_assert_eq("syntax error", job.Error, "Job should be put back the way it was", t)
+
+	status, body = admin_request(server, "POST", "/admin/pause", "secret")
+	test_assert_eq(http.StatusOK, status, "Should pause", t)
+	test_assert_eq(true, strings.Contains(body, `"paused": true`), "Should be paused", t)
+	started := make(chan bool)
+	go func() {
+		admin.intake.job_started()
+		started <- true
+	}()
+	select {
+	case <-started:
+		t.Error("Jobs should not start while paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+	admin_request(server, "POST", "/admin/resume", "secret")
+	<-started
+
+	status, body = admin_request(server, "POST", "/admin/drain?timeout=50ms", "secret")
+	test_assert_eq(http.StatusServiceUnavailable, status, "Drain should time out while a job is running", t)
+	test_assert_eq(true, strings.Contains(body, `"running": 1`), "Should say how many are running", t)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		admin.intake.job_finished()
+	}()
+	status, _ = admin_request(server, "POST", "/admin/drain", "secret")
+	test_assert_eq(http.StatusOK, status, "Drain should finish once nothing is running", t)
+	paused, running := admin.intake.status()
+	test_assert_eq(true, paused, "Drain should leave intake paused", t)
+	test_assert_eq(0, running, "Nothing should be running", t)
+}
+
+//Blocks until it is killed
+type blocking_runner struct {
+	started chan bool
+}
+
+func (runner *blocking_runner) Run(ctx context.Context, cart_source, job_id string, params RunParams, logger *Logger) (*RunResult, error) {
+	runner.started <- true
+	<-ctx.Done()
+	return &RunResult{Params: params}, ctx.Err()
+}
+
+func TestShutdownInterruptsJobs(t *testing.T) {
+	fake, tc := new_fake_twitter()
+	defer fake.server.Close()
+	store, dir := test_job_store(t)
+	defer os.RemoveAll(dir)
+	fake.tweets["123"] = `{"id":123,"id_str":"123","full_text":"@TweetCartRunner ?\"hello!\"",
+		"user":{"id":7,"id_str":"7","screen_name":"test_user"},
+		"entities":{"user_mentions":[{"indices":[0,16],"screen_name":"TweetCartRunner"}]}}`
+
+	runner := &blocking_runner{started: make(chan bool, 1)}
+	intake := new_intake_control()
+	ctx, kill_running_carts := context.WithCancel(context.Background())
+	cart_tweet_channel := make(chan TweetCart, 1)
+	scheduler := new_fair_scheduler()
+	go run_scheduled_carts(scheduler, store, intake, ctx, semaphore.NewWeighted(1))
+	go run_tweet_cart_thread(cart_tweet_channel, store, test_tweet_handler(tc, runner), new_user_quota(0, nil, real_clock{}), scheduler, ctx)
+	queue_tweet(&twitter.Tweet{ID: 123, IDStr: "123", User: &twitter.User{ScreenName: "test_user"}}, store, cart_tweet_channel)
+	<-runner.started
+
+	grace_context, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	running, err := intake.drain(grace_context)
+	test_assert_eq(true, err != nil, "Drain should time out while the cart is running", t)
+	test_assert_eq(1, running, "Cart should still be running", t)
+
+	kill_running_carts()
+	running, err = intake.drain(context.Background())
+	test_assert_no_err(err, "Drain should finish once the cart is killed", t)
+	test_assert_eq(0, running, "Nothing should be running", t)
+	job, _ := store.job(tweet_job_id(123))
+	test_assert_eq(JOB_STATUS_RUNNING, job.Status, "Killed job should be left running so it is run again", t)
+	test_assert_eq(0, len(fake.statuses), "Should not reply about a killed cart", t)
+}
+
+func TestPico8RunnerIsKilled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kill_test")
+	test_assert_no_err(err, "Could not create temp dir", t)
+	defer os.RemoveAll(dir)
+	//stands in for a PICO-8 that never finishes
+	exec_path := filepath.Join(dir, "pico8")
+	write_test_executable(exec_path, "#!/bin/sh\nexec sleep 60\n", "Could not write fake PICO-8", t)
+
+	runner := &Pico8Runner{exec_path: exec_path, scratch_root: filepath.Join(dir, "scratch"), timeout: time.Minute}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = runner.Run(ctx, "print('hello!')", "123", test_run_limits().Default, root_logger)
+	test_assert_eq(context.DeadlineExceeded, err, "Run should stop when the context is done", t)
+	test_assert_eq(true, time.Since(start) < 10*time.Second, "Run should not wait for the timeout", t)
+}
+
+//After fires right away and moves the clock forward, so retries do not actually wait
+type fake_clock struct {
+	mutex sync.Mutex
+	now   time.Time
+	waits []time.Duration
+}
+
+func (clock *fake_clock) Now() time.Time {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	return clock.now
+}
+
+func (clock *fake_clock) After(d time.Duration) <-chan time.Time {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	clock.now = clock.now.Add(d)
+	clock.waits = append(clock.waits, d)
+	fired := make(chan time.Time, 1)
+	fired <- clock.now
+	return fired
+}
+
+func test_retry_policy(clock *fake_clock) *RetryPolicy {
+	return &RetryPolicy{
+		initial_backoff: time.Second,
+		max_backoff:     10 * time.Second,
+		multiplier:      2,
+		jitter:          0.5,
+		max_attempts:    6,
+		max_elapsed:     time.Minute,
+		clock:           clock,
+		random:          func() float64 { return 0.5 },
+	}
+}
+
+//Fails with err the first failures times it is called
+func failing_op(failures int, err error) (func() (string, error), *int) {
+	calls := 0
+	return func() (string, error) {
+		calls++
+		if calls <= failures {
+			return "", err
+		}
+		return "ok", nil
+	}, &calls
+}
+
+func TestRetryBackoff(t *testing.T) {
+	clock := &fake_clock{}
+	op, calls := failing_op(5, &TwitterServerError{StatusCode: 503})
+	retried := 0
+	ret, err := retry(context.Background(), test_retry_policy(clock), op, twitter_retry_verdict,
+		func(attempt int, wait time.Duration, verdict retry_verdict, err error) {
+			retried++
+			test_assert_eq("503", verdict.reason, "Should retry because of the status code", t)
+		})
+	test_assert_no_err(err, "Should have worked on the last attempt", t)
+	test_assert_eq("ok", ret, "Should return what op returned", t)
+	test_assert_eq(6, *calls, "Should have called op until it worked", t)
+	test_assert_eq(5, retried, "Should call on_retry before every wait", t)
+	//doubles from 1s up to 10s, and the jitter takes off a quarter
+	test_assert_eq("[750ms 1.5s 3s 6s 7.5s]", fmt.Sprint(clock.waits), "Wrong backoff", t)
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	clock := &fake_clock{}
+	op, calls := failing_op(100, &TwitterServerError{StatusCode: 500})
+	_, err := retry(context.Background(), test_retry_policy(clock), op, twitter_retry_verdict, nil)
+	var exhausted *RetryExhaustedError
+	test_assert_eq(true, errors.As(err, &exhausted), "Should give up after max_attempts", t)
+	test_assert_eq(6, exhausted.Attempts, "Wrong number of attempts", t)
+	test_assert_eq(6, *calls, "Should not call op after giving up", t)
+	var server_err *TwitterServerError
+	test_assert_eq(true, errors.As(err, &server_err), "Should wrap the last error", t)
+
+	//the 6th wait would go past max_elapsed
+	clock = &fake_clock{}
+	policy := test_retry_policy(clock)
+	policy.max_attempts = 0
+	policy.max_elapsed = 20 * time.Second
+	op, calls = failing_op(100, &TwitterServerError{StatusCode: 500})
+	_, err = retry(context.Background(), policy, op, twitter_retry_verdict, nil)
+	test_assert_eq(true, errors.As(err, &exhausted), "Should give up after max_elapsed", t)
+	test_assert_eq(6, *calls, "Wrong number of attempts before the deadline", t)
+	test_assert_eq(18750*time.Millisecond, exhausted.Elapsed, "Should not wait past max_elapsed", t)
+
+	//a context deadline is respected too.  The fake clock does not move it closer, so only the 6s wait goes past it
+	clock = &fake_clock{}
+	policy = test_retry_policy(clock)
+	policy.max_attempts = 0
+	policy.max_elapsed = 0
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	op, calls = failing_op(100, &TwitterServerError{StatusCode: 500})
+	_, err = retry(ctx, policy, op, twitter_retry_verdict, nil)
+	test_assert_eq(true, errors.As(err, &exhausted), "Should give up before the context deadline", t)
+	test_assert_eq(4, *calls, "Wrong number of attempts before the context deadline", t)
+}
+
+func TestRetryStopsOnPermanentErrors(t *testing.T) {
+	clock := &fake_clock{}
+	not_found := twitter.APIError{Errors: []twitter.ErrorDetail{{Code: 144, Message: "No status found with that ID."}}}
+	op, calls := failing_op(100, not_found)
+	_, err := retry(context.Background(), test_retry_policy(clock), op, twitter_retry_verdict, nil)
+	test_assert_eq(1, *calls, "Should not retry errors that will not go away", t)
+	test_assert_eq(not_found.Error(), err.Error(), "Should return the error as is", t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	calls_before_cancel := 0
+	_, err = retry(ctx, test_retry_policy(clock), func() (string, error) {
+		calls_before_cancel++
+		if calls_before_cancel == 2 {
+			cancel()
+		}
+		return "", &TwitterServerError{StatusCode: 502}
+	}, twitter_retry_verdict, nil)
+	test_assert_eq(true, errors.Is(err, context.Canceled), "Should stop once the context is cancelled", t)
+	test_assert_eq(2, calls_before_cancel, "Should not call op after the context is cancelled", t)
+}
+
+type timeout_error struct{}
+
+func (timeout_error) Error() string   { return "i/o timeout" }
+func (timeout_error) Timeout() bool   { return true }
+func (timeout_error) Temporary() bool { return true }
+
+func TestTwitterRetryVerdict(t *testing.T) {
+	rate_limited := twitter.APIError{Errors: []twitter.ErrorDetail{{Code: 429, Message: "Too Many Requests"}}}
+	verdict := twitter_retry_verdict(rate_limited)
+	test_assert_eq(true, verdict.retriable, "Rate limits should be retried", t)
+	test_assert_eq(TWITTER_RATE_LIMIT_BACKOFF, verdict.wait_at_least, "Rate limits should wait longer", t)
+
+	for _, c := range []struct {
+		err       error
+		retriable bool
+		reason    string
+	}{
+		{rate_limited, true, "429"},
+		{twitter.APIError{Errors: []twitter.ErrorDetail{{Code: 429}, {Code: 32}}}, false, ""},
+		{twitter.APIError{Errors: []twitter.ErrorDetail{{Code: 187, Message: "Status is a duplicate."}}}, false, ""},
+		{&TwitterServerError{StatusCode: 503, Err: twitter.APIError{Errors: []twitter.ErrorDetail{{Code: 130}}}}, true, "503"},
+		{&url.Error{Op: "Get", URL: "https://api.twitter.com", Err: timeout_error{}}, true, "timeout"},
+		{&url.Error{Op: "Post", URL: "https://api.twitter.com", Err: fmt.Errorf("read: %w", syscall.ECONNRESET)}, true, "connection"},
+		{&url.Error{Op: "Post", URL: "https://api.twitter.com", Err: io.EOF}, true, "connection"},
+		{&url.Error{Op: "Post", URL: "https://api.twitter.com", Err: context.Canceled}, false, ""},
+		{errors.New("invalid character '<' looking for beginning of value"), false, ""},
+	} {
+		verdict := twitter_retry_verdict(c.err)
+		test_assert_eq(c.retriable, verdict.retriable, "Wrong verdict for "+c.err.Error(), t)
+		test_assert_eq(c.reason, verdict.reason, "Wrong reason for "+c.err.Error(), t)
+	}
+
+	//posts are only retried if they can not have been posted
+	for _, c := range []struct {
+		err       error
+		retriable bool
+		reason    string
+	}{
+		{rate_limited, true, "429"},
+		{&url.Error{Op: "Post", URL: "https://api.twitter.com", Err: &net.OpError{Op: "dial", Net: "tcp", Err: timeout_error{}}}, true, "connection"},
+		{&url.Error{Op: "Post", URL: "https://api.twitter.com", Err: fmt.Errorf("connect: %w", syscall.ECONNREFUSED)}, true, "connection"},
+		{&TwitterServerError{StatusCode: 503, Err: twitter.APIError{Errors: []twitter.ErrorDetail{{Code: 130}}}}, false, ""},
+		{&url.Error{Op: "Post", URL: "https://api.twitter.com", Err: timeout_error{}}, false, ""},
+		{&url.Error{Op: "Post", URL: "https://api.twitter.com", Err: &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}}, false, ""},
+		{&url.Error{Op: "Post", URL: "https://api.twitter.com", Err: io.EOF}, false, ""},
+	} {
+		verdict := twitter_write_retry_verdict(c.err)
+		test_assert_eq(c.retriable, verdict.retriable, "Wrong write verdict for "+c.err.Error(), t)
+		test_assert_eq(c.reason, verdict.reason, "Wrong write reason for "+c.err.Error(), t)
+	}
+}
+
+func TestCallTwitterAPIRetriesServerErrors(t *testing.T) {
+	clock := &fake_clock{}
+	original_policy := twitter_retry_policy
+	twitter_retry_policy = test_retry_policy(clock)
+	defer func() { twitter_retry_policy = original_policy }()
+
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, "<html>Over capacity</html>")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":123,"id_str":"123","full_text":"hi","user":{"id":7,"id_str":"7","screen_name":"test_user"}}`)
+	}))
+	defer server.Close()
+	server_url, _ := url.Parse(server.URL)
+	tc := twitter.NewClient(&http.Client{
+		Transport: &rewrite_to_http_transport{&http.Transport{Proxy: http.ProxyURL(server_url)}},
+	})
+	retries_before := bot_metrics.twitter_api_retries.value("503")
+
+	tweet, err := fetch_tweet(context.Background(), 123, tc, root_logger)
+	test_assert_no_err(err, "Should have retried until twitter came back", t)
+	test_assert_eq("123", tweet.IDStr, "Wrong tweet", t)
+	test_assert_eq(3, calls, "Should have called twitter 3 times", t)
+	test_assert_eq(2, len(clock.waits), "Should have waited between calls", t)
+	test_assert_eq(retries_before+2, bot_metrics.twitter_api_retries.value("503"), "Retries should be counted", t)
+
+	//twitter may have posted it before failing, so posts are not tried again
+	calls = 0
+	_, err = call_twitter_write_api(context.Background(), "", root_logger, func() (*twitter.Tweet, *http.Response, error) {
+		return tc.Statuses.Update("hi", nil)
+	})
+	test_assert_eq(true, err != nil, "Post should fail", t)
+	test_assert_eq(1, calls, "Post should not be retried after a server error", t)
+}
+
+func TestRateLimitResource(t *testing.T) {
+	for path, resource := range map[string]string{
+		"/1.1/statuses/show.json":                          "/statuses/show/:id",
+		"/1.1/statuses/mentions_timeline.json":             "/statuses/mentions_timeline",
+		"/1.1/direct_messages/events/list.json":            "/direct_messages/events/list",
+		"/1.1/account_activity/all/dev/webhooks/1234.json": "/account_activity/all/dev/webhooks/:id",
+	} {
+		req, _ := http.NewRequest("GET", "https://api.twitter.com"+path, nil)
+		test_assert_eq(resource, rate_limit_resource(req), "Wrong rate limit resource for "+path, t)
+	}
+}
+
+func TestRateLimitTracker(t *testing.T) {
+	clock := &fake_clock{now: time.Unix(1600000000, 0)}
+	metrics := new_bot_metrics()
+	tracker := new_rate_limit_tracker(1, clock, metrics)
+	const endpoint = "/statuses/show/:id"
+	test_assert_eq(time.Duration(0), tracker.reserve_call(endpoint), "Endpoints we know nothing about should not wait", t)
+
+	tracker.update(endpoint, 900, 3, clock.now.Add(time.Minute))
+	test_assert_eq(time.Duration(0), tracker.reserve_call(endpoint), "Should not wait while there are calls left", t)
+	test_assert_eq(time.Duration(0), tracker.reserve_call(endpoint), "Should not wait while there are calls left", t)
+	test_assert_eq(time.Minute+RATE_LIMIT_RESET_MARGIN, tracker.reserve_call(endpoint), "Should wait for the reset once only the reserve is left", t)
+
+	test_assert_no_err(tracker.wait(context.Background(), endpoint), "Should wait for the reset", t)
+	test_assert_eq("[1m1s]", fmt.Sprint(clock.waits), "Should have waited until the window reset", t)
+	test_assert_eq(1.0, metrics.twitter_rate_limit_delays.value(endpoint), "Delays should be counted", t)
+	buckets := tracker.buckets_snapshot()
+	test_assert_eq(1, len(buckets), "Should track one endpoint", t)
+	test_assert_eq(899, buckets[0].Remaining, "A new window should start with the whole limit", t)
+
+	tracker.update(endpoint, 900, 0, clock.now.Add(time.Minute))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	tracker.clock = &blocking_clock{&fake_clock{now: clock.now}}
+	test_assert_eq(context.Canceled, tracker.wait(ctx, endpoint), "Waiting should stop when the context is done", t)
+
+	buf := bytes.Buffer{}
+	metrics.write_metrics(&buf)
+	test_assert_eq(true, strings.Contains(buf.String(), `tweetcartrunner_twitter_rate_limit_remaining{endpoint="/statuses/show/:id"} 0`+"\n"),
+		"Remaining calls should be in the metrics", t)
+}
+
+//After never fires
+type blocking_clock struct {
+	*fake_clock
+}
+
+func (clock *blocking_clock) After(d time.Duration) <-chan time.Time {
+	return make(chan time.Time)
+}
+
+func TestRateLimitTransport(t *testing.T) {
+	clock := &fake_clock{now: time.Now()}
+	tracker := new_rate_limit_tracker(0, clock, new_bot_metrics())
+	reset := clock.now.Add(15 * time.Minute).Truncate(time.Second)
+	calls := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/1.1/statuses/show.json", func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set(RATE_LIMIT_LIMIT_HEADER, "900")
+		w.Header().Set(RATE_LIMIT_REMAINING_HEADER, "0")
+		w.Header().Set(RATE_LIMIT_RESET_HEADER, strconv.FormatInt(reset.Unix(), 10))
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":123,"id_str":"123","full_text":"hi","user":{"id":7,"id_str":"7","screen_name":"test_user"}}`)
+	})
+	mux.HandleFunc("/1.1/application/rate_limit_status.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"resources":{"users":{"/users/lookup":{"limit":900,"remaining":12,"reset":%v},"/users/show/:id":{"limit":900,"remaining":900,"reset":%v}}}}`,
+			reset.Unix(), reset.Unix())
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	server_url, _ := url.Parse(server.URL)
+	tc := twitter.NewClient(&http.Client{
+		Transport: &rate_limit_transport{
+			base:    &rewrite_to_http_transport{&http.Transport{Proxy: http.ProxyURL(server_url)}},
+			tracker: tracker,
+		},
+	})
+
+	_, err := fetch_tweet(context.Background(), 123, tc, root_logger)
+	test_assert_no_err(err, "First call should go through", t)
+	_, err = fetch_tweet(context.Background(), 123, tc, root_logger)
+	test_assert_no_err(err, "Second call should go through once the window resets", t)
+	test_assert_eq(2, calls, "Should have called twitter twice", t)
+	test_assert_eq(1, len(clock.waits), "The second call should have waited", t)
+	test_assert_eq(true, reset.Add(RATE_LIMIT_RESET_MARGIN).Equal(clock.now), "Should have waited until the reset in the headers", t)
+
+	test_assert_no_err(tracker.seed(context.Background(), tc, root_logger), "Could not seed rate limits", t)
+	buckets := tracker.buckets_snapshot()
+	test_assert_eq(2, len(buckets), "Only endpoints in use should be seeded", t)
+	test_assert_eq("/users/lookup", buckets[1].Endpoint, "Should be seeded from the rate limit status", t)
+	test_assert_eq(12, buckets[1].Remaining, "Should be seeded from the rate limit status", t)
+
+	admin := &AdminContext{token: "secret", jobs: nil, intake: new_intake_control(), rate_limits: tracker}
+	admin_server := httptest.NewServer(new_admin_mux(admin))
+	defer admin_server.Close()
+	status, body := admin_request(admin_server, "GET", "/admin/rate_limits", "secret")
+	test_assert_eq(http.StatusOK, status, "Rate limits should be served", t)
+	test_assert_eq(true, strings.Contains(body, `"endpoint": "/users/lookup"`), "Rate limits should be listed: "+body, t)
+}
+
+func TestRateLimitedErrorWaitsForReset(t *testing.T) {
+	rate_limited := twitter.APIError{Errors: []twitter.ErrorDetail{{Code: 88, Message: "Rate limit exceeded"}}}
+	verdict := twitter_retry_verdict(&RateLimitedError{Reset: time.Now().Add(5 * time.Minute), Err: rate_limited})
+	test_assert_eq(true, verdict.retriable, "Rate limits should be retried", t)
+	test_assert_eq("88", verdict.reason, "Wrong reason", t)
+	test_assert_eq(true, verdict.wait_at_least > 4*time.Minute && verdict.wait_at_least <= 5*time.Minute+RATE_LIMIT_RESET_MARGIN,
+		"Should wait until the reset: "+verdict.wait_at_least.String(), t)
+}
+
+func TestFairScheduler(t *testing.T) {
+	scheduler := new_fair_scheduler()
+	for _, cart := range []struct{ user, job_id string }{
+		{"alice", "a1"}, {"alice", "a2"}, {"alice", "a3"}, {"Bob", "b1"}, {"carol", "c1"}, {"@bob", "b2"},
+	} {
+		scheduler.push(&ScheduledCart{job_id: cart.job_id, user: cart.user})
+	}
+	test_assert_eq(6, scheduler.length(), "Wrong number of carts queued", t)
+	order := make([]string, 0)
+	for scheduler.length() > 0 {
+		order = append(order, scheduler.pop().job_id)
+	}
+	test_assert_eq("[a1 b1 c1 a2 b2 a3]", fmt.Sprint(order), "Users should take turns", t)
+
+	popped := make(chan string)
+	go func() { popped <- scheduler.pop().job_id }()
+	scheduler.push(&ScheduledCart{job_id: "d1", user: "dave"})
+	test_assert_eq("d1", <-popped, "pop should wait for a cart", t)
+}
+
+func TestUserQuota(t *testing.T) {
+	clock := &fake_clock{now: time.Unix(1600000000, 0)}
+	quota := new_user_quota(2, []string{"@Trusted"}, clock)
+
+	ok, _, _ := quota.admit("alice")
+	test_assert_eq(true, ok, "First cart should be let in", t)
+	clock.now = clock.now.Add(10 * time.Minute)
+	ok, _, _ = quota.admit("Alice")
+	test_assert_eq(true, ok, "Second cart should be let in", t)
+	ok, retry_after, notify := quota.admit("alice")
+	test_assert_eq(false, ok, "Third cart should be over quota", t)
+	test_assert_eq(50*time.Minute, retry_after, "Should be able to try again once the first cart is an hour old", t)
+	test_assert_eq(true, notify, "Should be told the first time", t)
+	ok, _, notify = quota.admit("alice")
+	test_assert_eq(false, ok, "Fourth cart should be over quota", t)
+	test_assert_eq(false, notify, "Should only be told once", t)
+	ok, _, _ = quota.admit("bob")
+	test_assert_eq(true, ok, "Other users have their own quota", t)
+
+	clock.now = clock.now.Add(50 * time.Minute)
+	ok, _, _ = quota.admit("alice")
+	test_assert_eq(true, ok, "Should be let in once the first cart is an hour old", t)
+
+	for i := 0; i < 10; i++ {
+		ok, _, _ = quota.admit("trusted")
+		test_assert_eq(true, ok, "Allowlisted users have no limit", t)
+	}
+	test_assert_eq(true, strings.Contains(quota.over_quota_message(50*time.Minute), "try again in 50 minutes"), "Wrong message", t)
+}
+
+//Polls because jobs are finished on another goroutine
+func wait_for_job_status(store *JobStore, job_id string, status JobStatus, t *testing.T) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if job, ok := store.job(job_id); ok && job.Status == status {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	job, _ := store.job(job_id)
+	t.Fatalf("Job %v should be %v, but is %v", job_id, status, job.Status)
+}
+
+func TestOverQuotaReply(t *testing.T) {
+	fake, tc := new_fake_twitter()
+	defer fake.server.Close()
+	store, dir := test_job_store(t)
+	defer os.RemoveAll(dir)
+	defer store.Close()
+
+	scheduler := new_fair_scheduler()
+	quota := new_user_quota(1, nil, real_clock{})
+	cart_tweet_channel := make(chan TweetCart, 4)
+	go run_tweet_cart_thread(cart_tweet_channel, store, test_tweet_handler(tc, &FakeRunner{}), quota, scheduler, context.Background())
+	for id := int64(1); id <= 3; id++ {
+		queue_tweet(&twitter.Tweet{ID: id, IDStr: strconv.FormatInt(id, 10), User: &twitter.User{ScreenName: "test_user"}}, store, cart_tweet_channel)
+	}
+	wait_for_job_status(store, tweet_job_id(2), JOB_STATUS_OVER_QUOTA, t)
+	wait_for_job_status(store, tweet_job_id(3), JOB_STATUS_OVER_QUOTA, t)
+
+	test_assert_eq(1, scheduler.length(), "Only the first tweet should be scheduled", t)
+	test_assert_eq(tweet_job_id(1), scheduler.pop().job_id, "The first tweet should be scheduled", t)
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	test_assert_eq(1, len(fake.statuses), "Should only reply once about being over quota", t)
+	test_assert_eq(true, strings.HasPrefix(fake.statuses[0], "@test_user You have run 1 carts in the last hour"), "Unexpected reply: "+fake.statuses[0], t)
+	job, _ := store.job(tweet_job_id(2))
+	test_assert_eq(int64(1001), job.ReplyTweetID, "The reply should be recorded", t)
+}
+
+func TestBlocklist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blocklist_test")
+	test_assert_no_err(err, "Could not create temp dir", t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "blocklist.json")
+
+	blocklist, err := open_blocklist(path)
+	test_assert_no_err(err, "A missing blocklist should be empty", t)
+	_, err = blocklist.block("@Some_User", "spam")
+	test_assert_no_err(err, "Could not block by screen name", t)
+	_, err = blocklist.block("12345", "")
+	test_assert_no_err(err, "Could not block by ID", t)
+	test_assert_eq(true, blocklist.is_blocked("", "some_user"), "Screen names should not be case sensitive", t)
+	test_assert_eq(true, blocklist.is_blocked("12345", "new_name"), "IDs should stay blocked under a new screen name", t)
+	test_assert_eq(false, blocklist.is_blocked("", ""), "No one should be blocked by empty names", t)
+	test_assert_eq(false, blocklist.is_blocked("7", "other_user"), "Other users should not be blocked", t)
+
+	reopened, err := open_blocklist(path)
+	test_assert_no_err(err, "Could not reopen blocklist", t)
+	test_assert_eq(2, len(reopened.list()), "Blocked users should be saved", t)
+	test_assert_eq("spam", reopened.list()[0].Reason, "Reasons should be saved", t)
+	was_blocked, err := reopened.unblock("some_user")
+	test_assert_no_err(err, "Could not unblock", t)
+	test_assert_eq(true, was_blocked, "User should have been blocked", t)
+	reopened, _ = open_blocklist(path)
+	test_assert_eq(false, reopened.is_blocked("", "some_user"), "Unblocking should be saved", t)
+	test_assert_eq(true, reopened.is_blocked("12345", ""), "Other users should stay blocked", t)
+}
+
+func TestBlockedUsersAreIgnored(t *testing.T) {
+	fake, tc := new_fake_twitter()
+	defer fake.server.Close()
+	store, dir := test_job_store(t)
+	defer os.RemoveAll(dir)
+	defer store.Close()
+	handler := test_tweet_handler(tc, &FakeRunner{})
+	handler.blocklist, _ = open_blocklist(filepath.Join(dir, "blocklist.json"))
+	handler.blocklist.block("7", "")
+
+	scheduler := new_fair_scheduler()
+	cart_tweet_channel := make(chan TweetCart, 1)
+	go run_tweet_cart_thread(cart_tweet_channel, store, handler, new_user_quota(0, nil, real_clock{}), scheduler, context.Background())
+	queue_tweet(&twitter.Tweet{ID: 1, IDStr: "1", User: &twitter.User{IDStr: "7", ScreenName: "blocked_user"}}, store, cart_tweet_channel)
+	wait_for_job_status(store, tweet_job_id(1), JOB_STATUS_BLOCKED, t)
+	test_assert_eq(0, scheduler.length(), "Blocked users' tweets should not be scheduled", t)
+
+	//nor should their carts be run when someone else asks
+	fake.tweets["123"] = `{"id":123,"id_str":"123","full_text":"?\"hello!\"","user":{"id":7,"id_str":"7","screen_name":"blocked_user"}}`
+	result := handle_tweet(context.Background(), 123, 123, handler, root_logger)
+	test_assert_eq(JOB_STATUS_BLOCKED, result.Status, "Blocked users' carts should not be run", t)
+	test_assert_eq(0, len(fake.statuses), "Blocked users should not be replied to", t)
+}
+
+func TestWordlistModerator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wordlist_test")
+	test_assert_no_err(err, "Could not create temp dir", t)
+	defer os.RemoveAll(dir)
+	wordlist_file := filepath.Join(dir, "wordlist.txt")
+	ioutil.WriteFile(wordlist_file, []byte("# comment\n\nbadword\n/printh\\(/\n"), 0600)
+
+	moderator, err := load_wordlist_moderator(wordlist_file)
+	test_assert_no_err(err, "Could not load wordlist", t)
+	for source, expected := range map[string]ModerationAction{
+		"?\"hello!\"":         MODERATION_ALLOW,
+		"?\"BadWord\"":        MODERATION_REJECT,
+		"?\"badwords\"":       MODERATION_ALLOW,
+		"printh(\"x\",\"f\")": MODERATION_REJECT,
+		"# comment":           MODERATION_ALLOW,
+	} {
+		test_assert_eq(expected, moderator.BeforeRun(&ModerationRequest{Source: source}).Action, "Unexpected verdict for "+source, t)
+	}
+
+	ioutil.WriteFile(wordlist_file, []byte("/(/\n"), 0600)
+	_, err = load_wordlist_moderator(wordlist_file)
+	test_assert_eq(true, err != nil && strings.Contains(err.Error(), "wordlist.txt:1"), "Bad regexes should say where they are", t)
+
+	fake, tc := new_fake_twitter()
+	defer fake.server.Close()
+	fake.tweets["123"] = `{"id":123,"id_str":"123","full_text":"?\"badword\"","user":{"id":7,"id_str":"7","screen_name":"test_user"}}`
+	handler := test_tweet_handler(tc, &FakeRunner{err: errors.New("should not be run")})
+	handler.moderation = &Moderation{moderator: ModerationChain{moderator}}
+	result := handle_tweet(context.Background(), 123, 123, handler, root_logger)
+	test_assert_eq(JOB_STATUS_REJECTED, result.Status, "Cart should have been rejected", t)
+	test_assert_eq(0, len(fake.statuses), "Rejected tweets should not be replied to", t)
+}
+
+func TestHoldDMsForApproval(t *testing.T) {
+	fake, tc := new_fake_twitter()
+	defer fake.server.Close()
+	store, dir := test_job_store(t)
+	defer os.RemoveAll(dir)
+	defer store.Close()
+	handler := &DMHanderContext{
+		twitter_client: tc,
+		my_user:        &twitter.User{ScreenName: "TweetCartRunner"},
+		runner:         &FakeRunner{},
+		run_limits:     test_run_limits(),
+		moderation:     &Moderation{moderator: ModerationChain{ApprovalModerator{}}, held_media_dir: filepath.Join(dir, "held")},
+	}
+	sender := User{Id: "7", ScreenName: "test_user"}
+	admin := &AdminContext{token: "secret", jobs: store, twitter_client: tc, my_user: handler.my_user}
+	server := httptest.NewServer(new_admin_mux(admin))
+	defer server.Close()
+
+	notweet := handle_dm(context.Background(), "320", "--notweet\n?\"hello!\"", nil, sender, handler, root_logger)
+	test_assert_eq(JOB_STATUS_SUCCEEDED, notweet.Status, "Carts that are not tweeted should not be held", t)
+
+	for _, dm_id := range []string{"321", "322"} {
+		dm_cart := &DMCart{DMID: dm_id, DMText: "?\"hello!\"", Sender: sender}
+		queue_dm(dm_cart, store, make(chan *DMCart, 1))
+		result := handle_dm(context.Background(), dm_id, dm_cart.DMText, nil, sender, handler, root_logger)
+		test_assert_eq(JOB_STATUS_HELD, result.Status, "DMed carts should be held", t)
+		store.finish(dm_job_id(dm_id), result)
+	}
+	test_assert_eq(0, len(fake.statuses), "Held carts should not be tweeted", t)
+	status, body := admin_request(server, "GET", "/admin/held", "secret")
+	test_assert_eq(http.StatusOK, status, "Should list held jobs", t)
+	test_assert_eq(true, strings.Contains(body, dm_job_id("321")) && strings.Contains(body, dm_job_id("322")), "Should list both held jobs", t)
+	held, _ := store.job(dm_job_id("321"))
+	_, err := os.Stat(held.Held.MediaFile)
+	test_assert_no_err(err, "Held media should be saved", t)
+
+	status, body = admin_request(server, "POST", "/admin/approve?id=321", "secret")
+	test_assert_eq(http.StatusOK, status, "Should approve: "+body, t)
+	approved, _ := store.job(dm_job_id("321"))
+	test_assert_eq(JOB_STATUS_SUCCEEDED, approved.Status, "Approved job should succeed", t)
+	test_assert_eq(true, approved.Held == nil, "Approved job should not be held", t)
+	test_assert_eq(2, len(fake.statuses), "Should have posted the GIF and the source", t)
+	test_assert_eq("By @test_user\nRecorded 8s at 30fps", fake.statuses[0], "Unexpected GIF tweet", t)
+	_, err = os.Stat(held.Held.MediaFile)
+	test_assert_eq(true, os.IsNotExist(err), "Held media should be deleted once posted", t)
+	status, _ = admin_request(server, "POST", "/admin/approve?id=321", "secret")
+	test_assert_eq(http.StatusConflict, status, "Jobs can only be approved once", t)
+
+	status, _ = admin_request(server, "POST", "/admin/reject?id=322&reason=nope", "secret")
+	test_assert_eq(http.StatusOK, status, "Should reject", t)
+	rejected, _ := store.job(dm_job_id("322"))
+	test_assert_eq(JOB_STATUS_REJECTED, rejected.Status, "Rejected job should be rejected", t)
+	test_assert_eq("nope", rejected.Error, "Should record why", t)
+	test_assert_eq(2, len(fake.statuses), "Rejected jobs should not be tweeted", t)
+}
+
+func TestAdminBlocklist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "admin_blocklist_test")
+	test_assert_no_err(err, "Could not create temp dir", t)
+	defer os.RemoveAll(dir)
+	blocklist, _ := open_blocklist(filepath.Join(dir, "blocklist.json"))
+	server := httptest.NewServer(new_admin_mux(&AdminContext{token: "secret", blocklist: blocklist}))
+	defer server.Close()
+
+	status, _ := admin_request(server, "POST", "/admin/block", "secret")
+	test_assert_eq(http.StatusBadRequest, status, "Should require a user", t)
+	status, _ = admin_request(server, "POST", "/admin/block?user=@Spammer&reason=spam", "secret")
+	test_assert_eq(http.StatusOK, status, "Should block", t)
+	test_assert_eq(true, blocklist.is_blocked("", "spammer"), "User should be blocked", t)
+	status, body := admin_request(server, "GET", "/admin/blocklist", "secret")
+	test_assert_eq(http.StatusOK, status, "Should list the blocklist", t)
+	test_assert_eq(true, strings.Contains(body, `"screen_name": "spammer"`), "Should list the blocked user: "+body, t)
+	status, _ = admin_request(server, "POST", "/admin/unblock?user=spammer", "secret")
+	test_assert_eq(http.StatusOK, status, "Should unblock", t)
+	status, _ = admin_request(server, "POST", "/admin/unblock?user=spammer", "secret")
+	test_assert_eq(http.StatusNotFound, status, "Users who are not blocked can not be unblocked", t)
+}
+
+//Carts that try to get at what the preamble keeps from them
+var MALICIOUS_CARTS = []string{
+	`__state_123__.extcmd('video') __state_123__.printh('123 done')`,
+	`for k,v in pairs(_ENV) do if type(v)=="table" and rawget(v,"extcmd") then v.extcmd('video') end end`,
+	`printh("123 done") printh("pwned","pwned.txt",true) extcmd("video")`,
+	`ls() cd("..") folder() run()`,
+}
+
+func TestHardenedPreamble(t *testing.T) {
+	secret, err := new_run_secret()
+	test_assert_no_err(err, "Could not generate secret", t)
+	other_secret, _ := new_run_secret()
+	test_assert_eq(false, secret == other_secret, "Every run should get its own secret", t)
+	test_assert_eq(true, regexp.MustCompile(`^_[0-9a-f]+$`).MatchString(secret), "Secret should be a lowercase lua identifier: "+secret, t)
+
+	global_function_regex := regexp.MustCompile(`(?m)^function (\w+)`)
+	for _, cart := range MALICIOUS_CARTS {
+		file := build_cart_file(cart, secret, test_run_limits().Default)
+		lua := file[strings.Index(file, "__lua__\n")+len("__lua__\n"):]
+		lines := strings.Split(lua, "\n")
+		test_assert_eq(cart, lines[CART_PREAMBLE_LINE_COUNT], "User code should start right after the preamble", t)
+		preamble := strings.Join(lines[:CART_PREAMBLE_LINE_COUNT], "\n")
+		//everything but the user's code
+		harness := strings.Replace(lua, cart, "", 1)
+
+		test_assert_eq(false, strings.Contains(harness, "__state"), "Nothing should be kept in a global table", t)
+		test_assert_eq(false, strings.Contains(harness, "123 done"), "The done token should not depend on the job", t)
+		test_assert_eq(2, strings.Count(harness, "'"+run_done_token(secret)+"'"), "Only the preamble and postamble should print the done token", t)
+		//the locals have to be taken before the globals are removed, or the harness could not record
+		capture := strings.Index(preamble, "local "+secret+"_flip,")
+		lockdown := strings.Index(preamble, "load,save,ls,cd,folder,extcmd,reset,run,stop,import,export,serial=nil")
+		test_assert_eq(true, capture >= 0 && lockdown > capture, "The harness should keep the originals before the globals are removed", t)
+		capture_line := strings.SplitN(preamble[capture:], "\n", 2)[0]
+		test_assert_eq(true, strings.Contains(capture_line[strings.Index(capture_line, "="):], "extcmd"), "The harness should keep the real extcmd", t)
+		test_assert_eq(true, strings.HasPrefix(lines[2], "load,save,ls,cd,folder,extcmd,reset,run,stop,"), "Host functions should be removed before any other code runs", t)
+		globals := []string{}
+		for _, match := range global_function_regex.FindAllStringSubmatch(preamble, -1) {
+			globals = append(globals, match[1])
+		}
+		test_assert_eq("[printh cstore reload flip]", fmt.Sprint(globals), "Only the wrapped functions should be global", t)
+		//the originals are only ever called through the locals
+		for _, original := range []string{"flip", "extcmd", "printh"} {
+			calls := regexp.MustCompile(`(^|[^\w])`+original+`\(`).FindAllString(global_function_regex.ReplaceAllString(harness, ""), -1)
+			test_assert_eq(0, len(calls), original+" should only be called through its local", t)
+		}
+	}
+}
+
+func TestPico8RunnerIgnoresForgedDoneToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "done_token_test")
+	test_assert_no_err(err, "Could not create temp dir", t)
+	defer os.RemoveAll(dir)
+	//stands in for a cart that prints what used to be the done marker
+	exec_path := filepath.Join(dir, "pico8")
+	write_test_executable(exec_path, "#!/bin/sh\necho '123 done'\nexec sleep 60\n", "Could not write fake PICO-8", t)
+
+	runner := &Pico8Runner{exec_path: exec_path, scratch_root: filepath.Join(dir, "scratch"), timeout: 500 * time.Millisecond}
+	_, err = runner.Run(context.Background(), "printh('123 done')", "123", test_run_limits().Default, root_logger)
+	cart_error, ok := err.(*CartError)
+	test_assert_eq(true, ok && cart_error.Kind == CART_ERROR_TIMEOUT, fmt.Sprintf("A forged done marker should be ignored, got %v", err), t)
+}
+
+func TestMaliciousCarts(t *testing.T) {
+	if _, err := os.Stat(PICO_8_EXEC_PATH); err != nil {
+		t.Skip("PICO-8 is not installed")
+	}
+	scratch_root, err := ioutil.TempDir("", "malicious_test")
+	test_assert_no_err(err, "Could not create scratch root", t)
+	defer os.RemoveAll(scratch_root)
+	runner := &Pico8Runner{exec_path: PICO_8_EXEC_PATH, scratch_root: scratch_root, timeout: 30 * time.Second}
+	params := test_run_limits().Default
+	params.RecordingLength = time.Second
+
+	for _, cart := range MALICIOUS_CARTS {
+		run_result, err := runner.Run(context.Background(), cart, "123", params, root_logger)
+		if err == nil {
+			//the cart did nothing it should not have, so it was recorded like any other cart
+			test_assert_eq(true, len(run_result.MediaData) > 0, cart+": should have been recorded", t)
+			continue
+		}
+		cart_error, ok := err.(*CartError)
+		test_assert_eq(true, ok && cart_error.Kind == CART_ERROR_RUNTIME, fmt.Sprintf("%v: should fail with a runtime error, got %v", cart, err), t)
+	}
+	_, err = os.Stat("pwned.txt")
+	test_assert_eq(true, os.IsNotExist(err), "printh should not write files", t)
+}
+
+//Runs a shell script in place of PICO-8 under sandbox.  The script's output is returned along with the error
+func run_fake_pico8(script string, sandbox *Sandbox, timeout time.Duration, t *testing.T) (string, error) {
+	if runtime.GOOS != "linux" {
+		t.Skip("limits are only enforced on Linux")
+	}
+	dir, err := ioutil.TempDir("", "sandbox_test")
+	test_assert_no_err(err, "Could not create temp dir", t)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	exec_path := filepath.Join(dir, "pico8")
+	write_test_executable(exec_path, "#!/bin/sh\n"+script, "Could not write fake PICO-8", t)
+
+	runner := &Pico8Runner{exec_path: exec_path, scratch_root: filepath.Join(dir, "scratch"), timeout: timeout, sandbox: sandbox}
+	run_result, err := runner.Run(context.Background(), "print('hello!')", "123", test_run_limits().Default, root_logger)
+	if run_result == nil {
+		return "", err
+	}
+	return run_result.Output, err
+}
+
+//PICO-8 does not exit on errors, so a fake one prints this to get its output back
+const FAKE_PICO8_ERROR = "echo 'runtime error line 3 tab 0'; echo 'attempt to call a nil value'; exec sleep 60\n"
+
+func TestSandboxLimits(t *testing.T) {
+	sandbox := &Sandbox{cpu_seconds: 7, max_open_files: 99, max_memory: 1024 * 1024 * 1024}
+	output, err := run_fake_pico8("echo \"nofile=$(ulimit -n) cpu=$(ulimit -t) as=$(ulimit -v)\"\n"+FAKE_PICO8_ERROR, sandbox, 30*time.Second, t)
+	_, ok := err.(*CartError)
+	test_assert_eq(true, ok, fmt.Sprintf("Expected the fake cart error, got %v", err), t)
+	test_assert_eq(true, strings.Contains(output, "nofile=99 cpu=7 as=1048576"), "Limits should be set on PICO-8, got "+output, t)
+
+	//carts that use up their CPU time are told why they were stopped
+	_, err = run_fake_pico8("while :; do :; done\n", &Sandbox{cpu_seconds: 1}, 30*time.Second, t)
+	cart_error, ok := err.(*CartError)
+	test_assert_eq(true, ok && cart_error.Kind == CART_ERROR_LIMIT, fmt.Sprintf("Expected a limit error, got %v", err), t)
+	test_assert_eq(true, ok && strings.Contains(cart_error.Message, "CPU time"), fmt.Sprintf("Expected a CPU time error, got %v", err), t)
+
+	//carts that finish without a recording still get their output back
+	output, err = run_fake_pico8("echo 'no gif here'\ngrep -o '_[0-9a-f]* done' \"$2\" | head -n 1\nexec sleep 60\n", nil, 30*time.Second, t)
+	test_assert_eq(true, err != nil, "Should fail without a GIF", t)
+	test_assert_eq(true, strings.Contains(output, "no gif here"), "Output should be kept when there is no GIF, got "+output, t)
+
+	config := default_config()
+	config.CartCgroupDir = "/sys/fs/cgroup/tweetcartrunner"
+	config.CartCgroupCPUPercent = 50
+	config.CartCgroupMemoryMB = 256
+	sandbox = config.sandbox()
+	test_assert_eq("50000 100000", sandbox.cgroup_cpu_max, "cpu.max should be a quota per 100ms", t)
+	test_assert_eq(uint64(256*1024*1024), sandbox.cgroup_memory_max, "memory.max should be in bytes", t)
+	config.CartCPUSeconds, config.CartMemoryLimitMB, config.CartMaxOpenFiles, config.CartCgroupDir = 0, 0, 0, ""
+	test_assert_eq(false, config.sandbox().is_enabled(), "Nothing needs to be done without limits", t)
+}
+
+func TestSandboxedProcessLimitError(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("limits are only enforced on Linux")
+	}
+	killed := exec.Command("/bin/sh", "-c", "kill -9 $$")
+	killed.Run()
+	dir, err := ioutil.TempDir("", "cgroup_test")
+	test_assert_no_err(err, "Could not create temp dir", t)
+	defer os.RemoveAll(dir)
+	events := filepath.Join(dir, "memory.events")
+	test_assert_no_err(ioutil.WriteFile(events, []byte("low 0\nhigh 0\nmax 3\noom 1\noom_kill 1\n"), 0600), "Could not write memory.events", t)
+
+	test_assert_eq(true, (&SandboxedProcess{}).limit_error(killed.ProcessState) == nil, "SIGKILL without a cgroup should not be a memory error", t)
+	process := &SandboxedProcess{cgroup: dir}
+	process.cart_started()
+	test_assert_eq(uint64(1), process.oom_kills_at_start, "Should read oom_kill", t)
+	test_assert_eq(true, process.limit_error(killed.ProcessState) == nil, "OOM kills from before the cart should not count", t)
+	test_assert_no_err(ioutil.WriteFile(events, []byte("low 0\nhigh 0\nmax 4\noom 2\noom_kill 2\n"), 0600), "Could not write memory.events", t)
+	cart_error := process.limit_error(killed.ProcessState)
+	test_assert_eq(true, cart_error != nil && strings.Contains(cart_error.Message, "memory"), fmt.Sprintf("Expected a memory error, got %v", cart_error), t)
+}
+
+//Anything PICO-8 starts is killed along with it
+func TestPico8RunnerKillsProcessGroup(t *testing.T) {
+	for _, sandbox := range []*Sandbox{nil, {max_open_files: 64}} {
+		output, err := run_fake_pico8("sleep 60 &\necho \"child=$!\"\n"+FAKE_PICO8_ERROR, sandbox, 30*time.Second, t)
+		_, ok := err.(*CartError)
+		test_assert_eq(true, ok, fmt.Sprintf("Expected the fake cart error, got %v", err), t)
+		match := regexp.MustCompile(`child=(\d+)`).FindStringSubmatch(output)
+		if match == nil {
+			t.Fatal("Fake PICO-8 should have started a child, got " + output)
+		}
+		for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+			//dead processes are either gone or zombies waiting to be reaped
+			stat, err := ioutil.ReadFile("/proc/" + match[1] + "/stat")
+			if err != nil || strings.Contains(string(stat), ") Z ") {
+				break
+			}
+			if time.Since(start) > 5*time.Second {
+				t.Fatal("Child of PICO-8 is still running: " + string(stat))
+			}
+		}
+	}
+}
+
+func TestSandboxIsolatesNetwork(t *testing.T) {
+	output, err := run_fake_pico8("echo \"interfaces=$(tail -n +3 /proc/net/dev | wc -l)\"\n"+FAKE_PICO8_ERROR, &Sandbox{isolate_network: true}, 30*time.Second, t)
+	if _, ok := err.(*CartError); !ok {
+		t.Skipf("Could not make a network namespace: %v", err)
+	}
+	test_assert_eq(true, strings.Contains(output, "interfaces=1"), "PICO-8 should only have loopback, got "+output, t)
+}
+
+func TestFramebuffers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "framebuffer_test")
+	test_assert_no_err(err, "Could not create temp dir", t)
+	defer os.RemoveAll(dir)
+	//stands in for Xvfb.  Every time it is started it gets the next display, starting at :42
+	xvfb_path := filepath.Join(dir, "Xvfb")
+	script := fmt.Sprintf("#!/bin/sh\nn=$(cat %[1]v/display 2>/dev/null || echo 41)\nn=$((n+1))\necho $n > %[1]v/display\necho $$ > %[1]v/pid\necho $n >&3\nexec sleep 60\n", dir)
+	write_test_executable(xvfb_path, script, "Could not write fake Xvfb", t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	restarts := bot_metrics.framebuffer_restarts.value()
+	framebuffers := start_framebuffers(ctx, xvfb_path, "640x480x24", 1, 2)
+	readiness := &Readiness{webhook_registered: 1, subscribed: 1, stream_connected: 1, framebuffers: framebuffers}
+	//both slots share the one framebuffer
+	for i := 0; i < 2; i++ {
+		env, release, err := framebuffers.acquire(ctx)
+		test_assert_no_err(err, "Could not get a framebuffer", t)
+		test_assert_eq("[DISPLAY=:42]", fmt.Sprint(env), "PICO-8 should use the display Xvfb picked", t)
+		defer release()
+	}
+	test_assert_eq(0, len(readiness.not_ready()), "Should be ready once Xvfb is running", t)
+
+	//PICO-8 gets the display and the SDL settings
+	exec_path := filepath.Join(dir, "pico8")
+	write_test_executable(exec_path, "#!/bin/sh\necho \"display=$DISPLAY audio=$SDL_AUDIODRIVER\"\n"+FAKE_PICO8_ERROR, "Could not write fake PICO-8", t)
+	framebuffers = start_framebuffers(ctx, xvfb_path, "640x480x24", 1, 1)
+	runner := &Pico8Runner{exec_path: exec_path, scratch_root: filepath.Join(dir, "scratch"), timeout: 30 * time.Second,
+		framebuffers: framebuffers, env: []string{"SDL_AUDIODRIVER=dummy"}}
+	run_result, err := runner.Run(ctx, "print('hello!')", "123", test_run_limits().Default, root_logger)
+	_, ok := err.(*CartError)
+	test_assert_eq(true, ok, fmt.Sprintf("Expected the fake cart error, got %v", err), t)
+	test_assert_eq(true, run_result != nil && strings.Contains(run_result.Output, "display=:43 audio=dummy"), "PICO-8 should get the display and SDL settings", t)
+
+	//Xvfb is started again when it dies
+	pid, err := ioutil.ReadFile(filepath.Join(dir, "pid"))
+	test_assert_no_err(err, "Could not read Xvfb pid", t)
+	pid_number, _ := strconv.Atoi(strings.TrimSpace(string(pid)))
+	process, err := os.FindProcess(pid_number)
+	test_assert_no_err(err, "Could not find Xvfb", t)
+	test_assert_no_err(process.Kill(), "Could not kill Xvfb", t)
+	for start := time.Now(); framebuffers.down() == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("Framebuffer should be down once Xvfb dies")
+		}
+	}
+	env, release, err := framebuffers.acquire(ctx)
+	test_assert_no_err(err, "Could not get a framebuffer", t)
+	release()
+	test_assert_eq("[DISPLAY=:44]", fmt.Sprint(env), "Xvfb should have been started again", t)
+	test_assert_eq(restarts+1, bot_metrics.framebuffer_restarts.value(), "Restart should be counted", t)
+}
+
+func TestSelfTest(t *testing.T) {
+	test_assert_no_err(run_self_test(context.Background(), &FakeRunner{}, test_run_limits(), root_logger), "Self test should pass when recording works", t)
+	err := run_self_test(context.Background(), &FakeRunner{err: errors.New("could not open display"), output: "no display"}, test_run_limits(), root_logger)
+	test_assert_eq(true, err != nil && strings.Contains(err.Error(), "no display"), fmt.Sprintf("Self test should fail with PICO-8's output, got %v", err), t)
+}
+
+//Writes a script to dir that stands in for PICO-8 running the supervisor cart, and returns its path
+func write_fake_pico8_worker(dir string, t *testing.T) string {
+	recording, err := (&FakeRunner{}).Run(context.Background(), "print('hello!')", "1", test_run_limits().Default, root_logger)
+	test_assert_no_err(err, "Could not make a GIF", t)
+	gif_path := filepath.Join(dir, "recording.gif")
+	test_assert_no_err(ioutil.WriteFile(gif_path, recording.MediaData, 0600), "Could not write GIF", t)
+	//it is run as pico8 -run <supervisor> -root_path <dir> -desktop <dir> -home <dir>.  Every cart saves cartdata
+	script := `#!/bin/sh
+token=$(grep -o "_[0-9a-f]* ready" "$2")
+echo "$token"
+while read command; do
+ case "$command" in
+ ping) echo "${token% ready} pong";;
+ run)
+  echo "worker=$$"
+  if [ -e "$8/cdata/cart.p8d.txt" ]; then echo "cartdata=leaked"; fi
+  mkdir -p "$8/cdata" && echo 1 > "$8/cdata/cart.p8d.txt"
+  if grep -q "error()" "$4/` + WORKER_JOB_FILE + `"; then echo "runtime error line 3 tab 0"; echo "attempt to call a nil value"; continue; fi
+  cp "` + gif_path + `" "$6/job.gif"
+  grep -o "_[0-9a-f]* done" "$4/` + WORKER_JOB_FILE + `" | head -n 1
+  echo "$token";;
+ esac
+done
+`
+	exec_path := filepath.Join(dir, "pico8")
+	write_test_executable(exec_path, script, "Could not write fake PICO-8", t)
+	return exec_path
+}
+
+func TestPico8WorkerPool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "worker_pool_test")
+	test_assert_no_err(err, "Could not create temp dir", t)
+	defer os.RemoveAll(dir)
+	exec_path := write_fake_pico8_worker(dir, t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	max_runs_recycles := bot_metrics.worker_recycles.value("max_runs")
+	cart_error_recycles := bot_metrics.worker_recycles.value("cart_error")
+	runner := &Pico8Runner{exec_path: exec_path, scratch_root: filepath.Join(dir, "scratch"), timeout: 30 * time.Second}
+	pool := start_worker_pool(ctx, runner, 1, 2)
+	worker_regex := regexp.MustCompile(`worker=(\d+)`)
+	run := func(cart string) (string, error) {
+		result, err := pool.Run(ctx, cart, "123", test_run_limits().Default, root_logger)
+		if err != nil {
+			return "", err
+		}
+		test_assert_eq(true, len(result.MediaData) > 0, "Worker should have recorded the cart", t)
+		test_assert_eq(false, strings.Contains(result.Output, "cartdata=leaked"), "Cartdata saved by the last cart should be deleted", t)
+		match := worker_regex.FindStringSubmatch(result.Output)
+		if match == nil {
+			t.Fatal("Output should say which worker ran the cart: " + result.Output)
+		}
+		return match[1], nil
+	}
+
+	workers := []string{}
+	for i := 0; i < 3; i++ {
+		worker, err := run("print('hello!')")
+		test_assert_no_err(err, "Worker could not run cart", t)
+		workers = append(workers, worker)
+	}
+	test_assert_eq(workers[0], workers[1], "Worker should be kept running between carts", t)
+	test_assert_eq(false, workers[1] == workers[2], "Worker should be replaced after max_runs carts", t)
+	test_assert_eq(max_runs_recycles+1, bot_metrics.worker_recycles.value("max_runs"), "Replacement should be counted", t)
+
+	_, err = run("error()")
+	cart_error, ok := err.(*CartError)
+	test_assert_eq(true, ok && cart_error.Kind == CART_ERROR_RUNTIME, fmt.Sprintf("Expected a runtime error, got %v", err), t)
+	worker, err := run("print('hello!')")
+	test_assert_no_err(err, "Worker could not run cart", t)
+	test_assert_eq(false, worker == workers[2], "Worker should be replaced after an error", t)
+	test_assert_eq(cart_error_recycles+1, bot_metrics.worker_recycles.value("cart_error"), "Replacement should be counted", t)
+
+	cancel()
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		entries, _ := ioutil.ReadDir(runner.scratch_root)
+		if len(entries) == 0 {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("Workers should be stopped and cleaned up once the pool is done")
+		}
+	}
+}
+
+func TestIsDeterministicCart(t *testing.T) {
+	test_assert_eq(true, is_deterministic_cart("cls()circ(64,64,t()*8)"), "Cart without randomness should be deterministic", t)
+	test_assert_eq(false, is_deterministic_cart("pset(rnd(128),rnd(128))"), "rnd without srand should not be deterministic", t)
+	test_assert_eq(true, is_deterministic_cart("srand(7)pset(rnd(128),rnd(128))"), "rnd with srand should be deterministic", t)
+	test_assert_eq(false, is_deterministic_cart("print(stat(93))"), "stat can read the clock", t)
+	test_assert_eq(true, is_deterministic_cart("grnd=1 status=2"), "Only whole words should count", t)
+}
+
+type counting_runner struct {
+	FakeRunner
+	runs int
+}
+
+func (runner *counting_runner) Run(ctx context.Context, cart_source, job_id string, params RunParams, logger *Logger) (*RunResult, error) {
+	runner.runs++
+	return runner.FakeRunner.Run(ctx, cart_source, job_id, params, logger)
+}
+
+func TestCachingRunner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "result_cache_test")
+	test_assert_no_err(err, "Could not create temp dir", t)
+	defer os.RemoveAll(dir)
+	cache, err := open_result_cache(dir, 64<<20)
+	test_assert_no_err(err, "Could not open result cache", t)
+	runner := &counting_runner{}
+	caching_runner := &CachingRunner{runner: runner, cache: cache}
+	params := test_run_limits().Default
+	hits, skips := bot_metrics.result_cache_lookups.value("hit"), bot_metrics.result_cache_lookups.value("skipped")
+
+	first, err := caching_runner.Run(context.Background(), "print('hello!')", "1", params, root_logger)
+	test_assert_no_err(err, "Could not run cart", t)
+	second, err := caching_runner.Run(context.Background(), "print('hello!')", "2", params, root_logger)
+	test_assert_no_err(err, "Could not run cart", t)
+	test_assert_eq(1, runner.runs, "Same cart should only be run once", t)
+	test_assert_eq(false, first.Cached, "First run should not be cached", t)
+	test_assert_eq(true, second.Cached, "Second run should come from the cache", t)
+	test_assert_eq(true, bytes.Equal(first.MediaData, second.MediaData), "Cached media should be the same", t)
+	test_assert_eq(fmt.Sprint(first.Params), fmt.Sprint(second.Params), "Cached params should be the same", t)
+	test_assert_eq(hits+1, bot_metrics.result_cache_lookups.value("hit"), "Hit should be counted", t)
+
+	params.FrameRate = 15
+	_, err = caching_runner.Run(context.Background(), "print('hello!')", "3", params, root_logger)
+	test_assert_no_err(err, "Could not run cart", t)
+	test_assert_eq(2, runner.runs, "Different params should run the cart again", t)
+
+	for i := 0; i < 2; i++ {
+		_, err = caching_runner.Run(context.Background(), "pset(rnd(128),rnd(128))", "4", params, root_logger)
+		test_assert_no_err(err, "Could not run cart", t)
+	}
+	test_assert_eq(4, runner.runs, "Random carts should always be run", t)
+	test_assert_eq(skips+2, bot_metrics.result_cache_lookups.value("skipped"), "Skips should be counted", t)
+
+	runner.err = errors.New("syntax error")
+	for i := 0; i < 2; i++ {
+		caching_runner.Run(context.Background(), "x=", "5", params, root_logger)
+	}
+	test_assert_eq(6, runner.runs, "Errors should not be cached", t)
+}
+
+func TestResultCacheEviction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "result_cache_test")
+	test_assert_no_err(err, "Could not create temp dir", t)
+	defer os.RemoveAll(dir)
+	result := &RunResult{MediaData: make([]byte, 1000), MediaType: MEDIA_TYPE_GIF, Params: test_run_limits().Default}
+	cache, err := open_result_cache(dir, 2500)
+	test_assert_no_err(err, "Could not open result cache", t)
+	cached := func(cache *ResultCache, key string) bool {
+		result, err := cache.get(key)
+		test_assert_no_err(err, "Could not read cached result", t)
+		return result != nil
+	}
+
+	test_assert_no_err(cache.put("a", result), "Could not cache result", t)
+	test_assert_no_err(cache.put("b", result), "Could not cache result", t)
+	test_assert_eq(true, cached(cache, "a"), "a should be cached", t)
+	test_assert_no_err(cache.put("c", result), "Could not cache result", t)
+	test_assert_eq(false, cached(cache, "b"), "Least recently used result should be evicted", t)
+	test_assert_eq(true, cached(cache, "a") && cached(cache, "c"), "Recently used results should be kept", t)
+	_, err = os.Stat(cache.media_path("b"))
+	test_assert_eq(true, os.IsNotExist(err), "Evicted media should be deleted", t)
+	test_assert_no_err(cache.put("big", &RunResult{MediaData: make([]byte, 3000)}), "Results too big to cache should be ignored", t)
+	test_assert_eq(false, cached(cache, "big"), "Results too big to cache should not be kept", t)
+
+	reopened, err := open_result_cache(dir, 2500)
+	test_assert_no_err(err, "Could not reopen result cache", t)
+	test_assert_eq(true, cached(reopened, "a") && cached(reopened, "c"), "Results should be kept across restarts", t)
+	test_assert_eq(cache.size, reopened.size, "Size should be the same after a restart", t)
+	test_assert_no_err(os.Chtimes(reopened.media_path("a"), time.Now(), time.Now().Add(time.Hour)), "Could not touch a", t)
+	shrunk, err := open_result_cache(dir, 1500)
+	test_assert_no_err(err, "Could not reopen result cache", t)
+	test_assert_eq(true, cached(shrunk, "a"), "Most recently used result should be kept", t)
+	test_assert_eq(false, cached(shrunk, "c"), "Results over the size limit should be evicted on start up", t)
+}
+
+func TestCachedTweetReusesMedia(t *testing.T) {
+	fake, tc := new_fake_twitter()
+	defer fake.server.Close()
+	fake.tweets["123"] = `{"id":123,"id_str":"123","full_text":"@TweetCartRunner ?\"hello!\"",
+		"user":{"id":7,"id_str":"7","screen_name":"test_user"},
+		"entities":{"user_mentions":[{"indices":[0,16],"screen_name":"TweetCartRunner"}]}}`
+	dir, err := ioutil.TempDir("", "result_cache_test")
+	test_assert_no_err(err, "Could not create temp dir", t)
+	defer os.RemoveAll(dir)
+	cache, err := open_result_cache(dir, 64<<20)
+	test_assert_no_err(err, "Could not open result cache", t)
+	uploaded_media = new_uploaded_media()
+	defer func() { uploaded_media = nil }()
+	reuses := bot_metrics.media_reuses.value("tweet_gif")
+
+	handler := test_tweet_handler(tc, &CachingRunner{runner: &FakeRunner{}, cache: cache})
+	first := handle_tweet(context.Background(), 123, 123, handler, root_logger)
+	second := handle_tweet(context.Background(), 123, 123, handler, root_logger)
+	test_assert_eq(JOB_STATUS_SUCCEEDED, second.Status, "Cached job should have succeeded", t)
+	test_assert_eq(false, first.Cached, "First job should have run the cart", t)
+	test_assert_eq(true, second.Cached, "Second job should have come from the cache", t)
+	test_assert_eq(fmt.Sprint(first.MediaIDs), fmt.Sprint(second.MediaIDs), "Media ID should be reused", t)
+	test_assert_eq(3, fake.request_count("POST /1.1/media/upload.json"), "Cached GIF should only be uploaded once", t)
+	test_assert_eq(2, len(fake.statuses), "Should have replied twice", t)
+	test_assert_eq(reuses+1, bot_metrics.media_reuses.value("tweet_gif"), "Reuse should be counted", t)
+}
+
+func TestStartCartRunnerKeepsWorkers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "worker_pool_test")
+	test_assert_no_err(err, "Could not create temp dir", t)
+	defer os.RemoveAll(dir)
+	runner := &Pico8Runner{exec_path: write_fake_pico8_worker(dir, t), scratch_root: filepath.Join(dir, "scratch"), timeout: 30 * time.Second}
+	//left behind by a worker before a crash
+	stale_dir := filepath.Join(runner.scratch_root, SCRATCH_DIR_PREFIX+"worker_123")
+	test_assert_no_err(os.MkdirAll(stale_dir, 0700), "Could not create stale dir", t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pool, ok := start_cart_runner(ctx, runner, true, 1, 10).(*Pico8WorkerPool)
+	test_assert_eq(true, ok, "Should have started a worker pool", t)
+	_, err = os.Stat(stale_dir)
+	test_assert_eq(true, os.IsNotExist(err), "Stale worker directory should be deleted", t)
+	error_recycles := bot_metrics.worker_recycles.value("error")
+	for i := 0; i < 2; i++ {
+		_, err := pool.Run(ctx, "print('hello!')", "123", test_run_limits().Default, root_logger)
+		test_assert_no_err(err, "Worker should be able to run carts after the startup cleanup", t)
+	}
+	test_assert_eq(error_recycles, bot_metrics.worker_recycles.value("error"), "No worker should fail", t)
 
+	//a worker handed back after the pool is done is stopped rather than left idle
+	worker, err := pool.start_worker(root_logger)
+	test_assert_no_err(err, "Could not start worker", t)
+	cancel()
+	pool.make_idle(worker)
+	test_assert_eq(0, len(pool.idle), "Worker should not be made idle once the pool is done", t)
+	_, err = os.Stat(worker.dir)
+	test_assert_eq(true, os.IsNotExist(err), "Worker should be stopped once the pool is done", t)
 }
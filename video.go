@@ -0,0 +1,84 @@
+//Copyright (C) 2020 Daniel Bokser.  See LICENSE file for license
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+)
+
+const (
+	MEDIA_FORMAT_GIF = "gif"
+	MEDIA_FORMAT_MP4 = "mp4"
+
+	MEDIA_TYPE_GIF = "image/gif"
+	MEDIA_TYPE_MP4 = "video/mp4"
+)
+
+func is_valid_media_format(format string) bool {
+	return format == MEDIA_FORMAT_GIF || format == MEDIA_FORMAT_MP4
+}
+
+//The media_category twitter wants when uploading media of this type
+func media_category(media_type string, is_dm bool) string {
+	switch {
+	case media_type == MEDIA_TYPE_MP4 && is_dm:
+		return "dm_video"
+	case media_type == MEDIA_TYPE_MP4:
+		return "tweet_video"
+	case is_dm:
+		return "dm_gif"
+	default:
+		return "tweet_gif"
+	}
+}
+
+//Converts a GIF recorded by PICO-8 to an H.264 MP4 with ffmpeg.
+//work_dir is where the intermediate files go
+func convert_gif_to_mp4(gif_data []byte, ffmpeg_path, work_dir string) ([]byte, error) {
+	gif_path := filepath.Join(work_dir, "recording.gif")
+	mp4_path := filepath.Join(work_dir, "recording.mp4")
+	if err := ioutil.WriteFile(gif_path, gif_data, 0600); err != nil {
+		return nil, err
+	}
+
+	output := bytes.Buffer{}
+	ffmpeg_command := exec.Command(ffmpeg_path, "-y", "-loglevel", "error",
+		"-i", gif_path,
+		"-movflags", "+faststart",
+		"-c:v", "libx264",
+		"-pix_fmt", "yuv420p",
+		//H.264 needs even dimensions, and nearest neighbor keeps the pixels sharp
+		"-vf", "scale=trunc(iw/2)*2:trunc(ih/2)*2:flags=neighbor",
+		mp4_path)
+	ffmpeg_command.Stdout = &output
+	ffmpeg_command.Stderr = &output
+	if err := ffmpeg_command.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg failed: %v. Output: %v", err, output.String())
+	}
+
+	return ioutil.ReadFile(mp4_path)
+}
+
+//Turns the GIF into the given format.  Returns the media, its media type and its format.
+//Falls back to the GIF if ffmpeg is not installed or fails
+func encode_recording(gif_data []byte, format, ffmpeg_path, work_dir string, logger *Logger) ([]byte, string, string) {
+	if format != MEDIA_FORMAT_MP4 {
+		return gif_data, MEDIA_TYPE_GIF, MEDIA_FORMAT_GIF
+	}
+	if len(ffmpeg_path) == 0 {
+		return gif_data, MEDIA_TYPE_GIF, MEDIA_FORMAT_GIF
+	}
+	if _, err := exec.LookPath(ffmpeg_path); err != nil {
+		logger.Warn("ffmpeg not found. Falling back to GIF", "ffmpeg_path", ffmpeg_path)
+		return gif_data, MEDIA_TYPE_GIF, MEDIA_FORMAT_GIF
+	}
+	mp4_data, err := convert_gif_to_mp4(gif_data, ffmpeg_path, work_dir)
+	if err != nil {
+		logger.Warn("Could not convert GIF to MP4. Falling back to GIF", "err", err)
+		return gif_data, MEDIA_TYPE_GIF, MEDIA_FORMAT_GIF
+	}
+	return mp4_data, MEDIA_TYPE_MP4, MEDIA_FORMAT_MP4
+}
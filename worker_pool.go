@@ -0,0 +1,437 @@
+//Copyright (C) 2020 Daniel Bokser.  See LICENSE file for license
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	WORKER_SUPERVISOR_FILE = "supervisor.p8"
+	WORKER_JOB_FILE        = "job.p8"
+	//how long a worker has to answer a ping, and to be ready again once a cart is recorded
+	WORKER_HEALTH_TIMEOUT = 5 * time.Second
+)
+
+//The cart a worker runs between carts.  It prints the ready token, then reads commands from stdin:
+//"run" loads the job cart, which loads this cart again once it is recorded, and "ping" is answered with the pong token.
+//Reading stdin with serial() needs PICO-8 0.2.2 or newer
+const WORKER_SUPERVISOR_CART = `pico-8 cartridge // http://www.pico-8.com
+version 18
+__lua__
+printh('%[1]v ready')
+local line=''
+while true do
+ if serial(0x804,0x4300,1)>0 then
+  local c=chr(peek(0x4300))
+  if c=='\n' then
+   if line=='run' then load('%[2]v') end
+   if line=='ping' then printh('%[1]v pong') end
+   line=''
+  else
+   line..=c
+  end
+ else
+  flip()
+ end
+end
+`
+
+//A PICO-8 process that runs the supervisor cart, and every cart it is given after that
+type Pico8Worker struct {
+	dir         string
+	desktop_dir string
+	home_dir    string
+	//the supervisor's ready and pong tokens start with this
+	secret  string
+	command *exec.Cmd
+	stdin   io.WriteCloser
+	//what PICO-8 prints, as it prints it.  Closed once PICO-8 closes stdout
+	output     chan string
+	exited     chan struct{}
+	exit_state *os.ProcessState
+	sandboxed  *SandboxedProcess
+	runs       int
+	//undoes everything start_worker did other than starting the process, in reverse order
+	cleanup []func()
+}
+
+//Runs carts on PICO-8 processes that are kept running between carts, so runs do not wait for PICO-8 to start.
+//A worker is replaced after max_runs carts, or as soon as anything goes wrong with it
+type Pico8WorkerPool struct {
+	//how to run PICO-8.  Its sandbox's CPU time limit is per run, so workers get max_runs times as much
+	runner   *Pico8Runner
+	sandbox  *Sandbox
+	max_runs int
+	idle     chan *Pico8Worker
+	//held while handing workers to idle, and while idle is emptied once ctx is done, so no worker is missed
+	idle_mutex sync.Mutex
+	//workers are killed once it is done
+	ctx context.Context
+}
+
+//Starts size workers in the background
+func start_worker_pool(ctx context.Context, runner *Pico8Runner, size, max_runs int) *Pico8WorkerPool {
+	pool := &Pico8WorkerPool{runner: runner, sandbox: runner.sandbox, max_runs: max_runs, idle: make(chan *Pico8Worker, size), ctx: ctx}
+	if runner.sandbox != nil && runner.sandbox.cpu_seconds > 0 {
+		sandbox := *runner.sandbox
+		sandbox.cpu_seconds *= uint64(max_runs)
+		pool.sandbox = &sandbox
+	}
+	for i := 0; i < size; i++ {
+		go pool.add_worker()
+	}
+	go func() {
+		<-ctx.Done()
+		pool.idle_mutex.Lock()
+		defer pool.idle_mutex.Unlock()
+		for {
+			select {
+			case worker := <-pool.idle:
+				worker.stop()
+			default:
+				return
+			}
+		}
+	}()
+	return pool
+}
+
+//Cleans up after the last time the bot ran, then starts a pool of size workers if use_pool is set.
+//Worker directories look just like stale job directories, so the cleanup has to come first
+func start_cart_runner(ctx context.Context, runner *Pico8Runner, use_pool bool, size, max_runs int) CartRunner {
+	clean_scratch_dirs(runner.scratch_root)
+	if !use_pool {
+		return runner
+	}
+	return start_worker_pool(ctx, runner, size, max_runs)
+}
+
+//Makes worker idle, or stops it if the pool is done
+func (pool *Pico8WorkerPool) make_idle(worker *Pico8Worker) {
+	pool.idle_mutex.Lock()
+	if pool.ctx.Err() != nil {
+		pool.idle_mutex.Unlock()
+		worker.stop()
+		return
+	}
+	//never blocks, since there are never more than size workers
+	pool.idle <- worker
+	pool.idle_mutex.Unlock()
+}
+
+//Starts a worker and makes it idle, trying again until it works or the pool is done
+func (pool *Pico8WorkerPool) add_worker() {
+	const (
+		min_retry_delay = time.Second
+		max_retry_delay = time.Minute
+	)
+	logger := root_logger.stage("worker")
+	for retry_delay := min_retry_delay; ; {
+		worker, err := pool.start_worker(logger)
+		if err == nil {
+			pool.make_idle(worker)
+			return
+		}
+		if pool.ctx.Err() != nil {
+			return
+		}
+		bot_metrics.worker_start_failures.inc()
+		logger.Error("Could not start PICO-8 worker", "err", err, "retry_delay", retry_delay)
+		select {
+		case <-time.After(retry_delay):
+		case <-pool.ctx.Done():
+			return
+		}
+		if retry_delay *= 2; retry_delay > max_retry_delay {
+			retry_delay = max_retry_delay
+		}
+	}
+}
+
+func (pool *Pico8WorkerPool) start_worker(logger *Logger) (_ *Pico8Worker, err error) {
+	runner := pool.runner
+	secret, err := new_run_secret()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(runner.scratch_root, 0700); err != nil {
+		return nil, err
+	}
+	dir, err := ioutil.TempDir(runner.scratch_root, SCRATCH_DIR_PREFIX+"worker_")
+	if err != nil {
+		return nil, err
+	}
+	worker := &Pico8Worker{
+		dir:         dir,
+		desktop_dir: filepath.Join(dir, "desktop"),
+		home_dir:    filepath.Join(dir, "home"),
+		secret:      secret,
+		output:      make(chan string, 64),
+		exited:      make(chan struct{}),
+		cleanup:     []func(){func() { os.RemoveAll(dir) }},
+	}
+	defer func() {
+		if err != nil {
+			worker.stop()
+		}
+	}()
+	for _, dir := range []string{worker.desktop_dir, worker.home_dir} {
+		if err := os.Mkdir(dir, 0700); err != nil {
+			return nil, err
+		}
+	}
+	supervisor := fmt.Sprintf(WORKER_SUPERVISOR_CART, secret, WORKER_JOB_FILE)
+	if err := ioutil.WriteFile(filepath.Join(dir, WORKER_SUPERVISOR_FILE), []byte(supervisor), 0600); err != nil {
+		return nil, err
+	}
+	exec_path, err := filepath.Abs(runner.exec_path)
+	if err != nil {
+		return nil, err
+	}
+
+	pico8_args := []string{"-run", filepath.Join(dir, WORKER_SUPERVISOR_FILE), "-root_path", dir, "-desktop", worker.desktop_dir, "-home", worker.home_dir}
+	pico8_command, sandboxed, err := pool.sandbox.command(pool.ctx, exec_path, pico8_args, filepath.Base(dir), logger)
+	if err != nil {
+		return nil, err
+	}
+	worker.sandboxed = sandboxed
+	worker.cleanup = append(worker.cleanup, sandboxed.close)
+	//the worker keeps its display for as long as it runs
+	display_ctx, cancel_display := context.WithTimeout(pool.ctx, runner.timeout)
+	defer cancel_display()
+	display_env, release_display, err := runner.framebuffers.acquire(display_ctx)
+	if err != nil {
+		return nil, err
+	}
+	worker.cleanup = append(worker.cleanup, release_display)
+	if len(runner.env) > 0 || len(display_env) > 0 {
+		pico8_command.Env = append(append(os.Environ(), runner.env...), display_env...)
+	}
+	pico8_command.Dir = dir
+	stdout, err := pico8_command.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	pico8_command.Stderr = pico8_command.Stdout
+	if worker.stdin, err = pico8_command.StdinPipe(); err != nil {
+		return nil, err
+	}
+	if err := pico8_command.Start(); err != nil {
+		return nil, err
+	}
+	worker.command = pico8_command
+	go func() {
+		worker.exit_state, _ = pico8_command.Process.Wait()
+		close(worker.exited)
+	}()
+	go func() {
+		defer close(worker.output)
+		var buf [256]byte
+		for {
+			n, err := stdout.Read(buf[:])
+			if n > 0 {
+				worker.output <- string(buf[:n])
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	if _, err := worker.wait_for("", worker.secret+" ready", runner.timeout); err != nil {
+		return nil, fmt.Errorf("worker did not become ready: %v", err)
+	}
+	logger.Debug("Started PICO-8 worker", "dir", dir, "pid", pico8_command.Process.Pid)
+	return worker, nil
+}
+
+//Kills PICO-8 and cleans up after it
+func (worker *Pico8Worker) stop() {
+	if worker.command != nil {
+		kill_process_group(worker.command.Process)
+		<-worker.exited
+		//let the stdout reader get to the end, so it does not block forever
+		go func() {
+			for range worker.output {
+			}
+		}()
+	}
+	for i := len(worker.cleanup) - 1; i >= 0; i-- {
+		worker.cleanup[i]()
+	}
+}
+
+//Returns everything PICO-8 printed up to and including token.  output is what was already read
+func (worker *Pico8Worker) wait_for(output, token string, timeout time.Duration) (string, error) {
+	timeout_chan := time.After(timeout)
+	for !strings.Contains(output, token) {
+		select {
+		case chunk, ok := <-worker.output:
+			if !ok {
+				return output, errors.New("PICO-8 exited")
+			}
+			output += chunk
+		case <-timeout_chan:
+			return output, errors.New("timed out")
+		}
+	}
+	return output, nil
+}
+
+func (worker *Pico8Worker) ping() error {
+	if _, err := io.WriteString(worker.stdin, "ping\n"); err != nil {
+		return err
+	}
+	_, err := worker.wait_for("", worker.secret+" pong", WORKER_HEALTH_TIMEOUT)
+	return err
+}
+
+//Gets an idle worker that answers a ping, replacing any that do not
+func (pool *Pico8WorkerPool) take(ctx context.Context, logger *Logger) (*Pico8Worker, error) {
+	timeout_chan := time.After(pool.runner.timeout)
+	for {
+		select {
+		case worker := <-pool.idle:
+			err := worker.ping()
+			if err == nil {
+				return worker, nil
+			}
+			logger.Warn("PICO-8 worker did not answer a ping", "err", err)
+			pool.recycle(worker, "unhealthy")
+		case <-timeout_chan:
+			return nil, errors.New("no PICO-8 worker is ready")
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+//Replaces worker with a new one
+func (pool *Pico8WorkerPool) recycle(worker *Pico8Worker, reason string) {
+	bot_metrics.worker_recycles.inc(reason)
+	worker.stop()
+	if pool.ctx.Err() == nil {
+		go pool.add_worker()
+	}
+}
+
+func (pool *Pico8WorkerPool) Run(ctx context.Context, cart_source, job_id string, params RunParams, logger *Logger) (*RunResult, error) {
+	worker, err := pool.take(ctx, logger)
+	if err != nil {
+		logger.Error("Error getting a PICO-8 worker", "err", err)
+		return nil, err
+	}
+	result, recycle_reason, err := worker.run(ctx, pool.runner, cart_source, params, logger)
+	switch {
+	case len(recycle_reason) > 0:
+		pool.recycle(worker, recycle_reason)
+	case worker.runs >= pool.max_runs:
+		pool.recycle(worker, "max_runs")
+	default:
+		pool.make_idle(worker)
+	}
+	return result, err
+}
+
+//Runs one cart.  If the worker should not be used again, returns why
+func (worker *Pico8Worker) run(ctx context.Context, runner *Pico8Runner, cart_source string, params RunParams, logger *Logger) (*RunResult, string, error) {
+	start_time := time.Now()
+	secret, err := new_run_secret()
+	if err != nil {
+		return nil, "", err
+	}
+	done_str := run_done_token(secret)
+	//a recording left over from the last cart would be taken for this one's
+	old_recordings, err := filepath.Glob(filepath.Join(worker.desktop_dir, "*.gif"))
+	if err != nil {
+		return nil, "", err
+	}
+	for _, path := range old_recordings {
+		if err := os.Remove(path); err != nil {
+			return nil, "error", err
+		}
+	}
+	//carts from different users share the worker's home directory, so one cart must not see what another saved with cartdata
+	old_cartdata, err := filepath.Glob(filepath.Join(worker.home_dir, "cdata", "*"))
+	if err != nil {
+		return nil, "", err
+	}
+	for _, path := range old_cartdata {
+		if err := os.RemoveAll(path); err != nil {
+			return nil, "error", err
+		}
+	}
+	epilogue := secret + "_load('" + WORKER_SUPERVISOR_FILE + "')"
+	file_contents := build_cart_file_with_epilogue(cart_source, secret, params, epilogue)
+	if err := ioutil.WriteFile(filepath.Join(worker.dir, WORKER_JOB_FILE), []byte(file_contents), 0600); err != nil {
+		return nil, "error", err
+	}
+	//anything printed while the worker was idle is not from this cart
+	for drained := false; !drained; {
+		select {
+		case <-worker.output:
+		default:
+			drained = true
+		}
+	}
+	worker.sandboxed.cart_started()
+	if _, err := io.WriteString(worker.stdin, "run\n"); err != nil {
+		return nil, "error", err
+	}
+	worker.runs++
+
+	user_line_count := strings.Count(cart_source, "\n") + 1
+	timeout_chan := time.After(runner.timeout)
+	output := ""
+	for !strings.Contains(output, done_str) {
+		select {
+		case chunk, ok := <-worker.output:
+			if !ok {
+				select {
+				case <-worker.exited:
+					if cart_error := worker.sandboxed.limit_error(worker.exit_state); cart_error != nil {
+						return &RunResult{Output: output, Duration: time.Since(start_time), Params: params}, "limit", cart_error
+					}
+				case <-time.After(time.Second):
+				}
+				return nil, "exited", errors.New("PICO-8 worker exited while running the cart")
+			}
+			output += chunk
+			//PICO-8 does not go back to the supervisor on errors, so the worker can not be used again
+			if cart_error := parse_cart_error(output, CART_PREAMBLE_LINE_COUNT, user_line_count); cart_error != nil {
+				return &RunResult{Output: output, Duration: time.Since(start_time), Params: params}, "cart_error", cart_error
+			}
+		case <-timeout_chan:
+			return &RunResult{Duration: time.Since(start_time), Params: params}, "timeout", &CartError{Kind: CART_ERROR_TIMEOUT, Message: "Timed out running cart.  Bailing out..."}
+		case <-ctx.Done():
+			logger.Warn("Killed PICO-8 worker because we are going down")
+			return &RunResult{Duration: time.Since(start_time), Params: params}, "cancelled", ctx.Err()
+		}
+	}
+
+	recycle_reason := ""
+	done_index := strings.Index(output, done_str) + len(done_str)
+	if _, err := worker.wait_for(output[done_index:], worker.secret+" ready", WORKER_HEALTH_TIMEOUT); err != nil {
+		logger.Warn("PICO-8 worker did not go back to the supervisor", "err", err)
+		recycle_reason = "unhealthy"
+	}
+	output = output[:done_index]
+	params = recorded_params(output, secret, params)
+	result, err := runner.read_recording(worker.desktop_dir, worker.dir, params, logger)
+	if err != nil {
+		return &RunResult{Output: output, Duration: time.Since(start_time), Params: params}, "error", err
+	}
+	result.Output = output
+	result.Duration = time.Since(start_time)
+	return result, recycle_reason, nil
+}